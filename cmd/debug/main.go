@@ -0,0 +1,264 @@
+package main
+
+/* a command line debugger. it loads a module and runs one wast-style action on it, such as
+ *   debug file.wat '(invoke "f" (i32.const 1))'
+ * and stops at the first instruction, after which the code can be stepped through and breakpoints set.
+ */
+
+import (
+    "bufio"
+    "encoding/hex"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+
+    "github.com/kazzmir/webassembly/lib/core"
+    "github.com/kazzmir/webassembly/lib/exec"
+    "github.com/kazzmir/webassembly/lib/sexp"
+)
+
+const help = `commands:
+  s, step                 run one instruction, going into calls
+  n, next                 run one instruction, going over calls
+  o, out                  run until the current function returns
+  c, continue             run until the next breakpoint
+  b, break F:O            stop at instruction O of function F
+  d, delete F:O           remove a breakpoint
+  breakpoints             list the breakpoints
+  bt, backtrace           show the active functions
+  l, list                 show the instructions of the current function
+  locals [frame]          show the locals of a frame, 0 is the current function
+  stack                   show the value stack of the current function
+  globals                 show the globals
+  mem offset [length]     show the bytes of memory 0
+  q, quit                 stop the code and leave`
+
+func parseLocation(text string) (exec.Location, error) {
+    function, offset, found := strings.Cut(text, ":")
+    if !found {
+        return exec.Location{}, fmt.Errorf("a location is function:offset")
+    }
+
+    functionIndex, err := strconv.ParseUint(function, 0, 32)
+    if err != nil {
+        return exec.Location{}, fmt.Errorf("invalid function '%v'", function)
+    }
+
+    offsetIndex, err := strconv.Atoi(offset)
+    if err != nil {
+        return exec.Location{}, fmt.Errorf("invalid offset '%v'", offset)
+    }
+
+    return exec.Location{Function: uint32(functionIndex), Offset: offsetIndex}, nil
+}
+
+type debugger struct {
+    module core.WebAssemblyModule
+    debugger *exec.Debugger
+    input *bufio.Scanner
+}
+
+/* the instructions of a function that is defined in the module */
+func (debugger *debugger) instructions(function uint32) []core.Expression {
+    defined := int(function) - debugger.module.GetImportFunctionCount()
+    codeSection := debugger.module.GetCodeSection()
+    if codeSection == nil || defined < 0 || defined >= len(codeSection.Code) {
+        return nil
+    }
+
+    return exec.FunctionInstructions(codeSection.Code[defined])
+}
+
+func (debugger *debugger) describeLocation(location exec.Location) string {
+    instructions := debugger.instructions(location.Function)
+    switch {
+        case location.Offset < 0:
+            return fmt.Sprintf("func %v (host)", location.Function)
+        case location.Offset < len(instructions):
+            return fmt.Sprintf("func %v:%v %v", location.Function, location.Offset, exec.DescribeInstruction(instructions[location.Offset]))
+    }
+
+    return fmt.Sprintf("func %v:%v end", location.Function, location.Offset)
+}
+
+func (debugger *debugger) list(location exec.Location){
+    for i, instruction := range debugger.instructions(location.Function) {
+        marker := "  "
+        if i == location.Offset {
+            marker = "=>"
+        }
+        fmt.Printf("%v %4v %v\n", marker, i, exec.DescribeInstruction(instruction))
+    }
+}
+
+func (debugger *debugger) showMemory(state *exec.DebugState, args []string) error {
+    store := state.Store()
+    if store == nil || len(store.Memory) == 0 {
+        return fmt.Errorf("there is no memory")
+    }
+    memory := store.Memory[0]
+
+    if len(args) == 0 {
+        return fmt.Errorf("give an offset")
+    }
+
+    offset, err := strconv.ParseUint(args[0], 0, 64)
+    if err != nil {
+        return fmt.Errorf("invalid offset '%v'", args[0])
+    }
+
+    length := uint64(64)
+    if len(args) > 1 {
+        length, err = strconv.ParseUint(args[1], 0, 64)
+        if err != nil {
+            return fmt.Errorf("invalid length '%v'", args[1])
+        }
+    }
+
+    end := offset + length
+    if offset > uint64(len(memory)) || end > uint64(len(memory)) || end < offset {
+        return fmt.Errorf("out of bounds, memory is %v bytes", len(memory))
+    }
+
+    fmt.Print(hex.Dump(memory[offset:end]))
+    return nil
+}
+
+/* read commands until one of them lets the code go on */
+func (debugger *debugger) pause(state *exec.DebugState) exec.DebugCommand {
+    fmt.Println(debugger.describeLocation(state.Location()))
+
+    for {
+        fmt.Print("(debug) ")
+        if !debugger.input.Scan() {
+            return exec.DebugStop
+        }
+
+        fields := strings.Fields(debugger.input.Text())
+        if len(fields) == 0 {
+            continue
+        }
+
+        var err error
+        switch fields[0] {
+            case "s", "step": return exec.DebugStep
+            case "n", "next": return exec.DebugStepOver
+            case "o", "out": return exec.DebugStepOut
+            case "c", "continue": return exec.DebugContinue
+            case "q", "quit": return exec.DebugStop
+            case "b", "break", "d", "delete":
+                if len(fields) != 2 {
+                    err = fmt.Errorf("give a location as function:offset")
+                    break
+                }
+                var location exec.Location
+                location, err = parseLocation(fields[1])
+                if err == nil {
+                    if fields[0] == "b" || fields[0] == "break" {
+                        debugger.debugger.SetBreakpoint(location)
+                    } else {
+                        debugger.debugger.ClearBreakpoint(location)
+                    }
+                }
+            case "breakpoints":
+                for _, location := range debugger.debugger.Breakpoints() {
+                    fmt.Println(debugger.describeLocation(location))
+                }
+            case "bt", "backtrace":
+                for i, location := range state.Frames() {
+                    fmt.Printf("#%v %v\n", i, debugger.describeLocation(location))
+                }
+            case "l", "list":
+                debugger.list(state.Location())
+            case "locals":
+                frame := 0
+                if len(fields) > 1 {
+                    frame, err = strconv.Atoi(fields[1])
+                }
+                if err == nil {
+                    for i, value := range state.Locals(frame) {
+                        fmt.Printf("%v: %v\n", i, value)
+                    }
+                }
+            case "stack":
+                for i, value := range state.Stack() {
+                    fmt.Printf("%v: 0x%x (%v)\n", i, value, int64(value))
+                }
+            case "globals":
+                if state.Store() != nil {
+                    for i, global := range state.Store().Globals {
+                        fmt.Printf("%v: %v\n", i, global.Value)
+                    }
+                }
+            case "mem":
+                err = debugger.showMemory(state, fields[1:])
+            case "h", "help":
+                fmt.Println(help)
+            default:
+                err = fmt.Errorf("unknown command %v, try help", fields[0])
+        }
+
+        if err != nil {
+            fmt.Printf("Error: %v\n", err)
+        }
+    }
+}
+
+/* the module in a .wasm file, or the first module of a .wat or .wast file */
+func loadModule(path string) (core.WebAssemblyModule, error) {
+    if filepath.Ext(path) == ".wasm" {
+        return core.ParseWasmFile(path, false)
+    }
+
+    wast, err := core.ParseWastFile(path)
+    if err != nil {
+        return core.WebAssemblyModule{}, err
+    }
+
+    for _, expression := range wast.Expressions {
+        if expression.Name == "module" {
+            return core.CreateWastModule(&expression)
+        }
+    }
+
+    return core.WebAssemblyModule{}, fmt.Errorf("no module in %v", path)
+}
+
+func main(){
+    if len(os.Args) != 3 {
+        fmt.Printf("Give a module and an action, such as: debug file.wat '(invoke \"f\" (i32.const 1))'\n")
+        os.Exit(1)
+    }
+
+    module, err := loadModule(os.Args[1])
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        os.Exit(1)
+    }
+
+    action, err := sexp.ParseSExpression(os.Args[2])
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        os.Exit(1)
+    }
+
+    debugger := debugger{module: module, input: bufio.NewScanner(os.Stdin)}
+    debugger.debugger = exec.NewDebugger(debugger.pause)
+    debugger.debugger.Pause()
+
+    store := exec.InitializeStore(module)
+    store.Debugger = debugger.debugger
+
+    fmt.Println("type help for a list of commands")
+    results, err := exec.Action(module, &action, store)
+    if err != nil {
+        fmt.Printf("Error: %v\n%v", err, exec.FormatBacktrace(err))
+        os.Exit(1)
+    }
+
+    for _, result := range results {
+        fmt.Println(result)
+    }
+}
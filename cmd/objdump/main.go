@@ -0,0 +1,453 @@
+package main
+
+/* print what is inside of a binary module, in the style of wasm-objdump: the section headers with their
+ * offsets and sizes, the details of the sections, and the instructions of each function with their
+ * offsets and bytes. all offsets are from the start of the file. sections are printed up to the first one
+ * that cannot be read, so a broken module shows where it went wrong.
+ *
+ *   objdump [-headers] [-details] [-disassemble] file.wasm
+ */
+
+import (
+    "bytes"
+    "encoding/hex"
+    "flag"
+    "fmt"
+    "os"
+    "strings"
+
+    "github.com/kazzmir/webassembly/lib/core"
+    "github.com/kazzmir/webassembly/lib/exec"
+)
+
+/* a section that was read and where it is */
+type section struct {
+    header core.SectionHeader
+    contents core.WebAssemblySection
+}
+
+type dump struct {
+    data []byte
+    sections []section
+    module core.WebAssemblyModule
+    names map[uint32]string
+    /* the header of the section that could not be read */
+    failed *core.SectionHeader
+}
+
+func sectionName(id byte) string {
+    switch id {
+        case core.CustomSection: return "Custom"
+        case core.TypeSection: return "Type"
+        case core.ImportSection: return "Import"
+        case core.FunctionSection: return "Function"
+        case core.TableSection: return "Table"
+        case core.MemorySection: return "Memory"
+        case core.GlobalSection: return "Global"
+        case core.ExportSection: return "Export"
+        case core.StartSection: return "Start"
+        case core.ElementSection: return "Elem"
+        case core.CodeSection: return "Code"
+        case core.DataSection: return "Data"
+    }
+
+    return fmt.Sprintf("Unknown(%v)", id)
+}
+
+/* the number of entries of a section, or -1 for a section without entries */
+func sectionCount(contents core.WebAssemblySection) int {
+    switch contents.(type) {
+        case *core.WebAssemblyTypeSection: return len(contents.(*core.WebAssemblyTypeSection).Functions)
+        case *core.WebAssemblyImportSection: return len(contents.(*core.WebAssemblyImportSection).Items)
+        case *core.WebAssemblyFunctionSection: return len(contents.(*core.WebAssemblyFunctionSection).Functions)
+        case *core.WebAssemblyTableSection: return len(contents.(*core.WebAssemblyTableSection).Items)
+        case *core.WebAssemblyMemorySection: return len(contents.(*core.WebAssemblyMemorySection).Memories)
+        case *core.WebAssemblyGlobalSection: return len(contents.(*core.WebAssemblyGlobalSection).Globals)
+        case *core.WebAssemblyExportSection: return len(contents.(*core.WebAssemblyExportSection).Items)
+        case *core.WebAssemblyElementSection: return len(contents.(*core.WebAssemblyElementSection).Elements)
+        case *core.WebAssemblyCodeSection: return len(contents.(*core.WebAssemblyCodeSection).Code)
+        case *core.WebAssemblyDataSection: return len(contents.(*core.WebAssemblyDataSection).Segments)
+    }
+
+    return -1
+}
+
+/* read the sections of a module, returns the sections that could be read along with the error that
+ * stopped the reading
+ */
+func readDump(data []byte) (*dump, error) {
+    out := &dump{data: data}
+
+    file := core.WebAssemblyNewReader(bytes.NewReader(data), false)
+    err := file.ReadMagic()
+    if err != nil {
+        return out, err
+    }
+
+    _, err = file.ReadVersion()
+    if err != nil {
+        return out, fmt.Errorf("Could not read the module version: %v", err)
+    }
+
+    for {
+        contents, err := file.ReadSection()
+        if err != nil {
+            header := file.LastSectionHeader()
+            if header.Size > 0 {
+                out.failed = &header
+                return out, fmt.Errorf("%v section at 0x%x with size 0x%x could not be read: %v", sectionName(header.Id), header.Offset, header.Size, err)
+            }
+            return out, err
+        }
+
+        if contents == nil {
+            return out, nil
+        }
+
+        out.sections = append(out.sections, section{header: file.LastSectionHeader(), contents: contents})
+        out.module.AddSection(contents)
+        out.names = out.module.FunctionNames()
+    }
+}
+
+func (dump *dump) printHeaders(){
+    fmt.Printf("Sections:\n\n")
+    for _, section := range dump.sections {
+        header := section.header
+        end := header.ContentOffset + int64(header.Size)
+        fmt.Printf("%9v start=0x%08x end=0x%08x (size=0x%08x)", sectionName(header.Id), header.ContentOffset, end, header.Size)
+
+        custom, ok := section.contents.(*core.WebAssemblyCustomSection)
+        if ok {
+            fmt.Printf(" %q", custom.Name)
+        } else if count := sectionCount(section.contents); count >= 0 {
+            fmt.Printf(" count: %v", count)
+        }
+        fmt.Println()
+    }
+}
+
+/* the name of a function in angle brackets, or nothing if it has no name */
+func (dump *dump) functionName(index uint32) string {
+    name, ok := dump.names[index]
+    if ok {
+        return fmt.Sprintf(" <%v>", name)
+    }
+
+    return ""
+}
+
+func describeType(function core.WebAssemblyFunction) string {
+    var inputs []string
+    for _, input := range function.InputTypes {
+        inputs = append(inputs, input.Type.ConvertToWat(""))
+    }
+
+    var outputs []string
+    for _, output := range function.OutputTypes {
+        outputs = append(outputs, output.ConvertToWat(""))
+    }
+
+    result := "nil"
+    if len(outputs) == 1 {
+        result = outputs[0]
+    } else if len(outputs) > 1 {
+        result = "(" + strings.Join(outputs, ", ") + ")"
+    }
+
+    return fmt.Sprintf("(%v) -> %v", strings.Join(inputs, ", "), result)
+}
+
+func describeLimit(limit core.Limit) string {
+    if limit.HasMaximum {
+        return fmt.Sprintf("initial=%v max=%v", limit.Minimum, limit.Maximum)
+    }
+
+    return fmt.Sprintf("initial=%v", limit.Minimum)
+}
+
+func describeReference(kind byte) string {
+    if kind == core.RefTypeExtern {
+        return "externref"
+    }
+
+    return "funcref"
+}
+
+func (dump *dump) printDetails(){
+    fmt.Printf("Section Details:\n\n")
+
+    imported := uint32(dump.module.GetImportFunctionCount())
+
+    for _, section := range dump.sections {
+        switch section.contents.(type) {
+            case *core.WebAssemblyCustomSection:
+                custom := section.contents.(*core.WebAssemblyCustomSection)
+                fmt.Printf("Custom:\n - name: %q size=%v\n", custom.Name, len(custom.Data))
+                continue
+            case *core.WebAssemblyStartSection:
+                start := section.contents.(*core.WebAssemblyStartSection)
+                fmt.Printf("Start:\n - start function: %v%v\n", start.Start.Id, dump.functionName(start.Start.Id))
+                continue
+        }
+
+        fmt.Printf("%v[%v]:\n", sectionName(section.header.Id), sectionCount(section.contents))
+
+        switch section.contents.(type) {
+            case *core.WebAssemblyTypeSection:
+                for i, function := range section.contents.(*core.WebAssemblyTypeSection).Functions {
+                    fmt.Printf(" - type[%v] %v\n", i, describeType(function))
+                }
+            case *core.WebAssemblyImportSection:
+                var functions, globals, memories, tables int
+                for _, item := range section.contents.(*core.WebAssemblyImportSection).Items {
+                    from := fmt.Sprintf("<- %v.%v", item.ModuleName, item.Name)
+                    switch item.Kind.(type) {
+                        case *core.FunctionImport:
+                            function := item.Kind.(*core.FunctionImport)
+                            fmt.Printf(" - func[%v] sig=%v%v %v\n", functions, function.Index, dump.functionName(uint32(functions)), from)
+                            functions += 1
+                        case *core.GlobalType:
+                            global := item.Kind.(*core.GlobalType)
+                            fmt.Printf(" - global[%v] %v mutable=%v %v\n", globals, global.ValueType.ConvertToWat(""), global.Mutable, from)
+                            globals += 1
+                        case *core.MemoryImportType:
+                            memory := item.Kind.(*core.MemoryImportType)
+                            fmt.Printf(" - memory[%v] pages: %v %v\n", memories, describeLimit(memory.Limit), from)
+                            memories += 1
+                        case *core.TableType:
+                            table := item.Kind.(*core.TableType)
+                            fmt.Printf(" - table[%v] type=%v %v %v\n", tables, describeReference(table.RefType), describeLimit(table.Limit), from)
+                            tables += 1
+                    }
+                }
+            case *core.WebAssemblyFunctionSection:
+                for i, function := range section.contents.(*core.WebAssemblyFunctionSection).Functions {
+                    index := imported + uint32(i)
+                    fmt.Printf(" - func[%v] sig=%v%v\n", index, function.Id, dump.functionName(index))
+                }
+            case *core.WebAssemblyTableSection:
+                for i, table := range section.contents.(*core.WebAssemblyTableSection).Items {
+                    fmt.Printf(" - table[%v] type=%v %v\n", i, describeReference(table.RefType), describeLimit(table.Limit))
+                }
+            case *core.WebAssemblyMemorySection:
+                for i, memory := range section.contents.(*core.WebAssemblyMemorySection).Memories {
+                    fmt.Printf(" - memory[%v] pages: %v\n", i, describeLimit(memory))
+                }
+            case *core.WebAssemblyGlobalSection:
+                for i, global := range section.contents.(*core.WebAssemblyGlobalSection).Globals {
+                    fmt.Printf(" - global[%v] %v mutable=%v\n", i, global.Global.ValueType.ConvertToWat(""), global.Global.Mutable)
+                }
+            case *core.WebAssemblyExportSection:
+                for _, item := range section.contents.(*core.WebAssemblyExportSection).Items {
+                    switch item.Kind.(type) {
+                        case *core.FunctionIndex:
+                            index := item.Kind.(*core.FunctionIndex).Id
+                            fmt.Printf(" - func[%v]%v -> %q\n", index, dump.functionName(index), item.Name)
+                        case *core.GlobalIndex:
+                            fmt.Printf(" - global[%v] -> %q\n", item.Kind.(*core.GlobalIndex).Id, item.Name)
+                        case *core.MemoryIndex:
+                            fmt.Printf(" - memory[%v] -> %q\n", item.Kind.(*core.MemoryIndex).Id, item.Name)
+                        case *core.TableIndex:
+                            fmt.Printf(" - table[%v] -> %q\n", item.Kind.(*core.TableIndex).Id, item.Name)
+                    }
+                }
+            case *core.WebAssemblyElementSection:
+                for i, element := range section.contents.(*core.WebAssemblyElementSection).Elements {
+                    fmt.Printf(" - segment[%v] type=%v count=%v\n", i, describeReference(element.Type), len(element.Inits))
+                }
+            case *core.WebAssemblyCodeSection:
+                for i, code := range section.contents.(*core.WebAssemblyCodeSection).Code {
+                    index := imported + uint32(i)
+                    fmt.Printf(" - func[%v] size=%v%v\n", index, code.Size, dump.functionName(index))
+                }
+            case *core.WebAssemblyDataSection:
+                for i, segment := range section.contents.(*core.WebAssemblyDataSection).Segments {
+                    _, passive := segment.Mode.(*core.MemoryPassiveMode)
+                    if passive {
+                        fmt.Printf(" - segment[%v] passive size=%v\n", i, len(segment.Data))
+                    } else {
+                        fmt.Printf(" - segment[%v] size=%v\n", i, len(segment.Data))
+                    }
+                }
+        }
+    }
+}
+
+/* bytes in hex with a space between each byte */
+func spacedHex(data []byte) string {
+    raw := hex.EncodeToString(data)
+    var spaced []string
+    for i := 0; i < len(raw); i += 2 {
+        spaced = append(spaced, raw[i:i+2])
+    }
+
+    return strings.Join(spaced, " ")
+}
+
+/* the width of the column of bytes */
+const byteColumn = 26
+
+/* print one line of the disassembly, long instructions have their bytes cut short */
+func (dump *dump) printInstruction(start int64, end int64, depth int, text string){
+    column := spacedHex(dump.data[start:end])
+    if len(column) > byteColumn {
+        column = column[:byteColumn - 4] + " ..."
+    }
+
+    fmt.Printf(" %06x: %-*v | %v%v\n", start, byteColumn, column, strings.Repeat("  ", depth), text)
+}
+
+/* print the bytes between instructions, which are the ends of blocks and elses */
+func (dump *dump) printBetween(start int64, end int64, depth *int){
+    for position := start; position < end; position++ {
+        switch dump.data[position] {
+            case core.InstructionEnd:
+                *depth -= 1
+                if *depth < 0 {
+                    *depth = 0
+                }
+                dump.printInstruction(position, position + 1, *depth, "end")
+            case 0x05:
+                dump.printInstruction(position, position + 1, *depth - 1, "else")
+            default:
+                /* an instruction that is not decoded */
+                dump.printInstruction(position, end, *depth, "?")
+                return
+        }
+    }
+}
+
+/* the most bytes of a broken section that are shown */
+const rawLimit = 512
+
+/* the bytes of a section that could not be read, 16 to a line */
+func (dump *dump) printRaw(header core.SectionHeader){
+    start := header.ContentOffset
+    end := start + int64(header.Size)
+    if end > int64(len(dump.data)) {
+        end = int64(len(dump.data))
+    }
+
+    fmt.Printf("\nContents of the %v section:\n", sectionName(header.Id))
+    if end - start > rawLimit {
+        end = start + rawLimit
+        defer fmt.Printf(" ...\n")
+    }
+
+    for line := start; line < end; line += 16 {
+        stop := line + 16
+        if stop > end {
+            stop = end
+        }
+        fmt.Printf(" %06x: %v\n", line, spacedHex(dump.data[line:stop]))
+    }
+}
+
+func (dump *dump) printDisassembly(){
+    fmt.Printf("Code Disassembly:\n")
+
+    imported := uint32(dump.module.GetImportFunctionCount())
+
+    for _, section := range dump.sections {
+        codeSection, ok := section.contents.(*core.WebAssemblyCodeSection)
+        if !ok {
+            continue
+        }
+
+        base := section.header.ContentOffset
+
+        for i, code := range codeSection.Code {
+            index := imported + uint32(i)
+            fmt.Printf("\n%06x func[%v]%v:\n", base + int64(code.Start), index, dump.functionName(index))
+
+            /* the locals come before the first instruction */
+            bodyEnd := base + int64(code.Start) + int64(code.Size)
+            first := bodyEnd
+            if len(code.Offsets) > 0 {
+                first = base + int64(code.Offsets[0])
+            }
+
+            locals := 0
+            for _, local := range code.DeclaredLocals() {
+                locals += int(local.Count)
+            }
+            dump.printInstruction(base + int64(code.Start), first, 0, fmt.Sprintf("locals: %v", locals))
+
+            instructions := exec.FunctionInstructions(code)
+            depth := 0
+            for j, offset := range code.Offsets {
+                start := base + int64(offset)
+                end := base + int64(code.Ends[j])
+                text := "?"
+                if j < len(instructions) {
+                    text = exec.DescribeInstruction(instructions[j])
+                }
+                dump.printInstruction(start, end, depth, text)
+
+                block, isBlock := instructions[j].(*core.BlockExpression)
+                if isBlock && block != nil {
+                    depth += 1
+                }
+
+                next := bodyEnd
+                if j + 1 < len(code.Offsets) {
+                    next = base + int64(code.Offsets[j + 1])
+                }
+                dump.printBetween(end, next, &depth)
+            }
+        }
+    }
+}
+
+func main(){
+    headers := flag.Bool("headers", false, "print the section headers")
+    details := flag.Bool("details", false, "print the contents of the sections")
+    disassemble := flag.Bool("disassemble", false, "print the instructions of each function")
+    flag.Parse()
+
+    if flag.NArg() != 1 {
+        fmt.Printf("Give a .wasm file, such as: objdump -disassemble file.wasm\n")
+        os.Exit(1)
+    }
+
+    /* everything is printed unless something in particular was asked for */
+    if !*headers && !*details && !*disassemble {
+        *headers = true
+        *details = true
+        *disassemble = true
+    }
+
+    path := flag.Arg(0)
+    data, err := os.ReadFile(path)
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        os.Exit(1)
+    }
+
+    dump, readErr := readDump(data)
+
+    fmt.Printf("%v: file format wasm\n\n", path)
+
+    if *headers {
+        dump.printHeaders()
+        fmt.Println()
+    }
+
+    if *details {
+        dump.printDetails()
+        fmt.Println()
+    }
+
+    if *disassemble {
+        dump.printDisassembly()
+    }
+
+    if readErr != nil {
+        fmt.Printf("\nError: %v\n", readErr)
+        if dump.failed != nil {
+            dump.printRaw(*dump.failed)
+        }
+        os.Exit(1)
+    }
+}
@@ -0,0 +1,318 @@
+package main
+
+/* an interactive interpreter. it takes the same commands as a .wast file, such as (module ...),
+ * (invoke "f" (i32.const 1)), (get "g") and (assert_return ...), along with some commands that start with
+ * a colon for looking at the state of the current module. a command can span several lines.
+ */
+
+import (
+    "bufio"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+
+    "github.com/kazzmir/webassembly/lib/core"
+    "github.com/kazzmir/webassembly/lib/exec"
+    "github.com/kazzmir/webassembly/lib/sexp"
+)
+
+const help = `commands:
+  (module ...)                 define a new current module
+  (invoke "name" args...)      call an exported function and print its results
+  (get "name")                 print the value of an exported global
+  (assert_return ...)          check a result, like in a .wast file
+  (assert_exhaustion ...)      check that a call runs out of stack
+  :load file                   load a .wat, .wast or .wasm file
+  :exports                     list the exports of the current module
+  :globals                     list the globals and their values
+  :memory [offset [length]]    show the bytes of memory 0
+  :help                        show this help
+  :quit                        leave`
+
+type repl struct {
+    module core.WebAssemblyModule
+    store *exec.Store
+    output io.Writer
+}
+
+func (repl *repl) setModule(module core.WebAssemblyModule){
+    repl.module = module
+    repl.store = exec.InitializeStore(module)
+}
+
+/* the number of parentheses that are still open at the end of the text, ignoring the ones in strings and
+ * in comments
+ */
+func openParentheses(text string) int {
+    depth := 0
+    inString := false
+    for i := 0; i < len(text); i++ {
+        switch {
+            case inString && text[i] == '\\':
+                i += 1
+            case text[i] == '"':
+                inString = !inString
+            case inString:
+            case text[i] == ';' && i + 1 < len(text) && text[i+1] == ';':
+                for i < len(text) && text[i] != '\n' {
+                    i += 1
+                }
+            case text[i] == '(':
+                depth += 1
+            case text[i] == ')':
+                depth -= 1
+        }
+    }
+
+    return depth
+}
+
+func (repl *repl) printResults(results []exec.RuntimeValue){
+    if len(results) == 0 {
+        fmt.Fprintln(repl.output, "ok")
+        return
+    }
+
+    var parts []string
+    for _, result := range results {
+        parts = append(parts, result.String())
+    }
+    fmt.Fprintln(repl.output, strings.Join(parts, " "))
+}
+
+/* run one wast-style command */
+func (repl *repl) command(command *sexp.SExpression) error {
+    if command.Name == "module" {
+        module, err := core.CreateWastModule(command)
+        if err != nil {
+            return err
+        }
+        repl.setModule(module)
+        fmt.Fprintln(repl.output, "module defined")
+        return nil
+    }
+
+    if repl.store == nil {
+        return fmt.Errorf("no module defined")
+    }
+
+    switch command.Name {
+        case "invoke", "get":
+            results, err := exec.Action(repl.module, command, repl.store)
+            if err != nil {
+                return err
+            }
+            repl.printResults(results)
+        case "assert_return":
+            err := exec.AssertReturn(repl.module, *command, repl.store)
+            if err != nil {
+                return err
+            }
+            fmt.Fprintln(repl.output, "ok")
+        case "assert_exhaustion":
+            err := exec.AssertExhaustion(repl.module, *command, repl.store)
+            if err != nil {
+                return err
+            }
+            fmt.Fprintln(repl.output, "ok")
+        default:
+            return fmt.Errorf("unknown command %v", command.Name)
+    }
+
+    return nil
+}
+
+/* run all the commands in some text */
+func (repl *repl) evaluate(text string) error {
+    wast, err := core.ParseWastBytes([]byte(text))
+    if err != nil {
+        return err
+    }
+
+    for i := range wast.Expressions {
+        err := repl.command(&wast.Expressions[i])
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+/* a .wasm file becomes the current module, the commands of a .wat or .wast file are run in order */
+func (repl *repl) load(path string) error {
+    if filepath.Ext(path) == ".wasm" {
+        module, err := core.ParseWasmFile(path, false)
+        if err != nil {
+            return err
+        }
+        repl.setModule(module)
+        fmt.Fprintln(repl.output, "module defined")
+        return nil
+    }
+
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return err
+    }
+
+    return repl.evaluate(string(data))
+}
+
+func (repl *repl) showExports(){
+    exports := repl.module.GetExportSection()
+    if exports == nil {
+        return
+    }
+
+    for _, item := range exports.Items {
+        switch item.Kind.(type) {
+            case *core.FunctionIndex:
+                function := item.Kind.(*core.FunctionIndex)
+                description := ""
+                typeIndex := repl.module.GetFunctionTypeIndex(function.Id)
+                if typeIndex != nil {
+                    description = " " + exec.DescribeFunctionType(repl.module.GetTypeSection().GetFunction(typeIndex.Id))
+                }
+                fmt.Fprintf(repl.output, "%v: func %v%v\n", item.Name, function.Id, description)
+            default:
+                fmt.Fprintf(repl.output, "%v: %v\n", item.Name, item.Kind)
+        }
+    }
+}
+
+func (repl *repl) showGlobals(){
+    for i, global := range repl.store.Globals {
+        kind := global.Type.ConvertToWat("")
+        if global.Mutable {
+            kind = "mut " + kind
+        }
+        fmt.Fprintf(repl.output, "%v %v %v = %v\n", i, global.Name, kind, global.Value)
+    }
+}
+
+func (repl *repl) showMemory(args []string) error {
+    if len(repl.store.Memory) == 0 {
+        return fmt.Errorf("the module has no memory")
+    }
+
+    memory := repl.store.Memory[0]
+
+    numbers := []uint64{0, 64}
+    for i, arg := range args {
+        if i >= len(numbers) {
+            return fmt.Errorf("too many arguments")
+        }
+        value, err := strconv.ParseUint(arg, 0, 64)
+        if err != nil {
+            return fmt.Errorf("'%v' is not a number", arg)
+        }
+        numbers[i] = value
+    }
+
+    offset := numbers[0]
+    end := offset + numbers[1]
+    if offset > uint64(len(memory)) || end > uint64(len(memory)) || end < offset {
+        return fmt.Errorf("out of bounds, memory is %v bytes", len(memory))
+    }
+
+    fmt.Fprintf(repl.output, "%v", hex.Dump(memory[offset:end]))
+    return nil
+}
+
+/* run a command that starts with a colon, returns false to quit */
+func (repl *repl) special(line string) (bool, error) {
+    fields := strings.Fields(line)
+    switch fields[0] {
+        case ":quit", ":q":
+            return false, nil
+        case ":help":
+            fmt.Fprintln(repl.output, help)
+            return true, nil
+        case ":load":
+            if len(fields) != 2 {
+                return true, fmt.Errorf("give one file to load")
+            }
+            return true, repl.load(fields[1])
+    }
+
+    if repl.store == nil {
+        return true, fmt.Errorf("no module defined")
+    }
+
+    switch fields[0] {
+        case ":exports":
+            repl.showExports()
+        case ":globals":
+            repl.showGlobals()
+        case ":memory":
+            return true, repl.showMemory(fields[1:])
+        default:
+            return true, fmt.Errorf("unknown command %v, try :help", fields[0])
+    }
+
+    return true, nil
+}
+
+/* read commands until the input ends or :quit */
+func (repl *repl) run(input io.Reader){
+    scanner := bufio.NewScanner(input)
+    scanner.Buffer(nil, 1 << 24)
+
+    var pending strings.Builder
+    fmt.Fprint(repl.output, "> ")
+    for scanner.Scan() {
+        line := scanner.Text()
+
+        if pending.Len() == 0 && strings.HasPrefix(strings.TrimSpace(line), ":") {
+            more, err := repl.special(strings.TrimSpace(line))
+            if err != nil {
+                fmt.Fprintf(repl.output, "Error: %v\n", err)
+            }
+            if !more {
+                return
+            }
+            fmt.Fprint(repl.output, "> ")
+            continue
+        }
+
+        pending.WriteString(line)
+        pending.WriteString("\n")
+
+        if openParentheses(pending.String()) > 0 {
+            fmt.Fprint(repl.output, "... ")
+            continue
+        }
+
+        text := pending.String()
+        pending.Reset()
+        if strings.TrimSpace(text) != "" {
+            err := repl.evaluate(text)
+            if err != nil {
+                fmt.Fprintf(repl.output, "Error: %v\n%v", err, exec.FormatBacktrace(err))
+            }
+        }
+
+        fmt.Fprint(repl.output, "> ")
+    }
+
+    fmt.Fprintln(repl.output)
+}
+
+func main(){
+    repl := repl{output: os.Stdout}
+
+    for _, path := range os.Args[1:] {
+        err := repl.load(path)
+        if err != nil {
+            fmt.Printf("Error: could not load %v: %v\n", path, err)
+        }
+    }
+
+    fmt.Println("type :help for a list of commands")
+    repl.run(os.Stdin)
+}
@@ -1,20 +1,53 @@
 package main
 
 import (
+    "io"
     "log"
     "os"
+    "bufio"
     "fmt"
+    "flag"
+    "errors"
+    "strconv"
     "strings"
     "path/filepath"
     "github.com/kazzmir/webassembly/lib/core"
+    "github.com/kazzmir/webassembly/lib/debuginfo"
     "github.com/kazzmir/webassembly/lib/exec"
+    "github.com/kazzmir/webassembly/lib/wasi"
 )
 
+/* the exit code when the program traps, which is what a native program that aborts exits with */
+const exitTrap = 134
+/* the exit code when the program cannot be loaded or called */
+const exitError = 1
+
+/* a flag that can be given more than once */
+type listFlag []string
+
+func (list *listFlag) String() string {
+    return strings.Join(*list, ",")
+}
+
+func (list *listFlag) Set(value string) error {
+    *list = append(*list, value)
+    return nil
+}
+
 func cleanName(name string) string {
     return strings.Trim(name, "\"")
 }
 
-func handleWast(wast core.Wast){
+/* a tracer that writes json lines to trace, or nil if trace is nil */
+func makeTracer(trace io.Writer, module *core.WebAssemblyModule) exec.Tracer {
+    if trace == nil {
+        return nil
+    }
+
+    return exec.NewJSONTracer(trace, module)
+}
+
+func handleWast(wast core.Wast, trace io.Writer){
 
     var module core.WebAssemblyModule
     var store *exec.Store
@@ -23,12 +56,13 @@ func handleWast(wast core.Wast){
         switch command.Name {
             case "module":
                 var err error
-                module, err = core.CreateWasmModule(&command)
+                module, err = core.CreateWastModule(&command)
                 if err != nil {
                     log.Printf("Error creating module: %v", err)
                     return
                 }
                 store = exec.InitializeStore(module)
+                store.Tracer = makeTracer(trace, &module)
             case "assert_return":
                 if store == nil {
                     fmt.Printf("Error: no module defined\n")
@@ -38,19 +72,290 @@ func handleWast(wast core.Wast){
                 fmt.Printf("Execute %v\n", command.String())
                 err := exec.AssertReturn(module, command, store)
                 if err != nil {
-                    fmt.Printf("Error: %v\n", err)
+                    fmt.Printf("Error: %v\n%v", err, exec.FormatBacktrace(err))
+                }
+            case "assert_exhaustion":
+                if store == nil {
+                    fmt.Printf("Error: no module defined\n")
+                    continue
+                }
+
+                fmt.Printf("Execute %v\n", command.String())
+                err := exec.AssertExhaustion(module, command, store)
+                if err != nil {
+                    fmt.Printf("Error: %v\n%v", err, exec.FormatBacktrace(err))
                 }
         }
     }
 }
 
+/* the value of a command line argument as the given type */
+func parseArgument(kind core.ValueType, arg string) (exec.RuntimeValue, error) {
+    switch kind {
+        case core.ValueTypeI32:
+            value, err := strconv.ParseInt(arg, 0, 64)
+            if err != nil || value < -(1 << 31) || value >= 1 << 32 {
+                return exec.RuntimeValue{}, fmt.Errorf("'%v' is not an i32", arg)
+            }
+            return exec.ValueI32(int32(value)), nil
+        case core.ValueTypeI64:
+            value, err := strconv.ParseInt(arg, 0, 64)
+            if err != nil {
+                unsigned, err := strconv.ParseUint(arg, 0, 64)
+                if err != nil {
+                    return exec.RuntimeValue{}, fmt.Errorf("'%v' is not an i64", arg)
+                }
+                value = int64(unsigned)
+            }
+            return exec.ValueI64(value), nil
+        case core.ValueTypeF32:
+            value, err := strconv.ParseFloat(arg, 32)
+            if err != nil {
+                return exec.RuntimeValue{}, fmt.Errorf("'%v' is not an f32", arg)
+            }
+            return exec.ValueF32(float32(value)), nil
+        case core.ValueTypeF64:
+            value, err := strconv.ParseFloat(arg, 64)
+            if err != nil {
+                return exec.RuntimeValue{}, fmt.Errorf("'%v' is not an f64", arg)
+            }
+            return exec.ValueF64(value), nil
+    }
+
+    return exec.RuntimeValue{}, fmt.Errorf("arguments of type %v cannot be given on the command line", kind.ConvertToWat(""))
+}
+
+/* the arguments of an exported function from the command line */
+func parseArguments(module core.WebAssemblyModule, name string, args []string) ([]exec.RuntimeValue, error) {
+    function, ok := module.GetExportSection().FindExportByName(name).(*core.FunctionIndex)
+    if !ok {
+        return nil, fmt.Errorf("no such exported function '%v'", name)
+    }
+
+    typeIndex := module.GetFunctionTypeIndex(function.Id)
+    if typeIndex == nil {
+        return nil, fmt.Errorf("invalid function index %v", function.Id)
+    }
+
+    functionType := module.GetTypeSection().GetFunction(typeIndex.Id)
+    if len(args) != len(functionType.InputTypes) {
+        return nil, fmt.Errorf("function '%v' expects %v arguments but got %v", name, len(functionType.InputTypes), len(args))
+    }
+
+    var out []exec.RuntimeValue
+    for i, arg := range args {
+        value, err := parseArgument(functionType.InputTypes[i].Type, arg)
+        if err != nil {
+            return nil, fmt.Errorf("argument %v: %v", i, err)
+        }
+        out = append(out, value)
+    }
+
+    return out, nil
+}
+
+func importsWasi(module core.WebAssemblyModule) bool {
+    for index := 0; index < module.GetImportFunctionCount(); index++ {
+        item, _ := module.GetFunctionImport(uint32(index))
+        if item.ModuleName == wasi.ModuleName {
+            return true
+        }
+    }
+
+    return false
+}
+
+/* the exit code for the error a program stopped with */
+func exitCode(err error, module *core.WebAssemblyModule) int {
+    var exit *wasi.ExitError
+    if errors.As(err, &exit) {
+        return int(exit.Code)
+    }
+
+    fmt.Fprintf(os.Stderr, "trap: %v\n%v", err, formatBacktrace(err, module))
+    return exitTrap
+}
+
+/* the backtrace of an error, with the source line of each frame if the module has DWARF line tables */
+func formatBacktrace(err error, module *core.WebAssemblyModule) string {
+    info, infoErr := debuginfo.Load(module)
+    if infoErr != nil {
+        return exec.FormatBacktrace(err)
+    }
+
+    return exec.FormatBacktraceWith(err, func(frame exec.BacktraceFrame) string {
+        if frame.CodeOffset >= 0 {
+            line, ok := info.Lookup(uint64(frame.CodeOffset))
+            if ok {
+                return fmt.Sprintf("      %v\n", line)
+            }
+        }
+        return ""
+    })
+}
+
+func writeProfile(path string, profiler *exec.Profiler, module *core.WebAssemblyModule) error {
+    file, err := os.Create(path)
+    if err != nil {
+        return err
+    }
+
+    err = profiler.WritePprof(file, module)
+    if err != nil {
+        file.Close()
+        return err
+    }
+
+    return file.Close()
+}
+
+/* run the exported function 'invoke' of a binary module, or _start if it is empty, and return the exit code.
+ * a module that imports wasi gets the standard streams, the environment in env, and the directories in
+ * dirs which are either a host directory or host::guest. if trace is not nil every step of the code is
+ * written to it as json lines, and if profile is not empty a pprof profile of the code is written to that file.
+ */
+func runWasm(path string, args []string, invoke string, dirs []string, env []string, trace io.Writer, profile string) int {
+    module, err := core.ParseWasmFile(path, false)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+        return exitError
+    }
+
+    name := invoke
+    var values []exec.RuntimeValue
+    programArgs := []string{filepath.Base(path)}
+    if invoke == "" {
+        name = "_start"
+        programArgs = append(programArgs, args...)
+    } else {
+        values, err = parseArguments(module, invoke, args)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+            return exitError
+        }
+    }
+
+    var hosts []*exec.HostModule
+    if importsWasi(module) {
+        config := wasi.Config{
+            Args: programArgs,
+            Environ: env,
+            Stdin: os.Stdin,
+            Stdout: os.Stdout,
+            Stderr: os.Stderr,
+        }
+
+        for _, dir := range dirs {
+            host, guest, found := strings.Cut(dir, "::")
+            if !found {
+                guest = host
+            }
+            config.Preopens = append(config.Preopens, wasi.Preopen{Path: guest, FS: wasi.DirFS(host)})
+        }
+
+        hosts = append(hosts, wasi.New(config).HostModule())
+    }
+
+    instance, err := exec.Compile(module).Instantiate(hosts...)
+    if err != nil {
+        /* a start function that traps or exits ends the program like _start would, anything else is a
+         * module that could not be linked
+         */
+        var start *exec.StartError
+        if errors.As(err, &start) {
+            return exitCode(err, &module)
+        }
+
+        fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+        return exitError
+    }
+
+    if invoke == "" {
+        _, ok := module.GetExportSection().FindExportByName(name).(*core.FunctionIndex)
+        if !ok {
+            fmt.Fprintf(os.Stderr, "Error: no _start function, give a function to call with -invoke\n")
+            return exitError
+        }
+    }
+
+    instance.Store().Tracer = makeTracer(trace, &module)
+
+    var profiler *exec.Profiler
+    if profile != "" {
+        profiler = exec.NewProfiler()
+        instance.Store().Profiler = profiler
+    }
+
+    results, err := instance.Invoke(name, values)
+
+    /* the profile is written even if the code trapped or exited */
+    if profiler != nil {
+        profileErr := writeProfile(profile, profiler, &module)
+        if profileErr != nil {
+            fmt.Fprintf(os.Stderr, "Error: unable to write the profile: %v\n", profileErr)
+        }
+    }
+
+    if err != nil {
+        return exitCode(err, &module)
+    }
+
+    for _, result := range results {
+        fmt.Println(result.String())
+    }
+
+    return 0
+}
+
 func main(){
     log.SetFlags(log.LstdFlags | log.Lmicroseconds | log.Lshortfile)
-    log.Printf("Web assembly runner\n")
 
-    if len(os.Args) > 1 {
-        path := os.Args[1]
+    invoke := flag.String("invoke", "", "call this export of a .wasm file instead of _start, the arguments after the file are its arguments")
+    disassemble := flag.Bool("disassemble", false, "print a .wasm file in the text format instead of running it")
+    var dirs listFlag
+    var env listFlag
+    flag.Var(&dirs, "dir", "let a wasi program use a directory, given as host or host::guest")
+    flag.Var(&env, "env", "set an environment variable of a wasi program, given as NAME=value")
+    tracePath := flag.String("trace", "", "write every function call, instruction, memory access and trap to this file as json lines")
+    profile := flag.String("profile", "", "write a pprof profile of a .wasm program to this file, see it with 'go tool pprof'")
+    flag.Parse()
+
+    var trace *bufio.Writer
+    if *tracePath != "" {
+        file, err := os.Create(*tracePath)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+            os.Exit(exitError)
+        }
+        defer file.Close()
+        trace = bufio.NewWriter(file)
+    }
+
+    /* the trace has to be written out before exiting */
+    flushTrace := func(){
+        if trace != nil {
+            err := trace.Flush()
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "Error: unable to write the trace: %v\n", err)
+            }
+        }
+    }
+
+    /* a nil *bufio.Writer in an io.Writer is not nil */
+    var traceWriter io.Writer
+    if trace != nil {
+        traceWriter = trace
+    }
+
+    if flag.NArg() > 0 {
+        path := flag.Arg(0)
         if filepath.Ext(path) == ".wasm" {
+            if !*disassemble {
+                code := runWasm(path, flag.Args()[1:], *invoke, dirs, env, traceWriter, *profile)
+                flushTrace()
+                os.Exit(code)
+            }
+
             module, err := core.ParseWasmFile(path, true)
             if err != nil {
                 log.Printf("Error: %v\n", err)
@@ -58,11 +363,13 @@ func main(){
                 fmt.Println(module.ConvertToWat(""))
             }
         } else if filepath.Ext(path) == ".wast" {
+            log.Printf("Web assembly runner\n")
             wast, err := core.ParseWastFile(path)
             if err != nil {
                 log.Printf("Error: %v\n", err)
             } else {
-                handleWast(wast)
+                handleWast(wast, traceWriter)
+                flushTrace()
             }
         }
     } else {
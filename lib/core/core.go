@@ -3,7 +3,6 @@ package core
 import (
     "log"
     "os"
-    "bufio"
     "io"
     "fmt"
     "bytes"
@@ -21,10 +20,23 @@ func isAsmBytes(asm []byte) bool {
 }
 
 type WebAssemblyFileModule struct {
-    path string
     io io.ReadCloser
-    reader *bufio.Reader
+    reader *OffsetReader
     debug bool
+    /* id of the last known (non-custom) section that was read, used to place custom sections */
+    lastSection byte
+    readKnownSection bool
+    header SectionHeader
+}
+
+/* where a section is in the binary, the offsets are from the start of the file */
+type SectionHeader struct {
+    Id byte
+    /* the offset of the section id */
+    Offset int64
+    /* the offset of the contents, which come after the id and the size */
+    ContentOffset int64
+    Size uint32
 }
 
 func WebAssemblyNew(path string, debug bool) (WebAssemblyFileModule, error) {
@@ -34,26 +46,34 @@ func WebAssemblyNew(path string, debug bool) (WebAssemblyFileModule, error) {
     }
 
     return WebAssemblyFileModule{
-        path: path,
         io: file,
-        reader: bufio.NewReader(file),
+        reader: NewOffsetReader(file),
         debug: debug,
     }, nil
 }
 
+/* read a module from an arbitrary reader, the reader is not closed */
+func WebAssemblyNewReader(reader io.Reader, debug bool) WebAssemblyFileModule {
+    return WebAssemblyFileModule{
+        io: io.NopCloser(reader),
+        reader: NewOffsetReader(reader),
+        debug: debug,
+    }
+}
+
 func (module *WebAssemblyFileModule) ReadMagic() error {
     asmBytes := make([]byte, 4)
     count, err := io.ReadFull(module.reader, asmBytes)
     if count != len(asmBytes) {
         if err != nil {
-            return err
+            return fmt.Errorf("Failed to read asm bytes at byte offset %v: %w", module.reader.Offset(), err)
         }
 
-        return fmt.Errorf("Failed to read asm bytes from '%v'\n", module.path)
+        return fmt.Errorf("Failed to read asm bytes at byte offset %v", module.reader.Offset())
     }
 
     if !isAsmBytes(asmBytes){
-        return fmt.Errorf("Unable to read the module preamble from '%v'. Not a webassembly file?", module.path)
+        return fmt.Errorf("Unable to read the module preamble at byte offset 0. Not a webassembly file?")
     }
 
     return nil
@@ -177,8 +197,9 @@ func (function *WebAssemblyFunction) Equals(other WebAssemblyFunction) bool {
         return false
     }
 
+    /* parameter names are not part of the type */
     for i := 0; i < len(function.InputTypes); i++ {
-        if function.InputTypes[i] != other.InputTypes[i] {
+        if function.InputTypes[i].Type != other.InputTypes[i].Type {
             return false
         }
     }
@@ -665,6 +686,15 @@ func ReadMemoryArgument(reader *ByteReader) (MemoryArgument, error) {
     }, nil
 }
 
+/* the text of a load or store instruction with the offset of its memory argument */
+func (memory MemoryArgument) convertToWat(name string) string {
+    if memory.Offset != 0 {
+        return fmt.Sprintf("%v offset=%v", name, memory.Offset)
+    }
+
+    return name
+}
+
 func (module *WebAssemblyFileModule) ReadCodeSection(size uint32) (*WebAssemblyCodeSection, error) {
     if module.debug {
         log.Printf("Read code section size %v\n", size)
@@ -689,15 +719,24 @@ func (module *WebAssemblyFileModule) ReadCodeSection(size uint32) (*WebAssemblyC
             log.Printf("Reading code entry %v size %v\n", i, size)
         }
 
+        start := uint32(sectionReader.Offset())
         codeReader := NewByteReader(io.LimitReader(sectionReader, int64(size)))
         code, err := ReadCode(codeReader)
         if err != nil {
-            return nil, fmt.Errorf("Could not read code %v: %v", i, err)
+            return nil, fmt.Errorf("Could not read code %v, the body at code section offset %v with size %v: %v", i, start, size, err)
         }
 
+        /* the offsets of the instructions were counted from the start of the body */
+        for j := range code.Offsets {
+            code.Offsets[j] += start
+            code.Ends[j] += start
+        }
+        code.Start = start
+        code.Size = size
+
         _, err = codeReader.ReadByte()
         if err == nil {
-            return nil, fmt.Errorf("Error reading code %v: not all bytes were read", i)
+            return nil, fmt.Errorf("Error reading code %v: not all bytes were read, the body at code section offset %v with size %v has extra bytes from offset %v", i, start, size, start + uint32(codeReader.Offset()) - 1)
         }
 
         if module.debug {
@@ -860,30 +899,32 @@ func (module *WebAssemblyFileModule) ReadCustomSection(size uint32) (*WebAssembl
         return nil, fmt.Errorf("Could not read name from custom section: %v", err)
     }
 
-    var section WebAssemblyCustomSection
-
-    for {
-        raw, err := sectionReader.ReadByte()
-        if errors.Is(err, io.EOF){
-            break
-        }
-        if err != nil {
-            return nil, fmt.Errorf("Could not read bytes from custom section: %v", err)
-        }
+    data, err := io.ReadAll(sectionReader)
+    if err != nil {
+        return nil, fmt.Errorf("Could not read bytes from custom section '%v': %v", name, err)
+    }
 
-        _ = raw
+    placement := CustomSectionPlacement{
+        Before: true,
+        Section: CustomPlacementFirst,
     }
 
-    _, err = sectionReader.ReadByte()
-    if err == nil {
-        return nil, fmt.Errorf("Error reading custom section: not all bytes were read")
+    if module.readKnownSection {
+        placement = CustomSectionPlacement{
+            Before: false,
+            Section: module.lastSection,
+        }
     }
 
     if module.debug {
-        log.Printf("Custom section '%v'\n", name)
+        log.Printf("Custom section '%v' size %v %v\n", name, len(data), placement.ConvertToWat())
     }
 
-    return &section, nil
+    return &WebAssemblyCustomSection{
+        Name: name,
+        Data: data,
+        Placement: placement,
+    }, nil
 }
 
 func (module *WebAssemblyFileModule) ReadMemorySection(size uint32) (*WebAssemblyMemorySection, error) {
@@ -910,6 +951,7 @@ func (module *WebAssemblyFileModule) ReadMemorySection(size uint32) (*WebAssembl
             log.Printf("Read memory element %v: %v\n", i, limit)
         }
 
+        section.AddMemory(limit, "")
     }
 
     return &section, nil
@@ -1067,7 +1109,28 @@ const (
     DataSection byte = 11
 )
 
+/* read the next section, or nil if there are no more sections. errors report the byte offset
+ * of the section and the offset where reading failed
+ */
 func (module *WebAssemblyFileModule) ReadSection() (WebAssemblySection, error) {
+    start := module.reader.Offset()
+    module.header = SectionHeader{Offset: start}
+    section, err := module.readSection()
+    if err != nil {
+        return nil, fmt.Errorf("Error in section starting at byte offset %v, failed at byte offset %v: %w", start, module.reader.Offset(), err)
+    }
+
+    return section, nil
+}
+
+/* the header of the section that ReadSection read last, which is known even if the contents of the
+ * section could not be read. the size is 0 if the header itself could not be read
+ */
+func (module *WebAssemblyFileModule) LastSectionHeader() SectionHeader {
+    return module.header
+}
+
+func (module *WebAssemblyFileModule) readSection() (WebAssemblySection, error) {
     sectionId, err := module.ReadSectionId()
     if err != nil {
         /* If we read eof then we probably read all bytes available, so there is no section to read */
@@ -1083,6 +1146,15 @@ func (module *WebAssemblyFileModule) ReadSection() (WebAssemblySection, error) {
         return nil, fmt.Errorf("Could not read section size: %v", err)
     }
 
+    module.header.Id = sectionId
+    module.header.ContentOffset = module.reader.Offset()
+    module.header.Size = sectionSize
+
+    if sectionId != CustomSection {
+        module.lastSection = sectionId
+        module.readKnownSection = true
+    }
+
     switch sectionId {
         case CustomSection:
             out, err := module.ReadCustomSection(sectionSize)
@@ -1146,14 +1218,29 @@ func ParseWasmFile(path string, debug bool) (WebAssemblyModule, error) {
 
     defer module.Close()
 
-    err = module.ReadMagic()
+    return parseWasm(&module)
+}
+
+/* parse a binary module that is already in memory, such as the contents of a (module binary ...) form */
+func ParseWasmBytes(data []byte) (WebAssemblyModule, error) {
+    return ParseWasm(bytes.NewReader(data))
+}
+
+/* parse a binary module from any reader, such as a network connection */
+func ParseWasm(reader io.Reader) (WebAssemblyModule, error) {
+    module := WebAssemblyNewReader(reader, false)
+    return parseWasm(&module)
+}
+
+func parseWasm(module *WebAssemblyFileModule) (WebAssemblyModule, error) {
+    err := module.ReadMagic()
     if err != nil {
         return WebAssemblyModule{}, err
     }
 
     version, err := module.ReadVersion()
     if err != nil {
-        return WebAssemblyModule{}, err
+        return WebAssemblyModule{}, fmt.Errorf("Could not read the module version at byte offset %v: %w", module.reader.Offset(), err)
     }
 
     if version != 1 {
@@ -1177,6 +1264,4 @@ func ParseWasmFile(path string, debug bool) (WebAssemblyModule, error) {
         }
         moduleOut.AddSection(section)
     }
-
-    return WebAssemblyModule{}, nil
 }
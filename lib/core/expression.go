@@ -13,11 +13,25 @@ type Local struct {
     Count uint32
     Name string
     Type ValueType
+    /* the text format keeps the parameters in the locals so they can be found by name */
+    Parameter bool
 }
 
 type Code struct {
     Locals []Local
     Expressions []Expression
+    /* for code read from a binary module, the offset of each instruction from the start of the code
+     * section. the instructions are in the order they are written, a block comes before the instructions
+     * inside of it and else and end are not included
+     */
+    Offsets []uint32
+    /* the offset just past the bytes of each instruction, for a block that is just past its block type */
+    Ends []uint32
+    /* for code read from a binary module, the offset of the body from the start of the code section, which
+     * is just after the size of the body, and the size of the body in bytes
+     */
+    Start uint32
+    Size uint32
 }
 
 func (code *Code) LookupLocal(name string) (int, bool) {
@@ -37,10 +51,11 @@ func (code *Code) ConvertToWat(indents string) string {
     /* the function implicitly creates a label */
     labelStack.Push(0)
 
-    if len(code.Locals) > 0 {
+    locals := code.DeclaredLocals()
+    if len(locals) > 0 {
         out.WriteString(indents)
         out.WriteString("(local")
-        for i, local := range code.Locals {
+        for i, local := range locals {
             out.WriteByte(' ')
             for x := 0; x < int(local.Count); x++ {
                 out.WriteString(local.Type.ConvertToWat(indents))
@@ -48,7 +63,7 @@ func (code *Code) ConvertToWat(indents string) string {
                     out.WriteByte(' ')
                 }
             }
-            if i < len(code.Locals) - 1 {
+            if i < len(locals) - 1 {
                 out.WriteByte(' ')
             }
         }
@@ -67,6 +82,17 @@ func (code *Code) ConvertToWat(indents string) string {
     return out.String()
 }
 
+/* the locals that are declared by the function, without the parameters */
+func (code *Code) DeclaredLocals() []Local {
+    var out []Local
+    for _, local := range code.Locals {
+        if !local.Parameter {
+            out = append(out, local)
+        }
+    }
+    return out
+}
+
 func (code *Code) AddLocal(count uint32, type_ ValueType){
     code.Locals = append(code.Locals, Local{Count: count, Type: type_})
 }
@@ -220,17 +246,19 @@ func (expr *F64ConstExpression) ConvertToWat(labels data.Stack[int], indents str
 }
 
 type F32LoadExpression struct {
+    Memory MemoryArgument
 }
 
 func (expr *F32LoadExpression) ConvertToWat(labels data.Stack[int], indents string) string {
-    return fmt.Sprintf("f32.load")
+    return expr.Memory.convertToWat("f32.load")
 }
 
 type F64LoadExpression struct {
+    Memory MemoryArgument
 }
 
 func (expr *F64LoadExpression) ConvertToWat(labels data.Stack[int], indents string) string {
-    return fmt.Sprintf("f64.load")
+    return expr.Memory.convertToWat("f64.load")
 }
 
 type F32ReinterpretI32Expression struct {
@@ -248,10 +276,11 @@ func (expr *F64ReinterpretI64Expression) ConvertToWat(labels data.Stack[int], in
 }
 
 type F64StoreExpression struct {
+    Memory MemoryArgument
 }
 
 func (expr *F64StoreExpression) ConvertToWat(labels data.Stack[int], indents string) string {
-    return fmt.Sprintf("f64.store")
+    return expr.Memory.convertToWat("f64.store")
 }
 
 type F64AddExpression struct {
@@ -416,10 +445,11 @@ func (expr *F32MaxExpression) ConvertToWat(labels data.Stack[int], indents strin
 }
 
 type F32StoreExpression struct {
+    Memory MemoryArgument
 }
 
 func (expr *F32StoreExpression) ConvertToWat(labels data.Stack[int], indents string) string {
-    return fmt.Sprintf("f32.store")
+    return expr.Memory.convertToWat("f32.store")
 }
 
 type F32NeExpression struct {
@@ -608,52 +638,59 @@ func (expr *I64LtuExpression) ConvertToWat(labels data.Stack[int], indents strin
 }
 
 type I32Load16sExpression struct {
+    Memory MemoryArgument
 }
 
 func (expr *I32Load16sExpression) ConvertToWat(labels data.Stack[int], indents string) string {
-    return "i32.load16_s"
+    return expr.Memory.convertToWat("i32.load16_s")
 }
 
 type I32Load16uExpression struct {
+    Memory MemoryArgument
 }
 
 func (expr *I32Load16uExpression) ConvertToWat(labels data.Stack[int], indents string) string {
-    return "i32.load16_u"
+    return expr.Memory.convertToWat("i32.load16_u")
 }
 
 type I64Load16sExpression struct {
+    Memory MemoryArgument
 }
 
 func (expr *I64Load16sExpression) ConvertToWat(labels data.Stack[int], indents string) string {
-    return "i64.load16_s"
+    return expr.Memory.convertToWat("i64.load16_s")
 }
 
 type I64Load16uExpression struct {
+    Memory MemoryArgument
 }
 
 func (expr *I64Load16uExpression) ConvertToWat(labels data.Stack[int], indents string) string {
-    return "i64.load16_u"
+    return expr.Memory.convertToWat("i64.load16_u")
 }
 
 type I64Load32sExpression struct {
+    Memory MemoryArgument
 }
 
 func (expr *I64Load32sExpression) ConvertToWat(labels data.Stack[int], indents string) string {
-    return "i64.load32_s"
+    return expr.Memory.convertToWat("i64.load32_s")
 }
 
 type I64Load32uExpression struct {
+    Memory MemoryArgument
 }
 
 func (expr *I64Load32uExpression) ConvertToWat(labels data.Stack[int], indents string) string {
-    return "i64.load32_u"
+    return expr.Memory.convertToWat("i64.load32_u")
 }
 
 type I64LoadExpression struct {
+    Memory MemoryArgument
 }
 
 func (expr *I64LoadExpression) ConvertToWat(labels data.Stack[int], indents string) string {
-    return "i64.load"
+    return expr.Memory.convertToWat("i64.load")
 }
 
 type I32ReinterpretF32Expression struct {
@@ -670,20 +707,20 @@ func (expr *I64ReinterpretF64Expression) ConvertToWat(labels data.Stack[int], in
     return "i64.reinterpret_f64"
 }
 
-/* FIXME: generalize these load expression types */
 type I32Load8sExpression struct {
     Memory MemoryArgument
 }
 
 func (expr *I32Load8sExpression) ConvertToWat(labels data.Stack[int], indents string) string {
-    return "i32.load8_s"
+    return expr.Memory.convertToWat("i32.load8_s")
 }
 
 type I32Load8uExpression struct {
+    Memory MemoryArgument
 }
 
 func (expr *I32Load8uExpression) ConvertToWat(labels data.Stack[int], indents string) string {
-    return "i32.load8_u"
+    return expr.Memory.convertToWat("i32.load8_u")
 }
 
 type I64Load8sExpression struct {
@@ -691,7 +728,15 @@ type I64Load8sExpression struct {
 }
 
 func (expr *I64Load8sExpression) ConvertToWat(labels data.Stack[int], indents string) string {
-    return "i64.load8_s"
+    return expr.Memory.convertToWat("i64.load8_s")
+}
+
+type I64Load8uExpression struct {
+    Memory MemoryArgument
+}
+
+func (expr *I64Load8uExpression) ConvertToWat(labels data.Stack[int], indents string) string {
+    return expr.Memory.convertToWat("i64.load8_u")
 }
 
 type I64DivsExpression struct {
@@ -793,52 +838,59 @@ func (expr *I64GeuExpression) ConvertToWat(labels data.Stack[int], indents strin
 }
 
 type I32StoreExpression struct {
+    Memory MemoryArgument
 }
 
 func (expr *I32StoreExpression) ConvertToWat(labels data.Stack[int], indents string) string {
-    return "i32.store"
+    return expr.Memory.convertToWat("i32.store")
 }
 
 type I64StoreExpression struct {
+    Memory MemoryArgument
 }
 
 func (expr *I64StoreExpression) ConvertToWat(labels data.Stack[int], indents string) string {
-    return "i64.store"
+    return expr.Memory.convertToWat("i64.store")
 }
 
 type I64Store8Expression struct {
+    Memory MemoryArgument
 }
 
 func (expr *I64Store8Expression) ConvertToWat(labels data.Stack[int], indents string) string {
-    return "i64.store8"
+    return expr.Memory.convertToWat("i64.store8")
 }
 
 type I64Store32Expression struct {
+    Memory MemoryArgument
 }
 
 func (expr *I64Store32Expression) ConvertToWat(labels data.Stack[int], indents string) string {
-    return "i64.store32"
+    return expr.Memory.convertToWat("i64.store32")
 }
 
 type I64Store16Expression struct {
+    Memory MemoryArgument
 }
 
 func (expr *I64Store16Expression) ConvertToWat(labels data.Stack[int], indents string) string {
-    return "i64.store16"
+    return expr.Memory.convertToWat("i64.store16")
 }
 
 type I32Store8Expression struct {
+    Memory MemoryArgument
 }
 
 func (expr *I32Store8Expression) ConvertToWat(labels data.Stack[int], indents string) string {
-    return "i32.store8"
+    return expr.Memory.convertToWat("i32.store8")
 }
 
 type I32Store16Expression struct {
+    Memory MemoryArgument
 }
 
 func (expr *I32Store16Expression) ConvertToWat(labels data.Stack[int], indents string) string {
-    return "i32.store16"
+    return expr.Memory.convertToWat("i32.store16")
 }
 
 type I32LoadExpression struct {
@@ -846,7 +898,7 @@ type I32LoadExpression struct {
 }
 
 func (expr *I32LoadExpression) ConvertToWat(labels data.Stack[int], indents string) string {
-    return "i32.load"
+    return expr.Memory.convertToWat("i32.load")
 }
 
 type I32EqzExpression struct {
@@ -1139,6 +1191,8 @@ type BlockExpression struct {
     Instructions []Expression
     ElseInstructions []Expression // for if-then-else
     Kind BlockKind
+    /* values the block takes from the stack when it is entered */
+    ParameterTypes []ValueType
     ExpectedType []ValueType
 }
 
@@ -1187,6 +1241,12 @@ func ReadBlockInstruction(reader *ByteReader, readingIf bool) (BlockExpression,
         return BlockExpression{}, 0, fmt.Errorf("Could not read block type: %v", err)
     }
 
+    /* the block is the last instruction that was recorded */
+    if reader.instructions != nil {
+        reader.endInstruction(len(*reader.instructions) - 1)
+    }
+
+    var expectedType []ValueType
     if blockType == 0x40 {
     } else {
         /* Read the type from the byte we just read */
@@ -1194,7 +1254,7 @@ func ReadBlockInstruction(reader *ByteReader, readingIf bool) (BlockExpression,
         if err != nil {
             return BlockExpression{}, 0, fmt.Errorf("Unable to read block type: %v", err)
         }
-        _ = valueType
+        expectedType = append(expectedType, valueType)
     }
 
     instructions, end, err := ReadExpressionSequence(reader, readingIf)
@@ -1202,7 +1262,159 @@ func ReadBlockInstruction(reader *ByteReader, readingIf bool) (BlockExpression,
         return BlockExpression{}, 0, fmt.Errorf("Unable to read block instructions: %v", err)
     }
 
-    return BlockExpression{Instructions: instructions}, end, nil
+    return BlockExpression{Instructions: instructions, ExpectedType: expectedType}, end, nil
+}
+
+/* the expression for a load or store instruction, or nil if the instruction is not one */
+func memoryInstruction(instruction byte, memory MemoryArgument) Expression {
+    switch instruction {
+        case 0x28: return &I32LoadExpression{Memory: memory}
+        case 0x29: return &I64LoadExpression{Memory: memory}
+        case 0x2a: return &F32LoadExpression{Memory: memory}
+        case 0x2b: return &F64LoadExpression{Memory: memory}
+        case 0x2c: return &I32Load8sExpression{Memory: memory}
+        case 0x2d: return &I32Load8uExpression{Memory: memory}
+        case 0x2e: return &I32Load16sExpression{Memory: memory}
+        case 0x2f: return &I32Load16uExpression{Memory: memory}
+        case 0x30: return &I64Load8sExpression{Memory: memory}
+        case 0x31: return &I64Load8uExpression{Memory: memory}
+        case 0x32: return &I64Load16sExpression{Memory: memory}
+        case 0x33: return &I64Load16uExpression{Memory: memory}
+        case 0x34: return &I64Load32sExpression{Memory: memory}
+        case 0x35: return &I64Load32uExpression{Memory: memory}
+        case 0x36: return &I32StoreExpression{Memory: memory}
+        case 0x37: return &I64StoreExpression{Memory: memory}
+        case 0x38: return &F32StoreExpression{Memory: memory}
+        case 0x39: return &F64StoreExpression{Memory: memory}
+        case 0x3a: return &I32Store8Expression{Memory: memory}
+        case 0x3b: return &I32Store16Expression{Memory: memory}
+        case 0x3c: return &I64Store8Expression{Memory: memory}
+        case 0x3d: return &I64Store16Expression{Memory: memory}
+        case 0x3e: return &I64Store32Expression{Memory: memory}
+    }
+
+    return nil
+}
+
+/* the expression for an instruction without immediates, these are the same expressions
+ * that the text format produces. returns nil for instructions that have no expression yet,
+ * which the reader reports as an error.
+ */
+func simpleInstruction(instruction byte) Expression {
+    switch instruction {
+        case 0x00: return &UnreachableExpression{}
+        case 0x0f: return &ReturnExpression{}
+        case 0x1a: return &DropExpression{}
+        case 0x1b: return &SelectExpression{}
+
+        case 0x45: return &I32EqzExpression{}
+        case 0x46: return &I32EqExpression{}
+        case 0x47: return &I32NeExpression{}
+        case 0x48: return &I32LtsExpression{}
+        case 0x49: return &I32LtuExpression{}
+        case 0x4a: return &I32GtsExpression{}
+        case 0x4b: return &I32GtuExpression{}
+        case 0x4c: return &I32LesExpression{}
+        case 0x4d: return &I32LeuExpression{}
+        case 0x4e: return &I32GesExpression{}
+        case 0x4f: return &I32GeuExpression{}
+
+        case 0x50: return &I64EqzExpression{}
+        case 0x51: return &I64EqExpression{}
+        case 0x52: return &I64NeExpression{}
+        case 0x53: return &I64LtsExpression{}
+        case 0x54: return &I64LtuExpression{}
+        case 0x55: return &I64GtsExpression{}
+        case 0x56: return &I64GtuExpression{}
+        case 0x57: return &I64LesExpression{}
+        case 0x58: return &I64LeuExpression{}
+        case 0x59: return &I64GesExpression{}
+        case 0x5a: return &I64GeuExpression{}
+
+        case 0x5b: return &F32EqExpression{}
+        case 0x5c: return &F32NeExpression{}
+        case 0x5d: return &F32LtExpression{}
+        case 0x5e: return &F32GtExpression{}
+        case 0x5f: return &F32LeExpression{}
+        case 0x60: return &F32GeExpression{}
+
+        case 0x61: return &F64EqExpression{}
+        case 0x62: return &F64NeExpression{}
+        case 0x63: return &F64LtExpression{}
+        case 0x64: return &F64GtExpression{}
+        case 0x65: return &F64LeExpression{}
+        case 0x66: return &F64GeExpression{}
+
+        case 0x67: return &I32ClzExpression{}
+        case 0x68: return &I32CtzExpression{}
+        case 0x69: return &I32PopcntExpression{}
+        case 0x6a: return &I32AddExpression{}
+        case 0x6b: return &I32SubExpression{}
+        case 0x6c: return &I32MulExpression{}
+        case 0x6d: return &I32DivsExpression{}
+        case 0x6e: return &I32DivuExpression{}
+        case 0x6f: return &I32RemsExpression{}
+        case 0x70: return &I32RemuExpression{}
+        case 0x71: return &I32AndExpression{}
+        case 0x72: return &I32OrExpression{}
+        case 0x73: return &I32XOrExpression{}
+        case 0x74: return &I32ShlExpression{}
+        case 0x75: return &I32ShrsExpression{}
+        case 0x76: return &I32ShruExpression{}
+        case 0x77: return &I32RotlExpression{}
+        case 0x78: return &I32RotrExpression{}
+
+        case 0x7a: return &I64CtzExpression{}
+        case 0x7c: return &I64AddExpression{}
+        case 0x7d: return &I64SubExpression{}
+        case 0x7e: return &I64MulExpression{}
+        case 0x7f: return &I64DivsExpression{}
+        case 0x80: return &I64DivuExpression{}
+        case 0x81: return &I64RemsExpression{}
+        case 0x82: return &I64RemuExpression{}
+        case 0x83: return &I64AndExpression{}
+        case 0x84: return &I64OrExpression{}
+        case 0x85: return &I64XOrExpression{}
+        case 0x86: return &I64ShlExpression{}
+        case 0x87: return &I64ShrsExpression{}
+        case 0x88: return &I64ShruExpression{}
+
+        case 0x8c: return &F32NegExpression{}
+        case 0x91: return &F32SqrtExpression{}
+        case 0x92: return &F32AddExpression{}
+        case 0x93: return &F32SubExpression{}
+        case 0x94: return &F32MulExpression{}
+        case 0x95: return &F32DivExpression{}
+        case 0x96: return &F32MinExpression{}
+        case 0x97: return &F32MaxExpression{}
+        case 0x98: return &F32CopySignExpression{}
+
+        case 0x9a: return &F64NegExpression{}
+        case 0xa0: return &F64AddExpression{}
+        case 0xa1: return &F64SubExpression{}
+        case 0xa2: return &F64MulExpression{}
+        case 0xa3: return &F64DivExpression{}
+        case 0xa4: return &F64MinExpression{}
+        case 0xa5: return &F64MaxExpression{}
+        case 0xa6: return &F64CopySignExpression{}
+
+        case 0xa7: return &I32WrapI64Expression{}
+        case 0xac: return &I64ExtendI32sExpression{}
+        case 0xad: return &I64ExtendI32uExpression{}
+        case 0xb0: return &I64TruncF64sExpression{}
+        case 0xb7: return &F64ConvertI32sExpression{}
+        case 0xb8: return &F64ConvertI32uExpression{}
+        case 0xba: return &F64ConvertI64uExpression{}
+        case 0xbb: return &F64PromoteF32Expression{}
+        case 0xbc: return &I32ReinterpretF32Expression{}
+        case 0xbd: return &I64ReinterpretF64Expression{}
+        case 0xbe: return &F32ReinterpretI32Expression{}
+        case 0xbf: return &F64ReinterpretI64Expression{}
+        case 0xc0: return &I32Extend8sExpression{}
+        case 0xc1: return &I32Extend16sExpression{}
+    }
+
+    return nil
 }
 
 /* Read a sequence of instructions. If 'readingIf' is true then we are inside an
@@ -1216,6 +1428,15 @@ func ReadExpressionSequence(reader *ByteReader, readingIf bool) ([]Expression, E
 
     count := 0
     for {
+        /* the offset is recorded before the instructions inside of a block are read */
+        recorded := 0
+        length := len(sequence)
+        if reader.instructions != nil {
+            recorded = len(*reader.instructions)
+            *reader.instructions = append(*reader.instructions, uint32(reader.offset))
+            *reader.ends = append(*reader.ends, uint32(reader.offset))
+        }
+
         instruction, err := reader.ReadByte()
         if err != nil {
             return nil, 0, fmt.Errorf("Could not read instruction: %v", err)
@@ -1226,12 +1447,6 @@ func ReadExpressionSequence(reader *ByteReader, readingIf bool) ([]Expression, E
         }
 
         switch instruction {
-            /* unreachable */
-            case 0x00: break
-
-            /* nop */
-            case 0x01: break
-
             /* block */
             case 0x02:
                 block, _, err := ReadBlockInstruction(reader, false)
@@ -1269,7 +1484,7 @@ func ReadExpressionSequence(reader *ByteReader, readingIf bool) ([]Expression, E
                         return nil, 0, fmt.Errorf("Could not read else expressions in if block at instruction %v: %v", count, err)
                     }
 
-                    _ = elseExpression
+                    ifBlock.ElseInstructions = elseExpression
                 }
 
                 sequence = append(sequence, &ifBlock)
@@ -1280,7 +1495,8 @@ func ReadExpressionSequence(reader *ByteReader, readingIf bool) ([]Expression, E
                     return nil, 0, fmt.Errorf("Read an else bytecode (0x5) outside of an if block at instruction %v", count)
                 }
 
-                return nil, SequenceIf, nil
+                reader.forget(recorded)
+                return sequence, SequenceIf, nil
 
             /* call */
             case 0x10:
@@ -1310,6 +1526,7 @@ func ReadExpressionSequence(reader *ByteReader, readingIf bool) ([]Expression, E
                 if debug {
                     log.Printf("Read %v instructions\n", count+1)
                 }
+                reader.forget(recorded)
                 return sequence, SequenceEnd, nil
 
             /* br */
@@ -1337,6 +1554,8 @@ func ReadExpressionSequence(reader *ByteReader, readingIf bool) ([]Expression, E
                     return nil, 0, fmt.Errorf("Could not read labels length for br_table instruction %v: %v", count, err)
                 }
 
+                /* the default label is kept as the last entry */
+                var table []uint32
                 var i uint32
                 for i = 0; i < labels; i++ {
                     index, err := ReadU32(reader)
@@ -1344,7 +1563,7 @@ func ReadExpressionSequence(reader *ByteReader, readingIf bool) ([]Expression, E
                         return nil, 0, fmt.Errorf("Could not read label index %v for br_table instruction %v: %v", i, count, err)
                     }
 
-                    _ = index
+                    table = append(table, index)
                 }
 
                 lastIndex, err := ReadU32(reader)
@@ -1352,19 +1571,7 @@ func ReadExpressionSequence(reader *ByteReader, readingIf bool) ([]Expression, E
                     return nil, 0, fmt.Errorf("Could not read the last label index for br_table instruction %v: %v", count, err)
                 }
 
-                _ = lastIndex
-
-            /* return */
-            case 0xf:
-                break
-
-            /* drop */
-            case 0x1a:
-                break
-
-            /* select */
-            case 0x1b:
-                break
+                sequence = append(sequence, &BranchTableExpression{Labels: append(table, lastIndex)})
 
             /* local.get */
             case 0x20:
@@ -1391,7 +1598,7 @@ func ReadExpressionSequence(reader *ByteReader, readingIf bool) ([]Expression, E
                     return nil, 0, fmt.Errorf("Could not read local index instruction %v: %v", count, err)
                 }
 
-                _ = local
+                sequence = append(sequence, &LocalTeeExpression{Local: local})
 
             /* global.get */
             case 0x23:
@@ -1463,10 +1670,11 @@ func ReadExpressionSequence(reader *ByteReader, readingIf bool) ([]Expression, E
                     return nil, 0, fmt.Errorf("Could not read memory argument for instruction %v: %v", count, err)
                 }
 
-                switch instruction {
-                    case 0x28:
-                        sequence = append(sequence, &I32LoadExpression{Memory: memory})
+                expression := memoryInstruction(instruction, memory)
+                if expression == nil {
+                    return nil, 0, fmt.Errorf("Unsupported memory instruction 0x%x at instruction %v", instruction, count)
                 }
+                sequence = append(sequence, expression)
 
             /* memory.size */
             case 0x3f,
@@ -1487,6 +1695,10 @@ func ReadExpressionSequence(reader *ByteReader, readingIf bool) ([]Expression, E
                     return nil, 0, fmt.Errorf("Expected byte following %s instruction %v to be 0 but got %v", name, count, zero)
                 }
 
+                if instruction == 0x40 {
+                    sequence = append(sequence, &MemoryGrowExpression{})
+                }
+
             /* i32.const n */
             case 0x41:
                 i32, err := ReadS32(reader)
@@ -1503,7 +1715,7 @@ func ReadExpressionSequence(reader *ByteReader, readingIf bool) ([]Expression, E
                     return nil, 0, fmt.Errorf("Unable to read i64 value at instruction %v: %v", count, err)
                 }
 
-                _ = i64
+                sequence = append(sequence, &I64ConstExpression{N: i64})
 
             /* f32.const */
             case 0x43:
@@ -1525,15 +1737,23 @@ func ReadExpressionSequence(reader *ByteReader, readingIf bool) ([]Expression, E
 
             /* No-argument instructions */
 
+            /* nop does nothing, so like in the text format it has no expression */
+            case 0x01:
+
+                /* unreachable */
+            case 0x00,
+                /* return */
+                0x0f,
+                /* drop */
+                0x1a,
+                /* select */
+                0x1b,
                 /* i32.eqz */
-            case 0x45:
+                0x45,
                 /* i32.eq */
-                break
-            case 0x46:
-                sequence = append(sequence, &I32EqExpression{})
-
+                0x46,
                 /* i32.ne */
-            case 0x47,
+                0x47,
                 /* i32.lt_s */
                 0x48,
                 /* i32.lt_u */
@@ -1601,24 +1821,17 @@ func ReadExpressionSequence(reader *ByteReader, readingIf bool) ([]Expression, E
                 /* i32.ctz */
                 0x68,
                 /* i32.popcnt */
-                0x69:
-                    break
+                0x69,
                 /* i32.add */
-            case 0x6a:
-                sequence = append(sequence, &I32AddExpression{})
-
+                0x6a,
                 /* i32.sub */
-            case 0x6b:
-                break
+                0x6b,
                 /* i32.mul */
-            case 0x6c:
-                sequence = append(sequence, &I32MulExpression{})
+                0x6c,
                 /* i32.div_s */
-            case 0x6d:
-                sequence = append(sequence, &I32DivSignedExpression{})
-
+                0x6d,
                 /* i32.div_u */
-            case 0x6e,
+                0x6e,
                 /* i32.rem_s */
                 0x6f,
                 /* i32.rem_u */
@@ -1780,14 +1993,57 @@ func ReadExpressionSequence(reader *ByteReader, readingIf bool) ([]Expression, E
                 /* f32.reinterpret_i32 */
                 0xbe,
                 /* f64.reinterpret_i64 */
-                0xbf:
+                0xbf,
+                /* i32.extend8_s */
+                0xc0,
+                /* i32.extend16_s */
+                0xc1:
+
+                /* leaving out an instruction that has no expression yet would change what the code
+                 * computes, so the module cannot be read
+                 */
+                expression := simpleInstruction(instruction)
+                if expression == nil {
+                    return nil, 0, fmt.Errorf("Unsupported instruction 0x%x at instruction %v", instruction, count)
+                }
+                sequence = append(sequence, expression)
+
+            /* ref.null t */
+            case 0xd0:
+                refType, err := reader.ReadByte()
+                if err != nil {
+                    return nil, 0, fmt.Errorf("Could not read reference type for ref.null at instruction %v: %v", count, err)
+                }
 
-                break
+                switch refType {
+                    case 0x70: sequence = append(sequence, &RefFuncNullExpression{})
+                    case 0x6f: sequence = append(sequence, &RefExternNullExpression{})
+                    default:
+                        return nil, 0, fmt.Errorf("Unknown reference type 0x%x for ref.null at instruction %v", refType, count)
+                }
+
+            /* ref.func x */
+            case 0xd2:
+                index, err := ReadFunctionIndex(reader)
+                if err != nil {
+                    return nil, 0, fmt.Errorf("Could not read function index for ref.func at instruction %v: %v", count, err)
+                }
+
+                sequence = append(sequence, &RefFuncExpression{Function: index})
 
             default:
                 return nil, 0, fmt.Errorf("Unimplemented instruction 0x%x", instruction)
         }
 
+        /* an instruction that has no expression does not get an offset either. a block ended where its
+         * block type did
+         */
+        if len(sequence) == length {
+            reader.forget(recorded)
+        } else if instruction != 0x02 && instruction != 0x03 && instruction != 0x04 {
+            reader.endInstruction(recorded)
+        }
+
         count += 1
     }
 }
@@ -1824,8 +2080,16 @@ func ReadCode(reader *ByteReader) (Code, error) {
         code.AddLocal(count, valueType)
     }
 
+    reader.instructions = &code.Offsets
+    reader.ends = &code.Ends
     expressions, _, err := ReadExpressionSequence(reader, false)
+    reader.instructions = nil
+    reader.ends = nil
     if err != nil {
+        /* the last offset is the instruction that could not be read */
+        if len(code.Offsets) > 0 {
+            return Code{}, fmt.Errorf("Could not read expressions, failed in the instruction at byte %v of the body: %v", code.Offsets[len(code.Offsets)-1], err)
+        }
         return Code{}, fmt.Errorf("Could not read expressions: %v", err)
     }
 
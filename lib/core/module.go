@@ -1,7 +1,9 @@
 package core
 
 import (
+    "io"
     "fmt"
+    "bytes"
     "strings"
 
     "github.com/kazzmir/webassembly/lib/data"
@@ -158,6 +160,9 @@ func (section *WebAssemblyGlobalSection) String() string {
     return "global section"
 }
 
+/* the size of one page of linear memory */
+const MemoryPageSize = 65536
+
 type WebAssemblyMemorySection struct {
     Memories []Limit
     Names []string
@@ -183,7 +188,58 @@ func (section *WebAssemblyMemorySection) String() string {
     return "memory section"
 }
 
+/* pseudo section ids that a custom section placement can refer to, meaning
+ * the first or last known section in the module
+ */
+const (
+    CustomPlacementFirst byte = 0xfe
+    CustomPlacementLast byte = 0xff
+)
+
+/* where a custom section lives relative to the known sections, such as (after type).
+ * Section is either a section id (TypeSection, CodeSection, etc) or one of
+ * CustomPlacementFirst/CustomPlacementLast.
+ */
+type CustomSectionPlacement struct {
+    Before bool
+    Section byte
+}
+
+func sectionWatName(id byte) string {
+    switch id {
+        case TypeSection: return "type"
+        case ImportSection: return "import"
+        case FunctionSection: return "func"
+        case TableSection: return "table"
+        case MemorySection: return "memory"
+        case GlobalSection: return "global"
+        case ExportSection: return "export"
+        case StartSection: return "start"
+        case ElementSection: return "elem"
+        case CodeSection: return "code"
+        case DataSection: return "data"
+        case CustomPlacementFirst: return "first"
+        case CustomPlacementLast: return "last"
+    }
+
+    return "?"
+}
+
+func (placement CustomSectionPlacement) ConvertToWat() string {
+    if placement.Before {
+        return fmt.Sprintf("(before %v)", sectionWatName(placement.Section))
+    }
+
+    return fmt.Sprintf("(after %v)", sectionWatName(placement.Section))
+}
+
+/* custom sections hold arbitrary named data, such as 'name', 'producers', or '.debug_info'.
+ * the payload is kept as raw bytes so that tools can inspect or rewrite it.
+ */
 type WebAssemblyCustomSection struct {
+    Name string
+    Data []byte
+    Placement CustomSectionPlacement
 }
 
 func (section *WebAssemblyCustomSection) ToInterface() WebAssemblySection {
@@ -193,12 +249,30 @@ func (section *WebAssemblyCustomSection) ToInterface() WebAssemblySection {
     return section
 }
 
+/* convert a byte string into a .wat string literal, escaping anything that is not printable */
+func watString(data []byte) string {
+    var out strings.Builder
+    out.WriteByte('"')
+    for _, b := range data {
+        if b == '"' || b == '\\' || b < 0x20 || b >= 0x7f {
+            out.WriteString(fmt.Sprintf("\\%02x", b))
+        } else {
+            out.WriteByte(b)
+        }
+    }
+    out.WriteByte('"')
+    return out.String()
+}
+
+/* custom sections are written using the annotation syntax
+ *   (@custom "name" (after type) "data")
+ */
 func (section *WebAssemblyCustomSection) ConvertToWat(module *WebAssemblyModule, indents string) string {
-    return "(custom)"
+    return fmt.Sprintf("%v(@custom %v %v %v)", indents, watString([]byte(section.Name)), section.Placement.ConvertToWat(), watString(section.Data))
 }
 
 func (section *WebAssemblyCustomSection) String() string {
-    return "custom section"
+    return fmt.Sprintf("custom section '%v'", section.Name)
 }
 
 type ElementInit struct {
@@ -215,6 +289,14 @@ type ElementModeActive struct {
     Offset []Expression
 }
 
+/* passive elements are only used by table.init */
+type ElementModePassive struct {
+}
+
+/* declarative elements only declare function references for ref.func */
+type ElementModeDeclarative struct {
+}
+
 type WebAssemblyElementSection struct {
     Elements []ElementInit
 }
@@ -227,6 +309,10 @@ func (section *WebAssemblyElementSection) ToInterface() WebAssemblySection {
     return section
 }
 
+func (section *WebAssemblyElementSection) AddElement(element ElementInit){
+    section.Elements = append(section.Elements, element)
+}
+
 func (section *WebAssemblyElementSection) AddFunctionRefInit(functions []*FunctionIndex, table int, expression []Expression){
     var inits []Expression
     for _, function := range functions {
@@ -250,6 +336,11 @@ func (section *WebAssemblyElementSection) ConvertToWat(module *WebAssemblyModule
         out.WriteString(indents)
         out.WriteString(fmt.Sprintf("(elem (;%v;) ", i))
 
+        _, isDeclarative := element.Mode.(*ElementModeDeclarative)
+        if isDeclarative {
+            out.WriteString("declare ")
+        }
+
         active, isActive := element.Mode.(*ElementModeActive)
         if isActive {
             out.WriteString("(")
@@ -498,6 +589,18 @@ func (section *WebAssemblyExportSection) ConvertToWat(module *WebAssemblyModule,
             found = true
         }
 
+        memory, ok := item.Kind.(*MemoryIndex)
+        if ok {
+            out.WriteString(fmt.Sprintf("(memory %v)", memory.Id))
+            found = true
+        }
+
+        global, ok := item.Kind.(*GlobalIndex)
+        if ok {
+            out.WriteString(fmt.Sprintf("(global %v)", global.Id))
+            found = true
+        }
+
         if !found {
             out.WriteString(fmt.Sprintf("unhandled export index %+v", item.Kind))
         }
@@ -567,16 +670,23 @@ type ImportSectionItem struct {
     ModuleName string
     Name string
     Kind Index
+    // the $name given to the import in the text format, if any
+    LocalName string
 }
 
 type WebAssemblyImportSection struct {
     Items []ImportSectionItem
 }
 
-func (section *WebAssemblyImportSection) CountFunctions() int {
+/* count the imports of one kind, such as *FunctionImport or *GlobalType */
+func countImports[T Index](section *WebAssemblyImportSection) int {
+    if section == nil {
+        return 0
+    }
+
     count := 0
     for _, item := range section.Items {
-        _, ok := item.Kind.(*FunctionImport)
+        _, ok := item.Kind.(T)
         if ok {
             count += 1
         }
@@ -585,6 +695,64 @@ func (section *WebAssemblyImportSection) CountFunctions() int {
     return count
 }
 
+/* find the index of an import of one kind by its $name. imports always come first
+ * in their index space, so the index is just the position among imports of that kind
+ */
+func findImportByName[T Index](section *WebAssemblyImportSection, name string) (uint32, bool) {
+    if section == nil || name == "" {
+        return 0, false
+    }
+
+    var index uint32
+    for _, item := range section.Items {
+        _, ok := item.Kind.(T)
+        if ok {
+            if item.LocalName == name {
+                return index, true
+            }
+            index += 1
+        }
+    }
+
+    return 0, false
+}
+
+/* get the nth import of one kind */
+func getImport[T Index](section *WebAssemblyImportSection, index uint32) (ImportSectionItem, bool) {
+    if section == nil {
+        return ImportSectionItem{}, false
+    }
+
+    var count uint32
+    for _, item := range section.Items {
+        _, ok := item.Kind.(T)
+        if ok {
+            if count == index {
+                return item, true
+            }
+            count += 1
+        }
+    }
+
+    return ImportSectionItem{}, false
+}
+
+func (section *WebAssemblyImportSection) CountFunctions() int {
+    return countImports[*FunctionImport](section)
+}
+
+func (section *WebAssemblyImportSection) CountGlobals() int {
+    return countImports[*GlobalType](section)
+}
+
+func (section *WebAssemblyImportSection) CountTables() int {
+    return countImports[*TableType](section)
+}
+
+func (section *WebAssemblyImportSection) CountMemories() int {
+    return countImports[*MemoryImportType](section)
+}
+
 func (section *WebAssemblyImportSection) ToInterface() WebAssemblySection {
     if section == nil {
         return nil
@@ -661,10 +829,16 @@ func (section *WebAssemblyImportSection) String() string {
 }
 
 func (section *WebAssemblyImportSection) AddImport(moduleName string, name string, kind Index) {
+    section.AddNamedImport(moduleName, name, kind, "")
+}
+
+/* add an import that can be referred to by the given $name */
+func (section *WebAssemblyImportSection) AddNamedImport(moduleName string, name string, kind Index, localName string) {
     section.Items = append(section.Items, ImportSectionItem{
         ModuleName: moduleName,
         Name: name,
         Kind: kind,
+        LocalName: localName,
     })
 }
 
@@ -715,13 +889,11 @@ func (section *WebAssemblyTypeSection) GetTypeByName(name string) *TypeIndex {
  * just returns the index of an existing type
  */
 func (section *WebAssemblyTypeSection) GetOrCreateFunctionType(function WebAssemblyFunction) uint32 {
-    /*
     for i, check := range section.Functions {
         if check.Equals(function) {
             return uint32(i)
         }
     }
-    */
 
     section.AddFunctionType(function)
     return uint32(len(section.Functions) - 1)
@@ -825,6 +997,18 @@ func (module *WebAssemblyModule) GetElementSection() *WebAssemblyElementSection
     return findSection[*WebAssemblyElementSection](module.Sections)
 }
 
+func (module *WebAssemblyModule) GetImportSection() *WebAssemblyImportSection {
+    return findSection[*WebAssemblyImportSection](module.Sections)
+}
+
+func (module *WebAssemblyModule) GetDataSection() *WebAssemblyDataSection {
+    return findSection[*WebAssemblyDataSection](module.Sections)
+}
+
+func (module *WebAssemblyModule) GetStartSection() *WebAssemblyStartSection {
+    return findSection[*WebAssemblyStartSection](module.Sections)
+}
+
 func (module *WebAssemblyModule) GetFunction(index uint32) WebAssemblyFunction {
     for _, section := range module.Sections {
         type_, ok := section.(*WebAssemblyTypeSection)
@@ -847,10 +1031,348 @@ func (module *WebAssemblyModule) GetImportFunctionCount() int {
     return 0
 }
 
+func (module *WebAssemblyModule) GetImportGlobalCount() int {
+    return module.GetImportSection().CountGlobals()
+}
+
+func (module *WebAssemblyModule) GetImportTableCount() int {
+    return module.GetImportSection().CountTables()
+}
+
+func (module *WebAssemblyModule) GetImportMemoryCount() int {
+    return module.GetImportSection().CountMemories()
+}
+
+/* the type index of a function in the function index space, where imported functions come
+ * before the functions defined in the module
+ */
+func (module *WebAssemblyModule) GetFunctionTypeIndex(index uint32) *TypeIndex {
+    imported := uint32(module.GetImportFunctionCount())
+    if index < imported {
+        item, ok := getImport[*FunctionImport](module.GetImportSection(), index)
+        if ok {
+            return &TypeIndex{Id: item.Kind.(*FunctionImport).Index}
+        }
+        return nil
+    }
+
+    functionSection := module.GetFunctionSection()
+    if functionSection == nil {
+        return nil
+    }
+
+    return functionSection.GetFunctionType(int(index - imported))
+}
+
+/* returns the import that the function index refers to, if the function is imported */
+func (module *WebAssemblyModule) GetFunctionImport(index uint32) (ImportSectionItem, bool) {
+    return getImport[*FunctionImport](module.GetImportSection(), index)
+}
+
+/* look up a function by its $name in the function index space */
+func (module *WebAssemblyModule) LookupFunction(name string) (uint32, bool) {
+    index, ok := findImportByName[*FunctionImport](module.GetImportSection(), name)
+    if ok {
+        return index, true
+    }
+
+    functionSection := module.GetFunctionSection()
+    if functionSection != nil {
+        index, ok := functionSection.GetFunctionIndexByName(name)
+        if ok {
+            return uint32(module.GetImportFunctionCount() + index), true
+        }
+    }
+
+    return 0, false
+}
+
+/* look up a global by its $name in the global index space */
+func (module *WebAssemblyModule) LookupGlobal(name string) (uint32, bool) {
+    index, ok := findImportByName[*GlobalType](module.GetImportSection(), name)
+    if ok {
+        return index, true
+    }
+
+    globalSection := module.GetGlobalSection()
+    if globalSection != nil {
+        index, ok := globalSection.LookupGlobal(name)
+        if ok {
+            return uint32(module.GetImportGlobalCount()) + index, true
+        }
+    }
+
+    return 0, false
+}
+
+/* look up a table by its $name in the table index space */
+func (module *WebAssemblyModule) LookupTable(name string) (uint32, bool) {
+    index, ok := findImportByName[*TableType](module.GetImportSection(), name)
+    if ok {
+        return index, true
+    }
+
+    tableSection := module.GetTableSection()
+    if tableSection != nil {
+        index, ok := tableSection.FindTableIndexByName(name)
+        if ok {
+            return uint32(module.GetImportTableCount()) + index, true
+        }
+    }
+
+    return 0, false
+}
+
+/* look up a memory by its $name in the memory index space */
+func (module *WebAssemblyModule) LookupMemory(name string) (uint32, bool) {
+    index, ok := findImportByName[*MemoryImportType](module.GetImportSection(), name)
+    if ok {
+        return index, true
+    }
+
+    memorySection := module.GetMemorySection()
+    if memorySection != nil {
+        for i, check := range memorySection.Names {
+            if name != "" && check == name {
+                return uint32(module.GetImportMemoryCount() + i), true
+            }
+        }
+    }
+
+    return 0, false
+}
+
+/* the limits of a memory in the memory index space */
+func (module *WebAssemblyModule) GetMemoryLimit(index uint32) (Limit, bool) {
+    imported := uint32(module.GetImportMemoryCount())
+    if index < imported {
+        item, ok := getImport[*MemoryImportType](module.GetImportSection(), index)
+        if ok {
+            return item.Kind.(*MemoryImportType).Limit, true
+        }
+        return Limit{}, false
+    }
+
+    memorySection := module.GetMemorySection()
+    if memorySection != nil && index - imported < uint32(len(memorySection.Memories)) {
+        return memorySection.Memories[index - imported], true
+    }
+
+    return Limit{}, false
+}
+
 func (module *WebAssemblyModule) AddSection(section WebAssemblySection) {
     module.Sections = append(module.Sections, section)
 }
 
+/* the binary section id of a known section, or CustomSection */
+func sectionId(section WebAssemblySection) byte {
+    switch section.(type) {
+        case *WebAssemblyTypeSection: return TypeSection
+        case *WebAssemblyImportSection: return ImportSection
+        case *WebAssemblyFunctionSection: return FunctionSection
+        case *WebAssemblyTableSection: return TableSection
+        case *WebAssemblyMemorySection: return MemorySection
+        case *WebAssemblyGlobalSection: return GlobalSection
+        case *WebAssemblyExportSection: return ExportSection
+        case *WebAssemblyStartSection: return StartSection
+        case *WebAssemblyElementSection: return ElementSection
+        case *WebAssemblyCodeSection: return CodeSection
+        case *WebAssemblyDataSection: return DataSection
+    }
+
+    return CustomSection
+}
+
+/* all custom sections in the order they appear in the module */
+func (module *WebAssemblyModule) GetCustomSections() []*WebAssemblyCustomSection {
+    var out []*WebAssemblyCustomSection
+    for _, section := range module.Sections {
+        custom, ok := section.(*WebAssemblyCustomSection)
+        if ok {
+            out = append(out, custom)
+        }
+    }
+
+    return out
+}
+
+/* returns the first custom section with the given name, or nil */
+func (module *WebAssemblyModule) FindCustomSection(name string) *WebAssemblyCustomSection {
+    for _, custom := range module.GetCustomSections() {
+        if custom.Name == name {
+            return custom
+        }
+    }
+
+    return nil
+}
+
+/* the function names in the function names subsection of a 'name' custom section, by function index */
+func readFunctionNames(data []byte) (map[uint32]string, error) {
+    out := make(map[uint32]string)
+    reader := NewByteReader(bytes.NewReader(data))
+    for {
+        id, err := reader.ReadByte()
+        if err == io.EOF {
+            return out, nil
+        }
+        if err != nil {
+            return nil, err
+        }
+
+        content, err := ReadByteVector(reader)
+        if err != nil {
+            return nil, fmt.Errorf("Could not read name subsection: %v", err)
+        }
+
+        /* subsection 1 holds the function names, the others name modules, locals and so on */
+        if id != 1 {
+            continue
+        }
+
+        subsection := NewByteReader(bytes.NewReader(content))
+        count, err := ReadU32(subsection)
+        if err != nil {
+            return nil, fmt.Errorf("Could not read function name count: %v", err)
+        }
+
+        for i := uint32(0); i < count; i++ {
+            index, err := ReadU32(subsection)
+            if err != nil {
+                return nil, fmt.Errorf("Could not read function name index: %v", err)
+            }
+
+            name, err := ReadName(subsection)
+            if err != nil {
+                return nil, err
+            }
+
+            out[index] = name
+        }
+    }
+}
+
+/* a name for each function that has one, by function index. names come from the 'name' custom section,
+ * then the $names of the text format without the $, then the names of exports, and imports are named
+ * module.name
+ */
+func (module *WebAssemblyModule) FunctionNames() map[uint32]string {
+    out := make(map[uint32]string)
+
+    exportSection := module.GetExportSection()
+    if exportSection != nil {
+        for _, item := range exportSection.Items {
+            function, ok := item.Kind.(*FunctionIndex)
+            if ok {
+                _, exists := out[function.Id]
+                if !exists {
+                    out[function.Id] = item.Name
+                }
+            }
+        }
+    }
+
+    importSection := module.GetImportSection()
+    if importSection != nil {
+        var index uint32
+        for _, item := range importSection.Items {
+            _, ok := item.Kind.(*FunctionImport)
+            if ok {
+                if item.LocalName != "" {
+                    out[index] = strings.TrimPrefix(item.LocalName, "$")
+                } else {
+                    out[index] = item.ModuleName + "." + item.Name
+                }
+                index += 1
+            }
+        }
+    }
+
+    functionSection := module.GetFunctionSection()
+    if functionSection != nil {
+        imported := uint32(module.GetImportFunctionCount())
+        for name, index := range functionSection.NamedFunctions {
+            out[imported + uint32(index)] = strings.TrimPrefix(name, "$")
+        }
+    }
+
+    custom := module.FindCustomSection("name")
+    if custom != nil {
+        /* a broken name section only loses the names */
+        names, err := readFunctionNames(custom.Data)
+        if err == nil {
+            for index, name := range names {
+                out[index] = name
+            }
+        }
+    }
+
+    return out
+}
+
+/* add a new custom section. the section is put into the section list next to the
+ * known section named by the placement, after any custom sections already there.
+ */
+func (module *WebAssemblyModule) AddCustomSection(name string, data []byte, placement CustomSectionPlacement) *WebAssemblyCustomSection {
+    custom := &WebAssemblyCustomSection{
+        Name: name,
+        Data: data,
+        Placement: placement,
+    }
+
+    /* find the known section that the placement refers to */
+    anchor := -1
+    for i, section := range module.Sections {
+        id := sectionId(section)
+        if id == CustomSection {
+            continue
+        }
+
+        if placement.Section == id || placement.Section == CustomPlacementLast || (placement.Section == CustomPlacementFirst && anchor == -1) {
+            anchor = i
+        }
+    }
+
+    position := len(module.Sections)
+    if anchor != -1 {
+        if placement.Before {
+            position = anchor
+        } else {
+            /* skip past custom sections that already follow the anchor */
+            position = anchor + 1
+            for position < len(module.Sections) && sectionId(module.Sections[position]) == CustomSection {
+                position += 1
+            }
+        }
+    } else if placement.Before {
+        position = 0
+    }
+
+    module.Sections = append(module.Sections, nil)
+    copy(module.Sections[position+1:], module.Sections[position:])
+    module.Sections[position] = custom
+
+    return custom
+}
+
+/* remove all custom sections with the given name, returning how many were removed */
+func (module *WebAssemblyModule) RemoveCustomSection(name string) int {
+    var kept []WebAssemblySection
+    removed := 0
+    for _, section := range module.Sections {
+        custom, ok := section.(*WebAssemblyCustomSection)
+        if ok && custom.Name == name {
+            removed += 1
+            continue
+        }
+        kept = append(kept, section)
+    }
+
+    module.Sections = kept
+    return removed
+}
+
 func (module *WebAssemblyModule) ConvertToWat(indents string) string {
     var out strings.Builder
 
@@ -0,0 +1,231 @@
+package core
+
+import (
+    "testing"
+    "bytes"
+    "os"
+    "path/filepath"
+    "strings"
+
+    "github.com/kazzmir/webassembly/lib/sexp"
+)
+
+func TestCustomSections(test *testing.T){
+    wasm := []byte{0, 'a', 's', 'm', 1, 0, 0, 0}
+    /* custom section 'first' before any known section */
+    wasm = append(wasm, 0, 7, 5, 'f', 'i', 'r', 's', 't', 0xaa)
+    /* empty type section */
+    wasm = append(wasm, 1, 1, 0)
+    /* custom section 'meta' after the type section */
+    wasm = append(wasm, 0, 7, 4, 'm', 'e', 't', 'a', 'x', '"')
+
+    path := filepath.Join(test.TempDir(), "custom.wasm")
+    err := os.WriteFile(path, wasm, 0644)
+    if err != nil {
+        test.Fatalf("could not write wasm file: %v", err)
+    }
+
+    module, err := ParseWasmFile(path, false)
+    if err != nil {
+        test.Fatalf("could not parse wasm: %v", err)
+    }
+
+    customs := module.GetCustomSections()
+    if len(customs) != 2 {
+        test.Fatalf("expected 2 custom sections but got %v", len(customs))
+    }
+
+    first := module.FindCustomSection("first")
+    if first == nil || string(first.Data) != "\xaa" {
+        test.Fatalf("custom section 'first' was not read correctly: %+v", first)
+    }
+
+    if !first.Placement.Before || first.Placement.Section != CustomPlacementFirst {
+        test.Fatalf("expected 'first' to be placed before the first section: %+v", first.Placement)
+    }
+
+    meta := module.FindCustomSection("meta")
+    if meta == nil || meta.Placement.Before || meta.Placement.Section != TypeSection {
+        test.Fatalf("expected 'meta' to be placed after the type section: %+v", meta)
+    }
+
+    wat := module.ConvertToWat("")
+    if !strings.Contains(wat, `(@custom "meta" (after type) "x\22")`) {
+        test.Fatalf("custom section annotation missing from wat: %v", wat)
+    }
+
+    module.AddCustomSection("producers", []byte("go"), CustomSectionPlacement{Before: true, Section: TypeSection})
+    if len(module.Sections) != 4 {
+        test.Fatalf("expected 4 sections but got %v", len(module.Sections))
+    }
+
+    /* the new section goes directly before the type section */
+    if module.Sections[1] != module.FindCustomSection("producers") {
+        test.Fatalf("custom section 'producers' was not placed before the type section")
+    }
+
+    if module.RemoveCustomSection("first") != 1 {
+        test.Fatalf("expected to remove one custom section")
+    }
+
+    if module.FindCustomSection("first") != nil {
+        test.Fatalf("custom section 'first' was not removed")
+    }
+}
+
+func TestParseReader(test *testing.T){
+    wasm := []byte{0, 'a', 's', 'm', 1, 0, 0, 0}
+    /* type section with a single function type () -> () */
+    wasm = append(wasm, 1, 4, 1, 0x60, 0, 0)
+
+    module, err := ParseWasm(bytes.NewReader(wasm))
+    if err != nil {
+        test.Fatalf("could not parse wasm: %v", err)
+    }
+
+    if len(module.GetTypeSection().Functions) != 1 {
+        test.Fatalf("expected 1 function type but got %v", len(module.GetTypeSection().Functions))
+    }
+
+    /* the second section claims 5 bytes but stops after the count */
+    truncated := append(append([]byte{}, wasm...), 1, 5, 1)
+    _, err = ParseWasmBytes(truncated)
+    if err == nil || !strings.Contains(err.Error(), "starting at byte offset 14") {
+        test.Fatalf("expected an error that reports the section offset but got %v", err)
+    }
+
+    _, err = ParseWasmBytes([]byte("\x00wat\x01\x00\x00\x00"))
+    if err == nil || !strings.Contains(err.Error(), "byte offset 0") {
+        test.Fatalf("expected an error about the preamble but got %v", err)
+    }
+
+    wast, err := ParseWastBytes([]byte("(module (func))\n(assert_return (invoke \"f\"))"))
+    if err != nil || len(wast.Expressions) != 2 {
+        test.Fatalf("expected 2 wast expressions but got %v: %v", len(wast.Expressions), err)
+    }
+
+    _, err = ParseWast(strings.NewReader("(module (func)"))
+    if err == nil || !strings.Contains(err.Error(), "byte offset 14") {
+        test.Fatalf("expected an error that reports the byte offset but got %v", err)
+    }
+}
+
+func TestFunctionNames(test *testing.T){
+    text := `(module
+      (import "env" "log" (func (param i32)))
+      (import "env" "print" (func $print (param i32)))
+      (func $f)
+      (func (export "g"))
+      (func (export "h")))`
+
+    expr, err := sexp.ParseSExpression(text)
+    if err != nil {
+        test.Fatalf("unable to parse: %v", err)
+    }
+
+    module, err := CreateWasmModule(&expr)
+    if err != nil {
+        test.Fatalf("unable to create module: %v", err)
+    }
+
+    /* the name section names function 4 */
+    module.AddCustomSection("name", []byte{1, 7, 1, 4, 4, 'm', 'a', 'i', 'n'}, CustomSectionPlacement{Before: false, Section: CustomPlacementLast})
+
+    names := module.FunctionNames()
+    expected := map[uint32]string{0: "env.log", 1: "print", 2: "f", 3: "g", 4: "main"}
+    if len(names) != len(expected) {
+        test.Fatalf("expected names %v but got %v", expected, names)
+    }
+
+    for index, name := range expected {
+        if names[index] != name {
+            test.Fatalf("expected names %v but got %v", expected, names)
+        }
+    }
+}
+
+func TestInstructionOffsets(test *testing.T){
+    /* (func (result i32) (block (result i32) (i32.const 1)) (drop) (i32.const 2)) */
+    wasm := []byte{0, 'a', 's', 'm', 1, 0, 0, 0}
+    wasm = append(wasm, 1, 5, 1, 0x60, 0, 1, 0x7f)
+    wasm = append(wasm, 3, 2, 1, 0)
+    body := []byte{0, 0x02, 0x7f, 0x41, 1, 0x0b, 0x1a, 0x41, 2, 0x0b}
+    wasm = append(wasm, 10, byte(len(body) + 2), 1, byte(len(body)))
+    wasm = append(wasm, body...)
+
+    module, err := ParseWasmBytes(wasm)
+    if err != nil {
+        test.Fatalf("unable to parse: %v", err)
+    }
+
+    /* the code section starts with the count and the size of the body, then the locals */
+    offsets := module.GetCodeSection().Code[0].Offsets
+    expected := []uint32{3, 5, 8, 9}
+    if len(offsets) != len(expected) {
+        test.Fatalf("expected offsets %v but got %v", expected, offsets)
+    }
+    for i := range expected {
+        if offsets[i] != expected[i] {
+            test.Fatalf("expected offsets %v but got %v", expected, offsets)
+        }
+    }
+
+    code := module.GetCodeSection().Code[0]
+    ends := []uint32{5, 7, 9, 11}
+    for i := range ends {
+        if code.Ends[i] != ends[i] {
+            test.Fatalf("expected ends %v but got %v", ends, code.Ends)
+        }
+    }
+
+    if code.Start != 2 || code.Size != uint32(len(body)) {
+        test.Fatalf("expected the body at 2 with size %v but got %v %v", len(body), code.Start, code.Size)
+    }
+
+    /* an unknown instruction after the i32.const is reported where it is */
+    body = []byte{0, 0x41, 1, 0xff, 0x0b}
+    wasm = wasm[:len(wasm) - 14]
+    wasm = append(wasm, 10, byte(len(body) + 2), 1, byte(len(body)))
+    wasm = append(wasm, body...)
+
+    _, err = ParseWasmBytes(wasm)
+    if err == nil || !strings.Contains(err.Error(), "the body at code section offset 2 with size 5") || !strings.Contains(err.Error(), "failed in the instruction at byte 3 of the body") {
+        test.Fatalf("wrong error %v", err)
+    }
+}
+
+func TestSectionHeaders(test *testing.T){
+    wasm := []byte("\x00asm\x01\x00\x00\x00")
+    wasm = append(wasm, 1, 5, 1, 0x60, 0, 1, 0x7f)
+    /* a function section that says it has 2 functions but only has 1 */
+    wasm = append(wasm, 3, 2, 2, 0)
+
+    module := WebAssemblyNewReader(bytes.NewReader(wasm), false)
+    if err := module.ReadMagic(); err != nil {
+        test.Fatalf("unable to read magic: %v", err)
+    }
+    if _, err := module.ReadVersion(); err != nil {
+        test.Fatalf("unable to read version: %v", err)
+    }
+
+    _, err := module.ReadSection()
+    if err != nil {
+        test.Fatalf("unable to read the type section: %v", err)
+    }
+
+    header := module.LastSectionHeader()
+    if header != (SectionHeader{Id: TypeSection, Offset: 8, ContentOffset: 10, Size: 5}) {
+        test.Fatalf("wrong type section header %+v", header)
+    }
+
+    /* the header of a broken section is still known */
+    _, err = module.ReadSection()
+    if err == nil {
+        test.Fatalf("expected the function section to fail")
+    }
+
+    header = module.LastSectionHeader()
+    if header != (SectionHeader{Id: FunctionSection, Offset: 15, ContentOffset: 17, Size: 2}) {
+        test.Fatalf("wrong function section header %+v", header)
+    }
+}
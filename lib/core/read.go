@@ -2,6 +2,7 @@ package core
 
 import (
     "io"
+    "bufio"
     "fmt"
     "unicode/utf8"
     "encoding/binary"
@@ -10,15 +11,25 @@ import (
 type ByteReader struct {
     io.ByteReader
     Reader io.Reader
+    /* the number of bytes read so far */
+    offset int64
+    /* when not nil ReadExpressionSequence adds the offset of each instruction it reads, and the offset
+     * just past its bytes
+     */
+    instructions *[]uint32
+    ends *[]uint32
 }
 
 func (reader *ByteReader) Read(data []byte) (int, error) {
-    return reader.Reader.Read(data)
+    count, err := reader.Reader.Read(data)
+    reader.offset += int64(count)
+    return count, err
 }
 
 func (reader *ByteReader) ReadByte() (byte, error) {
     out := make([]byte, 1)
     count, err := reader.Reader.Read(out)
+    reader.offset += int64(count)
     if err != nil {
         return 0, err
     }
@@ -30,6 +41,66 @@ func (reader *ByteReader) ReadByte() (byte, error) {
     return 0, fmt.Errorf("Did not read a byte")
 }
 
+/* keeps track of how many bytes have been consumed so errors can report where they happened */
+type OffsetReader struct {
+    reader *bufio.Reader
+    offset int64
+}
+
+func NewOffsetReader(reader io.Reader) *OffsetReader {
+    return &OffsetReader{
+        reader: bufio.NewReader(reader),
+    }
+}
+
+func (reader *OffsetReader) Offset() int64 {
+    return reader.offset
+}
+
+func (reader *OffsetReader) Read(data []byte) (int, error) {
+    count, err := reader.reader.Read(data)
+    reader.offset += int64(count)
+    return count, err
+}
+
+func (reader *OffsetReader) ReadByte() (byte, error) {
+    out, err := reader.reader.ReadByte()
+    if err == nil {
+        reader.offset += 1
+    }
+    return out, err
+}
+
+func (reader *OffsetReader) UnreadByte() error {
+    err := reader.reader.UnreadByte()
+    if err == nil {
+        reader.offset -= 1
+    }
+    return err
+}
+
+/* drop the instruction offsets from the given position on, for bytes that turned out not to be an
+ * instruction such as end
+ */
+func (reader *ByteReader) forget(position int){
+    if reader.instructions != nil {
+        *reader.instructions = (*reader.instructions)[:position]
+        *reader.ends = (*reader.ends)[:position]
+    }
+}
+
+/* the instruction at the given position ends at the current offset */
+func (reader *ByteReader) endInstruction(position int){
+    if reader.instructions != nil {
+        (*reader.ends)[position] = uint32(reader.offset)
+    }
+}
+
+/* the number of bytes that have been read */
+func (reader *ByteReader) Offset() int64 {
+    return reader.offset
+}
+
 func NewByteReader(reader io.Reader) *ByteReader {
     return &ByteReader{
         Reader: reader,
@@ -1,17 +1,17 @@
 package core
 
 import (
-    "bufio"
+    "bytes"
     "os"
     "io"
     "errors"
     "fmt"
-    "math"
     "strconv"
     "strings"
     // "regexp"
     "github.com/kazzmir/webassembly/lib/sexp"
     "github.com/kazzmir/webassembly/lib/data"
+    "github.com/kazzmir/webassembly/lib/literal"
 )
 
 // wast is a super set of .wat in that it can contain (module ...) expressions as well as other things
@@ -51,390 +51,23 @@ func min(a, b int) int {
 }
 
 func MakeFunctionType(function *sexp.SExpression) WebAssemblyFunction {
-    var out WebAssemblyFunction
-
-    // (func $name (param ...) (result ...) code ...)
-    // param or result might not exist, but if they do exist they will appear in positions 1/2
-    for i := 0; i < len(function.Children); i++ {
-        if i == 0 && isId(function.Children[i].Value) {
-            continue
-        }
-        if function.Children[i].Name == "param" {
-            param := function.Children[i]
-            name := ""
-            for z := 0; z < len(param.Children); z++ {
-                if z == 0 && ValueTypeFromName(param.Children[i].Value) == InvalidValueType {
-                    name = param.Children[i].Value
-                    continue
-                }
-                if z > 0 {
-                    name = ""
-                }
-                out.InputTypes = append(out.InputTypes, Parameter{
-                    Type: ValueTypeFromName(param.Children[i].Value),
-                    Name: name,
-                })
-            }
-        } else if function.Children[i].Name == "result" {
-            out.OutputTypes = ConvertValueTypes(function.Children[i])
-        }
+    // (func $name? (param ...) (result ...))
+    children := function.Children
+    if len(children) > 0 && isId(children[0].Value) {
+        children = children[1:]
     }
 
+    out, _ := parseParamsResults(children)
     return out
 }
 
-/* try to parse as base 10 and also as base 16 */
-func parseLiteralI32(data string) (int32, error) {
-    x, err := strconv.ParseInt(data, 0, 32)
-    if err == nil {
-        return int32(x), nil
-    }
-
-    m, err := strconv.ParseUint(data, 0, 32)
-    if err == nil {
-        return int32(m), nil
-    }
-
-    // handle 0_123_456_789
-    // remove _ and leading 0
-    normalized := strings.TrimLeft(strings.ReplaceAll(data, "_", ""), "0")
-    m, err = strconv.ParseUint(normalized, 0, 32)
-    if err == nil {
-        return int32(m), nil
-    }
-
-    return 0, err
-}
-
-func parseNum(reader *strings.Reader) (int64, error) {
-    var out int64
-
-    for {
-        digit, err := reader.ReadByte()
-        if err != nil {
-            return out, nil
-        }
-
-        value, err := strconv.ParseInt(string(digit), 0, 64)
-        if err != nil {
-            reader.UnreadByte()
-            return out, nil
-        }
-
-        out = out * 10 + value
-    }
-
-    return out, nil
-}
-
-func parseHexFloat(reader *strings.Reader) (float64, error) {
-    var out float64
-
-    for {
-        digit, err := reader.ReadByte()
-        if err != nil {
-            return out, nil
-        }
-
-        value, err := strconv.ParseInt("0x" + string(digit), 0, 64)
-        if err != nil {
-            reader.UnreadByte()
-            return out, nil
-        }
-
-        out = out * 16 + float64(value)
-    }
-
-    return out, nil
-}
-
-func parseHexFrac(reader *strings.Reader) (float64, error) {
-    digit, err := reader.ReadByte()
-    if err != nil {
-        return 0, err
-    }
-
-    value, err := strconv.ParseInt("0x" + string(digit), 0, 64)
-    if err != nil {
-        reader.UnreadByte()
-        return 0, err
-    }
-
-    rest, err := parseHexFrac(reader)
-    if err != nil {
-        return float64(value) / 16, nil
-    } else {
-        return (float64(value) + rest/16) / 16, nil
-    }
-}
-
-func parseRawFloat(reader *strings.Reader) (float64, error) {
-    var out float64
-
-    for {
-        digit, err := reader.ReadByte()
-        if err != nil {
-            return out, nil
-        }
-
-        value, err := strconv.ParseInt(string(digit), 0, 64)
-        if err != nil {
-            reader.UnreadByte()
-            return out, nil
-        }
-
-        out = out * 10 + float64(value)
-    }
-
-    return out, nil
-}
-
-/* parse a base-10 float */
-    /*
-func parseRawFloat(data string) (float64, error) {
-    if strings.HasPrefix(data, "0x") {
-        value, err = parseRawHexFloat(data)
-        if err == nil {
-            return value, nil
-        }
-    }
-
-    var out float64
-
-    for _, digit := range data {
-        value, err := strconv.ParseInt(string(digit), 0, 64)
-        if err != nil {
-            return 0, err
-        }
-
-        out = out * 10 + float64(value)
-    }
-
-    return out, nil
-
-    return 0, nil
-}
-    */
-
-/* 0x <hexnum> .? */
-func parseFloat64_1(reader *strings.Reader) (float64, error) {
-    p, err := parseHexFloat(reader)
-    if err != nil {
-        return 0, err
-    }
-
-    if reader.Len() == 0 {
-        return p, nil
-    }
-
-    next, err := reader.ReadByte()
-    if err != nil {
-        return 0, err
-    }
-
-    if next != '.' {
-        return 0, fmt.Errorf("expected .")
-    }
-
-    if reader.Len() != 0 {
-        return 0, fmt.Errorf("fail")
-    }
-
-    return p, nil
-}
-
-/* 0x <hexnum> . <hexfrac> */
-func parseFloat64_2(reader *strings.Reader) (float64, error) {
-    p, err := parseHexFloat(reader)
-    if err != nil {
-        return 0, err
-    }
-
-    next, err := reader.ReadByte()
-    if err != nil {
-        return 0, err
-    }
-
-    if next != '.' {
-        return 0, fmt.Errorf("expected .")
-    }
-
-    q, err := parseHexFrac(reader)
-    if err != nil {
-        return 0, err
-    }
-
-    if reader.Len() != 0 {
-        return 0, fmt.Errorf("fail")
-    }
-
-    return p+q, nil
-}
-
-/* 0x <hexnum> . p +- <num> */
-func parseFloat64_3(reader *strings.Reader) (float64, error) {
-    p, err := parseHexFloat(reader)
-    if err != nil {
-        return 0, err
-    }
-
-    next, err := reader.ReadByte()
-    if err != nil {
-        return 0, err
-    }
-
-    if next != '.' {
-        reader.UnreadByte()
-    }
-
-    pChar, err := reader.ReadByte()
-    if err != nil {
-        return 0, err
-    }
-
-    if strings.ToLower(string(pChar)) != "p" {
-        return 0, err
-    }
-
-    sign := 1
-    next, err = reader.ReadByte()
-    if err != nil {
-        return 0, fmt.Errorf("fail")
-    }
-
-    if next == '-' {
-        sign = -1
-    } else if next == '+' {
-        sign = 1
-    } else {
-        reader.UnreadByte()
-    }
-
-    e, err := parseNum(reader)
-    if err != nil {
-        return 0, err
-    }
-
-    if reader.Len() != 0 {
-        return 0, fmt.Errorf("fail")
-    }
-
-    return p * math.Pow(2, float64(e) * float64(sign)), nil
-}
-
-/* 0x <hexnum> . <hexfrac> p +- <num> */
-func parseFloat64_4(reader *strings.Reader) (float64, error) {
-    p, err := parseHexFloat(reader)
-    if err != nil {
-        return 0, err
-    }
-
-    next, err := reader.ReadByte()
-    if err != nil {
-        return 0, err
-    }
-
-    if next != '.' {
-        return 0, fmt.Errorf("expected .")
-    }
-
-    q, err := parseHexFrac(reader)
-    if err != nil {
-        return 0, err
-    }
-
-    pChar, err := reader.ReadByte()
-    if err != nil {
-        return 0, err
-    }
-
-    if strings.ToLower(string(pChar)) != "p" {
-        return 0, err
-    }
-
-    sign := 1
-    next, err = reader.ReadByte()
-    if err != nil {
-        return 0, fmt.Errorf("fail")
-    }
-
-    if next == '-' {
-        sign = -1
-    } else if next == '+' {
-        sign = 1
-    } else {
-        reader.UnreadByte()
-    }
-
-    e, err := parseNum(reader)
-    if err != nil {
-        return 0, err
-    }
-
-    if reader.Len() != 0 {
-        return 0, fmt.Errorf("fail")
-    }
-
-    return (p+q) * math.Pow(2, float64(e) * float64(sign)), nil
-}
-
-func parseFloat64(data string) (float64, error) {
-
-    var sign float64 = 1
-    if len(data) > 0 {
-        if data[0] == '-' {
-            sign = -1
-            data = data[1:]
-        } else if data[0] == '+' {
-            sign = 1
-            data = data[1:]
-        }
-    }
-
-    if strings.HasPrefix(data, "nan") {
-        // FIXME: handle payload
-        return math.NaN(), nil
-    }
-
-    normalized := strings.ReplaceAll(data, "_", "")
-
-    /* give the native go parser a whack at it */
-    check, err := strconv.ParseFloat(normalized, 64)
-    if err == nil {
-        return check*sign, nil
-    }
-
-    if strings.HasPrefix(normalized, "0x") {
-        left, err := parseFloat64_1(strings.NewReader(normalized[2:]))
-        if err == nil {
-            return sign*left, nil
-        }
-
-        left, err = parseFloat64_2(strings.NewReader(normalized[2:]))
-        if err == nil {
-            return sign*left, nil
-        }
-
-        left, err = parseFloat64_3(strings.NewReader(normalized[2:]))
-        if err == nil {
-            return sign*left, nil
-        }
-
-        left, err = parseFloat64_4(strings.NewReader(normalized[2:]))
-        if err == nil {
-            return sign*left, nil
-        }
-
-        return 0, fmt.Errorf("could not read float")
-    } else {
-        value, err := strconv.ParseFloat(normalized, 64)
-        return sign*value, err
+/* the types of a block's (param ...), which cannot have names */
+func blockParameters(param *sexp.SExpression) []ValueType {
+    var out []ValueType
+    for _, child := range param.Children {
+        out = append(out, ValueTypeFromName(child.Value))
     }
-}
-
-func parseFloat32(data string) (float32, error) {
-    x, err := parseFloat64(data)
-    return float32(x), err
+    return out
 }
 
 func MakeExpressions(module WebAssemblyModule, code *Code, labels data.Stack[string], expr *sexp.SExpression) []Expression {
@@ -472,6 +105,7 @@ func MakeExpressions(module WebAssemblyModule, code *Code, labels data.Stack[str
     switch expr.Name {
         case "block", "loop":
             var children []Expression
+            var parameterTypes []ValueType
             var expectedType []ValueType
             for i, child := range expr.Children {
                 if child.Name == "result" {
@@ -481,11 +115,19 @@ func MakeExpressions(module WebAssemblyModule, code *Code, labels data.Stack[str
                     continue
                 }
                 if child.Name == "param" {
-                    /* FIXME: handle this */
+                    parameterTypes = append(parameterTypes, blockParameters(child)...)
                     continue
                 }
                 if child.Name == "type" {
-                    /* FIXME: handle this */
+                    index := module.GetTypeSection().GetTypeByName(child.Children[0].Value)
+                    if index != nil {
+                        functionType := module.GetTypeSection().GetFunction(index.Id)
+                        parameterTypes = nil
+                        for _, input := range functionType.InputTypes {
+                            parameterTypes = append(parameterTypes, input.Type)
+                        }
+                        expectedType = functionType.OutputTypes
+                    }
                     continue
                 }
                 /* (block $x ...) */
@@ -510,11 +152,13 @@ func MakeExpressions(module WebAssemblyModule, code *Code, labels data.Stack[str
             return []Expression{&BlockExpression{
                     Instructions: children,
                     Kind: kind,
+                    ParameterTypes: parameterTypes,
                     ExpectedType: expectedType,
                 },
             }
         case "if":
             var out []Expression
+            var parameterTypes []ValueType
             var expectedType []ValueType
 
             var thenInstructions []Expression
@@ -531,7 +175,7 @@ func MakeExpressions(module WebAssemblyModule, code *Code, labels data.Stack[str
                 }
 
                 if child.Name == "param" {
-                    // FIXME:
+                    parameterTypes = append(parameterTypes, blockParameters(child)...)
                     continue
                 }
                 if child.Name == "type" {
@@ -539,6 +183,10 @@ func MakeExpressions(module WebAssemblyModule, code *Code, labels data.Stack[str
                     index := module.GetTypeSection().GetTypeByName(name)
                     if index != nil {
                         functionType := module.GetTypeSection().GetFunction(index.Id)
+                        parameterTypes = nil
+                        for _, input := range functionType.InputTypes {
+                            parameterTypes = append(parameterTypes, input.Type)
+                        }
                         expectedType = functionType.OutputTypes
                     }
                     continue
@@ -567,6 +215,7 @@ func MakeExpressions(module WebAssemblyModule, code *Code, labels data.Stack[str
                     Instructions: thenInstructions,
                     ElseInstructions: elseInstructions,
                     Kind: BlockKindIf,
+                    ParameterTypes: parameterTypes,
                     ExpectedType: expectedType,
                 })
         case "select":
@@ -643,7 +292,7 @@ func MakeExpressions(module WebAssemblyModule, code *Code, labels data.Stack[str
             }
             return append(out, &ReturnExpression{})
         case "i32.const":
-            value, err := parseLiteralI32(expr.Children[0].Value)
+            value, err := literal.ParseI32(expr.Children[0].Value)
             if err != nil {
                 fmt.Printf("Warning: could not parse i32.const literal '%v'\n", expr.Children[0].Value)
                 return nil
@@ -699,24 +348,15 @@ func MakeExpressions(module WebAssemblyModule, code *Code, labels data.Stack[str
             }
             return append(out, &I64AddExpression{})
         case "i64.const":
-            data := strings.ReplaceAll(expr.Children[0].Value, "_", "")
-            var use int64
-            value, err := strconv.ParseUint(data, 0, 64)
-            if err == nil {
-                use = int64(value)
-            } else {
-                value, err := strconv.ParseInt(data, 0, 64)
-                if err == nil {
-                    use = value
-                } else {
-                    fmt.Printf("Error: could not parse int64 constant: %v\n", err)
-                    return nil
-                }
+            value, err := literal.ParseI64(expr.Children[0].Value)
+            if err != nil {
+                fmt.Printf("Error: could not parse int64 constant: %v\n", err)
+                return nil
             }
 
             return []Expression{
                 &I64ConstExpression{
-                    N: use,
+                    N: value,
                 },
             }
 
@@ -754,37 +394,34 @@ func MakeExpressions(module WebAssemblyModule, code *Code, labels data.Stack[str
             return append(out, &MemoryGrowExpression{})
 
         case "call_indirect":
-            var typeIndex *TypeIndex
-            tableId := 0
+            var tableId uint32
             typeStart := 0
 
-            if expr.Children[0].Value != "" {
-                value, err := strconv.Atoi(expr.Children[0].Value)
-                if err == nil {
-                    tableId = value
-                } else {
-                    value, ok := module.GetTableSection().FindTableIndexByName(expr.Children[0].Value)
-                    if !ok {
-                        fmt.Printf("Error: could not find table '%v'\n", expr.Children[0].Value)
-                        return nil
-                    }
-                    tableId = int(value)
+            if len(expr.Children) > 0 && expr.Children[0].Value != "" {
+                value, err := resolveIndex(expr.Children[0].Value, module.LookupTable)
+                if err != nil {
+                    fmt.Printf("Error: could not find table '%v'\n", expr.Children[0].Value)
+                    return nil
                 }
+                tableId = value
 
                 typeStart = 1
             }
 
-            type_ := expr.Children[typeStart]
-            typeIndex = module.GetTypeSection().GetTypeByName(type_.Children[0].Value)
+            _, typeIndex, used, err := parseTypeUse(module.GetTypeSection(), expr.Children[typeStart:])
+            if err != nil {
+                fmt.Printf("Error: invalid call_indirect type: %v\n", err)
+                return nil
+            }
 
             var out []Expression
-            for _, child := range expr.Children[typeStart+1:] {
+            for _, child := range expr.Children[typeStart+used:] {
                 out = append(out, MakeExpressions(module, code, labels, child)...)
             }
 
             return append(out, &CallIndirectExpression{
-                Index: typeIndex,
-                Table: &TableIndex{Id: uint32(tableId)},
+                Index: &TypeIndex{Id: typeIndex},
+                Table: &TableIndex{Id: tableId},
             })
 
         case "call":
@@ -795,34 +432,46 @@ func MakeExpressions(module WebAssemblyModule, code *Code, labels data.Stack[str
 
             name := expr.Children[0].Value
 
-            var index int
+            var index uint32
             value, err := strconv.Atoi(name)
             if err == nil {
-                index = value
+                index = uint32(value)
             } else {
                 var ok bool
                 /* look up the function by name, but if we can't find it now then the function might exist later
                  * once more functions are parsed. in case the function can't be found then insert a delayed
                  * expression that will get replaced in a second pass.
                  */
-                index, ok = module.GetFunctionSection().GetFunctionIndexByName(name)
+                index, ok = module.LookupFunction(name)
                 if !ok {
                     return append(out, &SecondPassExpression{
                         Replace: func() Expression {
-                            check, ok := module.GetFunctionSection().GetFunctionIndexByName(name)
+                            check, ok := module.LookupFunction(name)
                             if ok {
-                                return &CallExpression{Index: &FunctionIndex{uint32(check)}}
+                                return &CallExpression{Index: &FunctionIndex{check}}
                             } else {
                                 fmt.Printf("Error: unknown function with name '%v'\n", name)
                                 return nil
                             }
                         },
                     })
-                    return nil
                 }
             }
 
-            return append(out, &CallExpression{Index: &FunctionIndex{uint32(index)}})
+            return append(out, &CallExpression{Index: &FunctionIndex{index}})
+        case "ref.func":
+            if len(expr.Children) != 1 {
+                fmt.Printf("Error: invalid ref.func %v\n", expr)
+                return nil
+            }
+
+            index, err := resolveIndex(expr.Children[0].Value, module.LookupFunction)
+            if err != nil {
+                fmt.Printf("Error: %v\n", err)
+                return nil
+            }
+
+            return []Expression{&RefFuncExpression{Function: &FunctionIndex{Id: index}}}
         case "unreachable":
             return append(subexpressions(expr), &UnreachableExpression{})
         case "ref.null":
@@ -835,7 +484,7 @@ func MakeExpressions(module WebAssemblyModule, code *Code, labels data.Stack[str
 
             return nil
         case "ref.extern":
-            value, err := parseLiteralI32(expr.Children[0].Value)
+            value, err := literal.ParseI32(expr.Children[0].Value)
             if err != nil {
                 fmt.Printf("Error: could not parse ref.extern index: %v", err)
                 return nil
@@ -941,7 +590,7 @@ func MakeExpressions(module WebAssemblyModule, code *Code, labels data.Stack[str
         case "f32.div":
             return append(subexpressions(expr), &F32DivExpression{})
         case "f32.const":
-            value, err := parseFloat32(expr.Children[0].Value)
+            value, err := literal.ParseF32(expr.Children[0].Value)
             if err != nil {
                 fmt.Printf("Unable to parse float '%v': %v\n", expr.Children[0].Value, err)
                 return nil
@@ -961,9 +610,10 @@ func MakeExpressions(module WebAssemblyModule, code *Code, labels data.Stack[str
         case "f64.add":
             return append(subexpressions(expr), &F64AddExpression{})
         case "f64.const":
-            value, err := parseFloat64(expr.Children[0].Value)
+            value, err := literal.ParseF64(expr.Children[0].Value)
             if err != nil {
                 fmt.Printf("Unable to parse float '%v': %v\n", expr.Children[0].Value, err)
+                return nil
             }
             return []Expression{
                 &F64ConstExpression{
@@ -1038,7 +688,7 @@ func MakeExpressions(module WebAssemblyModule, code *Code, labels data.Stack[str
             v, err := strconv.Atoi(name.Value)
             if err != nil {
                 var ok bool
-                index, ok = module.GetGlobalSection().LookupGlobal(name.Value)
+                index, ok = module.LookupGlobal(name.Value)
                 if !ok {
                     fmt.Printf("Error: unable to find global '%v'\n", name.Value)
                     return nil
@@ -1061,7 +711,7 @@ func MakeExpressions(module WebAssemblyModule, code *Code, labels data.Stack[str
             v, err := strconv.Atoi(name.Value)
             if err != nil {
                 var ok bool
-                index, ok = module.GetGlobalSection().LookupGlobal(name.Value)
+                index, ok = module.LookupGlobal(name.Value)
                 if !ok {
                     fmt.Printf("Error: unable to find global '%v'\n", name.Value)
                     return nil
@@ -1148,9 +798,11 @@ func MakeExpressions(module WebAssemblyModule, code *Code, labels data.Stack[str
         case "i64.store8":
             return append(subexpressions(expr), &I64Store8Expression{})
         case "i64.store32":
-            return append(subexpressions(expr), &I64Store8Expression{})
+            return append(subexpressions(expr), &I64Store32Expression{})
         case "i64.load8_s":
             return append(subexpressions(expr), &I64Load8sExpression{MemoryArgument{}})
+        case "i64.load8_u":
+            return append(subexpressions(expr), &I64Load8uExpression{MemoryArgument{}})
         case "f64.store":
             return append(subexpressions(expr), &F64StoreExpression{})
         case "i64.store":
@@ -1260,9 +912,358 @@ func isId(name string) bool {
     return len(name) > 0 && name[0] == '$'
 }
 
+/* parse (param ...) and (result ...) children into a function type. a param is either named, as
+ * in (param $x i32), or lists any number of unnamed types, as in (param i32 i64). returns the
+ * number of children that were consumed.
+ */
+func parseParamsResults(children []*sexp.SExpression) (WebAssemblyFunction, int) {
+    var out WebAssemblyFunction
+
+    used := 0
+    for _, child := range children {
+        switch child.Name {
+            case "param":
+                var paramName string
+                for i, param := range child.Children {
+                    use := ValueTypeFromName(param.Value)
+                    if i == 0 && use == InvalidValueType {
+                        paramName = param.Value
+                    } else {
+                        out.InputTypes = append(out.InputTypes, Parameter{
+                            Name: paramName,
+                            Type: use,
+                        })
+
+                        paramName = ""
+                    }
+                }
+            case "result":
+                out.OutputTypes = append(out.OutputTypes, ConvertValueTypes(child)...)
+            default:
+                return out, used
+        }
+
+        used += 1
+    }
+
+    return out, used
+}
+
+/* parse a typeuse: (type x)? (param ...)* (result ...)*
+ * returns the function type, its index in the type section, and the number of children consumed.
+ * without a (type x) the type is implicitly created, or an identical existing type is reused.
+ */
+func parseTypeUse(typeSection *WebAssemblyTypeSection, children []*sexp.SExpression) (WebAssemblyFunction, uint32, int, error) {
+    var typeIndex *TypeIndex
+    used := 0
+
+    if len(children) > 0 && children[0].Name == "type" {
+        if len(children[0].Children) != 1 {
+            return WebAssemblyFunction{}, 0, 0, fmt.Errorf("Invalid type use %v", children[0])
+        }
+
+        name := children[0].Children[0].Value
+        index, err := literal.ParseU32(name)
+        if err == nil {
+            typeIndex = &TypeIndex{Id: index}
+        } else {
+            typeIndex = typeSection.GetTypeByName(name)
+            if typeIndex == nil {
+                return WebAssemblyFunction{}, 0, 0, fmt.Errorf("Unknown type '%v'", name)
+            }
+        }
+
+        if typeIndex.Id >= uint32(len(typeSection.Functions)) {
+            return WebAssemblyFunction{}, 0, 0, fmt.Errorf("Unknown type %v", typeIndex.Id)
+        }
+
+        used = 1
+    }
+
+    function, count := parseParamsResults(children[used:])
+    used += count
+
+    if typeIndex != nil {
+        expected := typeSection.GetFunction(typeIndex.Id)
+        if count == 0 {
+            return expected, typeIndex.Id, used, nil
+        }
+
+        /* the inline params and results must match the referenced type, they only serve to name the params */
+        if !expected.Equals(function) {
+            return WebAssemblyFunction{}, 0, 0, fmt.Errorf("Inline function type does not match type %v", typeIndex.Id)
+        }
+
+        return function, typeIndex.Id, used, nil
+    }
+
+    return function, typeSection.GetOrCreateFunctionType(function), used, nil
+}
+
+/* parse limits, min max?, and return the number of children consumed */
+func parseLimit(children []*sexp.SExpression) (Limit, int, error) {
+    if len(children) == 0 {
+        return Limit{}, 0, fmt.Errorf("Missing limits")
+    }
+
+    minimum, err := literal.ParseU32(children[0].Value)
+    if err != nil {
+        return Limit{}, 0, fmt.Errorf("Invalid minimum limit '%v': %v", children[0].Value, err)
+    }
+
+    if len(children) > 1 && children[1].Value != "" {
+        maximum, err := literal.ParseU32(children[1].Value)
+        if err == nil {
+            return Limit{Minimum: minimum, Maximum: maximum, HasMaximum: true}, 2, nil
+        }
+    }
+
+    return Limit{Minimum: minimum}, 1, nil
+}
+
+func refTypeFromName(name string) (byte, bool) {
+    switch name {
+        case "funcref": return RefTypeFunction, true
+        case "externref": return RefTypeExtern, true
+    }
+
+    return 0, false
+}
+
+/* parse a global type, either 'i32' or '(mut i32)' */
+func parseGlobalType(expr *sexp.SExpression) (GlobalType, error) {
+    if expr.Name == "mut" {
+        if len(expr.Children) != 1 {
+            return GlobalType{}, fmt.Errorf("Invalid global type %v", expr)
+        }
+
+        valueType := ValueTypeFromName(expr.Children[0].Value)
+        if valueType == InvalidValueType {
+            return GlobalType{}, fmt.Errorf("Invalid global type %v", expr)
+        }
+
+        return GlobalType{ValueType: valueType, Mutable: true}, nil
+    }
+
+    valueType := ValueTypeFromName(expr.Value)
+    if valueType == InvalidValueType {
+        return GlobalType{}, fmt.Errorf("Invalid global type %v", expr)
+    }
+
+    return GlobalType{ValueType: valueType, Mutable: false}, nil
+}
+
+/* decode a string literal such as "a\n\00\u{263a}" into its bytes */
+func decodeString(value string) string {
+    if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+        value = value[1:len(value)-1]
+    }
+
+    var out strings.Builder
+    for i := 0; i < len(value); i++ {
+        if value[i] != '\\' || i + 1 >= len(value) {
+            out.WriteByte(value[i])
+            continue
+        }
+
+        i += 1
+        switch value[i] {
+            case 't': out.WriteByte('\t')
+            case 'n': out.WriteByte('\n')
+            case 'r': out.WriteByte('\r')
+            case '"': out.WriteByte('"')
+            case '\'': out.WriteByte('\'')
+            case '\\': out.WriteByte('\\')
+            case 'u':
+                /* \u{hex} is a unicode code point that is written as utf8 */
+                end := strings.IndexByte(value[i:], '}')
+                if i + 1 < len(value) && value[i+1] == '{' && end != -1 {
+                    code, err := strconv.ParseUint(strings.ReplaceAll(value[i+2:i+end], "_", ""), 16, 32)
+                    if err == nil {
+                        out.WriteRune(rune(code))
+                    }
+                    i += end
+                }
+            default:
+                /* \hh is a raw byte */
+                if i + 1 < len(value) {
+                    raw, err := strconv.ParseUint(value[i:i+2], 16, 8)
+                    if err == nil {
+                        out.WriteByte(byte(raw))
+                        i += 1
+                        continue
+                    }
+                }
+
+                out.WriteByte('\\')
+                out.WriteByte(value[i])
+        }
+    }
+
+    return out.String()
+}
+
+/* resolve an index that is either a number or a $name */
+func resolveIndex(value string, lookup func(string) (uint32, bool)) (uint32, error) {
+    index, err := literal.ParseU32(value)
+    if err == nil {
+        return index, nil
+    }
+
+    index, ok := lookup(value)
+    if !ok {
+        return 0, fmt.Errorf("Unknown name '%v'", value)
+    }
+
+    return index, nil
+}
+
+/* convert instructions that live outside of a function, such as offsets or global initializers.
+ * a single unfolded instruction is allowed too, as in (offset i32.const 0)
+ */
+func makeConstantExpressions(module WebAssemblyModule, exprs []*sexp.SExpression) []Expression {
+    if len(exprs) > 0 && exprs[0].Value != "" {
+        return MakeExpressions(module, nil, data.Stack[string]{}, &sexp.SExpression{Name: exprs[0].Value, Children: exprs[1:]})
+    }
+
+    var out []Expression
+    for _, expr := range exprs {
+        out = append(out, MakeExpressions(module, nil, data.Stack[string]{}, expr)...)
+    }
+
+    return out
+}
+
+/* the items of an element segment are either function indices or expressions,
+ * such as (ref.func $f) or (item ref.null func)
+ */
+func parseElementItems(module WebAssemblyModule, items []*sexp.SExpression) ([]Expression, error) {
+    var out []Expression
+    for _, item := range items {
+        if item.Value != "" {
+            index, err := resolveIndex(item.Value, module.LookupFunction)
+            if err != nil {
+                return nil, err
+            }
+            out = append(out, &RefFuncExpression{Function: &FunctionIndex{Id: index}})
+        } else if item.Name == "item" {
+            out = append(out, makeConstantExpressions(module, item.Children)...)
+        } else {
+            out = append(out, makeConstantExpressions(module, []*sexp.SExpression{item})...)
+        }
+    }
+
+    return out, nil
+}
+
+type fieldImport struct {
+    ModuleName string
+    Name string
+}
+
+/* the part of a func/table/memory/global field that comes before its description:
+ *   $name? (export "name")* (import "module" "name")?
+ */
+type fieldHeader struct {
+    Name string
+    Exports []string
+    Import *fieldImport
+}
+
+func parseFieldHeader(field *sexp.SExpression) (fieldHeader, []*sexp.SExpression) {
+    var header fieldHeader
+
+    children := field.Children
+    if len(children) > 0 && isId(children[0].Value) {
+        header.Name = children[0].Value
+        children = children[1:]
+    }
+
+    for len(children) > 0 {
+        child := children[0]
+        if child.Name == "export" && len(child.Children) == 1 {
+            header.Exports = append(header.Exports, decodeString(child.Children[0].Value))
+        } else if child.Name == "import" && len(child.Children) == 2 {
+            header.Import = &fieldImport{
+                ModuleName: decodeString(child.Children[0].Value),
+                Name: decodeString(child.Children[1].Value),
+            }
+        } else {
+            break
+        }
+
+        children = children[1:]
+    }
+
+    return header, children
+}
+
+/* (import "m" "n" (func $f ...)) is the same as the inline form (func $f (import "m" "n") ...) */
+func inlineImport(expr *sexp.SExpression) (*sexp.SExpression, error) {
+    if len(expr.Children) != 3 || expr.Children[2].Name == "" {
+        return nil, fmt.Errorf("Invalid import %v", expr)
+    }
+
+    description := expr.Children[2]
+    field := &sexp.SExpression{Name: description.Name}
+
+    rest := description.Children
+    if len(rest) > 0 && isId(rest[0].Value) {
+        field.AddChild(rest[0])
+        rest = rest[1:]
+    }
+
+    field.AddChild(&sexp.SExpression{Name: "import", Children: expr.Children[0:2]})
+    for _, child := range rest {
+        field.AddChild(child)
+    }
+
+    return field, nil
+}
+
+/* create a module from a (module ...) command in a wast script. besides the usual text format
+ * a script can embed a module as binary, (module binary "\00asm" ...), or as text inside
+ * strings, (module quote "(func)" ...). in both cases the strings are concatenated.
+ */
+func CreateWastModule(module *sexp.SExpression) (WebAssemblyModule, error) {
+    children := module.Children
+    if len(children) > 0 && isId(children[0].Value) {
+        children = children[1:]
+    }
+
+    if len(children) == 0 || (children[0].Value != "binary" && children[0].Value != "quote") {
+        return CreateWasmModule(module)
+    }
+
+    var contents strings.Builder
+    for _, child := range children[1:] {
+        if !strings.HasPrefix(child.Value, "\"") {
+            return WebAssemblyModule{}, fmt.Errorf("Expected a string in module %v but got %v", children[0].Value, child.String())
+        }
+        contents.WriteString(decodeString(child.Value))
+    }
+
+    if children[0].Value == "binary" {
+        return ParseWasmBytes([]byte(contents.String()))
+    }
+
+    /* the quoted text is either a list of module fields or a complete (module ...) */
+    text, err := sexp.ParseSExpression("(module " + contents.String() + ")")
+    if err != nil {
+        return WebAssemblyModule{}, fmt.Errorf("Could not parse quoted module: %v", err)
+    }
+
+    if len(text.Children) == 1 && text.Children[0].Name == "module" {
+        return CreateWastModule(text.Children[0])
+    }
+
+    return CreateWasmModule(&text)
+}
+
 func CreateWasmModule(module *sexp.SExpression) (WebAssemblyModule, error) {
     var moduleOut WebAssemblyModule
     typeSection := NewWebAssemblyTypeSection()
+    importSection := new(WebAssemblyImportSection)
     functionSection := WebAssemblyFunctionSectionCreate()
     codeSection := new(WebAssemblyCodeSection)
     tableSection := new(WebAssemblyTableSection)
@@ -1270,8 +1271,11 @@ func CreateWasmModule(module *sexp.SExpression) (WebAssemblyModule, error) {
     memorySection := new(WebAssemblyMemorySection)
     globalSection := new(WebAssemblyGlobalSection)
     elementSection := new(WebAssemblyElementSection)
+    dataSection := new(WebAssemblyDataSection)
+    var startSection *WebAssemblyStartSection
 
     moduleOut.AddSection(typeSection)
+    moduleOut.AddSection(importSection)
     moduleOut.AddSection(functionSection)
     moduleOut.AddSection(codeSection)
     moduleOut.AddSection(tableSection)
@@ -1279,279 +1283,449 @@ func CreateWasmModule(module *sexp.SExpression) (WebAssemblyModule, error) {
     moduleOut.AddSection(globalSection)
     moduleOut.AddSection(memorySection)
     moduleOut.AddSection(exportSection)
+    moduleOut.AddSection(dataSection)
+
+    /* names can refer to fields that are defined later in the module, so anything that refers to
+     * a name outside of a function body is resolved once every field has been seen. these
+     * run in the order they were added.
+     */
+    var pending []func() error
 
+    addExports := func(names []string, index Index){
+        for _, name := range names {
+            exportSection.AddExport(name, index)
+        }
+    }
+
+    /* explicit types keep their indices and can be used before they are defined, so handle them first */
     for _, expr := range module.Children {
-        /*
-        if expr.Name == "func" {
-            fmt.Printf("Func: %v\n", expr)
+        if expr.Name != "type" {
+            continue
+        }
+
+        var name string
+        for i, child := range expr.Children {
+            if i == 0 && isId(child.Value) {
+                name = child.Value
+                continue
+            }
+            if child.Name == "func" {
+                typeSection.AddFunctionType(MakeFunctionType(child))
+                if name != "" {
+                    typeSection.AssociateName(name, &TypeIndex{Id: uint32(len(typeSection.Functions) - 1)})
+                }
+            }
+        }
+    }
+
+    for _, expr := range module.Children {
+        if expr.Name == "import" {
+            field, err := inlineImport(expr)
+            if err != nil {
+                return WebAssemblyModule{}, err
+            }
+            expr = field
         }
-        */
 
         switch expr.Name {
             case "func":
+                header, rest := parseFieldHeader(expr)
+                functionType, typeIndex, used, err := parseTypeUse(typeSection, rest)
+                if err != nil {
+                    return WebAssemblyModule{}, err
+                }
+
+                if header.Import != nil {
+                    index := importSection.CountFunctions()
+                    importSection.AddNamedImport(header.Import.ModuleName, header.Import.Name, &FunctionImport{Index: typeIndex}, header.Name)
+                    addExports(header.Exports, &FunctionIndex{Id: uint32(index)})
+                    break
+                }
+
                 var code Code
-                var functionType WebAssemblyFunction
-                var functionName string
-                var exportedName string
-
-                for i, child := range expr.Children {
-                    /* named function */
-                    if i == 0 && isId(child.Value) {
-                        functionName = child.Value
-                    } else {
-                        switch child.Name {
-                            case "import":
-                                /* FIXME */
-                            case "type":
-                                if len(child.Children) > 0 {
-                                    if child.Children[0].Value != "" {
-                                        var type_ *TypeIndex
-                                        index, err := strconv.Atoi(child.Children[0].Value)
-                                        if err == nil {
-                                            type_ = &TypeIndex{Id: uint32(index)}
-                                        } else {
-                                            type_ = typeSection.GetTypeByName(child.Children[0].Value)
-                                        }
-
-                                        if type_ != nil {
-                                            functionType = typeSection.GetFunction(type_.Id)
-
-                                            for _, parameter := range functionType.InputTypes {
-                                                code.Locals = append(code.Locals, Local{
-                                                    Count: 1,
-                                                    Name: parameter.Name,
-                                                    Type: parameter.Type,
-                                                })
-                                            }
-                                        }
-                                    }
-                                }
-                            case "export":
-                                exportedName = cleanName(child.Children[0].Value)
-                            case "param":
-                                var paramName string
-                                for i, param := range child.Children {
-                                    use := ValueTypeFromName(param.Value)
-                                    if i == 0 && use == InvalidValueType {
-                                        paramName = param.Value
-                                    } else {
-                                        code.Locals = append(code.Locals, Local{
-                                            Count: 1,
-                                            Name: paramName,
-                                            Type: use,
-                                        })
-
-                                        functionType.InputTypes = append(functionType.InputTypes, Parameter{
-                                            Name: paramName,
-                                            Type: use,
-                                        })
-
-                                        paramName = ""
-                                    }
-                                }
-                                // functionType.InputTypes = append(functionType.InputTypes, ConvertValueTypes(child)...)
-                            case "result":
-                                functionType.OutputTypes = ConvertValueTypes(child)
-                            case "local":
-                                if len(child.Children) > 0 {
-                                    var firstLocalName string
-                                    start := 0
-                                    if ValueTypeFromName(child.Children[0].Value) == InvalidValueType {
-                                        firstLocalName = child.Children[0].Value
-                                        start = 1
-                                    }
-                                    for i := start; i < len(child.Children); i++ {
-                                        name := ""
-                                        if i == start {
-                                            name = firstLocalName
-                                        }
-                                        code.Locals = append(code.Locals, Local{
-                                            Count: 1,
-                                            Name: name,
-                                            Type: ValueTypeFromName(child.Children[i].Value),
-                                        })
-                                    }
+                for _, parameter := range functionType.InputTypes {
+                    code.Locals = append(code.Locals, Local{
+                        Count: 1,
+                        Name: parameter.Name,
+                        Type: parameter.Type,
+                        Parameter: true,
+                    })
+                }
+
+                for _, child := range rest[used:] {
+                    if child.Name == "local" {
+                        if len(child.Children) > 0 {
+                            var firstLocalName string
+                            start := 0
+                            if ValueTypeFromName(child.Children[0].Value) == InvalidValueType {
+                                firstLocalName = child.Children[0].Value
+                                start = 1
+                            }
+                            for i := start; i < len(child.Children); i++ {
+                                name := ""
+                                if i == start {
+                                    name = firstLocalName
                                 }
-                            default:
-                                code.Expressions = append(code.Expressions, MakeExpressions(moduleOut, &code, data.Stack[string]{}, child)...)
+                                code.Locals = append(code.Locals, Local{
+                                    Count: 1,
+                                    Name: name,
+                                    Type: ValueTypeFromName(child.Children[i].Value),
+                                })
+                            }
                         }
+                    } else {
+                        code.Expressions = append(code.Expressions, MakeExpressions(moduleOut, &code, data.Stack[string]{}, child)...)
                     }
                 }
 
-                typeIndex := typeSection.GetOrCreateFunctionType(functionType)
                 functionIndex := functionSection.AddFunction(&TypeIndex{
                     Id: typeIndex,
-                }, cleanName(functionName))
+                }, header.Name)
 
                 codeSection.AddCode(code)
-                if exportedName != "" {
-                    exportSection.AddExport(exportedName, &FunctionIndex{Id: functionIndex})
-                }
+
+                /* imports always come before definitions, so the import count is final at this point */
+                addExports(header.Exports, &FunctionIndex{Id: uint32(importSection.CountFunctions()) + functionIndex})
             case "type":
-                var name string
-                for i, child := range expr.Children {
-                    if i == 0 && isId(child.Value) {
-                        name = child.Value
-                        continue
+                /* already handled */
+            case "global":
+                header, rest := parseFieldHeader(expr)
+                if len(rest) == 0 {
+                    return WebAssemblyModule{}, fmt.Errorf("Missing global type in %v", expr)
+                }
+
+                globalType, err := parseGlobalType(rest[0])
+                if err != nil {
+                    return WebAssemblyModule{}, err
+                }
+
+                if header.Import != nil {
+                    index := importSection.CountGlobals()
+                    importSection.AddNamedImport(header.Import.ModuleName, header.Import.Name, &globalType, header.Name)
+                    addExports(header.Exports, &GlobalIndex{Id: uint32(index)})
+                    break
+                }
+
+                position := len(globalSection.Globals)
+                globalSection.AddGlobal(&globalType, nil, header.Name)
+                addExports(header.Exports, &GlobalIndex{Id: uint32(importSection.CountGlobals() + position)})
+
+                init := rest[1:]
+                pending = append(pending, func() error {
+                    globalSection.Globals[position].Expression = makeConstantExpressions(moduleOut, init)
+                    return nil
+                })
+            case "memory":
+                header, rest := parseFieldHeader(expr)
+
+                var limit Limit
+                var initial []byte
+                hasData := false
+
+                if len(rest) > 0 && rest[0].Name == "data" {
+                    /* (memory (data "...")) is sized to exactly fit the data */
+                    for _, child := range rest[0].Children {
+                        initial = append(initial, decodeString(child.Value)...)
                     }
-                    if child.Name == "func" {
-                        typeIndex := typeSection.GetOrCreateFunctionType(MakeFunctionType(child))
-                        if name != "" {
-                            typeSection.AssociateName(name, &TypeIndex{Id: typeIndex})
-                        }
+                    pages := uint32((len(initial) + MemoryPageSize - 1) / MemoryPageSize)
+                    limit = Limit{Minimum: pages, Maximum: pages, HasMaximum: true}
+                    hasData = true
+                } else {
+                    var err error
+                    limit, _, err = parseLimit(rest)
+                    if err != nil {
+                        return WebAssemblyModule{}, fmt.Errorf("Unable to read memory limits: %v", err)
                     }
                 }
-            case "global":
-                var name *sexp.SExpression
-                var kind *sexp.SExpression
-                var value *sexp.SExpression
 
-                current := 0
+                index := uint32(importSection.CountMemories())
+                if header.Import != nil {
+                    importSection.AddNamedImport(header.Import.ModuleName, header.Import.Name, &MemoryImportType{Limit: limit}, header.Name)
+                } else {
+                    index += uint32(len(memorySection.Memories))
+                    memorySection.AddMemory(limit, header.Name)
+                }
+
+                addExports(header.Exports, &MemoryIndex{Id: index})
+
+                if hasData {
+                    dataSection.AddData(initial, &MemoryActiveMode{
+                        Memory: index,
+                        Offset: []Expression{&I32ConstExpression{N: 0}},
+                    })
+                }
+
+            case "table":
+                header, rest := parseFieldHeader(expr)
+
+                table := TableType{Name: header.Name}
+                var elements *sexp.SExpression
+
+                if len(rest) == 0 {
+                    return WebAssemblyModule{}, fmt.Errorf("Missing table type in %v", expr)
+                }
+
+                refType, ok := refTypeFromName(rest[0].Value)
+                if ok && len(rest) > 1 && rest[1].Name == "elem" {
+                    /* (table funcref (elem ...)) has exactly as many entries as elements */
+                    elements = rest[1]
+                    count := uint32(len(elements.Children))
+                    table.Limit = Limit{Minimum: count, Maximum: count, HasMaximum: true}
+                    table.RefType = refType
+                } else {
+                    limit, used, err := parseLimit(rest)
+                    if err != nil {
+                        return WebAssemblyModule{}, fmt.Errorf("Unable to read table limits: %v", err)
+                    }
+
+                    if len(rest) <= used {
+                        return WebAssemblyModule{}, fmt.Errorf("Missing reference type for table %v", expr)
+                    }
 
-                if len(expr.Children) > 0 {
-                    if isId(expr.Children[0].Value) {
-                        name = expr.Children[0]
-                        current += 1
+                    refType, ok := refTypeFromName(rest[used].Value)
+                    if !ok {
+                        return WebAssemblyModule{}, fmt.Errorf("Invalid reference type '%v'", rest[used].Value)
                     }
+
+                    table.Limit = limit
+                    table.RefType = refType
                 }
 
-                useName := ""
-                if name != nil {
-                    useName = name.Value
+                index := uint32(importSection.CountTables())
+                if header.Import != nil {
+                    importSection.AddNamedImport(header.Import.ModuleName, header.Import.Name, &table, header.Name)
+                } else {
+                    index += tableSection.AddTable(table)
                 }
 
-                if len(expr.Children) > current {
-                    kind = expr.Children[current]
-                    if kind.Name == "import" {
-                        if len(kind.Children) != 2 {
-                            fmt.Printf("Syntax error with global: %v\n", expr)
-                            break
-                        }
+                addExports(header.Exports, &TableIndex{Id: index})
+
+                if elements != nil {
+                    position := len(elementSection.Elements)
+                    elementSection.AddElement(ElementInit{
+                        Type: table.RefType,
+                        Mode: &ElementModeActive{
+                            Table: int(index),
+                            Offset: []Expression{&I32ConstExpression{N: 0}},
+                        },
+                    })
 
-                        name1 := kind.Children[0].Value
-                        name2 := kind.Children[1].Value
-                        current += 1
-                        if len(expr.Children) <= current {
-                            fmt.Printf("Syntax error with global: expected type\n")
-                            break
+                    pending = append(pending, func() error {
+                        inits, err := parseElementItems(moduleOut, elements.Children)
+                        if err != nil {
+                            return err
                         }
+                        elementSection.Elements[position].Inits = inits
+                        return nil
+                    })
+                }
 
-                        typeExpr := expr.Children[current]
+            case "elem":
+                children := expr.Children
+                if len(children) > 0 && isId(children[0].Value) {
+                    children = children[1:]
+                }
 
-                        globalType := GlobalType{}
+                element := ElementInit{
+                    Type: RefTypeFunction,
+                    Mode: &ElementModePassive{},
+                }
 
-                        if kind.Name == "mut" {
-                            globalType.Mutable = true
-                            globalType.ValueType = ValueTypeFromName(typeExpr.Children[0].Value)
-                        } else {
-                            globalType.Mutable = false
-                            globalType.ValueType = ValueTypeFromName(typeExpr.Value)
-                        }
+                /* active segments: (elem (table x)? (offset ...) elemlist), where the offset may be
+                 * abbreviated to a single folded instruction
+                 */
+                var active *ElementModeActive
+                tableName := "0"
+                var offset []*sexp.SExpression
+
+                if len(children) > 0 && children[0].Value == "declare" {
+                    element.Mode = &ElementModeDeclarative{}
+                    children = children[1:]
+                } else {
+                    if len(children) > 0 && children[0].Name == "table" && len(children[0].Children) == 1 {
+                        tableName = children[0].Children[0].Value
+                        children = children[1:]
+                        active = &ElementModeActive{}
+                    }
 
-                        globalSection.AddGlobal(&globalType, nil, useName)
+                    if len(children) > 0 && children[0].Name == "offset" {
+                        offset = children[0].Children
+                        children = children[1:]
+                        active = &ElementModeActive{}
+                    } else if len(children) > 0 && children[0].Name != "" && children[0].Name != "item" {
+                        offset = children[0:1]
+                        children = children[1:]
+                        active = &ElementModeActive{}
+                    }
+                }
 
-                        // FIXME: create import for name1 and name2
-                        _ = name1
-                        _ = name2
+                if active != nil {
+                    element.Mode = active
+                }
 
-                        break
-                    } else if kind.Name == "export" {
-                        break
+                /* the element list is 'func x*' or 'reftype item*'. the func keyword may be left off */
+                if len(children) > 0 {
+                    if children[0].Value == "func" {
+                        children = children[1:]
+                    } else {
+                        refType, ok := refTypeFromName(children[0].Value)
+                        if ok {
+                            element.Type = refType
+                            children = children[1:]
+                        }
                     }
                 }
 
-                if len(expr.Children) > current + 1 {
-                    kind = expr.Children[current]
-                    current += 1
-                    value = expr.Children[current]
+                items := children
+                position := len(elementSection.Elements)
+                elementSection.AddElement(element)
 
-                    globalType := GlobalType{}
+                pending = append(pending, func() error {
+                    inits, err := parseElementItems(moduleOut, items)
+                    if err != nil {
+                        return err
+                    }
+                    elementSection.Elements[position].Inits = inits
 
-                    if kind.Name == "mut" {
-                        globalType.Mutable = true
-                        globalType.ValueType = ValueTypeFromName(kind.Children[0].Value)
-                    } else {
-                        globalType.Mutable = false
-                        globalType.ValueType = ValueTypeFromName(kind.Value)
+                    if active != nil {
+                        table, err := resolveIndex(tableName, moduleOut.LookupTable)
+                        if err != nil {
+                            return err
+                        }
+                        active.Table = int(table)
+                        active.Offset = makeConstantExpressions(moduleOut, offset)
                     }
 
-                    valueExpr := MakeExpressions(moduleOut, nil, data.Stack[string]{}, value)
-                    globalSection.AddGlobal(&globalType, valueExpr, useName)
-                }
+                    return nil
+                })
+
             case "data":
-                // FIXME:
-            case "import":
-                // FIXME:
-            case "memory":
-                var name string
-                for i, child := range expr.Children {
-                    if i == 0 && isId(child.Value) {
-                        name = child.Value
-                        continue
-                    }
+                children := expr.Children
+                if len(children) > 0 && isId(children[0].Value) {
+                    children = children[1:]
+                }
+
+                var active *MemoryActiveMode
+                memoryName := "0"
+                var offset []*sexp.SExpression
+
+                if len(children) > 0 && children[0].Name == "memory" && len(children[0].Children) == 1 {
+                    memoryName = children[0].Children[0].Value
+                    children = children[1:]
+                    active = &MemoryActiveMode{}
+                }
 
-                    min, err := strconv.Atoi(child.Value)
+                if len(children) > 0 && children[0].Name == "offset" {
+                    offset = children[0].Children
+                    children = children[1:]
+                    active = &MemoryActiveMode{}
+                } else if len(children) > 0 && children[0].Name != "" {
+                    offset = children[0:1]
+                    children = children[1:]
+                    active = &MemoryActiveMode{}
+                }
+
+                var bytes []byte
+                for _, child := range children {
+                    bytes = append(bytes, decodeString(child.Value)...)
+                }
+
+                if active == nil {
+                    dataSection.AddData(bytes, &MemoryPassiveMode{})
+                    break
+                }
+
+                dataSection.AddData(bytes, active)
+                pending = append(pending, func() error {
+                    memory, err := resolveIndex(memoryName, moduleOut.LookupMemory)
                     if err != nil {
-                        fmt.Printf("Error: unable to read minimum length of memory: %v", err)
-                        break
+                        return err
                     }
+                    active.Memory = memory
+                    active.Offset = makeConstantExpressions(moduleOut, offset)
+                    return nil
+                })
 
-                    memorySection.AddMemory(Limit{Minimum: uint32(min)}, name)
+            case "export":
+                if len(expr.Children) != 2 || len(expr.Children[1].Children) != 1 {
+                    return WebAssemblyModule{}, fmt.Errorf("Invalid export %v", expr)
                 }
 
-            case "table":
-                // so far this handles an inline table expression with funcref elements already given
-                tableName := ""
-                for i := 0; i < len(expr.Children); i++ {
-                    if expr.Children[i].Value == "funcref" {
-                        if len(expr.Children) > i+1 {
-                            elements := expr.Children[i+1]
-                            if elements.Name == "elem" {
-                                tableId := tableSection.AddTable(TableType{
-                                    Limit: Limit{
-                                        Minimum: uint32(len(elements.Children)),
-                                        Maximum: uint32(len(elements.Children)),
-                                        HasMaximum: true,
-                                    },
-                                    RefType: RefTypeFunction,
-                                    Name: tableName,
-                                })
-
-                                /* initialize the elements after the module has been parsed */
-                                defer func(){
-                                    var functions []*FunctionIndex
-                                    for _, element := range elements.Children {
-                                        if element.Value != "" {
-                                            index, err := strconv.Atoi(element.Value)
-                                            if err == nil {
-                                                functions = append(functions, &FunctionIndex{Id: uint32(index)})
-                                            } else {
-                                                functionIndex, ok := functionSection.GetFunctionIndexByName(element.Value)
-                                                if ok {
-                                                    functions = append(functions, &FunctionIndex{Id: uint32(functionIndex)})
-                                                } else {
-                                                    fmt.Printf("Warning: unable to find funcref '%v'\n", element.Value)
-                                                }
-                                            }
-                                        }
-                                    }
-
-                                    elementSection.AddFunctionRefInit(functions, int(tableId), []Expression{&I32ConstExpression{N: 0}})
-                                }()
-                            }
-                        }
+                name := decodeString(expr.Children[0].Value)
+                description := expr.Children[1]
+                target := description.Children[0].Value
+
+                var id *uint32
+                var lookup func(string) (uint32, bool)
+
+                switch description.Name {
+                    case "func":
+                        index := &FunctionIndex{}
+                        exportSection.AddExport(name, index)
+                        id = &index.Id
+                        lookup = moduleOut.LookupFunction
+                    case "table":
+                        index := &TableIndex{}
+                        exportSection.AddExport(name, index)
+                        id = &index.Id
+                        lookup = moduleOut.LookupTable
+                    case "memory":
+                        index := &MemoryIndex{}
+                        exportSection.AddExport(name, index)
+                        id = &index.Id
+                        lookup = moduleOut.LookupMemory
+                    case "global":
+                        index := &GlobalIndex{}
+                        exportSection.AddExport(name, index)
+                        id = &index.Id
+                        lookup = moduleOut.LookupGlobal
+                    default:
+                        return WebAssemblyModule{}, fmt.Errorf("Invalid export %v", expr)
+                }
 
-                        break
-                    } else {
-                        tableName = expr.Children[i].Value
+                pending = append(pending, func() error {
+                    index, err := resolveIndex(target, lookup)
+                    if err != nil {
+                        return err
                     }
+                    *id = index
+                    return nil
+                })
+
+            case "start":
+                if len(expr.Children) != 1 {
+                    return WebAssemblyModule{}, fmt.Errorf("Invalid start %v", expr)
                 }
 
+                start := &WebAssemblyStartSection{}
+                target := expr.Children[0].Value
+                pending = append(pending, func() error {
+                    index, err := resolveIndex(target, moduleOut.LookupFunction)
+                    if err != nil {
+                        return err
+                    }
+                    start.Start.Id = index
+                    return nil
+                })
+
+                startSection = start
+
             default:
                 fmt.Printf("Warning: unhandled wast top level '%v'\n", expr.Name)
         }
     }
 
+    for _, run := range pending {
+        err := run()
+        if err != nil {
+            return WebAssemblyModule{}, err
+        }
+    }
+
+    if startSection != nil {
+        moduleOut.AddSection(startSection)
+    }
+
     for _, code := range codeSection.Code {
         doSecondPass(&code)
     }
@@ -1560,15 +1734,24 @@ func CreateWasmModule(module *sexp.SExpression) (WebAssemblyModule, error) {
 }
 
 func ParseWastFile(path string) (Wast, error) {
-    var wast Wast
-
     file, err := os.Open(path)
     if err != nil {
         return Wast{}, err
     }
     defer file.Close()
 
-    reader := bufio.NewReader(file)
+    return ParseWast(file)
+}
+
+func ParseWastBytes(data []byte) (Wast, error) {
+    return ParseWast(bytes.NewReader(data))
+}
+
+/* parse every top level s-expression of a wast script */
+func ParseWast(input io.Reader) (Wast, error) {
+    var wast Wast
+
+    reader := NewOffsetReader(input)
 
     for {
         next, err := sexp.ParseSExpressionReader(reader)
@@ -1576,7 +1759,7 @@ func ParseWastFile(path string) (Wast, error) {
             if errors.Is(err, io.EOF) {
                 break
             }
-            return Wast{}, err
+            return Wast{}, fmt.Errorf("Could not parse s-expression at byte offset %v: %w", reader.Offset(), err)
         }
         
         wast.Expressions = append(wast.Expressions, next)
@@ -1,33 +1,185 @@
 package core
 
 import (
+    "strings"
     "testing"
-    "math"
+
+    "github.com/kazzmir/webassembly/lib/data"
+    "github.com/kazzmir/webassembly/lib/sexp"
 )
 
-func near(a float64, b float64) bool {
-    if math.Abs(a - b) > 0.00000001 {
-        return false
+func TestInlineFields(test *testing.T){
+    text := `(module
+      (type $t (func (param i32) (result i32)))
+      (func $log (import "env" "log") (param i32))
+      (global $g (export "g") (mut i32) (i32.const 4))
+      (memory (export "mem") (data "ab\63"))
+      (table $tab 2 4 funcref)
+      (elem (table $tab) (offset (i32.const 1)) func $f)
+      (func $f (export "f") (type $t) (local.get 0))
+      (export "f2" (func $f))
+      (start $f))`
+
+    expr, err := sexp.ParseSExpression(text)
+    if err != nil {
+        test.Fatalf("unable to parse: %v", err)
+    }
+
+    module, err := CreateWasmModule(&expr)
+    if err != nil {
+        test.Fatalf("unable to create module: %v", err)
+    }
+
+    if module.GetImportFunctionCount() != 1 {
+        test.Fatalf("expected 1 imported function but got %v", module.GetImportFunctionCount())
+    }
+
+    /* the imported function comes first, so $f is function 1 */
+    index, ok := module.LookupFunction("$f")
+    if !ok || index != 1 {
+        test.Fatalf("expected $f to be function 1 but got %v", index)
+    }
+
+    /* the import's type was created implicitly after the explicit type */
+    if len(module.GetTypeSection().Functions) != 2 {
+        test.Fatalf("expected 2 types but got %v", len(module.GetTypeSection().Functions))
+    }
+
+    for _, name := range []string{"f", "f2"} {
+        function, ok := module.GetExportSection().FindExportByName(name).(*FunctionIndex)
+        if !ok || function.Id != 1 {
+            test.Fatalf("expected export '%v' to be function 1", name)
+        }
+    }
+
+    memory := module.GetMemorySection().Memories[0]
+    if memory.Minimum != 1 || !memory.HasMaximum || memory.Maximum != 1 {
+        test.Fatalf("memory with inline data should have exactly 1 page: %+v", memory)
+    }
+
+    segment := module.GetDataSection().Segments[0]
+    if string(segment.Data) != "abc" {
+        test.Fatalf("unexpected data segment %q", segment.Data)
+    }
+
+    table := module.GetTableSection().Items[0]
+    if table.Limit.Minimum != 2 || table.Limit.Maximum != 4 || table.RefType != RefTypeFunction {
+        test.Fatalf("unexpected table %+v", table)
+    }
+
+    element := module.GetElementSection().Elements[0]
+    active, ok := element.Mode.(*ElementModeActive)
+    if !ok || active.Table != 0 || len(active.Offset) != 1 || len(element.Inits) != 1 {
+        test.Fatalf("unexpected element segment %+v", element)
+    }
+
+    if module.GetStartSection() == nil || module.GetStartSection().Start.Id != 1 {
+        test.Fatalf("expected start function 1")
+    }
+
+    global, ok := module.GetExportSection().FindExportByName("g").(*GlobalIndex)
+    if !ok || global.Id != 0 || !module.GetGlobalSection().Globals[0].Global.Mutable {
+        test.Fatalf("expected exported mutable global 0")
     }
+}
+
+func TestBinaryAndQuoteModules(test *testing.T){
+    /* (func (export "add") (param i32 i32) (result i32) (i32.add (local.get 0) (local.get 1))) */
+    binary := `(module binary "\00asm" "\01\00\00\00"
+      "\01\07\01\60\02\7f\7f\01\7f"
+      "\03\02\01\00"
+      "\07\07\01\03add\00\00"
+      "\0a\09\01\07\00\20\00\20\01\6a\0b")`
+
+    quote := `(module quote "(func (export \"add\") (param i32 i32) (result i32)"
+      " (i32.add (local.get 0) (local.get 1)))")`
+
+    quoteModule := `(module $m quote "(module (func (export \"add\") (param i32 i32) (result i32) (i32.add (local.get 0) (local.get 1))))")`
+
+    for _, text := range []string{binary, quote, quoteModule} {
+        expr, err := sexp.ParseSExpression(text)
+        if err != nil {
+            test.Fatalf("unable to parse %v: %v", text, err)
+        }
+
+        module, err := CreateWastModule(&expr)
+        if err != nil {
+            test.Fatalf("unable to create module %v: %v", text, err)
+        }
+
+        function, ok := module.GetExportSection().FindExportByName("add").(*FunctionIndex)
+        if !ok || function.Id != 0 {
+            test.Fatalf("expected export 'add' to be function 0 in %v", text)
+        }
 
-    return true
+        expressions := module.GetCodeSection().Code[0].Expressions
+        if len(expressions) != 3 {
+            test.Fatalf("expected 3 expressions but got %v in %v", len(expressions), text)
+        }
+
+        if _, ok := expressions[2].(*I32AddExpression); !ok {
+            test.Fatalf("expected the last expression to be i32.add but got %v", expressions[2])
+        }
+    }
 }
 
-func TestParseFloat(test *testing.T){
-    value, err := parseFloat32("0x0p+0")
+func TestBinaryMemory(test *testing.T){
+    /* (memory 1 2) */
+    expr, err := sexp.ParseSExpression(`(module binary "\00asm" "\01\00\00\00" "\05\04\01\01\01\02")`)
     if err != nil {
         test.Fatalf("unable to parse: %v", err)
     }
-    if !near(float64(value), 0) {
-        test.Fatalf("value was not near 0: %v", value)
+
+    module, err := CreateWastModule(&expr)
+    if err != nil {
+        test.Fatalf("unable to create module: %v", err)
+    }
+
+    memory := module.GetMemorySection()
+    if memory == nil || len(memory.Memories) != 1 {
+        test.Fatalf("expected one memory but got %v", memory)
+    }
+
+    if memory.Memories[0] != (Limit{Minimum: 1, Maximum: 2, HasMaximum: true}) {
+        test.Fatalf("wrong memory limit %v", memory.Memories[0])
+    }
+}
+
+func TestBinaryMemoryArguments(test *testing.T){
+    /* (func (result i64) (i64.load offset=8 (i32.const 0))) */
+    expr, err := sexp.ParseSExpression(`(module binary "\00asm" "\01\00\00\00"
+      "\01\05\01\60\00\01\7e"
+      "\03\02\01\00"
+      "\0a\09\01\07\00\41\00\29\03\08\0b")`)
+    if err != nil {
+        test.Fatalf("unable to parse: %v", err)
+    }
+
+    module, err := CreateWastModule(&expr)
+    if err != nil {
+        test.Fatalf("unable to create module: %v", err)
+    }
+
+    load, ok := module.GetCodeSection().Code[0].Expressions[1].(*I64LoadExpression)
+    if !ok || load.Memory != (MemoryArgument{Align: 3, Offset: 8}) {
+        test.Fatalf("expected i64.load with offset 8 but got %v", module.GetCodeSection().Code[0].Expressions)
+    }
+
+    if load.ConvertToWat(data.Stack[int]{}, "") != "i64.load offset=8" {
+        test.Fatalf("wrong text %v", load.ConvertToWat(data.Stack[int]{}, ""))
     }
 
-    value, err = parseFloat32("0x3p+2")
+    /* i64.clz has no expression, so the module cannot be read rather than run without it */
+    expr, err = sexp.ParseSExpression(`(module binary "\00asm" "\01\00\00\00"
+      "\01\05\01\60\00\01\7e"
+      "\03\02\01\00"
+      "\0a\07\01\05\00\42\00\79\0b")`)
     if err != nil {
         test.Fatalf("unable to parse: %v", err)
     }
 
-    if !near(float64(value), 12) {
-        test.Fatalf("value was not near 12: %v", value)
+    _, err = CreateWastModule(&expr)
+    if err == nil || !strings.Contains(err.Error(), "Unsupported instruction 0x79") {
+        test.Fatalf("expected an unsupported instruction error but got %v", err)
     }
 }
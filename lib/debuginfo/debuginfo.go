@@ -0,0 +1,173 @@
+package debuginfo
+
+/* the DWARF debugging information of a module. compilers put the DWARF sections, such as .debug_info and
+ * .debug_line, into custom sections with the same names, and an address in them is an offset from the
+ * start of the code section. the sections are read with debug/dwarf, and the line tables are used to find
+ * the source line of an instruction.
+ *
+ *   info, err := debuginfo.Load(&module)
+ *   line, ok := info.Lookup(offset)
+ */
+
+import (
+    "debug/dwarf"
+    "errors"
+    "fmt"
+    "io"
+    "sort"
+
+    "github.com/kazzmir/webassembly/lib/core"
+)
+
+var ErrNoDebugInfo = errors.New("the module has no DWARF debug information")
+
+/* a position in the source code */
+type Line struct {
+    /* the first code section offset that belongs to the line */
+    Address uint64
+    File string
+    Line int
+    /* 0 if the column is not known */
+    Column int
+}
+
+func (line Line) String() string {
+    if line.Column > 0 {
+        return fmt.Sprintf("%v:%v:%v", line.File, line.Line, line.Column)
+    }
+
+    return fmt.Sprintf("%v:%v", line.File, line.Line)
+}
+
+/* a row of a line table, end is set for the address just past a sequence of code */
+type row struct {
+    line Line
+    end bool
+}
+
+type Info struct {
+    /* all of the DWARF data, for anything more than lines */
+    Data *dwarf.Data
+    /* the rows of every line table ordered by address */
+    rows []row
+}
+
+/* the sections that debug/dwarf takes besides the ones given to dwarf.New */
+var extraSections = []string{".debug_addr", ".debug_line_str", ".debug_str_offsets", ".debug_rnglists", ".debug_loclists"}
+
+/* read the DWARF custom sections of a module, returns ErrNoDebugInfo if there is no .debug_info section */
+func Load(module *core.WebAssemblyModule) (*Info, error) {
+    sections := make(map[string][]byte)
+    for _, custom := range module.GetCustomSections() {
+        sections[custom.Name] = custom.Data
+    }
+
+    if sections[".debug_info"] == nil {
+        return nil, ErrNoDebugInfo
+    }
+
+    data, err := dwarf.New(sections[".debug_abbrev"], sections[".debug_aranges"], sections[".debug_frame"],
+                           sections[".debug_info"], sections[".debug_line"], sections[".debug_pubnames"],
+                           sections[".debug_ranges"], sections[".debug_str"])
+    if err != nil {
+        return nil, fmt.Errorf("unable to read DWARF: %v", err)
+    }
+
+    for _, name := range extraSections {
+        if sections[name] != nil {
+            err = data.AddSection(name, sections[name])
+            if err != nil {
+                return nil, fmt.Errorf("unable to read %v: %v", name, err)
+            }
+        }
+    }
+
+    info := &Info{Data: data}
+    err = info.readLines()
+    if err != nil {
+        return nil, err
+    }
+
+    return info, nil
+}
+
+/* read the line table of every compile unit */
+func (info *Info) readLines() error {
+    reader := info.Data.Reader()
+    for {
+        entry, err := reader.Next()
+        if err != nil {
+            return fmt.Errorf("unable to read DWARF entries: %v", err)
+        }
+
+        if entry == nil {
+            break
+        }
+
+        if entry.Tag == dwarf.TagCompileUnit {
+            lines, err := info.Data.LineReader(entry)
+            if err != nil {
+                return fmt.Errorf("unable to read the line table: %v", err)
+            }
+
+            for lines != nil {
+                var next dwarf.LineEntry
+                err = lines.Next(&next)
+                if err == io.EOF {
+                    break
+                }
+                if err != nil {
+                    return fmt.Errorf("unable to read the line table: %v", err)
+                }
+
+                current := row{end: next.EndSequence}
+                current.line.Address = next.Address
+                if !next.EndSequence {
+                    current.line.Line = next.Line
+                    current.line.Column = next.Column
+                    if next.File != nil {
+                        current.line.File = next.File.Name
+                    }
+                }
+
+                info.rows = append(info.rows, current)
+            }
+        }
+
+        reader.SkipChildren()
+    }
+
+    /* where a sequence ends at the same address that another one starts the start wins */
+    sort.SliceStable(info.rows, func(i int, j int) bool {
+        if info.rows[i].line.Address != info.rows[j].line.Address {
+            return info.rows[i].line.Address < info.rows[j].line.Address
+        }
+        return info.rows[i].end && !info.rows[j].end
+    })
+
+    return nil
+}
+
+/* the source line of the code at an offset from the start of the code section */
+func (info *Info) Lookup(offset uint64) (Line, bool) {
+    index := sort.Search(len(info.rows), func(i int) bool {
+        return info.rows[i].line.Address > offset
+    }) - 1
+
+    if index < 0 || info.rows[index].end {
+        return Line{}, false
+    }
+
+    return info.rows[index].line, true
+}
+
+/* the source line of an instruction of a function, where instruction counts the instructions of the body
+ * as core.Code.Offsets does
+ */
+func (info *Info) LookupInstruction(code core.Code, instruction int) (Line, bool) {
+    if instruction < 0 || instruction >= len(code.Offsets) {
+        return Line{}, false
+    }
+
+    return info.Lookup(uint64(code.Offsets[instruction]))
+}
@@ -0,0 +1,117 @@
+package debuginfo
+
+import (
+    "encoding/binary"
+    "testing"
+
+    "github.com/kazzmir/webassembly/lib/core"
+)
+
+/* the DWARF 4 sections of one compile unit, main.c, whose code is at offsets 5 to 13 of the code section:
+ * line 1 from 5, line 3 column 7 from 10
+ */
+func makeSections() map[string][]byte {
+    abbrev := []byte{
+        /* abbreviation 1 is a compile unit without children */
+        1, 0x11, 0,
+        /* DW_AT_name DW_FORM_string, DW_AT_stmt_list DW_FORM_sec_offset, DW_AT_low_pc DW_FORM_addr */
+        0x03, 0x08, 0x10, 0x17, 0x11, 0x01,
+        0, 0,
+        0,
+    }
+
+    var unit []byte
+    /* version 4, abbreviations at 0, 4 byte addresses */
+    unit = append(unit, 4, 0, 0, 0, 0, 0, 4)
+    unit = append(unit, 1)
+    unit = append(unit, "main.c\x00"...)
+    unit = append(unit, 0, 0, 0, 0)
+    unit = append(unit, 0, 0, 0, 0)
+    info := binary.LittleEndian.AppendUint32(nil, uint32(len(unit)))
+    info = append(info, unit...)
+
+    var header []byte
+    /* minimum instruction length, maximum operations, default is_stmt, line base -5, line range 14,
+     * opcode base 13 and the lengths of the standard opcodes
+     */
+    header = append(header, 1, 1, 1, 0xfb, 14, 13)
+    header = append(header, 0, 1, 1, 1, 1, 0, 0, 0, 1, 0, 0, 1)
+    /* no include directories, then main.c in directory 0 */
+    header = append(header, 0)
+    header = append(header, "main.c\x00"...)
+    header = append(header, 0, 0, 0, 0)
+
+    program := []byte{
+        /* DW_LNE_set_address 5 */
+        0, 5, 2, 5, 0, 0, 0,
+        /* DW_LNS_copy */
+        1,
+        /* DW_LNS_advance_line 2, DW_LNS_advance_pc 5, DW_LNS_set_column 7, DW_LNS_copy */
+        3, 2, 2, 5, 5, 7, 1,
+        /* DW_LNS_advance_pc 3, DW_LNE_end_sequence */
+        2, 3, 0, 1, 1,
+    }
+
+    var table []byte
+    table = append(table, 4, 0)
+    table = binary.LittleEndian.AppendUint32(table, uint32(len(header)))
+    table = append(table, header...)
+    table = append(table, program...)
+    line := binary.LittleEndian.AppendUint32(nil, uint32(len(table)))
+    line = append(line, table...)
+
+    return map[string][]byte{
+        ".debug_abbrev": abbrev,
+        ".debug_info": info,
+        ".debug_line": line,
+    }
+}
+
+func TestLines(test *testing.T){
+    var module core.WebAssemblyModule
+    if _, err := Load(&module); err != ErrNoDebugInfo {
+        test.Fatalf("expected no debug info but got %v", err)
+    }
+
+    for name, data := range makeSections() {
+        module.AddCustomSection(name, data, core.CustomSectionPlacement{Section: core.CustomPlacementLast})
+    }
+
+    info, err := Load(&module)
+    if err != nil {
+        test.Fatalf("unable to load debug info: %v", err)
+    }
+
+    expected := map[uint64]string{
+        5: "main.c:1",
+        9: "main.c:1",
+        10: "main.c:3:7",
+        12: "main.c:3:7",
+    }
+
+    for offset, text := range expected {
+        line, ok := info.Lookup(offset)
+        if !ok || line.String() != text {
+            test.Errorf("expected %v at offset %v but got %v %v", text, offset, line, ok)
+        }
+    }
+
+    /* before the code and past the end of the sequence */
+    for _, offset := range []uint64{0, 4, 13, 100} {
+        line, ok := info.Lookup(offset)
+        if ok {
+            test.Errorf("expected no line at offset %v but got %v", offset, line)
+        }
+    }
+
+    code := core.Code{Offsets: []uint32{5, 7, 11}}
+    line, ok := info.LookupInstruction(code, 2)
+    if !ok || line.Line != 3 || line.Address != 10 {
+        test.Fatalf("wrong line for instruction 2: %v %v", line, ok)
+    }
+
+    _, ok = info.LookupInstruction(code, 3)
+    if ok {
+        test.Fatalf("expected no line past the last instruction")
+    }
+}
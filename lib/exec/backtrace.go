@@ -0,0 +1,160 @@
+package exec
+
+/* an error that stops the code, such as a trap, is returned as a TrapError that remembers the functions
+ * that were active when it happened. the error message is the message of the original error, so
+ * errors.Is and errors.As see through it.
+ */
+
+import (
+    "errors"
+    "fmt"
+    "strings"
+
+    "github.com/kazzmir/webassembly/lib/core"
+)
+
+/* a function in a backtrace */
+type BacktraceFrame struct {
+    Function uint32
+    /* the name of the function in the module, see core.FunctionNames, empty if it has none */
+    Name string
+    /* the instruction that was running, which is a call for every frame but the first, -1 for a host
+     * function. see FunctionInstructions
+     */
+    Offset int
+    /* the offset of the instruction from the start of the code section, see core.Code.Offsets. -1 if the
+     * module was not read from a binary
+     */
+    CodeOffset int64
+}
+
+func (frame BacktraceFrame) String() string {
+    name := fmt.Sprintf("func %v", frame.Function)
+    if frame.Name != "" {
+        name = fmt.Sprintf("%v (%v)", name, frame.Name)
+    }
+
+    if frame.Offset < 0 {
+        return name + " (host)"
+    }
+
+    if frame.CodeOffset >= 0 {
+        return fmt.Sprintf("%v at instruction %v, code offset 0x%x", name, frame.Offset, frame.CodeOffset)
+    }
+
+    return fmt.Sprintf("%v at instruction %v", name, frame.Offset)
+}
+
+/* a deep recursion would have a frame for every call, so only the innermost and the outermost frames are
+ * kept
+ */
+const backtraceHead = 50
+const backtraceTail = 10
+
+type TrapError struct {
+    Err error
+    /* the active functions, starting with the one where the error happened and ending with the function
+     * that was called from go
+     */
+    Frames []BacktraceFrame
+    /* the number of frames left out after the first backtraceHead frames */
+    Omitted int
+}
+
+func (trap *TrapError) Error() string {
+    return trap.Err.Error()
+}
+
+func (trap *TrapError) Unwrap() error {
+    return trap.Err
+}
+
+/* the frames of an error returned by a call, or nil if there are none. the frames of a deep backtrace
+ * are not all kept, see TrapError.Omitted
+ */
+func Backtrace(err error) []BacktraceFrame {
+    var trap *TrapError
+    if errors.As(err, &trap) {
+        return trap.Frames
+    }
+
+    return nil
+}
+
+/* the backtrace of an error as text, one frame per line with the innermost frame first */
+func FormatBacktrace(err error) string {
+    return FormatBacktraceWith(err, nil)
+}
+
+/* the backtrace of an error as text, where extra gives more lines to write after a frame. extra can be nil */
+func FormatBacktraceWith(err error, extra func(frame BacktraceFrame) string) string {
+    var trap *TrapError
+    if !errors.As(err, &trap) {
+        return ""
+    }
+
+    var out strings.Builder
+    depth := 0
+    for i, frame := range trap.Frames {
+        if i == backtraceHead && trap.Omitted > 0 {
+            out.WriteString(fmt.Sprintf("  ... %v frames omitted\n", trap.Omitted))
+            depth += trap.Omitted
+        }
+
+        out.WriteString(fmt.Sprintf("  #%v %v\n", depth, frame))
+        if extra != nil {
+            out.WriteString(extra(frame))
+        }
+        depth += 1
+    }
+
+    return out.String()
+}
+
+/* add the frame of a function to an error that is on its way out of the function */
+func addFrame(err error, function *compiledFunction, offset int) error {
+    trap, ok := err.(*TrapError)
+    if !ok {
+        trap = &TrapError{Err: err}
+    }
+
+    frame := BacktraceFrame{Function: function.index, Offset: offset, CodeOffset: -1}
+    if len(trap.Frames) < backtraceHead + backtraceTail {
+        trap.Frames = append(trap.Frames, frame)
+    } else {
+        /* the oldest frame of the tail is no longer one of the outermost frames */
+        copy(trap.Frames[backtraceHead:], trap.Frames[backtraceHead+1:])
+        trap.Frames[len(trap.Frames)-1] = frame
+        trap.Omitted += 1
+    }
+
+    return trap
+}
+
+/* give the frames of an error that leaves the code the names of their functions and the code offsets of
+ * their instructions
+ */
+func nameFrames(err error, module *core.WebAssemblyModule) {
+    trap, ok := err.(*TrapError)
+    if !ok || module == nil {
+        return
+    }
+
+    names := module.FunctionNames()
+    codeSection := module.GetCodeSection()
+    imported := module.GetImportFunctionCount()
+    for i := range trap.Frames {
+        frame := &trap.Frames[i]
+        if frame.Name == "" {
+            frame.Name = names[frame.Function]
+        }
+
+        defined := int(frame.Function) - imported
+        if frame.CodeOffset < 0 && codeSection != nil && defined >= 0 && defined < len(codeSection.Code) {
+            offsets := codeSection.Code[defined].Offsets
+            if frame.Offset >= 0 && frame.Offset < len(offsets) {
+                frame.CodeOffset = int64(offsets[frame.Offset])
+            }
+        }
+    }
+}
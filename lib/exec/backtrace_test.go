@@ -0,0 +1,133 @@
+package exec
+
+import (
+    "errors"
+    "fmt"
+    "strings"
+    "testing"
+
+    "github.com/kazzmir/webassembly/lib/core"
+)
+
+func TestBacktrace(test *testing.T){
+    module := makeModule(test, `(module
+        (import "env" "fail" (func $fail))
+        (func $divide (param i32 i32) (result i32)
+            (i32.div_s (local.get 0) (local.get 1)))
+        (func $middle (param i32) (result i32)
+            (i32.add (i32.const 1) (call $divide (i32.const 10) (local.get 0))))
+        (func (export "run") (param i32) (result i32)
+            (call $middle (local.get 0)))
+        (func (export "host")
+            (call $fail)))`)
+
+    failure := errors.New("host failure")
+    host := NewHostModule("env")
+    err := host.DefineFunc("fail", func() error {
+        return failure
+    })
+    if err != nil {
+        test.Fatalf("unable to add host function: %v", err)
+    }
+
+    instance, err := Compile(module).Instantiate(host)
+    if err != nil {
+        test.Fatalf("unable to instantiate: %v", err)
+    }
+
+    _, err = instance.Invoke("run", []RuntimeValue{ValueI32(0)})
+    if err == nil || err.Error() != "integer divide by zero" {
+        test.Fatalf("expected a trap but got %v", err)
+    }
+
+    /* the trap is in divide, which middle called from its 4th instruction */
+    expected := []BacktraceFrame{
+        {Function: 1, Name: "divide", Offset: 2, CodeOffset: -1},
+        {Function: 2, Name: "middle", Offset: 3, CodeOffset: -1},
+        {Function: 3, Name: "run", Offset: 1, CodeOffset: -1},
+    }
+
+    frames := Backtrace(err)
+    if fmt.Sprint(frames) != fmt.Sprint(expected) {
+        test.Fatalf("expected backtrace %v but got %v", expected, frames)
+    }
+
+    if FormatBacktrace(err) != "  #0 func 1 (divide) at instruction 2\n  #1 func 2 (middle) at instruction 3\n  #2 func 3 (run) at instruction 1\n" {
+        test.Fatalf("wrong backtrace text %q", FormatBacktrace(err))
+    }
+
+    /* errors from host functions keep their identity */
+    _, err = instance.Invoke("host", nil)
+    if !errors.Is(err, failure) {
+        test.Fatalf("expected the host failure but got %v", err)
+    }
+
+    frames = Backtrace(err)
+    if len(frames) != 2 || frames[0] != (BacktraceFrame{Function: 0, Name: "fail", Offset: -1, CodeOffset: -1}) || frames[1].Function != 4 {
+        test.Fatalf("wrong backtrace %v", frames)
+    }
+
+    /* an error that did not come from the code has no backtrace */
+    if Backtrace(failure) != nil || Backtrace(nil) != nil {
+        test.Fatalf("unexpected backtrace")
+    }
+}
+
+func TestBacktraceCodeOffset(test *testing.T){
+    module, err := core.ParseWasmFile("../../test-files/fail.wasm", false)
+    if err != nil {
+        test.Fatalf("unable to parse: %v", err)
+    }
+
+    _, err = Invoke(module, InitializeStore(module), "fail_me", nil)
+    if err == nil {
+        test.Fatalf("expected a trap")
+    }
+
+    /* the i32.div_s is the third instruction, at byte 11 of the code section */
+    frames := Backtrace(err)
+    if len(frames) != 1 || frames[0].Offset != 2 || frames[0].CodeOffset != 11 {
+        test.Fatalf("wrong backtrace %v", frames)
+    }
+
+    if frames[0].String() != "func 0 (fail_me) at instruction 2, code offset 0xb" {
+        test.Fatalf("wrong frame text %v", frames[0])
+    }
+}
+
+func TestBacktraceExhaustion(test *testing.T){
+    module := makeModule(test, `(module
+        (func $down (export "down") (param i32) (result i32)
+            (i32.add (i32.const 1) (call $down (local.get 0)))))`)
+
+    _, err := Invoke(module, InitializeStore(module), "down", []RuntimeValue{ValueI32(0)})
+    if !errors.Is(err, ErrCallStackExhausted) {
+        test.Fatalf("expected call stack exhausted but got %v", err)
+    }
+
+    /* only the innermost and the outermost frames are kept */
+    var trap *TrapError
+    if !errors.As(err, &trap) || len(trap.Frames) != backtraceHead + backtraceTail {
+        test.Fatalf("expected %v frames but got %v", backtraceHead + backtraceTail, len(Backtrace(err)))
+    }
+
+    if len(trap.Frames) + trap.Omitted < DefaultMaxCallDepth {
+        test.Fatalf("expected at least %v frames in all but got %v", DefaultMaxCallDepth, len(trap.Frames) + trap.Omitted)
+    }
+
+    text := FormatBacktrace(err)
+    lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+    if len(lines) != backtraceHead + backtraceTail + 1 {
+        test.Fatalf("expected %v lines but got %v", backtraceHead + backtraceTail + 1, len(lines))
+    }
+
+    if lines[backtraceHead] != fmt.Sprintf("  ... %v frames omitted", trap.Omitted) {
+        test.Fatalf("wrong omitted line %q", lines[backtraceHead])
+    }
+
+    /* the last frame keeps its depth in the whole backtrace */
+    last := fmt.Sprintf("  #%v func 0 (down) at instruction 2", len(trap.Frames) + trap.Omitted - 1)
+    if lines[len(lines)-1] != last {
+        test.Fatalf("expected %q but got %q", last, lines[len(lines)-1])
+    }
+}
@@ -0,0 +1,731 @@
+package exec
+
+/* lower the expression tree of a function into a flat list of instructions.
+ *
+ * structured control flow is resolved at compile time: every branch knows the index of the
+ * instruction it jumps to, the stack height of the block it leaves and how many values it carries
+ * along, so executing a branch is a copy of those values and a jump. blocks disappear entirely,
+ * an if becomes a conditional jump over the then-branch and a loop is just a jump target.
+ *
+ * the stack height is tracked statically while compiling, relative to the start of the function's
+ * frame, so the locals are at the bottom and the operands start right after them. after an unconditional branch the rest of the block is unreachable and the
+ * height is reset to the height of the enclosing block, that code is never executed so its
+ * height does not matter.
+ *
+ * BenchmarkLoop and BenchmarkFib measure the result. compared to walking the expression tree, the loop
+ * ran about 3.5 times as fast and fib about 2 times as fast. the untyped value stack later made calls
+ * cheaper, bringing fib to about 9 times as fast.
+ */
+
+import (
+    "fmt"
+    "reflect"
+
+    "github.com/kazzmir/webassembly/lib/core"
+)
+
+type opcode uint16
+
+const (
+    opUnreachable opcode = iota
+    opBranch
+    opBranchIf
+    opBranchTable
+    /* jumps stay within a block so they never adjust the stack */
+    opJump
+    opJumpIfZero
+    opReturn
+    opCall
+    opCallIndirect
+    opDrop
+    opSelect
+
+    opLocalGet
+    opLocalSet
+    opLocalTee
+    opGlobalGet
+    opGlobalSet
+
+    opI32Const
+    opI64Const
+    opF32Const
+    opF64Const
+    opRefNull
+    opRefFunc
+    opRefExtern
+
+    opMemoryGrow
+    opI32Load
+    opI64Load
+    opF32Load
+    opF64Load
+    opI32Load8s
+    opI32Load8u
+    opI32Load16s
+    opI32Load16u
+    opI64Load8s
+    opI64Load8u
+    opI64Load16s
+    opI64Load16u
+    opI64Load32s
+    opI64Load32u
+    opI32Store
+    opI64Store
+    opF32Store
+    opF64Store
+    opI32Store8
+    opI32Store16
+    opI64Store8
+    opI64Store16
+    opI64Store32
+
+    opI32Eqz
+    opI32Eq
+    opI32Ne
+    opI32Lts
+    opI32Ltu
+    opI32Gts
+    opI32Gtu
+    opI32Les
+    opI32Leu
+    opI32Ges
+    opI32Geu
+    opI64Eqz
+    opI64Eq
+    opI64Ne
+    opI64Lts
+    opI64Ltu
+    opI64Gts
+    opI64Gtu
+    opI64Les
+    opI64Leu
+    opI64Ges
+    opI64Geu
+    opF32Eq
+    opF32Ne
+    opF32Lt
+    opF32Gt
+    opF32Le
+    opF32Ge
+    opF64Eq
+    opF64Ne
+    opF64Lt
+    opF64Gt
+    opF64Le
+    opF64Ge
+
+    opI32Clz
+    opI32Ctz
+    opI32Popcnt
+    opI32Add
+    opI32Sub
+    opI32Mul
+    opI32Divs
+    opI32Divu
+    opI32Rems
+    opI32Remu
+    opI32And
+    opI32Or
+    opI32Xor
+    opI32Shl
+    opI32Shrs
+    opI32Shru
+    opI32Rotl
+    opI32Rotr
+    opI64Ctz
+    opI64Add
+    opI64Sub
+    opI64Mul
+    opI64Divs
+    opI64Divu
+    opI64Rems
+    opI64Remu
+    opI64And
+    opI64Or
+    opI64Xor
+    opI64Shl
+    opI64Shrs
+    opI64Shru
+
+    opF32Neg
+    opF32Sqrt
+    opF32Add
+    opF32Sub
+    opF32Mul
+    opF32Div
+    opF32Min
+    opF32Max
+    opF32CopySign
+    opF64Neg
+    opF64Add
+    opF64Sub
+    opF64Mul
+    opF64Div
+    opF64Min
+    opF64Max
+    opF64CopySign
+
+    opI32WrapI64
+    opI32Extend8s
+    opI32Extend16s
+    opI64ExtendI32s
+    opI64ExtendI32u
+    opI64TruncF64s
+    opF64ConvertI32s
+    opF64ConvertI32u
+    opF64ConvertI64u
+    opF64PromoteF32
+    opI32ReinterpretF32
+    opI64ReinterpretF64
+    opF32ReinterpretI32
+    opF64ReinterpretI64
+)
+
+/* where a branch continues and what it does to the stack. the values on top of the stack
+ * are moved down to 'height' and everything above them is discarded
+ */
+type branchTarget struct {
+    pc int
+    height int
+    keep int
+}
+
+type instruction struct {
+    op opcode
+    /* local, global, function, table or type index */
+    index uint32
+    /* the bits of a constant, or the offset of a memory access */
+    value uint64
+    branch branchTarget
+    /* br_table, the last entry is the default */
+    table []branchTarget
+    /* fuel used when the instruction is executed */
+    cost uint64
+    /* the instruction of the function body that this was compiled from, see FunctionInstructions */
+    offset int
+    /* the number of values the instruction takes from the stack and leaves on it */
+    pops int
+    pushes int
+}
+
+type compiledFunction struct {
+    code []instruction
+    /* the types of all locals, starting with the parameters */
+    locals []core.ValueType
+    /* the values of the declared locals when the function is entered */
+    initial []uint64
+    parameters int
+    results []core.ValueType
+    /* the largest stack height seen while compiling, including the locals */
+    maxHeight int
+    /* set for an imported function that is implemented by the host instead of code */
+    host func(store *Store, args []RuntimeValue) ([]RuntimeValue, error)
+    /* the index of the function in the function index space of its module */
+    index uint32
+}
+
+/* a branch whose target is not known until the end of its block is seen. entry is the index
+ * into the br_table, or -1 for the branch of the instruction itself
+ */
+type fixup struct {
+    instruction int
+    entry int
+}
+
+type label struct {
+    loop bool
+    /* first instruction of a loop */
+    start int
+    /* stack height when the block was entered */
+    height int
+    /* number of values carried by a branch to this label */
+    arity int
+    /* number of values left on the stack when the block ends */
+    results int
+    fixups []fixup
+}
+
+type compiler struct {
+    module *core.WebAssemblyModule
+    code []instruction
+    labels []*label
+    height int
+    maxHeight int
+    /* prices each expression, nil means every instruction costs 1 */
+    fuelCost func(core.Expression) uint64
+    /* the cost of the instructions emitted for the current expression */
+    cost uint64
+    /* the offset of the current expression, and of the expression after it */
+    offset int
+    next int
+}
+
+func (compiler *compiler) push(count int){
+    compiler.height += count
+    if compiler.height > compiler.maxHeight {
+        compiler.maxHeight = compiler.height
+    }
+}
+
+/* popping below the height of the current block can only happen in unreachable code */
+func (compiler *compiler) pop(count int){
+    compiler.height -= count
+    if len(compiler.labels) > 0 {
+        base := compiler.labels[len(compiler.labels)-1].height
+        if compiler.height < base {
+            compiler.height = base
+        }
+    }
+}
+
+/* add an instruction that pops 'pops' values and pushes 'pushes' values */
+func (compiler *compiler) emit(value instruction, pops int, pushes int) int {
+    compiler.pop(pops)
+    compiler.push(pushes)
+    value.cost = compiler.cost
+    value.offset = compiler.offset
+    value.pops = pops
+    value.pushes = pushes
+    compiler.code = append(compiler.code, value)
+    return len(compiler.code) - 1
+}
+
+/* the rest of the current block cannot be reached */
+func (compiler *compiler) unreachable(){
+    if len(compiler.labels) > 0 {
+        compiler.height = compiler.labels[len(compiler.labels)-1].height
+    }
+}
+
+/* the target of a branch to the label at 'depth', the instruction at 'index' is patched once the
+ * end of the block is known
+ */
+func (compiler *compiler) target(depth uint32, index int, entry int) (branchTarget, error) {
+    if int(depth) >= len(compiler.labels) {
+        return branchTarget{}, fmt.Errorf("invalid branch depth %v", depth)
+    }
+
+    label := compiler.labels[len(compiler.labels) - 1 - int(depth)]
+    if label.loop {
+        return branchTarget{pc: label.start, height: label.height, keep: label.arity}, nil
+    }
+
+    label.fixups = append(label.fixups, fixup{instruction: index, entry: entry})
+    return branchTarget{pc: -1, height: label.height, keep: label.arity}, nil
+}
+
+/* resolve all branches to the label that just ended */
+func (compiler *compiler) patch(label *label){
+    end := len(compiler.code)
+    for _, fix := range label.fixups {
+        if fix.entry == -1 {
+            compiler.code[fix.instruction].branch.pc = end
+        } else {
+            compiler.code[fix.instruction].table[fix.entry].pc = end
+        }
+    }
+}
+
+func (compiler *compiler) functionType(index uint32) (core.WebAssemblyFunction, error) {
+    if compiler.module == nil {
+        return core.WebAssemblyFunction{}, fmt.Errorf("no module to call function %v", index)
+    }
+
+    typeIndex := compiler.module.GetFunctionTypeIndex(index)
+    if typeIndex == nil {
+        return core.WebAssemblyFunction{}, fmt.Errorf("invalid function index %v", index)
+    }
+
+    return compiler.module.GetTypeSection().GetFunction(typeIndex.Id), nil
+}
+
+func (compiler *compiler) compileBlock(block *core.BlockExpression) error {
+    results := len(block.ExpectedType)
+    /* the block's parameters are already on the stack, and belong to the block rather than the enclosing code */
+    parameters := len(block.ParameterTypes)
+    offset := compiler.offset
+
+    if block.Kind == core.BlockKindIf {
+        compiler.pop(1)
+        jump := compiler.emit(instruction{op: opJumpIfZero}, 0, 0)
+
+        scope := &label{height: compiler.height - parameters, arity: results, results: results}
+        compiler.labels = append(compiler.labels, scope)
+
+        err := compiler.compileSequence(block.Instructions)
+        if err != nil {
+            return err
+        }
+
+        if len(block.ElseInstructions) > 0 {
+            /* the end of the then-branch skips over the else-branch, which is not an instruction of its own */
+            compiler.cost = 0
+            compiler.offset = offset
+            skip := compiler.emit(instruction{op: opJump}, 0, 0)
+            scope.fixups = append(scope.fixups, fixup{instruction: skip, entry: -1})
+
+            compiler.code[jump].branch.pc = len(compiler.code)
+            compiler.height = scope.height + parameters
+
+            err = compiler.compileSequence(block.ElseInstructions)
+            if err != nil {
+                return err
+            }
+        } else {
+            scope.fixups = append(scope.fixups, fixup{instruction: jump, entry: -1})
+        }
+
+        compiler.labels = compiler.labels[:len(compiler.labels)-1]
+        compiler.patch(scope)
+        compiler.height = scope.height + results
+        return nil
+    }
+
+    scope := &label{
+        loop: block.Kind == core.BlockKindLoop,
+        start: len(compiler.code),
+        height: compiler.height - parameters,
+        arity: results,
+        results: results,
+    }
+
+    /* a branch to a loop starts the loop over, which takes the loop's parameters */
+    if scope.loop {
+        scope.arity = parameters
+    }
+
+    compiler.labels = append(compiler.labels, scope)
+    err := compiler.compileSequence(block.Instructions)
+    if err != nil {
+        return err
+    }
+    compiler.labels = compiler.labels[:len(compiler.labels)-1]
+
+    compiler.patch(scope)
+    compiler.height = scope.height + results
+    return nil
+}
+
+func (compiler *compiler) compileSequence(expressions []core.Expression) error {
+    for _, expression := range expressions {
+        err := compiler.compileExpression(expression)
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+func (compiler *compiler) compileExpression(current core.Expression) error {
+    compiler.offset = compiler.next
+    compiler.next += 1
+    compiler.cost = 1
+    if compiler.fuelCost != nil {
+        compiler.cost = compiler.fuelCost(current)
+    }
+
+    switch current.(type) {
+        case *core.BlockExpression:
+            return compiler.compileBlock(current.(*core.BlockExpression))
+
+        case *core.UnreachableExpression:
+            compiler.emit(instruction{op: opUnreachable}, 0, 0)
+            compiler.unreachable()
+        case *core.BranchExpression:
+            expr := current.(*core.BranchExpression)
+            index := len(compiler.code)
+            target, err := compiler.target(expr.Label, index, -1)
+            if err != nil {
+                return err
+            }
+            compiler.emit(instruction{op: opBranch, branch: target}, 0, 0)
+            compiler.unreachable()
+        case *core.BranchIfExpression:
+            expr := current.(*core.BranchIfExpression)
+            index := len(compiler.code)
+            target, err := compiler.target(expr.Label, index, -1)
+            if err != nil {
+                return err
+            }
+            compiler.emit(instruction{op: opBranchIf, branch: target}, 1, 0)
+        case *core.BranchTableExpression:
+            expr := current.(*core.BranchTableExpression)
+            if len(expr.Labels) == 0 {
+                return fmt.Errorf("br_table had no labels")
+            }
+
+            index := len(compiler.code)
+            table := make([]branchTarget, len(expr.Labels))
+            /* the instruction has to exist before its table entries can be patched */
+            compiler.emit(instruction{op: opBranchTable, table: table}, 1, 0)
+            for i, depth := range expr.Labels {
+                target, err := compiler.target(depth, index, i)
+                if err != nil {
+                    return err
+                }
+                table[i] = target
+            }
+            compiler.unreachable()
+        case *core.ReturnExpression:
+            compiler.emit(instruction{op: opReturn}, 0, 0)
+            compiler.unreachable()
+
+        case *core.CallExpression:
+            expr := current.(*core.CallExpression)
+            functionType, err := compiler.functionType(expr.Index.Id)
+            if err != nil {
+                return err
+            }
+            compiler.emit(instruction{op: opCall, index: expr.Index.Id}, len(functionType.InputTypes), len(functionType.OutputTypes))
+        case *core.CallIndirectExpression:
+            expr := current.(*core.CallIndirectExpression)
+            if compiler.module == nil {
+                return fmt.Errorf("no module for call_indirect")
+            }
+            functionType := compiler.module.GetTypeSection().GetFunction(expr.Index.Id)
+            compiler.emit(instruction{op: opCallIndirect, index: expr.Table.Id, value: uint64(expr.Index.Id)}, len(functionType.InputTypes) + 1, len(functionType.OutputTypes))
+
+        case *core.DropExpression: compiler.emit(instruction{op: opDrop}, 1, 0)
+        case *core.SelectExpression: compiler.emit(instruction{op: opSelect}, 3, 1)
+
+        case *core.LocalGetExpression:
+            compiler.emit(instruction{op: opLocalGet, index: current.(*core.LocalGetExpression).Local}, 0, 1)
+        case *core.LocalSetExpression:
+            compiler.emit(instruction{op: opLocalSet, index: current.(*core.LocalSetExpression).Local}, 1, 0)
+        case *core.LocalTeeExpression:
+            compiler.emit(instruction{op: opLocalTee, index: current.(*core.LocalTeeExpression).Local}, 1, 1)
+        case *core.GlobalGetExpression:
+            compiler.emit(instruction{op: opGlobalGet, index: current.(*core.GlobalGetExpression).Global.Id}, 0, 1)
+        case *core.GlobalSetExpression:
+            compiler.emit(instruction{op: opGlobalSet, index: current.(*core.GlobalSetExpression).Global.Id}, 1, 0)
+
+        case *core.I32ConstExpression:
+            compiler.emit(instruction{op: opI32Const, value: uint64(uint32(current.(*core.I32ConstExpression).N))}, 0, 1)
+        case *core.I64ConstExpression:
+            compiler.emit(instruction{op: opI64Const, value: uint64(current.(*core.I64ConstExpression).N)}, 0, 1)
+        case *core.F32ConstExpression:
+            compiler.emit(instruction{op: opF32Const, value: fromF32(current.(*core.F32ConstExpression).N)}, 0, 1)
+        case *core.F64ConstExpression:
+            compiler.emit(instruction{op: opF64Const, value: fromF64(current.(*core.F64ConstExpression).N)}, 0, 1)
+        case *core.RefFuncNullExpression, *core.RefExternNullExpression:
+            compiler.emit(instruction{op: opRefNull}, 0, 1)
+        case *core.RefFuncExpression:
+            compiler.emit(instruction{op: opRefFunc, index: current.(*core.RefFuncExpression).Function.Id}, 0, 1)
+        case *core.RefExternExpression:
+            compiler.emit(instruction{op: opRefExtern, index: current.(*core.RefExternExpression).Id}, 0, 1)
+
+        case *core.MemoryGrowExpression: compiler.emit(instruction{op: opMemoryGrow}, 1, 1)
+        case *core.I32LoadExpression:
+            compiler.emit(instruction{op: opI32Load, value: uint64(current.(*core.I32LoadExpression).Memory.Offset)}, 1, 1)
+        case *core.I64LoadExpression:
+            compiler.emit(instruction{op: opI64Load, value: uint64(current.(*core.I64LoadExpression).Memory.Offset)}, 1, 1)
+        case *core.F32LoadExpression:
+            compiler.emit(instruction{op: opF32Load, value: uint64(current.(*core.F32LoadExpression).Memory.Offset)}, 1, 1)
+        case *core.F64LoadExpression:
+            compiler.emit(instruction{op: opF64Load, value: uint64(current.(*core.F64LoadExpression).Memory.Offset)}, 1, 1)
+        case *core.I32Load8sExpression:
+            compiler.emit(instruction{op: opI32Load8s, value: uint64(current.(*core.I32Load8sExpression).Memory.Offset)}, 1, 1)
+        case *core.I32Load8uExpression:
+            compiler.emit(instruction{op: opI32Load8u, value: uint64(current.(*core.I32Load8uExpression).Memory.Offset)}, 1, 1)
+        case *core.I32Load16sExpression:
+            compiler.emit(instruction{op: opI32Load16s, value: uint64(current.(*core.I32Load16sExpression).Memory.Offset)}, 1, 1)
+        case *core.I32Load16uExpression:
+            compiler.emit(instruction{op: opI32Load16u, value: uint64(current.(*core.I32Load16uExpression).Memory.Offset)}, 1, 1)
+        case *core.I64Load8sExpression:
+            compiler.emit(instruction{op: opI64Load8s, value: uint64(current.(*core.I64Load8sExpression).Memory.Offset)}, 1, 1)
+        case *core.I64Load8uExpression:
+            compiler.emit(instruction{op: opI64Load8u, value: uint64(current.(*core.I64Load8uExpression).Memory.Offset)}, 1, 1)
+        case *core.I64Load16sExpression:
+            compiler.emit(instruction{op: opI64Load16s, value: uint64(current.(*core.I64Load16sExpression).Memory.Offset)}, 1, 1)
+        case *core.I64Load16uExpression:
+            compiler.emit(instruction{op: opI64Load16u, value: uint64(current.(*core.I64Load16uExpression).Memory.Offset)}, 1, 1)
+        case *core.I64Load32sExpression:
+            compiler.emit(instruction{op: opI64Load32s, value: uint64(current.(*core.I64Load32sExpression).Memory.Offset)}, 1, 1)
+        case *core.I64Load32uExpression:
+            compiler.emit(instruction{op: opI64Load32u, value: uint64(current.(*core.I64Load32uExpression).Memory.Offset)}, 1, 1)
+        case *core.I32StoreExpression:
+            compiler.emit(instruction{op: opI32Store, value: uint64(current.(*core.I32StoreExpression).Memory.Offset)}, 2, 0)
+        case *core.I64StoreExpression:
+            compiler.emit(instruction{op: opI64Store, value: uint64(current.(*core.I64StoreExpression).Memory.Offset)}, 2, 0)
+        case *core.F32StoreExpression:
+            compiler.emit(instruction{op: opF32Store, value: uint64(current.(*core.F32StoreExpression).Memory.Offset)}, 2, 0)
+        case *core.F64StoreExpression:
+            compiler.emit(instruction{op: opF64Store, value: uint64(current.(*core.F64StoreExpression).Memory.Offset)}, 2, 0)
+        case *core.I32Store8Expression:
+            compiler.emit(instruction{op: opI32Store8, value: uint64(current.(*core.I32Store8Expression).Memory.Offset)}, 2, 0)
+        case *core.I32Store16Expression:
+            compiler.emit(instruction{op: opI32Store16, value: uint64(current.(*core.I32Store16Expression).Memory.Offset)}, 2, 0)
+        case *core.I64Store8Expression:
+            compiler.emit(instruction{op: opI64Store8, value: uint64(current.(*core.I64Store8Expression).Memory.Offset)}, 2, 0)
+        case *core.I64Store16Expression:
+            compiler.emit(instruction{op: opI64Store16, value: uint64(current.(*core.I64Store16Expression).Memory.Offset)}, 2, 0)
+        case *core.I64Store32Expression:
+            compiler.emit(instruction{op: opI64Store32, value: uint64(current.(*core.I64Store32Expression).Memory.Offset)}, 2, 0)
+
+        case *core.I32EqzExpression: compiler.emit(instruction{op: opI32Eqz}, 1, 1)
+        case *core.I32EqExpression: compiler.emit(instruction{op: opI32Eq}, 2, 1)
+        case *core.I32NeExpression: compiler.emit(instruction{op: opI32Ne}, 2, 1)
+        case *core.I32LtsExpression: compiler.emit(instruction{op: opI32Lts}, 2, 1)
+        case *core.I32LtuExpression: compiler.emit(instruction{op: opI32Ltu}, 2, 1)
+        case *core.I32GtsExpression: compiler.emit(instruction{op: opI32Gts}, 2, 1)
+        case *core.I32GtuExpression: compiler.emit(instruction{op: opI32Gtu}, 2, 1)
+        case *core.I32LesExpression: compiler.emit(instruction{op: opI32Les}, 2, 1)
+        case *core.I32LeuExpression: compiler.emit(instruction{op: opI32Leu}, 2, 1)
+        case *core.I32GesExpression: compiler.emit(instruction{op: opI32Ges}, 2, 1)
+        case *core.I32GeuExpression: compiler.emit(instruction{op: opI32Geu}, 2, 1)
+        case *core.I64EqzExpression: compiler.emit(instruction{op: opI64Eqz}, 1, 1)
+        case *core.I64EqExpression: compiler.emit(instruction{op: opI64Eq}, 2, 1)
+        case *core.I64NeExpression: compiler.emit(instruction{op: opI64Ne}, 2, 1)
+        case *core.I64LtsExpression: compiler.emit(instruction{op: opI64Lts}, 2, 1)
+        case *core.I64LtuExpression: compiler.emit(instruction{op: opI64Ltu}, 2, 1)
+        case *core.I64GtsExpression: compiler.emit(instruction{op: opI64Gts}, 2, 1)
+        case *core.I64GtuExpression: compiler.emit(instruction{op: opI64Gtu}, 2, 1)
+        case *core.I64LesExpression: compiler.emit(instruction{op: opI64Les}, 2, 1)
+        case *core.I64LeuExpression: compiler.emit(instruction{op: opI64Leu}, 2, 1)
+        case *core.I64GesExpression: compiler.emit(instruction{op: opI64Ges}, 2, 1)
+        case *core.I64GeuExpression: compiler.emit(instruction{op: opI64Geu}, 2, 1)
+        case *core.F32EqExpression: compiler.emit(instruction{op: opF32Eq}, 2, 1)
+        case *core.F32NeExpression: compiler.emit(instruction{op: opF32Ne}, 2, 1)
+        case *core.F32LtExpression: compiler.emit(instruction{op: opF32Lt}, 2, 1)
+        case *core.F32GtExpression: compiler.emit(instruction{op: opF32Gt}, 2, 1)
+        case *core.F32LeExpression: compiler.emit(instruction{op: opF32Le}, 2, 1)
+        case *core.F32GeExpression: compiler.emit(instruction{op: opF32Ge}, 2, 1)
+        case *core.F64EqExpression: compiler.emit(instruction{op: opF64Eq}, 2, 1)
+        case *core.F64NeExpression: compiler.emit(instruction{op: opF64Ne}, 2, 1)
+        case *core.F64LtExpression: compiler.emit(instruction{op: opF64Lt}, 2, 1)
+        case *core.F64GtExpression: compiler.emit(instruction{op: opF64Gt}, 2, 1)
+        case *core.F64LeExpression: compiler.emit(instruction{op: opF64Le}, 2, 1)
+        case *core.F64GeExpression: compiler.emit(instruction{op: opF64Ge}, 2, 1)
+
+        case *core.I32ClzExpression: compiler.emit(instruction{op: opI32Clz}, 1, 1)
+        case *core.I32CtzExpression: compiler.emit(instruction{op: opI32Ctz}, 1, 1)
+        case *core.I32PopcntExpression: compiler.emit(instruction{op: opI32Popcnt}, 1, 1)
+        case *core.I32AddExpression: compiler.emit(instruction{op: opI32Add}, 2, 1)
+        case *core.I32SubExpression: compiler.emit(instruction{op: opI32Sub}, 2, 1)
+        case *core.I32MulExpression: compiler.emit(instruction{op: opI32Mul}, 2, 1)
+        case *core.I32DivsExpression, *core.I32DivSignedExpression: compiler.emit(instruction{op: opI32Divs}, 2, 1)
+        case *core.I32DivuExpression: compiler.emit(instruction{op: opI32Divu}, 2, 1)
+        case *core.I32RemsExpression: compiler.emit(instruction{op: opI32Rems}, 2, 1)
+        case *core.I32RemuExpression: compiler.emit(instruction{op: opI32Remu}, 2, 1)
+        case *core.I32AndExpression: compiler.emit(instruction{op: opI32And}, 2, 1)
+        case *core.I32OrExpression: compiler.emit(instruction{op: opI32Or}, 2, 1)
+        case *core.I32XOrExpression: compiler.emit(instruction{op: opI32Xor}, 2, 1)
+        case *core.I32ShlExpression, *core.I32ShlsExpression, *core.I32ShluExpression: compiler.emit(instruction{op: opI32Shl}, 2, 1)
+        case *core.I32ShrsExpression: compiler.emit(instruction{op: opI32Shrs}, 2, 1)
+        case *core.I32ShruExpression: compiler.emit(instruction{op: opI32Shru}, 2, 1)
+        case *core.I32RotlExpression: compiler.emit(instruction{op: opI32Rotl}, 2, 1)
+        case *core.I32RotrExpression: compiler.emit(instruction{op: opI32Rotr}, 2, 1)
+        case *core.I64CtzExpression: compiler.emit(instruction{op: opI64Ctz}, 1, 1)
+        case *core.I64AddExpression: compiler.emit(instruction{op: opI64Add}, 2, 1)
+        case *core.I64SubExpression: compiler.emit(instruction{op: opI64Sub}, 2, 1)
+        case *core.I64MulExpression: compiler.emit(instruction{op: opI64Mul}, 2, 1)
+        case *core.I64DivsExpression: compiler.emit(instruction{op: opI64Divs}, 2, 1)
+        case *core.I64DivuExpression: compiler.emit(instruction{op: opI64Divu}, 2, 1)
+        case *core.I64RemsExpression: compiler.emit(instruction{op: opI64Rems}, 2, 1)
+        case *core.I64RemuExpression: compiler.emit(instruction{op: opI64Remu}, 2, 1)
+        case *core.I64AndExpression: compiler.emit(instruction{op: opI64And}, 2, 1)
+        case *core.I64OrExpression: compiler.emit(instruction{op: opI64Or}, 2, 1)
+        case *core.I64XOrExpression: compiler.emit(instruction{op: opI64Xor}, 2, 1)
+        case *core.I64ShlExpression: compiler.emit(instruction{op: opI64Shl}, 2, 1)
+        case *core.I64ShrsExpression: compiler.emit(instruction{op: opI64Shrs}, 2, 1)
+        case *core.I64ShruExpression: compiler.emit(instruction{op: opI64Shru}, 2, 1)
+
+        case *core.F32NegExpression: compiler.emit(instruction{op: opF32Neg}, 1, 1)
+        case *core.F32SqrtExpression: compiler.emit(instruction{op: opF32Sqrt}, 1, 1)
+        case *core.F32AddExpression: compiler.emit(instruction{op: opF32Add}, 2, 1)
+        case *core.F32SubExpression: compiler.emit(instruction{op: opF32Sub}, 2, 1)
+        case *core.F32MulExpression: compiler.emit(instruction{op: opF32Mul}, 2, 1)
+        case *core.F32DivExpression: compiler.emit(instruction{op: opF32Div}, 2, 1)
+        case *core.F32MinExpression: compiler.emit(instruction{op: opF32Min}, 2, 1)
+        case *core.F32MaxExpression: compiler.emit(instruction{op: opF32Max}, 2, 1)
+        case *core.F32CopySignExpression: compiler.emit(instruction{op: opF32CopySign}, 2, 1)
+        case *core.F64NegExpression: compiler.emit(instruction{op: opF64Neg}, 1, 1)
+        case *core.F64AddExpression: compiler.emit(instruction{op: opF64Add}, 2, 1)
+        case *core.F64SubExpression: compiler.emit(instruction{op: opF64Sub}, 2, 1)
+        case *core.F64MulExpression: compiler.emit(instruction{op: opF64Mul}, 2, 1)
+        case *core.F64DivExpression: compiler.emit(instruction{op: opF64Div}, 2, 1)
+        case *core.F64MinExpression: compiler.emit(instruction{op: opF64Min}, 2, 1)
+        case *core.F64MaxExpression: compiler.emit(instruction{op: opF64Max}, 2, 1)
+        case *core.F64CopySignExpression: compiler.emit(instruction{op: opF64CopySign}, 2, 1)
+
+        case *core.I32WrapI64Expression: compiler.emit(instruction{op: opI32WrapI64}, 1, 1)
+        case *core.I32Extend8sExpression: compiler.emit(instruction{op: opI32Extend8s}, 1, 1)
+        case *core.I32Extend16sExpression: compiler.emit(instruction{op: opI32Extend16s}, 1, 1)
+        case *core.I64ExtendI32sExpression: compiler.emit(instruction{op: opI64ExtendI32s}, 1, 1)
+        case *core.I64ExtendI32uExpression: compiler.emit(instruction{op: opI64ExtendI32u}, 1, 1)
+        case *core.I64TruncF64sExpression: compiler.emit(instruction{op: opI64TruncF64s}, 1, 1)
+        case *core.F64ConvertI32sExpression: compiler.emit(instruction{op: opF64ConvertI32s}, 1, 1)
+        case *core.F64ConvertI32uExpression: compiler.emit(instruction{op: opF64ConvertI32u}, 1, 1)
+        case *core.F64ConvertI64uExpression: compiler.emit(instruction{op: opF64ConvertI64u}, 1, 1)
+        case *core.F64PromoteF32Expression: compiler.emit(instruction{op: opF64PromoteF32}, 1, 1)
+        case *core.I32ReinterpretF32Expression: compiler.emit(instruction{op: opI32ReinterpretF32}, 1, 1)
+        case *core.I64ReinterpretF64Expression: compiler.emit(instruction{op: opI64ReinterpretF64}, 1, 1)
+        case *core.F32ReinterpretI32Expression: compiler.emit(instruction{op: opF32ReinterpretI32}, 1, 1)
+        case *core.F64ReinterpretI64Expression: compiler.emit(instruction{op: opF64ReinterpretI64}, 1, 1)
+
+        default:
+            return fmt.Errorf("unhandled instruction %v %+v", reflect.TypeOf(current), current)
+    }
+
+    return nil
+}
+
+/* compile a function body. the body behaves like a block whose label is the end of the function,
+ * so branching to it returns from the function
+ */
+func compile(module *core.WebAssemblyModule, code core.Code, functionType core.WebAssemblyFunction, fuelCost func(core.Expression) uint64) (*compiledFunction, error) {
+    out := compiledFunction{
+        parameters: len(functionType.InputTypes),
+        results: functionType.OutputTypes,
+    }
+
+    for _, input := range functionType.InputTypes {
+        out.locals = append(out.locals, input.Type)
+    }
+
+    for _, local := range code.DeclaredLocals() {
+        for i := uint32(0); i < local.Count; i++ {
+            out.locals = append(out.locals, local.Type)
+            out.initial = append(out.initial, zero(local.Type))
+        }
+    }
+
+    compiler := compiler{module: module, height: len(out.locals), maxHeight: len(out.locals), fuelCost: fuelCost}
+
+    results := len(out.results)
+    function := &label{height: compiler.height, arity: results, results: results}
+    compiler.labels = append(compiler.labels, function)
+
+    err := compiler.compileSequence(code.Expressions)
+    if err != nil {
+        return nil, err
+    }
+
+    compiler.labels = nil
+    compiler.patch(function)
+    /* reaching the end of the function is free, an explicit return is not. the offset of the end is one
+     * past the last instruction
+     */
+    compiler.cost = 0
+    compiler.offset = compiler.next
+    compiler.emit(instruction{op: opReturn}, 0, 0)
+
+    out.code = compiler.code
+    out.maxHeight = compiler.maxHeight
+    return &out, nil
+}
+
+/* compile a constant expression or a single instruction that is not part of any function */
+func compileExpressions(module *core.WebAssemblyModule, expressions []core.Expression, results []core.ValueType) (*compiledFunction, error) {
+    return compile(module, core.Code{Expressions: expressions}, core.WebAssemblyFunction{OutputTypes: results}, nil)
+}
+
+/* the stack slot of a local that has not been set yet */
+func zero(kind core.ValueType) uint64 {
+    switch kind {
+        case core.ValueTypeRefFunc, core.ValueTypeRefExtern: return RuntimeValueRefNull
+    }
+
+    return 0
+}
@@ -0,0 +1,120 @@
+package exec
+
+import (
+    "testing"
+
+    "github.com/kazzmir/webassembly/lib/core"
+    "github.com/kazzmir/webassembly/lib/data"
+    "github.com/kazzmir/webassembly/lib/sexp"
+)
+
+func TestBranches(test *testing.T){
+    /* a branch out of a block keeps only the block's results */
+    value := evaluate(test, core.ValueTypeI32, "(block (result i32) (i32.const 1) (i32.const 2) (br 0 (i32.const 7)) (i32.const 3))")
+    if value.I32 != 7 {
+        test.Fatalf("expected 7 but got %v", value)
+    }
+
+    value = evaluate(test, core.ValueTypeI32, "(block (result i32) (block (result i32) (br_table 0 1 (i32.const 4) (i32.const 1))) (i32.const 10) (i32.add))")
+    if value.I32 != 4 {
+        test.Fatalf("expected 4 but got %v", value)
+    }
+
+    value = evaluate(test, core.ValueTypeI32, "(block (result i32) (block (result i32) (br_table 0 1 (i32.const 4) (i32.const 0))) (i32.const 10) (i32.add))")
+    if value.I32 != 14 {
+        test.Fatalf("expected 14 but got %v", value)
+    }
+
+    value = evaluate(test, core.ValueTypeI32, "(if (result i32) (i32.const 0) (then (i32.const 1)) (else (i32.const 2)))")
+    if value.I32 != 2 {
+        test.Fatalf("expected 2 but got %v", value)
+    }
+
+    /* block parameters are consumed by the block */
+    value = evaluate(test, core.ValueTypeI32, "(block (result i32) (i32.const 3) (block (param i32) (result i32) (i32.const 4) (i32.mul)))")
+    if value.I32 != 12 {
+        test.Fatalf("expected 12 but got %v", value)
+    }
+}
+
+func TestBranchTargets(test *testing.T){
+    text := "(block (block (br_if 1 (i32.const 1))) (nop))"
+    expr, err := sexp.ParseSExpression(text)
+    if err != nil {
+        test.Fatalf("unable to parse %v: %v", text, err)
+    }
+
+    expressions := core.MakeExpressions(core.WebAssemblyModule{}, nil, data.Stack[string]{}, &expr)
+    function, err := compileExpressions(nil, expressions, nil)
+    if err != nil {
+        test.Fatalf("unable to compile %v: %v", text, err)
+    }
+
+    /* the branch jumps past the end of the outer block, which is where the function returns */
+    for _, instruction := range function.code {
+        if instruction.op == opBranchIf {
+            last := len(function.code) - 1
+            if function.code[last].op != opReturn || instruction.branch.pc != last {
+                test.Fatalf("expected branch to %v but it goes to %v", last, instruction.branch.pc)
+            }
+            return
+        }
+    }
+
+    test.Fatalf("no br_if in the compiled code")
+}
+
+/* a loop that runs many instructions in one call, with the profiler on if it is not nil */
+func benchmarkLoop(benchmark *testing.B, profiler *Profiler){
+    module := makeModule(benchmark, `(module
+        (func (export "loop") (param $n i32) (result i32)
+            (local $sum i32)
+            (block $done
+                (loop $next
+                    (br_if $done (i32.eqz (local.get $n)))
+                    (local.set $sum (i32.add (local.get $sum) (local.get $n)))
+                    (local.set $n (i32.sub (local.get $n) (i32.const 1)))
+                    (br $next)))
+            (local.get $sum)))`)
+
+    store := InitializeStore(module)
+    store.Profiler = profiler
+    args := []RuntimeValue{ValueI32(100000)}
+    benchmark.ResetTimer()
+    for i := 0; i < benchmark.N; i++ {
+        _, err := Invoke(module, store, "loop", args)
+        if err != nil {
+            benchmark.Fatalf("unable to invoke loop: %v", err)
+        }
+    }
+}
+
+/* the debugger, tracer and profiler are off, so this is the cost of checking for them */
+func BenchmarkLoop(benchmark *testing.B){
+    benchmarkLoop(benchmark, nil)
+}
+
+/* every instruction goes through the hooks */
+func BenchmarkLoopProfiled(benchmark *testing.B){
+    benchmarkLoop(benchmark, NewProfiler())
+}
+
+/* many small recursive calls */
+func BenchmarkFib(benchmark *testing.B){
+    module := makeModule(benchmark, `(module
+        (func $fib (export "fib") (param $n i32) (result i32)
+            (if (result i32) (i32.lt_s (local.get $n) (i32.const 2))
+                (then (local.get $n))
+                (else (i32.add (call $fib (i32.sub (local.get $n) (i32.const 1)))
+                               (call $fib (i32.sub (local.get $n) (i32.const 2))))))))`)
+
+    store := InitializeStore(module)
+    args := []RuntimeValue{ValueI32(20)}
+    benchmark.ResetTimer()
+    for i := 0; i < benchmark.N; i++ {
+        result, err := Invoke(module, store, "fib", args)
+        if err != nil || result[0] != ValueI32(6765) {
+            benchmark.Fatalf("unable to invoke fib: %v %v", result, err)
+        }
+    }
+}
@@ -0,0 +1,249 @@
+package exec
+
+/* a debugger that stops the code at breakpoints and lets it run one instruction at a time.
+ *
+ * a location in the code is a function index and an instruction offset, which counts the instructions of
+ * the function body in the order they are written in the text format, starting at 0. a block, loop or if
+ * is one instruction and the instructions inside of it come after it, else and end are not counted. the
+ * offset one past the last instruction is the end of the function.
+ *
+ * when the code stops the debugger's OnPause is called on the goroutine that runs the code, with the state
+ * of the code at the instruction that is about to run. OnPause can look at the locals, the value stack,
+ * the globals and the memory, and returns how the code should go on.
+ */
+
+import (
+    "sort"
+
+    "github.com/kazzmir/webassembly/lib/core"
+)
+
+type Location struct {
+    Function uint32
+    /* the instruction in the function, -1 for a host function */
+    Offset int
+}
+
+type DebugCommand int
+
+const (
+    /* run until the next breakpoint */
+    DebugContinue DebugCommand = iota
+    /* stop at the next instruction, which can be in a function that is called */
+    DebugStep
+    /* stop at the next instruction of the current function or of a function it returns to */
+    DebugStepOver
+    /* stop once the current function returns */
+    DebugStepOut
+    /* end the call with ErrStopped */
+    DebugStop
+)
+
+var ErrStopped = Trap("stopped by the debugger")
+
+type Debugger struct {
+    /* called when the code stops, the state is only valid until OnPause returns */
+    OnPause func(state *DebugState) DebugCommand
+    breakpoints map[Location]bool
+    /* changes whenever the breakpoints change, so the resolved breakpoints can be thrown away */
+    version int
+    resolved map[*compiledFunction]resolvedBreakpoints
+    command DebugCommand
+    /* the call depth when the last command was given */
+    depth int
+}
+
+/* the instructions of one compiled function that have a breakpoint */
+type resolvedBreakpoints struct {
+    version int
+    pcs map[int]bool
+}
+
+/* a function that is running, pc is the instruction it is at and sp is the top of its stack */
+type debugFrame struct {
+    function *compiledFunction
+    fp int
+    sp int
+    pc int
+}
+
+func NewDebugger(onPause func(state *DebugState) DebugCommand) *Debugger {
+    return &Debugger{
+        OnPause: onPause,
+        breakpoints: make(map[Location]bool),
+        resolved: make(map[*compiledFunction]resolvedBreakpoints),
+    }
+}
+
+func (debugger *Debugger) SetBreakpoint(location Location){
+    debugger.breakpoints[location] = true
+    debugger.version += 1
+}
+
+func (debugger *Debugger) ClearBreakpoint(location Location){
+    delete(debugger.breakpoints, location)
+    debugger.version += 1
+}
+
+/* the breakpoints ordered by function and then offset */
+func (debugger *Debugger) Breakpoints() []Location {
+    var out []Location
+    for location := range debugger.breakpoints {
+        out = append(out, location)
+    }
+
+    sort.Slice(out, func(i int, j int) bool {
+        if out[i].Function != out[j].Function {
+            return out[i].Function < out[j].Function
+        }
+        return out[i].Offset < out[j].Offset
+    })
+
+    return out
+}
+
+/* stop before the next instruction that runs, such as the first instruction of the next call */
+func (debugger *Debugger) Pause(){
+    debugger.command = DebugStep
+}
+
+/* true if there is a breakpoint at the instruction. a breakpoint at an instruction that does not compile
+ * to anything, like a block, stops at the first instruction after it
+ */
+func (debugger *Debugger) breakpointAt(function *compiledFunction, pc int) bool {
+    if len(debugger.breakpoints) == 0 {
+        return false
+    }
+
+    resolved, ok := debugger.resolved[function]
+    if !ok || resolved.version != debugger.version {
+        resolved = resolvedBreakpoints{version: debugger.version, pcs: make(map[int]bool)}
+        for location := range debugger.breakpoints {
+            if location.Function != function.index {
+                continue
+            }
+
+            for i, instruction := range function.code {
+                if instruction.offset >= location.Offset {
+                    resolved.pcs[i] = true
+                    break
+                }
+            }
+        }
+        debugger.resolved[function] = resolved
+    }
+
+    return resolved.pcs[pc]
+}
+
+/* called before every instruction while debugging, returns ErrStopped if the code should not go on */
+func (debugger *Debugger) check(machine *machine) error {
+    frame := &machine.frames[len(machine.frames)-1]
+
+    pause := false
+    switch debugger.command {
+        case DebugStep: pause = true
+        case DebugStepOver: pause = machine.depth <= debugger.depth
+        case DebugStepOut: pause = machine.depth < debugger.depth
+    }
+
+    if !pause && !debugger.breakpointAt(frame.function, frame.pc) {
+        return nil
+    }
+
+    command := DebugContinue
+    if debugger.OnPause != nil {
+        command = debugger.OnPause(&DebugState{machine: machine})
+    }
+
+    if command == DebugStop {
+        debugger.command = DebugContinue
+        return ErrStopped
+    }
+
+    debugger.command = command
+    debugger.depth = machine.depth
+    return nil
+}
+
+/* the state of the code where it stopped */
+type DebugState struct {
+    machine *machine
+}
+
+/* where the code stopped */
+func (state *DebugState) Location() Location {
+    return state.Frames()[0]
+}
+
+/* the locations of the active functions, starting with the one that stopped and ending with the
+ * function that was called from go
+ */
+func (state *DebugState) Frames() []Location {
+    frames := state.machine.frames
+    out := make([]Location, 0, len(frames))
+    for i := len(frames) - 1; i >= 0; i-- {
+        frame := frames[i]
+        offset := -1
+        if frame.function.host == nil {
+            offset = frame.function.code[frame.pc].offset
+        }
+        out = append(out, Location{Function: frame.function.index, Offset: offset})
+    }
+
+    return out
+}
+
+/* the locals of the frame at the given position in Frames, starting with the parameters */
+func (state *DebugState) Locals(frame int) []RuntimeValue {
+    frames := state.machine.frames
+    if frame < 0 || frame >= len(frames) {
+        return nil
+    }
+
+    active := frames[len(frames) - 1 - frame]
+    out := make([]RuntimeValue, len(active.function.locals))
+    for i, kind := range active.function.locals {
+        out[i] = fromSlot(kind, state.machine.stack[active.fp + i])
+    }
+
+    return out
+}
+
+/* the operands on the value stack of the function that stopped, with the top of the stack last. the stack
+ * does not know the types of the values, so they are the raw bits
+ */
+func (state *DebugState) Stack() []uint64 {
+    frame := state.machine.frames[len(state.machine.frames)-1]
+    start := frame.fp + len(frame.function.locals)
+    return append([]uint64(nil), state.machine.stack[start:frame.sp]...)
+}
+
+/* the globals, memory and tables of the code, which can be changed while the code is stopped */
+func (state *DebugState) Store() *Store {
+    return state.machine.store
+}
+
+func (state *DebugState) Module() *core.WebAssemblyModule {
+    return state.machine.module
+}
+
+/* the instructions of a function body in the order that instruction offsets count them */
+func FunctionInstructions(code core.Code) []core.Expression {
+    var out []core.Expression
+
+    var walk func(expressions []core.Expression)
+    walk = func(expressions []core.Expression){
+        for _, expression := range expressions {
+            out = append(out, expression)
+            block, ok := expression.(*core.BlockExpression)
+            if ok {
+                walk(block.Instructions)
+                walk(block.ElseInstructions)
+            }
+        }
+    }
+
+    walk(code.Expressions)
+    return out
+}
@@ -0,0 +1,131 @@
+package exec
+
+import (
+    "errors"
+    "testing"
+)
+
+func TestDebugger(test *testing.T){
+    module := makeModule(test, `(module
+        (func $square (param i32) (result i32)
+            (i32.mul (local.get 0) (local.get 0)))
+        (func (export "run") (param i32) (result i32)
+            (local i32)
+            (local.set 1 (call $square (local.get 0)))
+            (i32.add (local.get 1) (i32.const 1))))`)
+
+    /* the instructions of run: 0 local.get 0, 1 call, 2 local.set, 3 local.get 1, 4 i32.const, 5 i32.add */
+    code := module.GetCodeSection().Code[1]
+    instructions := FunctionInstructions(code)
+    if len(instructions) != 6 {
+        test.Fatalf("expected 6 instructions but got %v", len(instructions))
+    }
+
+    var stops []Location
+    var commands []DebugCommand
+    var locals []RuntimeValue
+    var stack []uint64
+
+    debugger := NewDebugger(func(state *DebugState) DebugCommand {
+        stops = append(stops, state.Location())
+        if state.Location() == (Location{Function: 1, Offset: 3}) {
+            locals = state.Locals(0)
+        }
+        if state.Location() == (Location{Function: 0, Offset: 2}) {
+            stack = state.Stack()
+            if frames := state.Frames(); len(frames) != 2 || frames[1] != (Location{Function: 1, Offset: 1}) {
+                test.Errorf("wrong frames %v", frames)
+            }
+        }
+
+        command := commands[0]
+        commands = commands[1:]
+        return command
+    })
+    debugger.SetBreakpoint(Location{Function: 1, Offset: 1})
+
+    store := InitializeStore(module)
+    store.Debugger = debugger
+
+    /* stop at the call, step into square and through it, then step over the rest of run */
+    commands = []DebugCommand{DebugStep, DebugStep, DebugStep, DebugStep, DebugStepOut, DebugStepOver, DebugContinue}
+    results, err := Invoke(module, store, "run", []RuntimeValue{ValueI32(5)})
+    if err != nil || results[0].AsInt32() != 26 {
+        test.Fatalf("expected 26 but got %v %v", results, err)
+    }
+
+    expected := []Location{{1, 1}, {0, 0}, {0, 1}, {0, 2}, {0, 3}, {1, 2}, {1, 3}}
+    if len(stops) != len(expected) {
+        test.Fatalf("expected stops %v but got %v", expected, stops)
+    }
+    for i := range expected {
+        if stops[i] != expected[i] {
+            test.Fatalf("expected stops %v but got %v", expected, stops)
+        }
+    }
+
+    if len(locals) != 2 || locals[1].AsInt32() != 25 {
+        test.Fatalf("wrong locals %v", locals)
+    }
+
+    if len(stack) != 2 || stack[0] != 5 || stack[1] != 5 {
+        test.Fatalf("wrong stack %v", stack)
+    }
+
+    /* stopping ends the call */
+    stops = nil
+    commands = []DebugCommand{DebugStop}
+    _, err = Invoke(module, store, "run", []RuntimeValue{ValueI32(5)})
+    if !errors.Is(err, ErrStopped) || len(stops) != 1 {
+        test.Fatalf("expected to stop but got %v", err)
+    }
+
+    /* without breakpoints the code only stops when asked to */
+    debugger.ClearBreakpoint(Location{Function: 1, Offset: 1})
+    stops = nil
+    _, err = Invoke(module, store, "run", []RuntimeValue{ValueI32(5)})
+    if err != nil || len(stops) != 0 {
+        test.Fatalf("expected no stops but got %v %v", stops, err)
+    }
+
+    debugger.Pause()
+    commands = []DebugCommand{DebugContinue}
+    _, err = Invoke(module, store, "run", []RuntimeValue{ValueI32(5)})
+    if err != nil || len(stops) != 1 || stops[0] != (Location{Function: 1, Offset: 0}) {
+        test.Fatalf("expected to stop at the start but got %v %v", stops, err)
+    }
+}
+
+func TestBreakpointInBlock(test *testing.T){
+    module := makeModule(test, `(module
+        (func (export "count") (param i32) (result i32)
+            (local i32)
+            (block
+                (loop
+                    (br_if 1 (i32.eqz (local.get 0)))
+                    (local.set 0 (i32.sub (local.get 0) (i32.const 1)))
+                    (local.set 1 (i32.add (local.get 1) (i32.const 1)))
+                    (br 0)))
+            (local.get 1)))`)
+
+    hits := 0
+    debugger := NewDebugger(func(state *DebugState) DebugCommand {
+        hits += 1
+        return DebugContinue
+    })
+
+    /* the loop compiles to nothing, so its breakpoint is at the local.get inside of it */
+    debugger.SetBreakpoint(Location{Function: 0, Offset: 1})
+
+    store := InitializeStore(module)
+    store.Debugger = debugger
+
+    results, err := Invoke(module, store, "count", []RuntimeValue{ValueI32(3)})
+    if err != nil || results[0].AsInt32() != 3 {
+        test.Fatalf("expected 3 but got %v %v", results, err)
+    }
+
+    if hits != 4 {
+        test.Fatalf("expected 4 stops but got %v", hits)
+    }
+}
@@ -1,11 +1,15 @@
 package exec
 
 import (
+    "context"
+    "errors"
     "fmt"
     "strings"
     "reflect"
     "math"
     "math/bits"
+    "runtime"
+    "time"
     "encoding/binary"
     "github.com/kazzmir/webassembly/lib/core"
     "github.com/kazzmir/webassembly/lib/data"
@@ -14,6 +18,13 @@ import (
 
 const MemoryPageSize = 65536
 
+/* limits on how far a guest can recurse before it traps, these are the defaults of a new store */
+const (
+    DefaultMaxCallDepth = 10000
+    /* in values, including the locals of every active function */
+    DefaultMaxStackSize = 1 << 20
+)
+
 type RuntimeValueKind int
 
 const (
@@ -31,8 +42,9 @@ type RuntimeValue struct {
     Kind RuntimeValueKind
     I32 int32
     I64 int64
-    F32 float32
-    F64 float64
+    // floats are kept as raw bits so that nan payloads survive
+    F32 uint32
+    F64 uint64
     RefFunc uint32
     RefExtern uint32
 }
@@ -55,19 +67,158 @@ func MakeRuntimeValue(kind core.ValueType) RuntimeValue {
         case core.ValueTypeF32: return RuntimeValue{Kind: RuntimeValueF32}
         case core.ValueTypeF64: return RuntimeValue{Kind: RuntimeValueF64}
         case core.ValueTypeRefFunc: return RuntimeValue{Kind: RuntimeValueRefFunc}
-        case core.ValueTypeRefExtern: return RuntimeValue{Kind: RuntimeValueRefFunc}
+        case core.ValueTypeRefExtern: return RuntimeValue{Kind: RuntimeValueRefExtern}
     }
 
     return RuntimeValue{Kind: RuntimeValueNone}
 }
 
+func ValueI32(value int32) RuntimeValue {
+    return RuntimeValue{
+        Kind: RuntimeValueI32,
+        I32: value,
+    }
+}
+
+func ValueI64(value int64) RuntimeValue {
+    return RuntimeValue{
+        Kind: RuntimeValueI64,
+        I64: value,
+    }
+}
+
+func ValueF32(value float32) RuntimeValue {
+    return ValueF32FromBits(math.Float32bits(value))
+}
+
+/* an f32 with exactly the given bits, which is the only way to make a nan with a particular payload */
+func ValueF32FromBits(value uint32) RuntimeValue {
+    return RuntimeValue{
+        Kind: RuntimeValueF32,
+        F32: value,
+    }
+}
+
+func ValueF64(value float64) RuntimeValue {
+    return ValueF64FromBits(math.Float64bits(value))
+}
+
+func ValueF64FromBits(value uint64) RuntimeValue {
+    return RuntimeValue{
+        Kind: RuntimeValueF64,
+        F64: value,
+    }
+}
+
+/* a reference to the function with the given index */
+func ValueRefFunc(value uint32) RuntimeValue {
+    return RuntimeValue{
+        Kind: RuntimeValueRefFunc,
+        RefFunc: value,
+    }
+}
+
+func ValueRefExtern(value uint32) RuntimeValue {
+    return RuntimeValue{
+        Kind: RuntimeValueRefExtern,
+        RefExtern: value,
+    }
+}
+
+/* the null reference of a reference type, either core.ValueTypeRefFunc or core.ValueTypeRefExtern */
+func ValueRefNull(kind core.ValueType) RuntimeValue {
+    if kind == core.ValueTypeRefExtern {
+        return ValueRefExtern(RuntimeValueRefNull)
+    }
+
+    return ValueRefFunc(RuntimeValueRefNull)
+}
+
+/* the webassembly type of the value */
+func (value RuntimeValue) Type() core.ValueType {
+    switch value.Kind {
+        case RuntimeValueI32: return core.ValueTypeI32
+        case RuntimeValueI64: return core.ValueTypeI64
+        case RuntimeValueF32: return core.ValueTypeF32
+        case RuntimeValueF64: return core.ValueTypeF64
+        case RuntimeValueRefFunc: return core.ValueTypeRefFunc
+        case RuntimeValueRefExtern: return core.ValueTypeRefExtern
+    }
+
+    return core.InvalidValueType
+}
+
+/* values are equal if they have the same type and the same bits, so a nan is only equal to a nan with the
+ * same payload and -0 is not equal to +0
+ */
+func (value RuntimeValue) Equal(other RuntimeValue) bool {
+    if value.Kind != other.Kind {
+        return false
+    }
+
+    switch value.Kind {
+        case RuntimeValueI32: return value.I32 == other.I32
+        case RuntimeValueI64: return value.I64 == other.I64
+        case RuntimeValueF32: return value.F32 == other.F32
+        case RuntimeValueF64: return value.F64 == other.F64
+        case RuntimeValueRefFunc: return value.RefFunc == other.RefFunc
+        case RuntimeValueRefExtern: return value.RefExtern == other.RefExtern
+    }
+
+    return true
+}
+
+/* the conversions below reinterpret the value as the requested go type, they do not check the type
+ * of the value. an i32 can be read as signed or unsigned, and so can an i64.
+ */
+
+func (value RuntimeValue) AsInt32() int32 {
+    return value.I32
+}
+
+func (value RuntimeValue) AsUint32() uint32 {
+    return uint32(value.I32)
+}
+
+func (value RuntimeValue) AsInt64() int64 {
+    return value.I64
+}
+
+func (value RuntimeValue) AsUint64() uint64 {
+    return uint64(value.I64)
+}
+
+func (value RuntimeValue) AsFloat32() float32 {
+    return value.Float32()
+}
+
+func (value RuntimeValue) AsFloat64() float64 {
+    return value.Float64()
+}
+
+func (value RuntimeValue) Float32() float32 {
+    return math.Float32frombits(value.F32)
+}
+
+func (value RuntimeValue) Float64() float64 {
+    return math.Float64frombits(value.F64)
+}
+
 func (value RuntimeValue) String() string {
     switch value.Kind {
         case RuntimeValueNone: return "none"
         case RuntimeValueI32: return fmt.Sprintf("%v:i32", value.I32)
         case RuntimeValueI64: return fmt.Sprintf("%v:i64", value.I64)
-        case RuntimeValueF32: return fmt.Sprintf("%v:f32", value.F32)
-        case RuntimeValueF64: return fmt.Sprintf("%v:f64", value.F64)
+        case RuntimeValueF32:
+            if isNaN32(value.F32) {
+                return fmt.Sprintf("nan:0x%x:f32", value.F32)
+            }
+            return fmt.Sprintf("%v:f32", value.Float32())
+        case RuntimeValueF64:
+            if isNaN64(value.F64) {
+                return fmt.Sprintf("nan:0x%x:f64", value.F64)
+            }
+            return fmt.Sprintf("%v:f64", value.Float64())
         case RuntimeValueRefFunc: return fmt.Sprintf("%v:func", value.RefFunc)
         case RuntimeValueRefExtern: return fmt.Sprintf("%v:extern", value.RefExtern)
     }
@@ -81,18 +232,114 @@ type Table struct {
 
 type Global struct {
     Name string
+    Type core.ValueType
     Value RuntimeValue
     Mutable bool
 }
 
+/* the memories, tables and globals of one instance of a module, along with its limits and fuel. a store is
+ * changed by the code that runs in it, so it must not be used by more than one goroutine at a time.
+ * use a CompiledModule to run the same module in several goroutines, each with its own instance.
+ */
 type Store struct {
     Tables []Table
     Globals []Global
     Memory [][]byte
+    /* calling deeper than this, or using more of the value stack, traps with 'call stack exhausted'. 0 or less
+     * means DefaultMaxCallDepth and DefaultMaxStackSize
+     */
+    MaxCallDepth int
+    MaxStackSize int
+    /* the fuel of each instruction, nil means every instruction costs 1. functions are compiled with the
+     * costs when they are first called, so this should be set before running any code
+     */
+    FuelCost func(expression core.Expression) uint64
+    /* fuel is only used once some has been added */
+    metered bool
+    fuel uint64
+    consumed uint64
+    /* compiled code of the module's functions, indexed without the imported functions */
+    functions []*compiledFunction
+    /* the host functions bound to the imported functions by Link */
+    imports []*compiledFunction
+    /* code shared with the other instances of the same module, nil if the store compiles its own code */
+    compiled *CompiledModule
+    /* the last snapshot, and which blocks of memory 0 have been written since then */
+    snapshot *Snapshot
+    dirty []bool
+    /* pauses the code at breakpoints and while stepping, nil when not debugging */
+    Debugger *Debugger
+    /* told about everything the code does, nil when not tracing */
+    Tracer Tracer
+    /* counts the calls, instructions and time of each function, nil when not profiling */
+    Profiler *Profiler
+}
+
+/* turn on fuel metering and add to the fuel that is left. each executed instruction uses some fuel, and
+ * running out of fuel traps with ErrOutOfFuel. fuel that is not used carries over to the next call.
+ */
+func (store *Store) AddFuel(amount uint64){
+    store.metered = true
+    store.fuel += amount
+}
+
+/* the fuel that is left */
+func (store *Store) Fuel() uint64 {
+    return store.fuel
+}
+
+/* the total amount of fuel used by all the calls so far */
+func (store *Store) FuelConsumed() uint64 {
+    return store.consumed
+}
+
+/* evaluate a constant expression, such as a global initializer or a segment offset. these can refer to
+ * globals that are already in the store
+ */
+func evaluateConstant(expressions []core.Expression, kind core.ValueType, store *Store) (RuntimeValue, error) {
+    function, err := compileExpressions(nil, expressions, []core.ValueType{kind})
+    if err != nil {
+        return RuntimeValue{}, err
+    }
+
+    results, err := execute(context.Background(), function, nil, nil, store)
+    if err != nil {
+        return RuntimeValue{}, err
+    }
+
+    return results[0], nil
 }
 
 func InitializeStore(module core.WebAssemblyModule) *Store {
-    var out Store
+    out := Store{
+        MaxCallDepth: DefaultMaxCallDepth,
+        MaxStackSize: DefaultMaxStackSize,
+    }
+
+    /* FIXME: imports are not linked to anything yet, so imported tables, globals and memories get
+     * placeholder entries that keep the indices of the module's own definitions correct
+     */
+    importSection := module.GetImportSection()
+    if importSection != nil {
+        for _, item := range importSection.Items {
+            switch item.Kind.(type) {
+                case *core.TableType:
+                    table := item.Kind.(*core.TableType)
+                    out.Tables = append(out.Tables, Table{Elements: make([]core.Index, table.Limit.Minimum)})
+                case *core.GlobalType:
+                    global := item.Kind.(*core.GlobalType)
+                    out.Globals = append(out.Globals, Global{
+                        Name: item.LocalName,
+                        Type: global.ValueType,
+                        Value: MakeRuntimeValue(global.ValueType),
+                        Mutable: global.Mutable,
+                    })
+                case *core.MemoryImportType:
+                    memory := item.Kind.(*core.MemoryImportType)
+                    out.Memory = append(out.Memory, make([]byte, memory.Limit.Minimum * MemoryPageSize))
+            }
+        }
+    }
 
     tableSection := module.GetTableSection()
     if tableSection != nil {
@@ -104,21 +351,18 @@ func InitializeStore(module core.WebAssemblyModule) *Store {
     globalSection := module.GetGlobalSection()
     if globalSection != nil {
         for _, global := range globalSection.Globals {
-
-            // FIXME: the global might be bound to an import
-            if len(global.Expression) > 0 {
-                value, err := EvaluateOne(global.Expression[0])
-                if err != nil {
-                    fmt.Printf("Error: unable to evaluate global: %v\n", err)
-                    continue
-                }
-
-                out.Globals = append(out.Globals, Global{
-                    Name: global.Name,
-                    Value: value,
-                    Mutable: global.Global.Mutable,
-                })
+            value, err := evaluateConstant(global.Expression, global.Global.ValueType, &out)
+            if err != nil {
+                fmt.Printf("Error: unable to evaluate global: %v\n", err)
+                value = MakeRuntimeValue(global.Global.ValueType)
             }
+
+            out.Globals = append(out.Globals, Global{
+                Name: global.Name,
+                Type: global.Global.ValueType,
+                Value: value,
+                Mutable: global.Global.Mutable,
+            })
         }
     }
 
@@ -136,1401 +380,1378 @@ func InitializeStore(module core.WebAssemblyModule) *Store {
             switch element.Mode.(type) {
                 case *core.ElementModeActive:
                     active := element.Mode.(*core.ElementModeActive)
+                    if active.Table >= len(out.Tables) {
+                        fmt.Printf("Error: element segment refers to invalid table %v\n", active.Table)
+                        continue
+                    }
+
+                    offset := 0
+                    if len(active.Offset) > 0 {
+                        value, err := evaluateConstant(active.Offset, core.ValueTypeI32, &out)
+                        if err != nil {
+                            fmt.Printf("Error: unable to evaluate element offset: %v\n", err)
+                            continue
+                        }
+                        offset = int(value.I32)
+                    }
+
+                    table := out.Tables[active.Table]
+                    if offset < 0 || offset + len(element.Inits) > len(table.Elements) {
+                        fmt.Printf("Error: element segment out of bounds of table %v\n", active.Table)
+                        continue
+                    }
+
                     for i, item := range element.Inits {
                         switch item.(type) {
                             case *core.RefFuncExpression:
                                 function := item.(*core.RefFuncExpression)
-                                out.Tables[active.Table].Elements[i] = function.Function
+                                table.Elements[offset + i] = function.Function
+                            default:
+                                /* a null reference */
+                                table.Elements[offset + i] = nil
                         }
                     }
             }
         }
     }
 
+    dataSection := module.GetDataSection()
+    if dataSection != nil {
+        for _, segment := range dataSection.Segments {
+            switch segment.Mode.(type) {
+                case *core.MemoryActiveMode:
+                    active := segment.Mode.(*core.MemoryActiveMode)
+                    if int(active.Memory) >= len(out.Memory) {
+                        fmt.Printf("Error: data segment refers to invalid memory %v\n", active.Memory)
+                        continue
+                    }
+
+                    value, err := evaluateConstant(active.Offset, core.ValueTypeI32, &out)
+                    if err != nil {
+                        fmt.Printf("Error: unable to evaluate data offset: %v\n", err)
+                        continue
+                    }
+
+                    memory := out.Memory[active.Memory]
+                    offset := int(uint32(value.I32))
+                    if offset + len(segment.Data) > len(memory) {
+                        fmt.Printf("Error: data segment out of bounds of memory %v\n", active.Memory)
+                        continue
+                    }
+
+                    copy(memory[offset:], segment.Data)
+            }
+        }
+    }
+
     return &out
 }
 
 /* activation frame: https://webassembly.github.io/spec/core/exec/runtime.html#syntax-frame */
 type Frame struct {
     Locals []RuntimeValue
-    Module core.WebAssemblyModule
+    Module *core.WebAssemblyModule
 }
 
 func Trap(reason string) error {
     return fmt.Errorf(reason)
 }
 
-func refFunc(value uint32) RuntimeValue {
-    return RuntimeValue{
-        Kind: RuntimeValueRefFunc,
-        RefFunc: value,
-    }
+type ByteWriter struct {
+    data []byte
 }
 
-func refExtern(value uint32) RuntimeValue {
-    return RuntimeValue{
-        Kind: RuntimeValueRefExtern,
-        RefExtern: value,
+func NewByteWriter(data []byte) *ByteWriter {
+    return &ByteWriter{data: data}
+}
+
+func (writer *ByteWriter) Write(data []byte) (int, error) {
+    if len(data) < len(writer.data) {
+        return copy(writer.data, data), nil
+    } else {
+        return 0, fmt.Errorf("buffer too small to write to")
     }
 }
 
-func refNull() RuntimeValue {
-    return refFunc(RuntimeValueRefNull)
+var True RuntimeValue = ValueI32(1)
+var False RuntimeValue = ValueI32(0)
+
+/* values on the operand stack are untyped 64-bit slots. an i32 is kept zero extended, an f32 as the
+ * bits of the float in the low 32 bits and a reference as its index, or RuntimeValueRefNull
+ */
+func fromI32(value int32) uint64 {
+    return uint64(uint32(value))
+}
+
+func fromF32(value float32) uint64 {
+    return uint64(math.Float32bits(value))
 }
 
-func i32(value int32) RuntimeValue {
-    return RuntimeValue{
-        Kind: RuntimeValueI32,
-        I32: value,
+func fromF64(value float64) uint64 {
+    return math.Float64bits(value)
+}
+
+func toF32(value uint64) float32 {
+    return math.Float32frombits(uint32(value))
+}
+
+func toF64(value uint64) float64 {
+    return math.Float64frombits(value)
+}
+
+func boolean(value bool) uint64 {
+    if value {
+        return 1
     }
+
+    return 0
 }
 
-func i64(value int64) RuntimeValue {
-    return RuntimeValue{
-        Kind: RuntimeValueI64,
-        I64: value,
+/* the stack slot of a runtime value */
+func toSlot(value RuntimeValue) uint64 {
+    switch value.Kind {
+        case RuntimeValueI32: return fromI32(value.I32)
+        case RuntimeValueI64: return uint64(value.I64)
+        case RuntimeValueF32: return uint64(value.F32)
+        case RuntimeValueF64: return value.F64
+        case RuntimeValueRefFunc: return uint64(value.RefFunc)
+        case RuntimeValueRefExtern: return uint64(value.RefExtern)
     }
+
+    return 0
 }
 
-func f32(value float32) RuntimeValue {
-    return RuntimeValue{
-        Kind: RuntimeValueF32,
-        F32: value,
+/* the runtime value of a stack slot, which needs the type that is known statically */
+func fromSlot(kind core.ValueType, slot uint64) RuntimeValue {
+    switch kind {
+        case core.ValueTypeI32: return ValueI32(int32(slot))
+        case core.ValueTypeI64: return ValueI64(int64(slot))
+        case core.ValueTypeF32: return ValueF32FromBits(uint32(slot))
+        case core.ValueTypeF64: return ValueF64FromBits(slot)
+        case core.ValueTypeRefFunc: return ValueRefFunc(uint32(slot))
+        case core.ValueTypeRefExtern: return ValueRefExtern(uint32(slot))
     }
+
+    return RuntimeValue{Kind: RuntimeValueNone}
 }
 
-func f64(value float64) RuntimeValue {
-    return RuntimeValue{
-        Kind: RuntimeValueF64,
-        F64: value,
+/* the bytes of memory 0 touched by an access of 'size' bytes at address+offset */
+func memoryAccess(store *Store, address uint64, offset uint64, size uint64) ([]byte, error) {
+    if store == nil || len(store.Memory) == 0 {
+        return nil, fmt.Errorf("no memory available")
+    }
+
+    memory := store.Memory[0]
+    start := uint64(uint32(address)) + offset
+    if start + size > uint64(len(memory)) {
+        return nil, Trap("out of bounds memory access")
     }
+
+    return memory[start:start+size], nil
 }
 
-type ByteWriter struct {
-    data []byte
+/* the value stack of one call into a module. every activation of a function has a frame on the stack
+ * that starts at its frame pointer with its locals, where the parameters are the arguments the caller
+ * left on top of its own operands, and continues with the operands of the function. the results of a
+ * function are moved to the start of its frame when it returns, which is where the caller expects them.
+ */
+type machine struct {
+    stack []uint64
+    module *core.WebAssemblyModule
+    store *Store
+    /* number of functions that are currently active */
+    depth int
+    maxDepth int
+    maxStack int
+    /* closed when the call should stop, nil if it can never be interrupted */
+    done <-chan struct{}
+    /* the active functions, only kept while debugging */
+    debugger *Debugger
+    frames []debugFrame
+    tracer Tracer
+    /* the last instruction that started while tracing, and whether the tracer was told about the trap */
+    location Location
+    trapped bool
+    profiler *Profiler
+    /* the function that is running in the call tree of the profiler */
+    profile *profileNode
+    /* true if any of the debugger, tracer or profiler is on */
+    hooks bool
 }
 
-func NewByteWriter(data []byte) *ByteWriter {
-    return &ByteWriter{data: data}
+var ErrCallStackExhausted = Trap("call stack exhausted")
+var ErrOutOfFuel = Trap("all fuel consumed")
+var ErrInterrupted = Trap("interrupted")
+
+func newMachine(ctx context.Context, module *core.WebAssemblyModule, store *Store) *machine {
+    out := machine{
+        module: module,
+        store: store,
+        maxDepth: DefaultMaxCallDepth,
+        maxStack: DefaultMaxStackSize,
+        done: ctx.Done(),
+    }
+
+    if store != nil {
+        if store.MaxCallDepth > 0 {
+            out.maxDepth = store.MaxCallDepth
+        }
+        if store.MaxStackSize > 0 {
+            out.maxStack = store.MaxStackSize
+        }
+        out.debugger = store.Debugger
+        out.tracer = store.Tracer
+        out.profiler = store.Profiler
+        out.hooks = out.debugger != nil || out.tracer != nil || out.profiler != nil
+    }
+
+    return &out
 }
 
-func (writer *ByteWriter) Write(data []byte) (int, error) {
-    if len(data) < len(writer.data) {
-        return copy(writer.data, data), nil
+/* make sure the stack has at least 'size' slots */
+func (machine *machine) reserve(size int) error {
+    if size > machine.maxStack {
+        return ErrCallStackExhausted
+    }
+
+    if size > len(machine.stack) {
+        length := len(machine.stack) * 2
+        if length < size {
+            length = size
+        }
+        stack := make([]uint64, length)
+        copy(stack, machine.stack)
+        machine.stack = stack
+    }
+
+    return nil
+}
+
+/* true if the context of the call is done. this is checked on calls and on branches back to the start of
+ * a loop, which is enough to stop any code that runs for a long time
+ */
+func (machine *machine) interrupted() bool {
+    if machine.done == nil {
+        return false
+    }
+
+    select {
+        case <-machine.done:
+            return true
+        default:
+            return false
+    }
+}
+
+/* run a function whose frame starts at fp, unless that would go past the maximum call depth */
+func (machine *machine) call(function *compiledFunction, fp int) error {
+    if machine.depth >= machine.maxDepth {
+        return ErrCallStackExhausted
+    }
+
+    if machine.interrupted() {
+        return ErrInterrupted
+    }
+
+    machine.depth += 1
+    var err error
+    if machine.hooks {
+        err = machine.callWithHooks(function, fp)
+    } else if function.host != nil {
+        err = machine.callHost(function, fp)
+        if err != nil {
+            err = addFrame(err, function, -1)
+        }
     } else {
-        return 0, fmt.Errorf("buffer too small to write to")
+        err = run(machine, function, fp)
     }
+    machine.depth -= 1
+    return err
 }
 
-var True RuntimeValue = i32(1)
-var False RuntimeValue = i32(0)
+/* call a function while telling the debugger, tracer and profiler about it */
+func (machine *machine) callWithHooks(function *compiledFunction, fp int) error {
+    if machine.debugger != nil {
+        machine.frames = append(machine.frames, debugFrame{function: function, fp: fp, sp: fp + function.parameters})
+    }
 
-// magic value meaning we are returning from the function rather than just exiting a block
-const ReturnLabel int = 1<<30
+    if machine.tracer != nil {
+        machine.traceEnter(function, fp)
+    }
 
-/* execute a single instruction
- *  input: stack of runtime values, stack of block labels, list of expressions to execute, instruction index into 'expressions', activation frame
- *  output: next instruction number to execute, number of blocks to skip (if greater than 0), and any errors that may occur (including traps)
- */
-// FIXME: remove labels
-func Execute(stack *data.Stack[RuntimeValue], labels *data.Stack[int], expressions []core.Expression, instruction int, frame Frame, store *Store) (int, int, error) {
-    current := expressions[instruction]
-
-    /*
-    fmt.Printf("Stack is now %+v executing %v\n", *stack, reflect.TypeOf(current))
-    if stack.Size() > 100 {
-        return 0, 0, fmt.Errorf("fail")
-    }
-    */
-
-    /* branches work by jumping to the Nth block, where N represents the nesting level of the blocks.
-     *   (block_a (block_b (br 0) (br 1)))
-     * Here the blocks are annotated with 'a' and 'b' to make their references more clear, but in actual
-     * syntax the _a and _b would be left off.
-     *
-     * The (br 0) would jump to the end of block_b, and the (br 1) would jump to the end of block_a. The number
-     * after the br represents how many nested blocks to jump back through.
-     *
-     * This interpreter implements branches as the second return value in (a,b,c) returning N+1 where N is the 0 in (br 0).
-     * When a block receives a non-zero value for b after executing an instruction, the block will immediately return
-     * with b-1, thus allowing the previous block to also abort early.
-     */
-    switch current.(type) {
-        case *core.BlockExpression:
-            block := current.(*core.BlockExpression)
+    var caller *profileNode
+    var started time.Time
+    if machine.profiler != nil {
+        caller = machine.profile
+        machine.profile = machine.profiler.enter(caller, function.index)
+        if machine.profiler.timed() {
+            started = time.Now()
+        }
+    }
 
-            instructions := block.Instructions
+    var err error
+    if function.host != nil {
+        err = machine.callHost(function, fp)
+        if err != nil {
+            err = addFrame(err, function, -1)
+        }
+    } else {
+        err = run(machine, function, fp)
+    }
 
-            /* for an if block, pop a value off the stack and if its not 0 then execute the normal instructions,
-             * otherwise execute the else instructions.
-             */
-            if block.Kind == core.BlockKindIf {
-                value := stack.Pop()
-                if value.Kind != RuntimeValueI32 {
-                    return 0, 0, fmt.Errorf("if expected an i32 on the stack but got %v", value)
-                }
-                if value.I32 == 0 {
-                    instructions = block.ElseInstructions
-                }
-            }
+    if machine.profiler != nil {
+        if machine.profiler.timed() {
+            machine.profile.nanoseconds += int64(time.Since(started))
+        }
+        machine.profile = caller
+    }
 
-            currentStackSize := stack.Size()
+    if machine.tracer != nil {
+        machine.traceExit(function, fp, err)
+    }
 
-            /* Keep track of the number of values on the stack in case they need to be popped off later */
-            // labels.Push(stack.Size())
-            local := 0
-            for local < len(instructions) {
-                var branch int
-                var err error
-                local, branch, err = Execute(stack, labels, instructions, local, frame, store)
-                if err != nil {
-                    return 0, 0, err
-                }
+    if machine.debugger != nil {
+        machine.frames = machine.frames[:len(machine.frames)-1]
+    }
+    return err
+}
 
-                if branch > 0 {
+/* call a host function with the arguments at fp, its results replace the arguments */
+func (machine *machine) callHost(function *compiledFunction, fp int) error {
+    args := make([]RuntimeValue, function.parameters)
+    for i := range args {
+        args[i] = fromSlot(function.locals[i], machine.stack[fp + i])
+    }
 
-                    /* if we are handling a return then don't change the branch value so that all parent blocks
-                     * also do a return. the stack will contain all kinds of stuff, but the function return
-                     * will pop off the values it needs
-                     */
-                    if branch == ReturnLabel {
-                        // labels.Pop()
-                        return instruction+1, branch, nil
-                    }
+    results, err := callHostFunction(function, machine.store, args)
+    if err != nil {
+        return err
+    }
 
-                    /* go back to the same block instruction if we are branching to this loop */
-                    if branch == 1 && block.Kind == core.BlockKindLoop {
-                        /* don't pop anything from the stack if we are re-entering the loop */
-                        // labels.Pop()
-                        return instruction, 0, nil
-                    }
+    if len(results) != len(function.results) {
+        return fmt.Errorf("host function returned %v values but %v were expected", len(results), len(function.results))
+    }
 
-                    // fmt.Printf("Branch to %v\n", branch)
-                    if branch == 1 {
-                        if len(block.ExpectedType) > stack.Size() {
-                            return 0, 0, fmt.Errorf("not enough values on the stack to return from the block")
-                        }
-                        /* we are jumping back to some block that only cares about the last N values on the stack, so pop all values
-                         * between whatever was on the stack when the block was entered and what is there now
-                         */
-                        results := stack.PopN(len(block.ExpectedType))
-
-                        for _, last := range results {
-                            if last.Kind == RuntimeValueNone {
-                                return 0, 0, fmt.Errorf("invalid runtime value on stack after branch")
-                            }
-                        }
+    err = machine.reserve(fp + len(results))
+    if err != nil {
+        return err
+    }
 
-                        /* Remove all values on the stack that were produced during the dynamic extent of this block
-                         */
-                        // size := labels.Pop()
-                        size := currentStackSize
-                        stack.Reduce(size)
-                        stack.PushAll(results)
-                    } else {
-                        // labels.Pop()
-                    }
+    for i, result := range results {
+        machine.stack[fp + i] = toSlot(result)
+    }
 
-                    /* otherwise go to the instruction after this block */
-                    return instruction+1, branch-1, nil
-                }
-            }
-            // labels.Pop()
-
-        case *core.UnreachableExpression:
-            return 0, 0, Trap("unreachable")
-        case *core.SelectExpression:
-            c := stack.Pop()
-
-            v2 := stack.Pop()
-            v1 := stack.Pop()
-            if c.I32 != 0 {
-                stack.Push(v1)
-            } else {
-                stack.Push(v2)
-            }
-        case *core.I32MulExpression:
-            stack.Push(RuntimeValue{
-                Kind: RuntimeValueI32,
-                I32: stack.Pop().I32 * stack.Pop().I32,
-            })
-        case *core.I32ConstExpression:
-            expr := current.(*core.I32ConstExpression)
-            stack.Push(RuntimeValue{
-                Kind: RuntimeValueI32,
-                I32: expr.N,
-            })
-        case *core.I64ConstExpression:
-            expr := current.(*core.I64ConstExpression)
-            stack.Push(RuntimeValue{
-                Kind: RuntimeValueI64,
-                I64: expr.N,
-            })
-        case *core.I64LeuExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            if uint64(b.I64) <= uint64(a.I64) {
-                stack.Push(True)
-            } else {
-                stack.Push(False)
-            }
-        case *core.I32LeuExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            if uint32(b.I32) <= uint32(a.I32) {
-                stack.Push(True)
-            } else {
-                stack.Push(False)
-            }
-        case *core.I32LesExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            if b.I32 <= a.I32 {
-                stack.Push(True)
-            } else {
-                stack.Push(False)
-            }
-        case *core.I32NeExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            if b.I32 != a.I32 {
-                stack.Push(True)
-            } else {
-                stack.Push(False)
-            }
-        case *core.I64ExtendI32uExpression:
-            stack.Push(i64(int64(uint32(stack.Pop().I32))))
-        case *core.I32Extend8sExpression:
-            stack.Push(i32(int32(int8(stack.Pop().I32))))
-        case *core.I32Extend16sExpression:
-            stack.Push(i32(int32(int16(stack.Pop().I32))))
-        case *core.I64ExtendI32sExpression:
-            value := stack.Pop()
-            stack.Push(i64(int64(value.I32)))
-        case *core.F64AddExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            stack.Push(f64(a.F64 + b.F64))
-        case *core.F32ConstExpression:
-            expr := current.(*core.F32ConstExpression)
-            stack.Push(RuntimeValue{
-                Kind: RuntimeValueF32,
-                F32: expr.N,
-            })
-        case *core.F64ConstExpression:
-            expr := current.(*core.F64ConstExpression)
-            stack.Push(RuntimeValue{
-                Kind: RuntimeValueF64,
-                F64: expr.N,
-            })
-        case *core.F64LeExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            if b.F64 < a.F64 {
-                stack.Push(True)
-            } else {
-                stack.Push(False)
-            }
-        case *core.F32EqExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            if b.F32 == a.F32 {
-                stack.Push(True)
-            } else {
-                stack.Push(False)
-            }
-        case *core.F64NeExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            if b.F64 != a.F64 {
-                stack.Push(True)
-            } else {
-                stack.Push(False)
-            }
-        case *core.F32NeExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            if b.F32 != a.F32 {
-                stack.Push(True)
-            } else {
-                stack.Push(False)
-            }
-        case *core.F32DivExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            stack.Push(f32(b.F32 / a.F32))
-        case *core.F32SubExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            stack.Push(f32(b.F32 - a.F32))
-        case *core.F32AddExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            stack.Push(f32(b.F32 + a.F32))
-        case *core.F32SqrtExpression:
-            value := stack.Pop()
-            stack.Push(f32(float32(math.Sqrt(float64(value.F32)))))
-        case *core.F32GtExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            if b.F32 > a.F32 {
-                stack.Push(True)
-            } else {
-                stack.Push(False)
-            }
-        case *core.F32LtExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            if b.F32 < a.F32 {
-                stack.Push(True)
-            } else {
-                stack.Push(False)
-            }
-        case *core.F32NegExpression:
-            stack.Push(f32(-stack.Pop().F32))
-        case *core.F64NegExpression:
-            stack.Push(f64(-stack.Pop().F64))
-        case *core.F64ConvertI64uExpression:
-            stack.Push(f64(float64(stack.Pop().I64)))
-        case *core.F64ConvertI32uExpression:
-            /* FIXME: check this */
-            stack.Push(f64(float64(uint32(stack.Pop().I32))))
-        case *core.F64ConvertI32sExpression:
-            stack.Push(f64(float64(stack.Pop().I32)))
-        case *core.I64TruncF64sExpression:
-            /* FIXME: handle NaN and infinity */
-            stack.Push(i64(int64(stack.Pop().F64)))
-        case *core.F64PromoteF32Expression:
-            /* FIXME: handle NaN stuff */
-            stack.Push(f64(float64(stack.Pop().F32)))
-        case *core.I32WrapI64Expression:
-            /* FIXME: not sure about this one */
-            value := stack.Pop()
-            stack.Push(i32(int32(value.I64 % int64(math.MaxInt32))))
-        case *core.I64LtuExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            if uint64(b.I64) < uint64(a.I64) {
-                stack.Push(True)
-            } else {
-                stack.Push(False)
-            }
-        case *core.I32LtuExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            if uint32(b.I32) < uint32(a.I32) {
-                stack.Push(True)
-            } else {
-                stack.Push(False)
-            }
-        case *core.I32LtsExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            if b.I32 < a.I32 {
-                stack.Push(True)
-            } else {
-                stack.Push(False)
-            }
-        case *core.I32EqExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            if b.I32 == a.I32 {
-                stack.Push(True)
-            } else {
-                stack.Push(False)
-            }
-        case *core.F64GeExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            if b.F64 >= a.F64 {
-                stack.Push(True)
-            } else {
-                stack.Push(False)
-            }
-        case *core.F64GtExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            if b.F64 > a.F64 {
-                stack.Push(True)
-            } else {
-                stack.Push(False)
-            }
-        case *core.F32GeExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            if b.F32 >= a.F32 {
-                stack.Push(True)
-            } else {
-                stack.Push(False)
-            }
-        case *core.F32LeExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            if b.F32 <= a.F32 {
-                stack.Push(True)
-            } else {
-                stack.Push(False)
-            }
-        case *core.F64LtExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            if b.F64 < a.F64 {
-                stack.Push(True)
-            } else {
-                stack.Push(False)
-            }
-        case *core.F64MaxExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            if a.F64 > b.F64 {
-                stack.Push(a)
-            } else {
-                stack.Push(b)
-            }
-        case *core.F64EqExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            if a.F64 == b.F64 {
-                stack.Push(a)
-            } else {
-                stack.Push(b)
-            }
-        case *core.F64CopySignExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            if a.F64 < 0 {
-                if b.F64 < 0 {
-                    stack.Push(b)
-                } else {
-                    stack.Push(f64(-b.F64))
-                }
-            } else {
-                if b.F64 > 0 {
-                    stack.Push(b)
-                } else {
-                    stack.Push(f64(-b.F64))
-                }
-            }
-        case *core.F32CopySignExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            if a.F32 < 0 {
-                if b.F32 < 0 {
-                    stack.Push(b)
-                } else {
-                    stack.Push(f32(-b.F32))
-                }
-            } else {
-                if b.F32 > 0 {
-                    stack.Push(b)
-                } else {
-                    stack.Push(f32(-b.F32))
-                }
-            }
-        case *core.F64DivExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            stack.Push(f64(b.F64 / a.F64))
-        case *core.F64MulExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            stack.Push(f64(b.F64 * a.F64))
-        case *core.F32MulExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            stack.Push(f32(b.F32 * a.F32))
-        case *core.F64SubExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            stack.Push(f64(b.F64 - a.F64))
-        case *core.F64MinExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            if a.F64 < b.F64 {
-                stack.Push(a)
-            } else {
-                stack.Push(b)
-            }
-        case *core.F32MinExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            if a.F32 < b.F32 {
-                stack.Push(a)
-            } else {
-                stack.Push(b)
-            }
-        case *core.F32MaxExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            if a.F32 > b.F32 {
-                stack.Push(a)
-            } else {
-                stack.Push(b)
-            }
-        case *core.MemoryGrowExpression:
-            if len(store.Memory) == 0 {
-                return 0, 0, fmt.Errorf("no memory defined for grow")
-            }
-
-            size := stack.Pop()
-
-            limit := frame.Module.GetMemorySection().Memories[0]
-            if limit.HasMaximum && len(store.Memory) / MemoryPageSize + int(size.I32) >= int(limit.Maximum) {
-                stack.Push(RuntimeValue{
-                    Kind: RuntimeValueI32,
-                    I32: -1,
-                })
-            } else {
-                oldSize := len(store.Memory[0]) / MemoryPageSize
-                more := make([]byte, size.I32 * MemoryPageSize)
-                store.Memory[0] = append(store.Memory[0], more...)
-                stack.Push(RuntimeValue{
-                    Kind: RuntimeValueI32,
-                    I32: int32(oldSize),
-                })
-            }
-
-        case *core.F32LoadExpression:
-            if len(store.Memory) == 0 {
-                return 0, 0, fmt.Errorf("no memory available for f32.load")
-            }
-
-            memory := store.Memory[0]
-
-            index := stack.Pop()
-
-            if int(index.I32) >= len(memory) {
-                return 0, 0, Trap(fmt.Sprintf("invalid memory index %v", index.I32))
-            }
-
-            stack.Push(f32(float32(binary.LittleEndian.Uint32(memory[index.I32:]))))
-
-        case *core.I32LoadExpression:
-            if len(store.Memory) == 0 {
-                return 0, 0, fmt.Errorf("no memory available for i32.load")
-            }
-
-            memory := store.Memory[0]
-
-            index := stack.Pop()
-
-            if int(index.I32) >= len(memory) {
-                return 0, 0, Trap(fmt.Sprintf("invalid memory index %v", index.I32))
-            }
-
-            stack.Push(i32(int32(binary.LittleEndian.Uint32(memory[index.I32:]))))
-
-        case *core.I32Load16sExpression:
-            if len(store.Memory) == 0 {
-                return 0, 0, fmt.Errorf("no memory available for i32.load8_s")
-            }
-
-            memory := store.Memory[0]
-
-            index := stack.Pop()
-
-            if int(index.I32) >= len(memory) {
-                return 0, 0, Trap(fmt.Sprintf("invalid memory index %v", index.I32))
-            }
-
-            stack.Push(i32(int32(int16(binary.LittleEndian.Uint16(memory[index.I32:])))))
-        case *core.I32Load16uExpression:
-            if len(store.Memory) == 0 {
-                return 0, 0, fmt.Errorf("no memory available for i32.load8_s")
-            }
-
-            memory := store.Memory[0]
-
-            index := stack.Pop()
-
-            if int(index.I32) >= len(memory) {
-                return 0, 0, Trap(fmt.Sprintf("invalid memory index %v", index.I32))
-            }
-
-            stack.Push(i32(int32(uint16(binary.LittleEndian.Uint16(memory[index.I32:])))))
-        case *core.I32Load8sExpression:
-            if len(store.Memory) == 0 {
-                return 0, 0, fmt.Errorf("no memory available for i32.load8_s")
-            }
-
-            memory := store.Memory[0]
-
-            index := stack.Pop()
-
-            if int(index.I32) >= len(memory) {
-                return 0, 0, Trap(fmt.Sprintf("invalid memory index %v", index.I32))
-            }
-
-            stack.Push(i32(int32(memory[index.I32])))
-        case *core.I32Load8uExpression:
-            if len(store.Memory) == 0 {
-                return 0, 0, fmt.Errorf("no memory available for i32.load8_u")
-            }
-
-            memory := store.Memory[0]
-
-            index := stack.Pop()
+    return nil
+}
 
-            if int(index.I32) >= len(memory) {
-                return 0, 0, Trap(fmt.Sprintf("invalid memory index %v", index.I32))
-            }
+/* move the values that a branch carries down to the height of the block it leaves, returns the new stack pointer */
+func branch(stack []uint64, sp int, fp int, target branchTarget) int {
+    height := fp + target.height
+    if sp - target.keep > height {
+        copy(stack[height:], stack[sp-target.keep:sp])
+    }
 
-            stack.Push(i32(int32(uint32(memory[index.I32]))))
-        case *core.I64Load8sExpression:
-            if len(store.Memory) == 0 {
-                return 0, 0, fmt.Errorf("no memory available for i64.load8_s")
-            }
+    return height + target.keep
+}
 
-            memory := store.Memory[0]
+/* returns the compiled code of a function, which is compiled the first time it is called.
+ * the index is in the function index space, where imported functions come first.
+ */
+func (store *Store) function(module *core.WebAssemblyModule, index uint32) (*compiledFunction, error) {
+    imported := uint32(module.GetImportFunctionCount())
+    if index < imported {
+        if int(index) < len(store.imports) && store.imports[index] != nil {
+            return store.imports[index], nil
+        }
+        item, _ := module.GetFunctionImport(index)
+        return nil, fmt.Errorf("imported function %v.%v is not linked", item.ModuleName, item.Name)
+    }
 
-            index := stack.Pop()
+    defined := int(index - imported)
 
-            if int(index.I32) >= len(memory) {
-                return 0, 0, Trap(fmt.Sprintf("invalid memory index %v", index.I32))
-            }
+    /* the code of a compiled module uses the default fuel costs */
+    if store.compiled != nil && store.FuelCost == nil {
+        return store.compiled.function(defined)
+    }
 
-            stack.Push(i64(int64(memory[index.I32])))
-        case *core.I64Load16sExpression:
-            if len(store.Memory) == 0 {
-                return 0, 0, fmt.Errorf("no memory available for i64.load16_s")
-            }
+    if defined < len(store.functions) && store.functions[defined] != nil {
+        return store.functions[defined], nil
+    }
 
-            memory := store.Memory[0]
+    compiled, err := compileFunction(module, index, store.FuelCost)
+    if err != nil {
+        return nil, err
+    }
 
-            index := stack.Pop()
+    for len(store.functions) <= defined {
+        store.functions = append(store.functions, nil)
+    }
+    store.functions[defined] = compiled
 
-            if int(index.I32) >= len(memory) {
-                return 0, 0, Trap(fmt.Sprintf("invalid memory index %v", index.I32))
-            }
+    return compiled, nil
+}
 
-            stack.Push(i64(int64(int16(binary.LittleEndian.Uint16(memory[index.I32:])))))
-        case *core.I64Load16uExpression:
-            if len(store.Memory) == 0 {
-                return 0, 0, fmt.Errorf("no memory available for i64.load16_u")
-            }
+/* compile the code of a function that is defined in the module, the index is in the function index space */
+func compileFunction(module *core.WebAssemblyModule, index uint32, fuelCost func(core.Expression) uint64) (*compiledFunction, error) {
+    defined := int(index) - module.GetImportFunctionCount()
+    functionTypeIndex := module.GetFunctionTypeIndex(index)
+    codeSection := module.GetCodeSection()
+    if defined < 0 || functionTypeIndex == nil || codeSection == nil || defined >= len(codeSection.Code) {
+        return nil, fmt.Errorf("invalid function index %v", index)
+    }
 
-            memory := store.Memory[0]
+    functionType := module.GetTypeSection().GetFunction(functionTypeIndex.Id)
+    compiled, err := compile(module, codeSection.Code[defined], functionType, fuelCost)
+    if err != nil {
+        return nil, fmt.Errorf("unable to compile function %v: %v", index, err)
+    }
+    compiled.index = index
 
-            index := stack.Pop()
+    return compiled, nil
+}
 
-            if int(index.I32) >= len(memory) {
-                return 0, 0, Trap(fmt.Sprintf("invalid memory index %v", index.I32))
-            }
+/* call a function with the given arguments, the arguments become the first locals of the function */
+func callFunction(ctx context.Context, index uint32, args []RuntimeValue, module *core.WebAssemblyModule, store *Store) ([]RuntimeValue, error) {
+    if store == nil {
+        return nil, fmt.Errorf("no store to call function %v", index)
+    }
 
-            stack.Push(i64(int64(uint16(binary.LittleEndian.Uint16(memory[index.I32:])))))
-        case *core.I64Load32sExpression:
-            if len(store.Memory) == 0 {
-                return 0, 0, fmt.Errorf("no memory available for i64.load32_s")
-            }
+    function, err := store.function(module, index)
+    if err != nil {
+        return nil, err
+    }
 
-            memory := store.Memory[0]
+    return execute(ctx, function, args, module, store)
+}
 
-            index := stack.Pop()
+/* run compiled code on a fresh stack. this is where runtime values are converted to and from stack slots,
+ * the module and store can be nil for code that does not call functions or access globals, tables or memory.
+ */
+func execute(ctx context.Context, function *compiledFunction, args []RuntimeValue, module *core.WebAssemblyModule, store *Store) (results []RuntimeValue, err error) {
+    if len(args) != function.parameters {
+        return nil, fmt.Errorf("function expects %v arguments but got %v", function.parameters, len(args))
+    }
 
-            if int(index.I32) >= len(memory) {
-                return 0, 0, Trap(fmt.Sprintf("invalid memory index %v", index.I32))
+    /* code that was not validated can pop values that do not exist or use locals that are out of range */
+    defer func(){
+        if failure := recover(); failure != nil {
+            problem, ok := failure.(runtime.Error)
+            if !ok {
+                panic(failure)
             }
+            results = nil
+            err = fmt.Errorf("invalid code: %v", problem)
+        }
+    }()
 
-            stack.Push(i64(int64(int32(binary.LittleEndian.Uint32(memory[index.I32:])))))
-        case *core.I64Load32uExpression:
-            if len(store.Memory) == 0 {
-                return 0, 0, fmt.Errorf("no memory available for i64.load32_u")
-            }
+    machine := newMachine(ctx, module, store)
+    err = machine.reserve(len(args))
+    if err != nil {
+        return nil, err
+    }
+    for i, arg := range args {
+        machine.stack[i] = toSlot(arg)
+    }
 
-            memory := store.Memory[0]
+    err = machine.call(function, 0)
+    if err != nil {
+        nameFrames(err, module)
+        return nil, err
+    }
 
-            index := stack.Pop()
+    out := make([]RuntimeValue, len(function.results))
+    for i, kind := range function.results {
+        out[i] = fromSlot(kind, machine.stack[i])
+    }
 
-            if int(index.I32) >= len(memory) {
-                return 0, 0, Trap(fmt.Sprintf("invalid memory index %v", index.I32))
-            }
+    return out, nil
+}
 
-            stack.Push(i64(int64(uint32(binary.LittleEndian.Uint32(memory[index.I32:])))))
-        case *core.I64LoadExpression:
-            if len(store.Memory) == 0 {
-                return 0, 0, fmt.Errorf("no memory available for i64.load32_u")
+/* execute the function whose frame starts at fp and whose arguments are already on the stack, until it
+ * returns. the stack can be reallocated by the functions it calls, so the stack is loaded again after a call.
+ * an error gets the frame of the function, at the instruction that was running, added to its backtrace
+ * where it is returned.
+ *
+ * this loop is the hot path, keep BenchmarkLoop and BenchmarkFib in mind when changing it. checking the
+ * debugger, tracer and profiler separately for every instruction and adding the frame in a deferred
+ * function made the loop take about 18ms instead of 12ms and fib about 6ms instead of 4ms.
+ */
+func run(machine *machine, function *compiledFunction, fp int) error {
+    code := function.code
+    err := machine.reserve(fp + function.maxHeight + 1)
+    if err != nil {
+        return addFrame(err, function, code[0].offset)
+    }
+    stack := machine.stack
+    module := machine.module
+    store := machine.store
+
+    copy(stack[fp+function.parameters:], function.initial)
+    sp := fp + len(function.locals)
+    pc := 0
+    metered := store != nil && store.metered
+    debugging := machine.debugger != nil
+    frame := len(machine.frames) - 1
+    tracing := machine.tracer != nil
+    /* the instruction that the tracer is told about once it is done, with its operands */
+    var traced *instruction
+    var operands []uint64
+    var height int
+    profiling := machine.profiler != nil
+    profile := machine.profile
+    /* the debugger, tracer and profiler are usually all off, so only one check is made per instruction */
+    hooks := debugging || tracing || profiling
+
+    for {
+        current := &code[pc]
+
+        if hooks {
+            /* the previous instruction is done. a call moves the location into the function it called */
+            if traced != nil {
+                machine.location = Location{Function: function.index, Offset: traced.offset}
+                machine.traceInstruction(traced, operands, sp - height, sp)
+            }
+
+            if debugging {
+                machine.frames[frame].pc = pc
+                machine.frames[frame].sp = sp
+                err := machine.debugger.check(machine)
+                if err != nil {
+                    return addFrame(err, function, current.offset)
+                }
             }
 
-            memory := store.Memory[0]
-
-            index := stack.Pop()
-
-            if int(index.I32) >= len(memory) {
-                return 0, 0, Trap(fmt.Sprintf("invalid memory index %v", index.I32))
+            if profiling {
+                machine.profiler.instruction(profile, current.offset)
             }
 
-            stack.Push(i64(int64(binary.LittleEndian.Uint64(memory[index.I32:]))))
-        case *core.I32StoreExpression:
-            value := stack.Pop()
-            index := stack.Pop()
-
-            if len(store.Memory) == 0 {
-                return 0, 0, fmt.Errorf("no memory available for i32.store")
+            if tracing {
+                machine.location = Location{Function: function.index, Offset: current.offset}
+                height = sp
+                operands = append([]uint64(nil), stack[max(sp - current.pops, fp):sp]...)
+                traced = current
             }
+        }
 
-            memory := store.Memory[0]
+        pc += 1
 
-            if int(index.I32) >= len(memory) {
-                return 0, 0, fmt.Errorf("invalid memory location: %v", index)
+        if metered {
+            if store.fuel < current.cost {
+                return addFrame(ErrOutOfFuel, function, current.offset)
             }
+            store.fuel -= current.cost
+            store.consumed += current.cost
+        }
 
-            binary.LittleEndian.PutUint32(memory[index.I32:], uint32(value.I32))
-        case *core.I64Store8Expression:
-            value := stack.Pop()
-            index := stack.Pop()
-
-            if len(store.Memory) == 0 {
-                return 0, 0, fmt.Errorf("no memory available for i32.store")
-            }
+        switch current.op {
+            case opUnreachable:
+                return addFrame(Trap("unreachable"), function, current.offset)
+            /* only a branch to a loop goes backwards */
+            case opBranch:
+                if current.branch.pc < pc && machine.interrupted() {
+                    return addFrame(ErrInterrupted, function, current.offset)
+                }
+                sp = branch(stack, sp, fp, current.branch)
+                pc = current.branch.pc
+            case opBranchIf:
+                sp -= 1
+                if uint32(stack[sp]) != 0 {
+                    if current.branch.pc < pc && machine.interrupted() {
+                        return addFrame(ErrInterrupted, function, current.offset)
+                    }
+                    sp = branch(stack, sp, fp, current.branch)
+                    pc = current.branch.pc
+                }
+            case opBranchTable:
+                sp -= 1
+                index := uint32(stack[sp])
+                last := uint32(len(current.table) - 1)
+                if index > last {
+                    index = last
+                }
+                target := current.table[index]
+                if target.pc < pc && machine.interrupted() {
+                    return addFrame(ErrInterrupted, function, current.offset)
+                }
+                sp = branch(stack, sp, fp, target)
+                pc = target.pc
+            case opJump:
+                pc = current.branch.pc
+            case opJumpIfZero:
+                sp -= 1
+                if uint32(stack[sp]) == 0 {
+                    pc = current.branch.pc
+                }
+            case opReturn:
+                results := len(function.results)
+                if sp - results < fp + len(function.locals) {
+                    return addFrame(Trap("not enough values on the stack"), function, current.offset)
+                }
+                copy(stack[fp:], stack[sp-results:sp])
+                return nil
 
-            memory := store.Memory[0]
+            case opCall:
+                if store == nil {
+                    return addFrame(fmt.Errorf("no store to call function %v", current.index), function, current.offset)
+                }
+                callee, err := store.function(module, current.index)
+                if err != nil {
+                    return addFrame(err, function, current.offset)
+                }
 
-            if int(index.I32) >= len(memory) {
-                return 0, 0, fmt.Errorf("invalid memory location: %v", index)
-            }
+                sp -= callee.parameters
+                err = machine.call(callee, sp)
+                if err != nil {
+                    return addFrame(err, function, current.offset)
+                }
+                stack = machine.stack
+                sp += len(callee.results)
 
-            binary.LittleEndian.PutUint64(memory[index.I32:], uint64(int8(value.I64)))
-        case *core.I32Store16Expression:
-            value := stack.Pop()
-            index := stack.Pop()
+            case opCallIndirect:
+                if store == nil || int(current.index) >= len(store.Tables) {
+                    return addFrame(fmt.Errorf("invalid table index %v", current.index), function, current.offset)
+                }
 
-            if len(store.Memory) == 0 {
-                return 0, 0, fmt.Errorf("no memory available for i32.store")
-            }
+                table := store.Tables[current.index]
+                sp -= 1
+                index := uint32(stack[sp])
 
-            memory := store.Memory[0]
+                if int(index) >= len(table.Elements) {
+                    return addFrame(Trap(fmt.Sprintf("undefined element %v", index)), function, current.offset)
+                }
 
-            if int(index.I32) >= len(memory) {
-                return 0, 0, fmt.Errorf("invalid memory location: %v", index)
-            }
+                var element *core.FunctionIndex
+                switch table.Elements[index].(type) {
+                    case *core.FunctionIndex:
+                        element = table.Elements[index].(*core.FunctionIndex)
+                    case nil:
+                        return addFrame(Trap("uninitialized element"), function, current.offset)
+                    default:
+                        return addFrame(fmt.Errorf("unknown element for call indirect %v", reflect.TypeOf(table.Elements[index])), function, current.offset)
+                }
 
-            binary.LittleEndian.PutUint16(memory[index.I32:], uint16(int16(value.I32)))
-        case *core.I32Store8Expression:
-            value := stack.Pop()
-            index := stack.Pop()
+                expected := module.GetTypeSection().GetFunction(uint32(current.value))
+                actualIndex := module.GetFunctionTypeIndex(element.Id)
+                if actualIndex == nil {
+                    return addFrame(fmt.Errorf("invalid function index %v", element.Id), function, current.offset)
+                }
+                actual := module.GetTypeSection().GetFunction(actualIndex.Id)
+                if !actual.Equals(expected) {
+                    return addFrame(Trap("indirect call type mismatch"), function, current.offset)
+                }
 
-            if len(store.Memory) == 0 {
-                return 0, 0, fmt.Errorf("no memory available for i32.store")
-            }
+                callee, err := store.function(module, element.Id)
+                if err != nil {
+                    return addFrame(err, function, current.offset)
+                }
 
-            memory := store.Memory[0]
+                sp -= callee.parameters
+                err = machine.call(callee, sp)
+                if err != nil {
+                    return addFrame(err, function, current.offset)
+                }
+                stack = machine.stack
+                sp += len(callee.results)
+
+            case opDrop:
+                sp -= 1
+            case opSelect:
+                sp -= 2
+                if uint32(stack[sp+1]) == 0 {
+                    stack[sp-1] = stack[sp]
+                }
 
-            if int(index.I32) >= len(memory) {
-                return 0, 0, fmt.Errorf("invalid memory location: %v", index)
-            }
+            case opLocalGet:
+                stack[sp] = stack[fp + int(current.index)]
+                sp += 1
+            case opLocalSet:
+                sp -= 1
+                stack[fp + int(current.index)] = stack[sp]
+            case opLocalTee:
+                stack[fp + int(current.index)] = stack[sp-1]
+            case opGlobalGet:
+                if store == nil || int(current.index) >= len(store.Globals) {
+                    return addFrame(fmt.Errorf("unable to get global %v", current.index), function, current.offset)
+                }
+                stack[sp] = toSlot(store.Globals[current.index].Value)
+                sp += 1
+            case opGlobalSet:
+                if store == nil || int(current.index) >= len(store.Globals) {
+                    return addFrame(fmt.Errorf("unable to set global %v", current.index), function, current.offset)
+                }
+                global := &store.Globals[current.index]
+                if !global.Mutable {
+                    return addFrame(fmt.Errorf("global %v is not mutable", current.index), function, current.offset)
+                }
+                sp -= 1
+                global.Value = fromSlot(global.Type, stack[sp])
+
+            case opI32Const, opI64Const, opF32Const, opF64Const:
+                stack[sp] = current.value
+                sp += 1
+            case opRefNull:
+                stack[sp] = RuntimeValueRefNull
+                sp += 1
+            case opRefFunc, opRefExtern:
+                stack[sp] = uint64(current.index)
+                sp += 1
+
+            case opMemoryGrow:
+                if store == nil || len(store.Memory) == 0 {
+                    return addFrame(fmt.Errorf("no memory defined for grow"), function, current.offset)
+                }
 
-            memory[index.I32] = byte(value.I32)
-        case *core.I64StoreExpression:
-            value := stack.Pop()
-            index := stack.Pop()
+                pages := uint64(uint32(stack[sp-1]))
+                oldSize := uint64(len(store.Memory[0]) / MemoryPageSize)
 
-            if len(store.Memory) == 0 {
-                return 0, 0, fmt.Errorf("no memory available for i64.store")
-            }
+                /* memory can never have more than 2^16 pages */
+                maximum := uint64(65536)
+                if module != nil {
+                    limit, _ := module.GetMemoryLimit(0)
+                    if limit.HasMaximum {
+                        maximum = uint64(limit.Maximum)
+                    }
+                }
 
-            memory := store.Memory[0]
+                if oldSize + pages > maximum {
+                    stack[sp-1] = fromI32(-1)
+                } else {
+                    store.Memory[0] = append(store.Memory[0], make([]byte, pages * MemoryPageSize)...)
+                    stack[sp-1] = oldSize
+                }
 
-            if int(index.I32) >= len(memory) {
-                return 0, 0, fmt.Errorf("invalid memory location: %v", index)
-            }
+            case opI32Load, opI32Load8s, opI32Load8u, opI32Load16s, opI32Load16u,
+                 opI64Load, opI64Load8s, opI64Load8u, opI64Load16s, opI64Load16u, opI64Load32s, opI64Load32u,
+                 opF32Load, opF64Load:
+                value, err := load(current, stack[sp-1], store)
+                if err != nil {
+                    return addFrame(err, function, current.offset)
+                }
+                stack[sp-1] = value
 
-            binary.LittleEndian.PutUint64(memory[index.I32:], uint64(value.I64))
-        case *core.I64Store16Expression:
-            value := stack.Pop()
-            index := stack.Pop()
+            case opI32Store, opI64Store, opF32Store, opF64Store, opI32Store8, opI32Store16, opI64Store8, opI64Store16, opI64Store32:
+                sp -= 2
+                err := storeValue(current, stack[sp], stack[sp+1], store)
+                if err != nil {
+                    return addFrame(err, function, current.offset)
+                }
 
-            if len(store.Memory) == 0 {
-                return 0, 0, fmt.Errorf("no memory available for i64.store16")
-            }
+            case opI32Eqz:
+                stack[sp-1] = boolean(uint32(stack[sp-1]) == 0)
+            case opI32Eq:
+                sp -= 1
+                stack[sp-1] = boolean(uint32(stack[sp-1]) == uint32(stack[sp]))
+            case opI32Ne:
+                sp -= 1
+                stack[sp-1] = boolean(uint32(stack[sp-1]) != uint32(stack[sp]))
+            case opI32Lts:
+                sp -= 1
+                stack[sp-1] = boolean(int32(stack[sp-1]) < int32(stack[sp]))
+            case opI32Ltu:
+                sp -= 1
+                stack[sp-1] = boolean(uint32(stack[sp-1]) < uint32(stack[sp]))
+            case opI32Gts:
+                sp -= 1
+                stack[sp-1] = boolean(int32(stack[sp-1]) > int32(stack[sp]))
+            case opI32Gtu:
+                sp -= 1
+                stack[sp-1] = boolean(uint32(stack[sp-1]) > uint32(stack[sp]))
+            case opI32Les:
+                sp -= 1
+                stack[sp-1] = boolean(int32(stack[sp-1]) <= int32(stack[sp]))
+            case opI32Leu:
+                sp -= 1
+                stack[sp-1] = boolean(uint32(stack[sp-1]) <= uint32(stack[sp]))
+            case opI32Ges:
+                sp -= 1
+                stack[sp-1] = boolean(int32(stack[sp-1]) >= int32(stack[sp]))
+            case opI32Geu:
+                sp -= 1
+                stack[sp-1] = boolean(uint32(stack[sp-1]) >= uint32(stack[sp]))
+            case opI64Eqz:
+                stack[sp-1] = boolean(stack[sp-1] == 0)
+            case opI64Eq:
+                sp -= 1
+                stack[sp-1] = boolean(stack[sp-1] == stack[sp])
+            case opI64Ne:
+                sp -= 1
+                stack[sp-1] = boolean(stack[sp-1] != stack[sp])
+            case opI64Lts:
+                sp -= 1
+                stack[sp-1] = boolean(int64(stack[sp-1]) < int64(stack[sp]))
+            case opI64Ltu:
+                sp -= 1
+                stack[sp-1] = boolean(stack[sp-1] < stack[sp])
+            case opI64Gts:
+                sp -= 1
+                stack[sp-1] = boolean(int64(stack[sp-1]) > int64(stack[sp]))
+            case opI64Gtu:
+                sp -= 1
+                stack[sp-1] = boolean(stack[sp-1] > stack[sp])
+            case opI64Les:
+                sp -= 1
+                stack[sp-1] = boolean(int64(stack[sp-1]) <= int64(stack[sp]))
+            case opI64Leu:
+                sp -= 1
+                stack[sp-1] = boolean(stack[sp-1] <= stack[sp])
+            case opI64Ges:
+                sp -= 1
+                stack[sp-1] = boolean(int64(stack[sp-1]) >= int64(stack[sp]))
+            case opI64Geu:
+                sp -= 1
+                stack[sp-1] = boolean(stack[sp-1] >= stack[sp])
+            case opF32Eq:
+                sp -= 1
+                stack[sp-1] = boolean(toF32(stack[sp-1]) == toF32(stack[sp]))
+            case opF32Ne:
+                sp -= 1
+                stack[sp-1] = boolean(toF32(stack[sp-1]) != toF32(stack[sp]))
+            case opF32Lt:
+                sp -= 1
+                stack[sp-1] = boolean(toF32(stack[sp-1]) < toF32(stack[sp]))
+            case opF32Gt:
+                sp -= 1
+                stack[sp-1] = boolean(toF32(stack[sp-1]) > toF32(stack[sp]))
+            case opF32Le:
+                sp -= 1
+                stack[sp-1] = boolean(toF32(stack[sp-1]) <= toF32(stack[sp]))
+            case opF32Ge:
+                sp -= 1
+                stack[sp-1] = boolean(toF32(stack[sp-1]) >= toF32(stack[sp]))
+            case opF64Eq:
+                sp -= 1
+                stack[sp-1] = boolean(toF64(stack[sp-1]) == toF64(stack[sp]))
+            case opF64Ne:
+                sp -= 1
+                stack[sp-1] = boolean(toF64(stack[sp-1]) != toF64(stack[sp]))
+            case opF64Lt:
+                sp -= 1
+                stack[sp-1] = boolean(toF64(stack[sp-1]) < toF64(stack[sp]))
+            case opF64Gt:
+                sp -= 1
+                stack[sp-1] = boolean(toF64(stack[sp-1]) > toF64(stack[sp]))
+            case opF64Le:
+                sp -= 1
+                stack[sp-1] = boolean(toF64(stack[sp-1]) <= toF64(stack[sp]))
+            case opF64Ge:
+                sp -= 1
+                stack[sp-1] = boolean(toF64(stack[sp-1]) >= toF64(stack[sp]))
+
+            case opI32Clz:
+                stack[sp-1] = uint64(bits.LeadingZeros32(uint32(stack[sp-1])))
+            case opI32Ctz:
+                stack[sp-1] = uint64(bits.TrailingZeros32(uint32(stack[sp-1])))
+            case opI32Popcnt:
+                stack[sp-1] = uint64(bits.OnesCount32(uint32(stack[sp-1])))
+            case opI32Add:
+                sp -= 1
+                stack[sp-1] = uint64(uint32(stack[sp-1]) + uint32(stack[sp]))
+            case opI32Sub:
+                sp -= 1
+                stack[sp-1] = uint64(uint32(stack[sp-1]) - uint32(stack[sp]))
+            case opI32Mul:
+                sp -= 1
+                stack[sp-1] = uint64(uint32(stack[sp-1]) * uint32(stack[sp]))
+            case opI32Divs:
+                sp -= 1
+                a, b := int32(stack[sp-1]), int32(stack[sp])
+                if b == 0 {
+                    return addFrame(Trap("integer divide by zero"), function, current.offset)
+                }
+                if a == math.MinInt32 && b == -1 {
+                    return addFrame(Trap("integer overflow"), function, current.offset)
+                }
+                stack[sp-1] = fromI32(a / b)
+            case opI32Divu:
+                sp -= 1
+                if uint32(stack[sp]) == 0 {
+                    return addFrame(Trap("integer divide by zero"), function, current.offset)
+                }
+                stack[sp-1] = uint64(uint32(stack[sp-1]) / uint32(stack[sp]))
+            case opI32Rems:
+                sp -= 1
+                if uint32(stack[sp]) == 0 {
+                    return addFrame(Trap("integer divide by zero"), function, current.offset)
+                }
+                stack[sp-1] = fromI32(int32(stack[sp-1]) % int32(stack[sp]))
+            case opI32Remu:
+                sp -= 1
+                if uint32(stack[sp]) == 0 {
+                    return addFrame(Trap("integer divide by zero"), function, current.offset)
+                }
+                stack[sp-1] = uint64(uint32(stack[sp-1]) % uint32(stack[sp]))
+            case opI32And:
+                sp -= 1
+                stack[sp-1] = stack[sp-1] & stack[sp]
+            case opI32Or:
+                sp -= 1
+                stack[sp-1] = stack[sp-1] | stack[sp]
+            case opI32Xor:
+                sp -= 1
+                stack[sp-1] = stack[sp-1] ^ stack[sp]
+            case opI32Shl:
+                sp -= 1
+                stack[sp-1] = uint64(uint32(stack[sp-1]) << (uint32(stack[sp]) % 32))
+            case opI32Shrs:
+                sp -= 1
+                stack[sp-1] = fromI32(int32(stack[sp-1]) >> (uint32(stack[sp]) % 32))
+            case opI32Shru:
+                sp -= 1
+                stack[sp-1] = uint64(uint32(stack[sp-1]) >> (uint32(stack[sp]) % 32))
+            case opI32Rotl:
+                sp -= 1
+                stack[sp-1] = uint64(bits.RotateLeft32(uint32(stack[sp-1]), int(int32(stack[sp]))))
+            case opI32Rotr:
+                sp -= 1
+                stack[sp-1] = uint64(bits.RotateLeft32(uint32(stack[sp-1]), -int(int32(stack[sp]))))
+            case opI64Ctz:
+                stack[sp-1] = uint64(bits.TrailingZeros64(stack[sp-1]))
+            case opI64Add:
+                sp -= 1
+                stack[sp-1] = stack[sp-1] + stack[sp]
+            case opI64Sub:
+                sp -= 1
+                stack[sp-1] = stack[sp-1] - stack[sp]
+            case opI64Mul:
+                sp -= 1
+                stack[sp-1] = stack[sp-1] * stack[sp]
+            case opI64Divs:
+                sp -= 1
+                a, b := int64(stack[sp-1]), int64(stack[sp])
+                if b == 0 {
+                    return addFrame(Trap("integer divide by zero"), function, current.offset)
+                }
+                if a == math.MinInt64 && b == -1 {
+                    return addFrame(Trap("integer overflow"), function, current.offset)
+                }
+                stack[sp-1] = uint64(a / b)
+            case opI64Divu:
+                sp -= 1
+                if stack[sp] == 0 {
+                    return addFrame(Trap("integer divide by zero"), function, current.offset)
+                }
+                stack[sp-1] = stack[sp-1] / stack[sp]
+            case opI64Rems:
+                sp -= 1
+                if stack[sp] == 0 {
+                    return addFrame(Trap("integer divide by zero"), function, current.offset)
+                }
+                stack[sp-1] = uint64(int64(stack[sp-1]) % int64(stack[sp]))
+            case opI64Remu:
+                sp -= 1
+                if stack[sp] == 0 {
+                    return addFrame(Trap("integer divide by zero"), function, current.offset)
+                }
+                stack[sp-1] = stack[sp-1] % stack[sp]
+            case opI64And:
+                sp -= 1
+                stack[sp-1] = stack[sp-1] & stack[sp]
+            case opI64Or:
+                sp -= 1
+                stack[sp-1] = stack[sp-1] | stack[sp]
+            case opI64Xor:
+                sp -= 1
+                stack[sp-1] = stack[sp-1] ^ stack[sp]
+            case opI64Shl:
+                sp -= 1
+                stack[sp-1] = stack[sp-1] << (stack[sp] % 64)
+            case opI64Shrs:
+                sp -= 1
+                stack[sp-1] = uint64(int64(stack[sp-1]) >> (stack[sp] % 64))
+            case opI64Shru:
+                sp -= 1
+                stack[sp-1] = stack[sp-1] >> (stack[sp] % 64)
+
+            case opF32Neg:
+                stack[sp-1] = stack[sp-1] ^ uint64(f32SignBit)
+            case opF32Sqrt:
+                value := uint32(stack[sp-1])
+                stack[sp-1] = uint64(f32Result(float32(math.Sqrt(float64(math.Float32frombits(value)))), value))
+            case opF32Add:
+                sp -= 1
+                a, b := uint32(stack[sp-1]), uint32(stack[sp])
+                stack[sp-1] = uint64(f32Result(math.Float32frombits(a) + math.Float32frombits(b), a, b))
+            case opF32Sub:
+                sp -= 1
+                a, b := uint32(stack[sp-1]), uint32(stack[sp])
+                stack[sp-1] = uint64(f32Result(math.Float32frombits(a) - math.Float32frombits(b), a, b))
+            case opF32Mul:
+                sp -= 1
+                a, b := uint32(stack[sp-1]), uint32(stack[sp])
+                stack[sp-1] = uint64(f32Result(math.Float32frombits(a) * math.Float32frombits(b), a, b))
+            case opF32Div:
+                sp -= 1
+                a, b := uint32(stack[sp-1]), uint32(stack[sp])
+                stack[sp-1] = uint64(f32Result(math.Float32frombits(a) / math.Float32frombits(b), a, b))
+            case opF32Min:
+                sp -= 1
+                stack[sp-1] = uint64(f32Min(uint32(stack[sp-1]), uint32(stack[sp])))
+            case opF32Max:
+                sp -= 1
+                stack[sp-1] = uint64(f32Max(uint32(stack[sp-1]), uint32(stack[sp])))
+            case opF32CopySign:
+                sp -= 1
+                stack[sp-1] = uint64(uint32(stack[sp-1]) &^ f32SignBit | uint32(stack[sp]) & f32SignBit)
+            case opF64Neg:
+                stack[sp-1] = stack[sp-1] ^ f64SignBit
+            case opF64Add:
+                sp -= 1
+                a, b := stack[sp-1], stack[sp]
+                stack[sp-1] = f64Result(toF64(a) + toF64(b), a, b)
+            case opF64Sub:
+                sp -= 1
+                a, b := stack[sp-1], stack[sp]
+                stack[sp-1] = f64Result(toF64(a) - toF64(b), a, b)
+            case opF64Mul:
+                sp -= 1
+                a, b := stack[sp-1], stack[sp]
+                stack[sp-1] = f64Result(toF64(a) * toF64(b), a, b)
+            case opF64Div:
+                sp -= 1
+                a, b := stack[sp-1], stack[sp]
+                stack[sp-1] = f64Result(toF64(a) / toF64(b), a, b)
+            case opF64Min:
+                sp -= 1
+                stack[sp-1] = f64Min(stack[sp-1], stack[sp])
+            case opF64Max:
+                sp -= 1
+                stack[sp-1] = f64Max(stack[sp-1], stack[sp])
+            case opF64CopySign:
+                sp -= 1
+                stack[sp-1] = stack[sp-1] &^ f64SignBit | stack[sp] & f64SignBit
+
+            case opI32WrapI64:
+                stack[sp-1] = uint64(uint32(stack[sp-1]))
+            case opI32Extend8s:
+                stack[sp-1] = fromI32(int32(int8(stack[sp-1])))
+            case opI32Extend16s:
+                stack[sp-1] = fromI32(int32(int16(stack[sp-1])))
+            case opI64ExtendI32s:
+                stack[sp-1] = uint64(int64(int32(stack[sp-1])))
+            case opI64ExtendI32u:
+                stack[sp-1] = uint64(uint32(stack[sp-1]))
+            case opI64TruncF64s:
+                value := toF64(stack[sp-1])
+                if value != value {
+                    return addFrame(Trap("invalid conversion to integer"), function, current.offset)
+                }
+                /* the truncated value has to fit in the range [-2^63, 2^63) */
+                if value <= -9223372036854777856.0 || value >= 9223372036854775808.0 {
+                    return addFrame(Trap("integer overflow"), function, current.offset)
+                }
+                stack[sp-1] = uint64(int64(value))
+            case opF64ConvertI32s:
+                stack[sp-1] = fromF64(float64(int32(stack[sp-1])))
+            case opF64ConvertI32u:
+                stack[sp-1] = fromF64(float64(uint32(stack[sp-1])))
+            case opF64ConvertI64u:
+                stack[sp-1] = fromF64(float64(stack[sp-1]))
+            case opF64PromoteF32:
+                stack[sp-1] = promoteF32(uint32(stack[sp-1]))
+            /* the bits of a value do not change when it is reinterpreted */
+            case opI32ReinterpretF32, opI64ReinterpretF64, opF32ReinterpretI32, opF64ReinterpretI64:
+
+            default:
+                return addFrame(fmt.Errorf("unknown opcode %v", current.op), function, current.offset)
+        }
+    }
+}
 
-            memory := store.Memory[0]
+/* the number of bytes a load or store instruction accesses, and whether it writes them. ok is false for
+ * instructions that do not access memory
+ */
+func accessSize(op opcode) (size uint64, write bool, ok bool) {
+    switch op {
+        case opI32Load8s, opI32Load8u, opI64Load8s, opI64Load8u: return 1, false, true
+        case opI32Load16s, opI32Load16u, opI64Load16s, opI64Load16u: return 2, false, true
+        case opI32Load, opF32Load, opI64Load32s, opI64Load32u: return 4, false, true
+        case opI64Load, opF64Load: return 8, false, true
+        case opI32Store8, opI64Store8: return 1, true, true
+        case opI32Store16, opI64Store16: return 2, true, true
+        case opI32Store, opF32Store, opI64Store32: return 4, true, true
+        case opI64Store, opF64Store: return 8, true, true
+    }
 
-            if int(index.I32) >= len(memory) {
-                return 0, 0, fmt.Errorf("invalid memory location: %v", index)
-            }
+    return 0, false, false
+}
 
-            binary.LittleEndian.PutUint16(memory[index.I32:], uint16(int16(value.I64)))
-        case *core.F64StoreExpression:
-            value := stack.Pop()
-            index := stack.Pop()
+/* read the value of a load instruction from memory */
+func load(current *instruction, address uint64, store *Store) (uint64, error) {
+    size, _, _ := accessSize(current.op)
 
-            if len(store.Memory) == 0 {
-                return 0, 0, fmt.Errorf("no memory available for i32.store")
-            }
+    memory, err := memoryAccess(store, address, current.value, size)
+    if err != nil {
+        return 0, err
+    }
 
-            memory := store.Memory[0]
+    switch current.op {
+        case opI32Load, opF32Load: return uint64(binary.LittleEndian.Uint32(memory)), nil
+        case opI32Load8s: return fromI32(int32(int8(memory[0]))), nil
+        case opI32Load8u: return uint64(memory[0]), nil
+        case opI32Load16s: return fromI32(int32(int16(binary.LittleEndian.Uint16(memory)))), nil
+        case opI32Load16u: return uint64(binary.LittleEndian.Uint16(memory)), nil
+        case opI64Load, opF64Load: return binary.LittleEndian.Uint64(memory), nil
+        case opI64Load8s: return uint64(int64(int8(memory[0]))), nil
+        case opI64Load8u: return uint64(memory[0]), nil
+        case opI64Load16s: return uint64(int64(int16(binary.LittleEndian.Uint16(memory)))), nil
+        case opI64Load16u: return uint64(binary.LittleEndian.Uint16(memory)), nil
+        case opI64Load32s: return uint64(int64(int32(binary.LittleEndian.Uint32(memory)))), nil
+        case opI64Load32u: return uint64(binary.LittleEndian.Uint32(memory)), nil
+    }
 
-            if int(index.I32) >= len(memory) {
-                return 0, 0, fmt.Errorf("invalid memory location: %v", index)
-            }
+    return 0, fmt.Errorf("unknown load opcode %v", current.op)
+}
 
-            binary.Write(NewByteWriter(memory[index.I32:]), binary.LittleEndian, value.F64)
-        case *core.F32StoreExpression:
-            value := stack.Pop()
-            index := stack.Pop()
+/* write the value of a store instruction to memory */
+func storeValue(current *instruction, address uint64, value uint64, store *Store) error {
+    size, _, _ := accessSize(current.op)
 
-            if len(store.Memory) == 0 {
-                return 0, 0, fmt.Errorf("no memory available for i32.store")
-            }
+    memory, err := memoryAccess(store, address, current.value, size)
+    if err != nil {
+        return err
+    }
 
-            memory := store.Memory[0]
+    if store.dirty != nil {
+        store.MarkMemoryDirty(uint64(uint32(address)) + current.value, size)
+    }
 
-            if int(index.I32) >= len(memory) {
-                return 0, 0, fmt.Errorf("invalid memory location: %v", index)
-            }
+    switch current.op {
+        case opI32Store8, opI64Store8: memory[0] = byte(value)
+        case opI32Store16, opI64Store16: binary.LittleEndian.PutUint16(memory, uint16(value))
+        case opI32Store, opF32Store, opI64Store32: binary.LittleEndian.PutUint32(memory, uint32(value))
+        case opI64Store, opF64Store: binary.LittleEndian.PutUint64(memory, value)
+    }
 
-            binary.Write(NewByteWriter(memory[index.I32:]), binary.LittleEndian, value.F32)
-        case *core.I64GeuExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            if uint64(b.I64) >= uint64(a.I64) {
-                stack.Push(True)
-            } else {
-                stack.Push(False)
-            }
-        case *core.I64GesExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            if b.I64 >= a.I64 {
-                stack.Push(True)
-            } else {
-                stack.Push(False)
-            }
-        case *core.I64LesExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            if b.I64 <= a.I64 {
-                stack.Push(True)
-            } else {
-                stack.Push(False)
-            }
-        case *core.I64NeExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            if b.I64 != a.I64 {
-                stack.Push(True)
-            } else {
-                stack.Push(False)
-            }
-        case *core.I64DivuExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            stack.Push(i64(int64(uint64(b.I64) / uint64(a.I64))))
-        case *core.RefFuncNullExpression:
-            stack.Push(refNull())
-        case *core.RefExternNullExpression:
-            stack.Push(refNull())
-        case *core.RefExternExpression:
-            value := current.(*core.RefExternExpression)
-            stack.Push(refExtern(value.Id))
-        case *core.I32EqzExpression:
-            value := stack.Pop()
-            result := 0
-            if value.I32 == 0 {
-                result = 1
-            }
+    return nil
+}
 
-            stack.Push(i32(int32(result)))
-        case *core.I64EqzExpression:
-            value := stack.Pop()
-            result := 0
-            if value.I64 == 0 {
-                result = 1
+/* the type of the value that a constant expression produces */
+func constantType(expression core.Expression) (core.ValueType, error) {
+    switch expression.(type) {
+        case *core.I32ConstExpression: return core.ValueTypeI32, nil
+        case *core.I64ConstExpression: return core.ValueTypeI64, nil
+        case *core.F32ConstExpression: return core.ValueTypeF32, nil
+        case *core.F64ConstExpression: return core.ValueTypeF64, nil
+        case *core.RefFuncNullExpression, *core.RefFuncExpression: return core.ValueTypeRefFunc, nil
+        case *core.RefExternNullExpression, *core.RefExternExpression: return core.ValueTypeRefExtern, nil
+        case *core.BlockExpression:
+            block := expression.(*core.BlockExpression)
+            if len(block.ExpectedType) == 1 {
+                return block.ExpectedType[0], nil
             }
+    }
 
-            stack.Push(i32(int32(result)))
-
-        case *core.I64DivsExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            stack.Push(i64(b.I64 / a.I64))
-        case *core.I32DivsExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            stack.Push(i32(b.I32 / a.I32))
-        case *core.I32DivuExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            stack.Push(i32(int32(uint32(b.I32) / uint32(a.I32))))
-        case *core.I32CtzExpression:
-            value := stack.Pop()
-            stack.Push(i32(int32(bits.TrailingZeros32(uint32(value.I32)))))
-        case *core.I32ClzExpression:
-            value := stack.Pop()
-            stack.Push(i32(int32(bits.LeadingZeros32(uint32(value.I32)))))
-        case *core.I32PopcntExpression:
-            stack.Push(i32(int32(bits.OnesCount32(uint32(stack.Pop().I32)))))
-        case *core.I64RemsExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            stack.Push(i64(b.I64 % a.I64))
-        case *core.I64RemuExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            stack.Push(i64(int64(uint64(b.I64) % uint64(a.I64))))
-        case *core.I32RemsExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            stack.Push(i32(b.I32 % a.I32))
-        case *core.I32RemuExpression:
-            a := stack.Pop()
-            b := stack.Pop()
-            stack.Push(i32(int32(uint32(b.I32) % uint32(a.I32))))
-        case *core.I64AndExpression:
-            arg1 := stack.Pop()
-            arg2 := stack.Pop()
-            stack.Push(i64(arg1.I64 & arg2.I64))
-        case *core.I64OrExpression:
-            arg1 := stack.Pop()
-            arg2 := stack.Pop()
-            stack.Push(i64(arg1.I64 | arg2.I64))
-        case *core.I64XOrExpression:
-            arg1 := stack.Pop()
-            arg2 := stack.Pop()
-            stack.Push(i64(arg1.I64 ^ arg2.I64))
-        case *core.I32AndExpression:
-            arg1 := stack.Pop()
-            arg2 := stack.Pop()
-            stack.Push(i32(arg1.I32 & arg2.I32))
-        case *core.I32OrExpression:
-            arg1 := stack.Pop()
-            arg2 := stack.Pop()
-            stack.Push(i32(arg1.I32 | arg2.I32))
-        case *core.I32XOrExpression:
-            arg1 := stack.Pop()
-            arg2 := stack.Pop()
-            stack.Push(i32(arg1.I32 ^ arg2.I32))
-        case *core.I64ShlExpression:
-            arg1 := stack.Pop()
-            arg2 := stack.Pop()
-            stack.Push(i64(arg2.I64 << (uint32(arg1.I64) % 64)))
-        case *core.I32ShlExpression:
-            arg1 := stack.Pop()
-            arg2 := stack.Pop()
-            stack.Push(i32(arg2.I32 << (uint32(arg1.I32) % 32)))
-        case *core.I32ShlsExpression:
-            arg1 := stack.Pop()
-            arg2 := stack.Pop()
-            stack.Push(i32(arg2.I32 << arg1.I32))
-        case *core.I32ShluExpression:
-            arg1 := stack.Pop()
-            arg2 := stack.Pop()
-            stack.Push(i32(arg2.I32 << uint32(arg1.I32)))
-        case *core.I32ShrsExpression:
-            arg1 := stack.Pop()
-            arg2 := stack.Pop()
-            stack.Push(i32(arg2.I32 >> (uint32(arg1.I32) % 32)))
-        case *core.I64ShrsExpression:
-            arg1 := stack.Pop()
-            arg2 := stack.Pop()
-            stack.Push(i64(arg2.I64 >> (uint64(arg1.I64) % 64)))
-        case *core.I64ShruExpression:
-            arg1 := stack.Pop()
-            arg2 := stack.Pop()
-            stack.Push(i64(int64(uint64(arg2.I64) >> (uint64(arg1.I64) % 64))))
-        case *core.I32ShruExpression:
-            arg1 := stack.Pop()
-            arg2 := stack.Pop()
-            stack.Push(i32(int32(uint32(arg2.I32) >> (uint32(arg1.I32) % 32))))
-        case *core.I32RotlExpression:
-            arg1 := stack.Pop()
-            arg2 := stack.Pop()
-            stack.Push(i32(int32(bits.RotateLeft32(uint32(arg2.I32), int(arg1.I32)))))
-        case *core.I32RotrExpression:
-            arg1 := stack.Pop()
-            arg2 := stack.Pop()
-            stack.Push(i32(int32(bits.RotateLeft32(uint32(arg2.I32), int(-arg1.I32)))))
-        case *core.I32AddExpression:
-            arg1 := stack.Pop()
-            arg2 := stack.Pop()
-            stack.Push(i32(arg1.I32 + arg2.I32))
-        case *core.I32SubExpression:
-            arg1 := stack.Pop()
-            arg2 := stack.Pop()
-            stack.Push(RuntimeValue{
-                Kind: RuntimeValueI32,
-                I32: arg2.I32 - arg1.I32,
-            })
-        case *core.I64LtsExpression:
-            arg1 := stack.Pop()
-            arg2 := stack.Pop()
-            value := 0
-            if arg2.I64 < arg1.I64 {
-                value = 1
-            }
-            stack.Push(i32(int32(value)))
-        case *core.I64GtsExpression:
-            arg1 := stack.Pop()
-            arg2 := stack.Pop()
-            value := 0
-            if arg2.I64 > arg1.I64 {
-                value = 1
-            }
-            stack.Push(i32(int32(value)))
-        case *core.I64GtuExpression:
-            arg1 := stack.Pop()
-            arg2 := stack.Pop()
-            value := 0
-            if uint64(arg2.I64) > uint64(arg1.I64) {
-                value = 1
-            }
-            stack.Push(i32(int32(value)))
-        case *core.I32GtsExpression:
-            arg1 := stack.Pop()
-            arg2 := stack.Pop()
-            value := 0
-            if arg2.I32 > arg1.I32 {
-                value = 1
-            }
-            stack.Push(i32(int32(value)))
-        case *core.I32GtuExpression:
-            arg1 := stack.Pop()
-            arg2 := stack.Pop()
-            value := 0
-            if uint32(arg2.I32) > uint32(arg1.I32) {
-                value = 1
-            }
-            stack.Push(i32(int32(value)))
-        case *core.I32GesExpression:
-            arg1 := stack.Pop()
-            arg2 := stack.Pop()
-            value := 0
-            if arg2.I32 >= arg1.I32 {
-                value = 1
-            }
-            stack.Push(i32(int32(value)))
-        case *core.I32GeuExpression:
-            arg1 := stack.Pop()
-            arg2 := stack.Pop()
-            value := 0
-            if uint32(arg2.I32) >= uint32(arg1.I32) {
-                value = 1
-            }
-            stack.Push(i32(int32(value)))
-        case *core.I64SubExpression:
-            arg1 := stack.Pop()
-            arg2 := stack.Pop()
-            stack.Push(i64(arg2.I64 - arg1.I64))
-        case *core.I64AddExpression:
-            arg1 := stack.Pop()
-            arg2 := stack.Pop()
-            stack.Push(i64(arg2.I64 + arg1.I64))
-        case *core.I64MulExpression:
-            arg1 := stack.Pop()
-            arg2 := stack.Pop()
-            stack.Push(i64(arg1.I64 * arg2.I64))
-        case *core.I64EqExpression:
-            arg1 := stack.Pop()
-            arg2 := stack.Pop()
-            if arg1.I64 == arg2.I64 {
-                stack.Push(True)
-            } else {
-                stack.Push(False)
-            }
-        case *core.DropExpression:
-            stack.Pop()
-        case *core.ReturnExpression:
-            return 0, ReturnLabel, nil
-        case *core.BranchTableExpression:
-            expr := current.(*core.BranchTableExpression)
-            value := stack.Pop()
-
-            if value.Kind != RuntimeValueI32 {
-                return 0, 0, Trap(fmt.Sprintf("top of stack was not an i32: %+v", value))
-            }
+    return 0, fmt.Errorf("unable to determine the type of %v", reflect.TypeOf(expression))
+}
 
-            /* FIXME: what to do here? */
-            if len(expr.Labels) == 0 {
-                return 0, 0, fmt.Errorf("br_table had no labels")
-            }
+/* evaluate a single expression and return whatever runtimevalue the expression produces */
+func EvaluateOne(expression core.Expression) (RuntimeValue, error) {
+    kind, err := constantType(expression)
+    if err != nil {
+        return RuntimeValue{}, err
+    }
 
-            index := uint32(value.I32)
+    function, err := compileExpressions(nil, []core.Expression{expression}, []core.ValueType{kind})
+    if err != nil {
+        return RuntimeValue{}, err
+    }
 
-            if int(index) < len(expr.Labels) {
-                return 0, int(expr.Labels[index])+1, nil
-            }
+    results, err := execute(context.Background(), function, nil, nil, nil)
+    if err != nil {
+        return RuntimeValue{}, err
+    }
 
-            return 0, int(expr.Labels[len(expr.Labels)-1])+1, nil
+    return results[0], nil
+}
 
-        case *core.BranchExpression:
-            expr := current.(*core.BranchExpression)
-            return 0, int(expr.Label)+1, nil
-        case *core.BranchIfExpression:
-            expr := current.(*core.BranchIfExpression)
-            value := stack.Pop()
-            if value.Kind == RuntimeValueNone {
-                return 0, 0, Trap("no value on stack for br_if")
-            }
+/* evaluate an entire function. the frame holds the arguments
+ */
+func RunCode(code core.Code, frame Frame, functionType core.WebAssemblyFunction, store *Store) ([]RuntimeValue, error) {
+    var fuelCost func(core.Expression) uint64
+    if store != nil {
+        fuelCost = store.FuelCost
+    }
 
-            if value.Kind != RuntimeValueI32 {
-                return 0, 0, Trap(fmt.Sprintf("top of stack was not an i32: %+v", value))
-            }
+    function, err := compile(frame.Module, code, functionType, fuelCost)
+    if err != nil {
+        return nil, err
+    }
 
-            if value.I32 == 0 {
-                // nothing, fall through
-            } else {
-                return 0, int(expr.Label)+1, nil
-            }
-        case *core.LocalGetExpression:
-            expr := current.(*core.LocalGetExpression)
+    return execute(context.Background(), function, frame.Locals, frame.Module, store)
+}
 
-            if len(frame.Locals) <= int(expr.Local) {
-                return 0, 0, fmt.Errorf("unable to get local %v when frame has %v locals", expr.Local, len(frame.Locals))
-            }
-            stack.Push(frame.Locals[expr.Local])
-        case *core.LocalTeeExpression:
-            expr := current.(*core.LocalTeeExpression)
+/* invoke an exported function in the given module */
+func Invoke(module core.WebAssemblyModule, store *Store, name string, args []RuntimeValue) ([]RuntimeValue, error) {
+    return InvokeContext(context.Background(), module, store, name, args)
+}
 
-            if len(frame.Locals) <= int(expr.Local) {
-                return 0, 0, fmt.Errorf("unable to tee local %v when frame has %v locals", expr.Local, len(frame.Locals))
-            }
-            frame.Locals[expr.Local] = stack.Top()
+/* invoke an exported function, stopping with ErrInterrupted once the context is done */
+func InvokeContext(ctx context.Context, module core.WebAssemblyModule, store *Store, name string, args []RuntimeValue) ([]RuntimeValue, error) {
+    kind := module.GetExportSection().FindExportByName(name)
+    function, ok := kind.(*core.FunctionIndex)
+    if !ok {
+        return nil, fmt.Errorf("no such exported function '%v'", name)
+    }
 
-        case *core.LocalSetExpression:
-            expr := current.(*core.LocalSetExpression)
+    typeIndex := module.GetFunctionTypeIndex(function.Id)
+    if typeIndex == nil {
+        return nil, fmt.Errorf("invalid function index %v", function.Id)
+    }
 
-            if len(frame.Locals) <= int(expr.Local) {
-                return 0, 0, fmt.Errorf("unable to set local %v when frame has %v locals", expr.Local, len(frame.Locals))
-            }
-            frame.Locals[expr.Local] = stack.Pop()
+    functionType := module.GetTypeSection().GetFunction(typeIndex.Id)
+    if len(args) != len(functionType.InputTypes) {
+        return nil, fmt.Errorf("function '%v' expects %v arguments but got %v", name, len(functionType.InputTypes), len(args))
+    }
 
-        case *core.GlobalSetExpression:
-            expr := current.(*core.GlobalSetExpression)
-            index := expr.Global.Id
+    for i, arg := range args {
+        expected := functionType.InputTypes[i].Type
+        actual := arg.Type()
+        if actual != expected {
+            return nil, fmt.Errorf("argument %v of function '%v' should be %v but is %v", i, name, expected.ConvertToWat(""), actual.ConvertToWat(""))
+        }
+    }
 
-            if int(index) >= len(store.Globals) {
-                return 0, 0, fmt.Errorf("unable to set global %v when store has %v globals", index, len(store.Globals))
-            }
+    return callFunction(ctx, function.Id, args, &module, store)
+}
 
-            if !store.Globals[index].Mutable {
-                return 0, 0, fmt.Errorf("global %v is not mutable", index)
-            }
+func cleanName(name string) string {
+    return strings.Trim(name, "\"")
+}
 
-            value := stack.Pop()
-            store.Globals[index].Value = value
-        case *core.GlobalGetExpression:
-            expr := current.(*core.GlobalGetExpression)
-            index := expr.Global.Id
+/* returns the pattern of (f32.const nan:canonical) or (f64.const nan:arithmetic) */
+func nanPattern(expr *sexp.SExpression) (string, bool) {
+    if expr.Name != "f32.const" && expr.Name != "f64.const" {
+        return "", false
+    }
 
-            if int(index) >= len(store.Globals) {
-                return 0, 0, fmt.Errorf("unable to set global %v when store has %v globals", index, len(store.Globals))
-            }
+    if len(expr.Children) != 1 {
+        return "", false
+    }
 
-            if !store.Globals[index].Mutable {
-                return 0, 0, fmt.Errorf("global %v is not mutable", index)
-            }
+    switch expr.Children[0].Value {
+        case "nan:canonical", "nan:arithmetic":
+            return expr.Children[0].Value, true
+    }
 
-            stack.Push(store.Globals[index].Value)
+    return "", false
+}
 
-        case *core.CallIndirectExpression:
-            expr := current.(*core.CallIndirectExpression)
-            if int(expr.Table.Id) >= len(store.Tables) {
-                return 0, 0, fmt.Errorf("invalid table index %v", expr.Table.Id)
+func matchNaN(value RuntimeValue, kind string, pattern string) bool {
+    switch kind {
+        case "f32.const":
+            if value.Kind != RuntimeValueF32 {
+                return false
             }
-
-            table := store.Tables[expr.Table.Id]
-            index := stack.Pop()
-
-            if index.Kind != RuntimeValueI32 {
-                return 0, 0, fmt.Errorf("call indirect stack value must be an i32 but was %v", index)
+            if pattern == "nan:canonical" {
+                return isCanonicalNaN32(value.F32)
             }
-
-            if index.I32 < 0 || int(index.I32) >= len(table.Elements) {
-                return 0, 0, fmt.Errorf("invalid table element index %v", index)
+            return isArithmeticNaN32(value.F32)
+        case "f64.const":
+            if value.Kind != RuntimeValueF64 {
+                return false
             }
-
-            element := table.Elements[index.I32]
-            switch element.(type) {
-                case *core.FunctionIndex:
-                    ref := element.(*core.FunctionIndex)
-                    functionTypeIndex := frame.Module.GetFunctionSection().GetFunctionType(int(ref.Id))
-                    functionType := frame.Module.GetTypeSection().GetFunction(functionTypeIndex.Id)
-
-                    args := stack.PopN(len(functionType.InputTypes))
-
-                    code := frame.Module.GetCodeSection().GetFunction(ref.Id)
-
-                    for i, local := range code.Locals {
-                        if i >= len(functionType.InputTypes) {
-                            args = append(args, MakeRuntimeValue(local.Type))
-                        }
-                    }
-
-                    out, err := RunCode(code, Frame{
-                        Locals: args,
-                        Module: frame.Module,
-                    }, functionType, store)
-
-                    if err != nil {
-                        return 0, 0, err
-                    }
-
-                    stack.PushAll(out)
-                default:
-                    return 0, 0, fmt.Errorf("unknown element for call indirect %v", reflect.TypeOf(element))
+            if pattern == "nan:canonical" {
+                return isCanonicalNaN64(value.F64)
             }
+            return isArithmeticNaN64(value.F64)
+    }
 
-        case *core.CallExpression:
-            /* create a new stack frame, pop N values off the stack and put them in the locals of the frame.
-             * then invoke the code of the function with the new frame.
-             * put the resulting runtime value back on the stack
-             */
-            expr := current.(*core.CallExpression)
-
-            functionTypeIndex := frame.Module.GetFunctionSection().GetFunctionType(int(expr.Index.Id))
-            functionType := frame.Module.GetTypeSection().GetFunction(functionTypeIndex.Id)
-
-            args := stack.PopN(len(functionType.InputTypes))
-
-            code := frame.Module.GetCodeSection().GetFunction(expr.Index.Id)
-
-            for i, local := range code.Locals {
-                if i >= len(functionType.InputTypes) {
-                    args = append(args, MakeRuntimeValue(local.Type))
-                }
-            }
+    return false
+}
 
-            out, err := RunCode(code, Frame{
-                Locals: args,
-                Module: frame.Module,
-            }, functionType, store)
+/* run a wast-style (invoke "name" args...) */
+func invokeAction(module core.WebAssemblyModule, what *sexp.SExpression, store *Store) ([]RuntimeValue, error) {
+    functionName := cleanName(what.Children[0].Value)
 
+    var args []RuntimeValue
+    for _, arg := range what.Children[1:] {
+        expressions := core.MakeExpressions(module, nil, data.Stack[string]{}, arg)
+        if len(expressions) > 0 {
+            nextArg, err := EvaluateOne(expressions[0])
             if err != nil {
-                return 0, 0, err
+                return nil, err
             }
 
-            stack.PushAll(out)
-
-        default:
-            return 0, 0, fmt.Errorf("unhandled instruction %v %+v", reflect.TypeOf(current), current)
+            args = append(args, nextArg)
+        }
     }
 
-    return instruction + 1, 0, nil
+    return Invoke(module, store, functionName, args)
 }
 
-/* evaluate a single expression and return whatever runtimevalue the expression produces */
-func EvaluateOne(expression core.Expression) (RuntimeValue, error) {
-    var stack data.Stack[RuntimeValue]
-    var labels data.Stack[int]
-
-    _, _, err := Execute(&stack, &labels, []core.Expression{expression}, 0, Frame{}, nil)
-    if err != nil {
-        return RuntimeValue{}, err
+/* the value of an exported global */
+func GetGlobal(module core.WebAssemblyModule, store *Store, name string) (RuntimeValue, error) {
+    global, ok := module.GetExportSection().FindExportByName(name).(*core.GlobalIndex)
+    if !ok {
+        return RuntimeValue{}, fmt.Errorf("no such exported global '%v'", name)
     }
 
-    if stack.Size() == 0 {
-        return RuntimeValue{}, fmt.Errorf("did not produce any values")
+    if int(global.Id) >= len(store.Globals) {
+        return RuntimeValue{}, fmt.Errorf("invalid global index %v", global.Id)
     }
 
-    /* FIXME: handle multiple values on the stack */
-    return stack.Pop(), nil
+    return store.Globals[global.Id].Value, nil
 }
 
-/* evaluate an entire function
- */
-func RunCode(code core.Code, frame Frame, functionType core.WebAssemblyFunction, store *Store) ([]RuntimeValue, error) {
-    var stack data.Stack[RuntimeValue]
-    var labels data.Stack[int]
-
-    instruction := 0
-
-    for instruction < len(code.Expressions) {
-        var branch int
-        var err error
-        instruction, branch, err = Execute(&stack, &labels, code.Expressions, instruction, frame, store)
-        if err != nil {
-            return nil, err
-        }
-        if branch == ReturnLabel {
-            if stack.Size() < len(functionType.OutputTypes) {
-                return nil, Trap("not enough values on the stack")
-            }
-            // FIXME: return the number of values as declared by the function (result ...)
-            return stack.PopN(len(functionType.OutputTypes)), nil
-        }
-        /* if we a branch was executed to label 0, then the 'branch' variable will be equal to 1,
-         * which has the same meaning as the end of the function
-         */
-        if branch == 1 {
-            return []RuntimeValue{stack.Pop()}, nil
-        }
-        if branch != 0 {
-            return nil, fmt.Errorf("Branch to non-existent block: %v", branch)
-        }
+/* run a wast-style action, either (invoke "name" args...) or (get "name") */
+func Action(module core.WebAssemblyModule, what *sexp.SExpression, store *Store) ([]RuntimeValue, error) {
+    if len(what.Children) == 0 {
+        return nil, fmt.Errorf("no name given to %v", what.Name)
     }
 
-    if stack.Size() != len(functionType.OutputTypes) {
-        return nil, fmt.Errorf("too many values still on the stack %v, but expected %v", stack.Size(), len(functionType.OutputTypes))
+    switch what.Name {
+        case "invoke":
+            return invokeAction(module, what, store)
+        case "get":
+            value, err := GetGlobal(module, store, cleanName(what.Children[0].Value))
+            if err != nil {
+                return nil, err
+            }
+            return []RuntimeValue{value}, nil
     }
 
-    return stack.ToArray(), nil
+    return nil, fmt.Errorf("unhandled action %v", what.Name)
 }
 
-/* invoke an exported function in the given module */
-func Invoke(module core.WebAssemblyModule, store *Store, name string, args []RuntimeValue) ([]RuntimeValue, error) {
-    kind := module.GetExportSection().FindExportByName(name)
-    if kind == nil {
-        return nil, fmt.Errorf("no such exported function '%v'", name)
+/* handle wast-style (assert_exhaustion (invoke ...) "message") */
+func AssertExhaustion(module core.WebAssemblyModule, assert sexp.SExpression, store *Store) error {
+    what := assert.Children[0]
+    if what.Name != "invoke" {
+        return fmt.Errorf("unhandled action %v", what.Name)
     }
 
-    function, ok := kind.(*core.FunctionIndex)
-    if ok {
-        code := module.GetCodeSection().GetFunction(function.Id)
-        functionTypeIndex := module.GetFunctionSection().GetFunctionType(int(function.Id))
-
-        type_ := module.GetTypeSection().GetFunction(functionTypeIndex.Id)
-
-        for i, local := range code.Locals {
-            if i >= len(type_.InputTypes) {
-                args = append(args, MakeRuntimeValue(local.Type))
-            }
-        }
-
-        frame := Frame{
-            Locals: args,
-            Module: module,
-        }
+    result, err := invokeAction(module, what, store)
+    if err == nil {
+        return fmt.Errorf("expected exhaustion but got result=%v", result)
+    }
 
-        return RunCode(code, frame, type_, store)
-    } else {
-        return nil, fmt.Errorf("no such exported function '%v'", name)
+    if !errors.Is(err, ErrCallStackExhausted) {
+        return fmt.Errorf("expected exhaustion but got error: %w", err)
     }
-   
-    return nil, fmt.Errorf("shouldnt get here")
-}
 
-func cleanName(name string) string {
-    return strings.Trim(name, "\"")
+    return nil
 }
 
 /* handle wast-style (assert_return ...) */
 func AssertReturn(module core.WebAssemblyModule, assert sexp.SExpression, store *Store) error {
     what := assert.Children[0]
-    if what.Name == "invoke" {
-
-        functionName := cleanName(what.Children[0].Value)
-
-        var args []RuntimeValue
-        for _, arg := range what.Children[1:] {
-            expressions := core.MakeExpressions(module, nil, data.Stack[string]{}, arg)
-            if len(expressions) > 0 {
-                nextArg, err := EvaluateOne(expressions[0])
-                if err != nil {
-                    return err
-                }
-
-                args = append(args, nextArg)
-            }
-        }
-
-        // store := InitializeStore(module)
-
-        result, err := Invoke(module, store, functionName, args)
+    if what.Name == "invoke" || what.Name == "get" {
+        result, err := Action(module, what, store)
         if err != nil {
             return err
         }
 
         if len(assert.Children) == 2 {
+            /* nan:canonical and nan:arithmetic match a class of nans rather than one value */
+            pattern, ok := nanPattern(assert.Children[1])
+            if ok {
+                if len(result) != 1 || !matchNaN(result[0], assert.Children[1].Name, pattern) {
+                    return fmt.Errorf("result=%v expected=%v", result, pattern)
+                }
+
+                return nil
+            }
+
             expressions := core.MakeExpressions(module, nil, data.Stack[string]{}, assert.Children[1])
             if len(expressions) == 0 {
                 return fmt.Errorf("Expected expression: %v", assert.Children[1])
@@ -1538,32 +1759,11 @@ func AssertReturn(module core.WebAssemblyModule, assert sexp.SExpression, store
             expected, err := EvaluateOne(expressions[0])
             if err != nil {
                 return err
-            } else {
-                fail := false
-
-                if len(result) != 1 || result[0] != expected {
-
-                    fail = true
-
-                    /* special-case handling for nan, inf */
-                    if result[0].Kind == expected.Kind {
-                        switch result[0].Kind {
-                            case RuntimeValueF32:
-                                if math.IsNaN(float64(result[0].F32)) && math.IsNaN(float64(expected.F32)) {
-                                    fail = false
-                                }
-                            case RuntimeValueF64:
-                                if math.IsNaN(result[0].F64) && math.IsNaN(expected.F64) {
-                                    fail = false
-                                }
-                        }
-                    }
-
+            }
 
-                    if fail {
-                        return fmt.Errorf("result=%v expected=%v", result, expected)
-                    }
-                }
+            /* floats are compared by their bits, so a nan only matches the exact same nan */
+            if len(result) != 1 || !result[0].Equal(expected) {
+                return fmt.Errorf("result=%v expected=%v", result, expected)
             }
         }
     }
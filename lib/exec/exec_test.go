@@ -0,0 +1,232 @@
+package exec
+
+import (
+    "context"
+    "errors"
+    "testing"
+    "time"
+
+    "github.com/kazzmir/webassembly/lib/core"
+    "github.com/kazzmir/webassembly/lib/sexp"
+)
+
+func makeModule(test testing.TB, text string) core.WebAssemblyModule {
+    expr, err := sexp.ParseSExpression(text)
+    if err != nil {
+        test.Fatalf("unable to parse %v: %v", text, err)
+    }
+
+    module, err := core.CreateWastModule(&expr)
+    if err != nil {
+        test.Fatalf("unable to create module: %v", err)
+    }
+
+    return module
+}
+
+func TestCallFrames(test *testing.T){
+    module := makeModule(test, `(module
+        (func $sum (export "sum") (param $n i64) (result i64)
+            (local $x i64)
+            (local.set $x (i64.const 100))
+            (if (result i64) (i64.eqz (local.get $n))
+                (then (i64.const 0))
+                (else (i64.add (local.get $n) (call $sum (i64.sub (local.get $n) (i64.const 1)))))))
+        (func (export "pick") (param f32 i32) (result f32 i32)
+            (local.get 0) (local.get 1)))`)
+
+    store := InitializeStore(module)
+
+    /* deep enough that the stack has to grow while frames are live */
+    result, err := Invoke(module, store, "sum", []RuntimeValue{ValueI64(2000)})
+    if err != nil {
+        test.Fatalf("unable to invoke sum: %v", err)
+    }
+    if len(result) != 1 || result[0] != ValueI64(2001000) {
+        test.Fatalf("expected 2001000 but got %v", result)
+    }
+
+    result, err = Invoke(module, store, "pick", []RuntimeValue{ValueF32(1.5), ValueI32(-3)})
+    if err != nil {
+        test.Fatalf("unable to invoke pick: %v", err)
+    }
+    if len(result) != 2 || result[0] != ValueF32(1.5) || result[1] != ValueI32(-3) {
+        test.Fatalf("expected [1.5 -3] but got %v", result)
+    }
+}
+
+func TestCallStackExhausted(test *testing.T){
+    module := makeModule(test, `(module
+        (func $down (export "down") (param i32) (result i32)
+            (if (result i32) (i32.eqz (local.get 0))
+                (then (i32.const 0))
+                (else (call $down (i32.sub (local.get 0) (i32.const 1))))))
+        (func $forever (export "forever") (call $forever)))`)
+
+    store := InitializeStore(module)
+
+    _, err := Invoke(module, store, "forever", nil)
+    if !errors.Is(err, ErrCallStackExhausted) {
+        test.Fatalf("expected call stack exhausted but got %v", err)
+    }
+
+    store.MaxCallDepth = 50
+    _, err = Invoke(module, store, "down", []RuntimeValue{ValueI32(40)})
+    if err != nil {
+        test.Fatalf("unable to invoke down: %v", err)
+    }
+
+    _, err = Invoke(module, store, "down", []RuntimeValue{ValueI32(60)})
+    if !errors.Is(err, ErrCallStackExhausted) {
+        test.Fatalf("expected call stack exhausted but got %v", err)
+    }
+
+    /* frames overlap by their arguments, but each one still takes at least one slot */
+    store.MaxCallDepth = DefaultMaxCallDepth
+    store.MaxStackSize = 100
+    _, err = Invoke(module, store, "down", []RuntimeValue{ValueI32(200)})
+    if !errors.Is(err, ErrCallStackExhausted) {
+        test.Fatalf("expected call stack exhausted but got %v", err)
+    }
+    /* a store that was not made by InitializeStore has no limits set, and gets the defaults */
+    store.MaxCallDepth = 0
+    store.MaxStackSize = 0
+    _, err = Invoke(module, store, "down", []RuntimeValue{ValueI32(200)})
+    if err != nil {
+        test.Fatalf("expected the default limits but got %v", err)
+    }
+}
+
+func TestFuel(test *testing.T){
+    module := makeModule(test, `(module
+        (memory 1)
+        (func (export "spin") (loop (br 0)))
+        (func (export "add") (result i32) (i32.add (i32.const 1) (i32.const 2)))
+        (func (export "load") (result i32) (i32.load (i32.const 0))))`)
+
+    store := InitializeStore(module)
+    store.FuelCost = func(expression core.Expression) uint64 {
+        switch expression.(type) {
+            case *core.I32LoadExpression: return 10
+        }
+        return 1
+    }
+
+    store.AddFuel(1000)
+    _, err := Invoke(module, store, "spin", nil)
+    if !errors.Is(err, ErrOutOfFuel) {
+        test.Fatalf("expected out of fuel but got %v", err)
+    }
+    if store.FuelConsumed() != 1000 || store.Fuel() != 0 {
+        test.Fatalf("expected all 1000 fuel to be consumed but consumed %v with %v left", store.FuelConsumed(), store.Fuel())
+    }
+
+    store.AddFuel(5)
+    _, err = Invoke(module, store, "add", nil)
+    if err != nil {
+        test.Fatalf("unable to invoke add: %v", err)
+    }
+    if store.Fuel() != 2 {
+        test.Fatalf("expected 2 fuel left but got %v", store.Fuel())
+    }
+
+    /* the constant uses 1 of the 2 that are left, which is not enough for the load */
+    _, err = Invoke(module, store, "load", nil)
+    if !errors.Is(err, ErrOutOfFuel) {
+        test.Fatalf("expected out of fuel but got %v", err)
+    }
+
+    store.AddFuel(10)
+    _, err = Invoke(module, store, "load", nil)
+    if err != nil {
+        test.Fatalf("unable to invoke load: %v", err)
+    }
+    if store.FuelConsumed() != 1015 || store.Fuel() != 0 {
+        test.Fatalf("expected 1015 fuel consumed but got %v", store.FuelConsumed())
+    }
+}
+
+func TestInvokeContext(test *testing.T){
+    module := makeModule(test, `(module
+        (func (export "spin") (loop (br 0)))
+        (func $recurse (export "recurse") (param i32) (result i32)
+            (if (result i32) (i32.eqz (local.get 0))
+                (then (call $recurse (i32.const 0)) (call $recurse (i32.const 0)) (i32.add))
+                (else (i32.const 1)))))`)
+
+    store := InitializeStore(module)
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Millisecond)
+    defer cancel()
+    _, err := InvokeContext(ctx, module, store, "spin", nil)
+    if !errors.Is(err, ErrInterrupted) {
+        test.Fatalf("expected interrupted but got %v", err)
+    }
+
+    /* a context that is already done stops the first call */
+    _, err = InvokeContext(ctx, module, store, "recurse", []RuntimeValue{ValueI32(1)})
+    if !errors.Is(err, ErrInterrupted) {
+        test.Fatalf("expected interrupted but got %v", err)
+    }
+
+    result, err := InvokeContext(context.Background(), module, store, "recurse", []RuntimeValue{ValueI32(1)})
+    if err != nil || len(result) != 1 || result[0] != ValueI32(1) {
+        test.Fatalf("expected 1 but got %v %v", result, err)
+    }
+}
+
+func TestAction(test *testing.T){
+    module := makeModule(test, `(module
+        (global (export "g") i64 (i64.const 42))
+        (func (export "double") (param i32) (result i32)
+            (i32.mul (local.get 0) (i32.const 2))))`)
+
+    store := InitializeStore(module)
+
+    action := func(text string) ([]RuntimeValue, error) {
+        expr, err := sexp.ParseSExpression(text)
+        if err != nil {
+            test.Fatalf("unable to parse %v: %v", text, err)
+        }
+        return Action(module, &expr, store)
+    }
+
+    results, err := action(`(invoke "double" (i32.const 21))`)
+    if err != nil || len(results) != 1 || results[0].AsInt32() != 42 {
+        test.Fatalf("expected 42 but got %v %v", results, err)
+    }
+
+    results, err = action(`(get "g")`)
+    if err != nil || len(results) != 1 || !results[0].Equal(ValueI64(42)) {
+        test.Fatalf("expected the global to be 42 but got %v %v", results, err)
+    }
+
+    _, err = action(`(get "double")`)
+    if err == nil {
+        test.Fatalf("expected an error for a function that is not a global")
+    }
+}
+
+func TestMemoryArgumentOffsets(test *testing.T){
+    /* (memory 1) (data (i32.const 8) "\01")
+     * (func (export "f") (result i64)
+     *   (i64.store offset=16 (i32.const 0) (i64.const 0xff02))
+     *   (i64.add (i64.load offset=8 (i32.const 0)) (i64.load8_u offset=17 (i32.const 0))))
+     */
+    module := makeModule(test, `(module binary "\00asm" "\01\00\00\00"
+        "\01\05\01\60\00\01\7e"
+        "\03\02\01\00"
+        "\05\03\01\00\01"
+        "\07\05\01\01f\00\00"
+        "\0a\18\01\16\00\41\00\42\82\fe\03\37\03\10\41\00\29\03\08\41\00\31\00\11\7c\0b"
+        "\0b\07\01\00\41\08\0b\01\01")`)
+
+    result, err := Invoke(module, InitializeStore(module), "f", nil)
+    if err != nil {
+        test.Fatalf("unable to invoke f: %v", err)
+    }
+
+    if len(result) != 1 || result[0] != ValueI64(256) {
+        test.Fatalf("expected 256 but got %v", result)
+    }
+}
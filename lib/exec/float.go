@@ -0,0 +1,182 @@
+package exec
+
+/* float operations that follow the nan rules of the spec
+ * https://webassembly.github.io/spec/core/exec/numerics.html#nan-propagation
+ *
+ * when an operation produces a nan, the result is the canonical nan if every nan input was
+ * canonical (or there were no nan inputs), otherwise it is some arithmetic nan, which is any
+ * nan with the quiet bit set. here the payload of the first non-canonical input is kept.
+ */
+
+import (
+    "math"
+
+    "github.com/kazzmir/webassembly/lib/literal"
+)
+
+const (
+    f32SignBit uint32 = 1 << 31
+    f32ExponentMask uint32 = 0x7f800000
+    f32PayloadMask uint32 = (1 << 23) - 1
+    f32QuietBit uint32 = 1 << 22
+
+    f64SignBit uint64 = 1 << 63
+    f64ExponentMask uint64 = 0x7ff0000000000000
+    f64PayloadMask uint64 = (1 << 52) - 1
+    f64QuietBit uint64 = 1 << 51
+)
+
+func isNaN32(bits uint32) bool {
+    return bits & f32ExponentMask == f32ExponentMask && bits & f32PayloadMask != 0
+}
+
+func isNaN64(bits uint64) bool {
+    return bits & f64ExponentMask == f64ExponentMask && bits & f64PayloadMask != 0
+}
+
+/* a canonical nan has only the quiet bit set in its payload, the sign can be anything */
+func isCanonicalNaN32(bits uint32) bool {
+    return bits &^ f32SignBit == literal.F32CanonicalNaN
+}
+
+func isCanonicalNaN64(bits uint64) bool {
+    return bits &^ f64SignBit == literal.F64CanonicalNaN
+}
+
+func isArithmeticNaN32(bits uint32) bool {
+    return isNaN32(bits) && bits & f32QuietBit != 0
+}
+
+func isArithmeticNaN64(bits uint64) bool {
+    return isNaN64(bits) && bits & f64QuietBit != 0
+}
+
+/* the nan that an operation produces given its inputs */
+func nan32(inputs ...uint32) uint32 {
+    for _, input := range inputs {
+        if isNaN32(input) && !isCanonicalNaN32(input) {
+            return input | f32QuietBit
+        }
+    }
+
+    return literal.F32CanonicalNaN
+}
+
+func nan64(inputs ...uint64) uint64 {
+    for _, input := range inputs {
+        if isNaN64(input) && !isCanonicalNaN64(input) {
+            return input | f64QuietBit
+        }
+    }
+
+    return literal.F64CanonicalNaN
+}
+
+/* the bits of the result of an arithmetic operation, replacing whatever nan the hardware produced */
+func f32Result(result float32, inputs ...uint32) uint32 {
+    if result != result {
+        return nan32(inputs...)
+    }
+
+    return math.Float32bits(result)
+}
+
+func f64Result(result float64, inputs ...uint64) uint64 {
+    if result != result {
+        return nan64(inputs...)
+    }
+
+    return math.Float64bits(result)
+}
+
+/* min and max propagate nans, and treat -0 as less than +0 */
+func f32Min(a uint32, b uint32) uint32 {
+    x := math.Float32frombits(a)
+    y := math.Float32frombits(b)
+
+    if x != x || y != y {
+        return nan32(a, b)
+    }
+
+    if x == 0 && y == 0 {
+        return a | b
+    }
+
+    if x < y {
+        return a
+    }
+
+    return b
+}
+
+func f32Max(a uint32, b uint32) uint32 {
+    x := math.Float32frombits(a)
+    y := math.Float32frombits(b)
+
+    if x != x || y != y {
+        return nan32(a, b)
+    }
+
+    if x == 0 && y == 0 {
+        return a & b
+    }
+
+    if x > y {
+        return a
+    }
+
+    return b
+}
+
+func f64Min(a uint64, b uint64) uint64 {
+    x := math.Float64frombits(a)
+    y := math.Float64frombits(b)
+
+    if x != x || y != y {
+        return nan64(a, b)
+    }
+
+    if x == 0 && y == 0 {
+        return a | b
+    }
+
+    if x < y {
+        return a
+    }
+
+    return b
+}
+
+func f64Max(a uint64, b uint64) uint64 {
+    x := math.Float64frombits(a)
+    y := math.Float64frombits(b)
+
+    if x != x || y != y {
+        return nan64(a, b)
+    }
+
+    if x == 0 && y == 0 {
+        return a & b
+    }
+
+    if x > y {
+        return a
+    }
+
+    return b
+}
+
+/* promoting a nan keeps its payload in the upper bits of the wider significand */
+func promoteF32(bits uint32) uint64 {
+    if isNaN32(bits) {
+        if isCanonicalNaN32(bits) {
+            return literal.F64CanonicalNaN
+        }
+
+        sign := uint64(bits & f32SignBit) << 32
+        payload := uint64(bits & f32PayloadMask) << 29
+        return sign | f64ExponentMask | f64QuietBit | payload
+    }
+
+    return math.Float64bits(float64(math.Float32frombits(bits)))
+}
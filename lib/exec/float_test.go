@@ -0,0 +1,61 @@
+package exec
+
+import (
+    "context"
+    "testing"
+
+    "github.com/kazzmir/webassembly/lib/core"
+    "github.com/kazzmir/webassembly/lib/data"
+    "github.com/kazzmir/webassembly/lib/sexp"
+)
+
+/* evaluate an expression that produces a single value of the given type */
+func evaluate(test *testing.T, kind core.ValueType, text string) RuntimeValue {
+    expr, err := sexp.ParseSExpression(text)
+    if err != nil {
+        test.Fatalf("unable to parse %v: %v", text, err)
+    }
+
+    expressions := core.MakeExpressions(core.WebAssemblyModule{}, nil, data.Stack[string]{}, &expr)
+    function, err := compileExpressions(nil, expressions, []core.ValueType{kind})
+    if err != nil {
+        test.Fatalf("unable to compile %v: %v", text, err)
+    }
+
+    results, err := execute(context.Background(), function, nil, nil, nil)
+    if err != nil {
+        test.Fatalf("unable to execute %v: %v", text, err)
+    }
+
+    return results[0]
+}
+
+func TestNaNPropagation(test *testing.T){
+    /* a signaling nan payload survives a round trip through the runtime */
+    value := evaluate(test, core.ValueTypeF32, "(f32.reinterpret_i32 (i32.reinterpret_f32 (f32.const nan:0x200000)))")
+    if value.F32 != 0x7fa00000 {
+        test.Fatalf("expected nan:0x200000 but got 0x%x", value.F32)
+    }
+
+    /* arithmetic on a non-canonical nan produces an arithmetic nan with the same payload */
+    value = evaluate(test, core.ValueTypeF32, "(f32.add (f32.const nan:0x200000) (f32.const 1))")
+    if !isArithmeticNaN32(value.F32) || value.F32 & f32PayloadMask != 0x600000 {
+        test.Fatalf("expected an arithmetic nan but got 0x%x", value.F32)
+    }
+
+    /* nans made from ordinary numbers are canonical */
+    value = evaluate(test, core.ValueTypeF64, "(f64.div (f64.const 0) (f64.const 0))")
+    if !isCanonicalNaN64(value.F64) {
+        test.Fatalf("expected a canonical nan but got 0x%x", value.F64)
+    }
+
+    value = evaluate(test, core.ValueTypeF64, "(f64.min (f64.const -0) (f64.const 0))")
+    if value.F64 != f64SignBit {
+        test.Fatalf("expected -0 but got %v", value)
+    }
+
+    value = evaluate(test, core.ValueTypeF64, "(f64.promote_f32 (f32.const -nan:0x1))")
+    if !isArithmeticNaN64(value.F64) || value.F64 & f64SignBit == 0 {
+        test.Fatalf("expected a negative arithmetic nan but got 0x%x", value.F64)
+    }
+}
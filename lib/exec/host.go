@@ -0,0 +1,323 @@
+package exec
+
+/* go functions that guest code can call as imports, and go functions that call into the exports of a guest.
+ *
+ * the webassembly type of a go function is derived from its go type: int32 and uint32 are i32, int64 and
+ * uint64 are i64, float32 is f32 and float64 is f64. a function can return an error as its last result,
+ * an error from a host function traps the guest and a trap in the guest is returned as the error of an
+ * exported function.
+ *
+ * a host function can also take a *Store as its first parameter, which is not part of its webassembly type.
+ * it is the store of the instance that called the function, which is how a host function gets to its memory.
+ */
+
+import (
+    "context"
+    "fmt"
+    "reflect"
+    "runtime/debug"
+    "strings"
+
+    "github.com/kazzmir/webassembly/lib/core"
+)
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+var storeType = reflect.TypeOf((*Store)(nil))
+
+/* a set of host functions that share a module name, which is the first name of an import */
+type HostModule struct {
+    Name string
+    functions map[string]*hostFunction
+}
+
+type hostFunction struct {
+    functionType core.WebAssemblyFunction
+    call func(store *Store, args []RuntimeValue) ([]RuntimeValue, error)
+}
+
+/* a host function that panicked. that is a bug in the go code of the function rather than in the guest, so
+ * it is not reported as invalid code
+ */
+type HostPanic struct {
+    Value any
+    /* the go stack where the panic happened */
+    Stack []byte
+}
+
+func (failure *HostPanic) Error() string {
+    return fmt.Sprintf("host function panicked: %v", failure.Value)
+}
+
+/* the panic value, if it is an error */
+func (failure *HostPanic) Unwrap() error {
+    err, _ := failure.Value.(error)
+    return err
+}
+
+/* call a host function, a panic in it is returned as a HostPanic */
+func callHostFunction(function *compiledFunction, store *Store, args []RuntimeValue) (results []RuntimeValue, err error) {
+    defer func(){
+        if failure := recover(); failure != nil {
+            results = nil
+            err = &HostPanic{Value: failure, Stack: debug.Stack()}
+        }
+    }()
+
+    return function.host(store, args)
+}
+
+func NewHostModule(name string) *HostModule {
+    return &HostModule{
+        Name: name,
+        functions: make(map[string]*hostFunction),
+    }
+}
+
+/* the webassembly type of a go type, if it has one */
+func valueTypeOf(kind reflect.Type) (core.ValueType, bool) {
+    switch kind.Kind() {
+        case reflect.Int32, reflect.Uint32: return core.ValueTypeI32, true
+        case reflect.Int64, reflect.Uint64: return core.ValueTypeI64, true
+        case reflect.Float32: return core.ValueTypeF32, true
+        case reflect.Float64: return core.ValueTypeF64, true
+    }
+
+    return core.InvalidValueType, false
+}
+
+/* the webassembly type of a go function type, and whether the go function also returns an error */
+func signatureOf(function reflect.Type) (core.WebAssemblyFunction, bool, error) {
+    if function.Kind() != reflect.Func {
+        return core.WebAssemblyFunction{}, false, fmt.Errorf("%v is not a function", function)
+    }
+
+    if function.IsVariadic() {
+        return core.WebAssemblyFunction{}, false, fmt.Errorf("variadic function %v is not supported", function)
+    }
+
+    var out core.WebAssemblyFunction
+    for i := 0; i < function.NumIn(); i++ {
+        if i == 0 && function.In(i) == storeType {
+            continue
+        }
+
+        kind, ok := valueTypeOf(function.In(i))
+        if !ok {
+            return core.WebAssemblyFunction{}, false, fmt.Errorf("parameter %v of %v has unsupported type %v", i, function, function.In(i))
+        }
+        out.InputTypes = append(out.InputTypes, core.Parameter{Type: kind})
+    }
+
+    results := function.NumOut()
+    hasError := results > 0 && function.Out(results - 1) == errorType
+    if hasError {
+        results -= 1
+    }
+
+    for i := 0; i < results; i++ {
+        kind, ok := valueTypeOf(function.Out(i))
+        if !ok {
+            return core.WebAssemblyFunction{}, false, fmt.Errorf("result %v of %v has unsupported type %v", i, function, function.Out(i))
+        }
+        out.OutputTypes = append(out.OutputTypes, kind)
+    }
+
+    return out, hasError, nil
+}
+
+/* the function type as it would be written in the text format, such as (param i32 i32) (result i64) */
+func DescribeFunctionType(function core.WebAssemblyFunction) string {
+    var out strings.Builder
+    out.WriteString("(param")
+    for _, input := range function.InputTypes {
+        out.WriteString(" ")
+        out.WriteString(input.Type.ConvertToWat(""))
+    }
+    out.WriteString(") (result")
+    for _, output := range function.OutputTypes {
+        out.WriteString(" ")
+        out.WriteString(output.ConvertToWat(""))
+    }
+    out.WriteString(")")
+    return out.String()
+}
+
+/* the go value of a runtime value, as the given go type */
+func goValue(value RuntimeValue, kind reflect.Type) reflect.Value {
+    out := reflect.New(kind).Elem()
+    switch kind.Kind() {
+        case reflect.Int32: out.SetInt(int64(value.I32))
+        case reflect.Uint32: out.SetUint(uint64(uint32(value.I32)))
+        case reflect.Int64: out.SetInt(value.I64)
+        case reflect.Uint64: out.SetUint(uint64(value.I64))
+        case reflect.Float32: out.SetFloat(float64(value.Float32()))
+        case reflect.Float64: out.SetFloat(value.Float64())
+    }
+
+    return out
+}
+
+/* the runtime value of a go value whose type has a webassembly type */
+func runtimeValueOf(value reflect.Value) RuntimeValue {
+    switch value.Kind() {
+        case reflect.Int32: return ValueI32(int32(value.Int()))
+        case reflect.Uint32: return ValueI32(int32(uint32(value.Uint())))
+        case reflect.Int64: return ValueI64(value.Int())
+        case reflect.Uint64: return ValueI64(int64(value.Uint()))
+        case reflect.Float32: return ValueF32(float32(value.Float()))
+        case reflect.Float64: return ValueF64(value.Float())
+    }
+
+    return RuntimeValue{Kind: RuntimeValueNone}
+}
+
+/* add a go function that modules can import as Name.name. the go function can take and return any of
+ * the types that have a webassembly type, and can return an error last to trap the guest
+ */
+func (host *HostModule) DefineFunc(name string, function any) error {
+    value := reflect.ValueOf(function)
+    if !value.IsValid() || value.Kind() != reflect.Func || value.IsNil() {
+        return fmt.Errorf("host function %v.%v is not a function", host.Name, name)
+    }
+
+    functionType, hasError, err := signatureOf(value.Type())
+    if err != nil {
+        return fmt.Errorf("host function %v.%v: %w", host.Name, name, err)
+    }
+
+    goType := value.Type()
+    withStore := goType.NumIn() > 0 && goType.In(0) == storeType
+    call := func(store *Store, args []RuntimeValue) ([]RuntimeValue, error) {
+        var in []reflect.Value
+        if withStore {
+            in = append(in, reflect.ValueOf(store))
+        }
+        for _, arg := range args {
+            in = append(in, goValue(arg, goType.In(len(in))))
+        }
+
+        out := value.Call(in)
+        if hasError {
+            last := out[len(out) - 1]
+            if !last.IsNil() {
+                return nil, last.Interface().(error)
+            }
+            out = out[:len(out) - 1]
+        }
+
+        results := make([]RuntimeValue, len(out))
+        for i, result := range out {
+            results[i] = runtimeValueOf(result)
+        }
+
+        return results, nil
+    }
+
+    host.functions[name] = &hostFunction{functionType: functionType, call: call}
+    return nil
+}
+
+/* bind the function imports of the module to host functions. every imported function has to be defined
+ * by one of the host modules with the same type that the module imports it with.
+ */
+func (store *Store) Link(module core.WebAssemblyModule, hosts ...*HostModule) error {
+    imported := uint32(module.GetImportFunctionCount())
+    store.imports = make([]*compiledFunction, imported)
+
+    for index := uint32(0); index < imported; index++ {
+        item, _ := module.GetFunctionImport(index)
+
+        var function *hostFunction
+        for _, host := range hosts {
+            if host.Name == item.ModuleName && host.functions[item.Name] != nil {
+                function = host.functions[item.Name]
+                break
+            }
+        }
+
+        if function == nil {
+            return fmt.Errorf("unknown import %v.%v", item.ModuleName, item.Name)
+        }
+
+        expected := module.GetTypeSection().GetFunction(module.GetFunctionTypeIndex(index).Id)
+        if !expected.Equals(function.functionType) {
+            return fmt.Errorf("incompatible import type for %v.%v: module expects %v but the host function is %v", item.ModuleName, item.Name, DescribeFunctionType(expected), DescribeFunctionType(function.functionType))
+        }
+
+        compiled := compiledFunction{
+            parameters: len(expected.InputTypes),
+            results: expected.OutputTypes,
+            host: function.call,
+            index: index,
+        }
+        for _, input := range expected.InputTypes {
+            compiled.locals = append(compiled.locals, input.Type)
+        }
+
+        store.imports[index] = &compiled
+    }
+
+    return nil
+}
+
+/* a go function that calls the exported function 'name' of the instance. F is a go function type whose
+ * parameters and results match the type of the export, and whose last result is an error, for example
+ *   add, err := ExportedFunc[func(int32, int32) (int32, error)](instance, "add")
+ */
+func ExportedFunc[F any](instance *Instance, name string) (F, error) {
+    module := instance.Module()
+    store := instance.Store()
+
+    var out F
+    goType := reflect.TypeOf(&out).Elem()
+
+    functionType, hasError, err := signatureOf(goType)
+    if err != nil {
+        return out, err
+    }
+
+    if !hasError {
+        return out, fmt.Errorf("the last result of %v must be an error", goType)
+    }
+
+    function, ok := module.GetExportSection().FindExportByName(name).(*core.FunctionIndex)
+    if !ok {
+        return out, fmt.Errorf("no such exported function '%v'", name)
+    }
+
+    typeIndex := module.GetFunctionTypeIndex(function.Id)
+    if typeIndex == nil {
+        return out, fmt.Errorf("invalid function index %v", function.Id)
+    }
+
+    expected := module.GetTypeSection().GetFunction(typeIndex.Id)
+    if !expected.Equals(functionType) {
+        return out, fmt.Errorf("exported function '%v' is %v but %v was requested", name, DescribeFunctionType(expected), goType)
+    }
+
+    call := func(in []reflect.Value) []reflect.Value {
+        args := make([]RuntimeValue, len(in))
+        for i, arg := range in {
+            args[i] = runtimeValueOf(arg)
+        }
+
+        results := make([]reflect.Value, goType.NumOut())
+        values, err := callFunction(context.Background(), function.Id, args, &module, store)
+        for i := 0; i < len(results) - 1; i++ {
+            if err != nil {
+                results[i] = reflect.Zero(goType.Out(i))
+            } else {
+                results[i] = goValue(values[i], goType.Out(i))
+            }
+        }
+
+        results[len(results) - 1] = reflect.Zero(errorType)
+        if err != nil {
+            results[len(results) - 1] = reflect.ValueOf(&err).Elem()
+        }
+
+        return results
+    }
+
+    return reflect.MakeFunc(goType, call).Interface().(F), nil
+}
@@ -0,0 +1,130 @@
+package exec
+
+import (
+    "errors"
+    "fmt"
+    "strings"
+    "testing"
+)
+
+func TestHostFunctions(test *testing.T){
+    module := makeModule(test, `(module
+        (import "env" "scale" (func $scale (param i32 f64) (result f64)))
+        (import "env" "fail" (func $fail (param i64)))
+        (func (export "run") (param i32) (result f64)
+            (call $scale (local.get 0) (f64.const 1.5)))
+        (func (export "fail") (param i64)
+            (call $fail (local.get 0))))`)
+
+    env := NewHostModule("env")
+    err := env.DefineFunc("scale", func(count int32, value float64) float64 {
+        return float64(count) * value
+    })
+    if err != nil {
+        test.Fatalf("unable to define scale: %v", err)
+    }
+
+    err = env.DefineFunc("fail", func(code uint64) error {
+        return fmt.Errorf("failed with %v", code)
+    })
+    if err != nil {
+        test.Fatalf("unable to define fail: %v", err)
+    }
+
+    compiled := Compile(module)
+    instance, err := compiled.Instantiate(env)
+    if err != nil {
+        test.Fatalf("unable to instantiate: %v", err)
+    }
+
+    run, err := ExportedFunc[func(int32) (float64, error)](instance, "run")
+    if err != nil {
+        test.Fatalf("unable to get run: %v", err)
+    }
+
+    value, err := run(4)
+    if err != nil || value != 6 {
+        test.Fatalf("expected 6 but got %v %v", value, err)
+    }
+
+    fail, err := ExportedFunc[func(uint64) error](instance, "fail")
+    if err != nil {
+        test.Fatalf("unable to get fail: %v", err)
+    }
+
+    err = fail(3)
+    if err == nil || err.Error() != "failed with 3" {
+        test.Fatalf("expected the host error but got %v", err)
+    }
+
+    /* the go types have to match the types in the module */
+    _, err = ExportedFunc[func(int64) (float64, error)](instance, "run")
+    if err == nil {
+        test.Fatalf("expected a type mismatch for run")
+    }
+
+    _, err = ExportedFunc[func(int32) float64](instance, "run")
+    if err == nil {
+        test.Fatalf("expected an error without an error result")
+    }
+
+    wrong := NewHostModule("env")
+    wrong.DefineFunc("scale", func(count int32, value float32) float64 {
+        return 0
+    })
+    wrong.DefineFunc("fail", func(code uint64){
+    })
+    _, err = compiled.Instantiate(wrong)
+    if err == nil {
+        test.Fatalf("expected an incompatible import for scale")
+    }
+
+    _, err = compiled.Instantiate()
+    if err == nil {
+        test.Fatalf("expected an unknown import")
+    }
+
+    err = env.DefineFunc("bad", func(value string) int32 {
+        return 0
+    })
+    if err == nil {
+        test.Fatalf("expected an unsupported parameter type")
+    }
+}
+
+func TestHostPanic(test *testing.T){
+    module := makeModule(test, `(module
+        (import "env" "index" (func $index (param i32) (result i32)))
+        (func (export "run") (param i32) (result i32)
+            (call $index (local.get 0))))`)
+
+    values := []int32{1, 2, 3}
+    env := NewHostModule("env")
+    err := env.DefineFunc("index", func(i int32) int32 {
+        return values[i]
+    })
+    if err != nil {
+        test.Fatalf("unable to define index: %v", err)
+    }
+
+    instance, err := Compile(module).Instantiate(env)
+    if err != nil {
+        test.Fatalf("unable to instantiate: %v", err)
+    }
+
+    /* a bug in the host function is not invalid guest code, and still has a backtrace */
+    _, err = instance.Invoke("run", []RuntimeValue{ValueI32(5)})
+    var failure *HostPanic
+    if !errors.As(err, &failure) || !strings.HasPrefix(err.Error(), "host function panicked: runtime error: index out of range") {
+        test.Fatalf("expected a host panic but got %v", err)
+    }
+
+    frames := Backtrace(err)
+    if len(frames) != 2 || frames[0].Offset != -1 || frames[0].Function != 0 {
+        test.Fatalf("wrong backtrace %v", frames)
+    }
+
+    if len(failure.Stack) == 0 {
+        test.Fatalf("expected the go stack of the panic")
+    }
+}
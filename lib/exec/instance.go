@@ -0,0 +1,112 @@
+package exec
+
+import (
+    "context"
+    "fmt"
+
+    "github.com/kazzmir/webassembly/lib/core"
+)
+
+/* a module whose functions have all been compiled. a compiled module is never changed after Compile returns,
+ * so it can be instantiated any number of times, from any number of goroutines at once.
+ */
+type CompiledModule struct {
+    module core.WebAssemblyModule
+    /* indexed without the imported functions, a function that failed to compile has an error instead */
+    functions []*compiledFunction
+    errors []error
+}
+
+/* compile every function of the module. the module must not be changed afterwards. a function that cannot
+ * be compiled is only an error when it is called, as with a module that is run directly from a store.
+ */
+func Compile(module core.WebAssemblyModule) *CompiledModule {
+    out := CompiledModule{module: module}
+
+    imported := uint32(module.GetImportFunctionCount())
+    codeSection := module.GetCodeSection()
+    if codeSection != nil {
+        for i := range codeSection.Code {
+            function, err := compileFunction(&out.module, imported + uint32(i), nil)
+            out.functions = append(out.functions, function)
+            out.errors = append(out.errors, err)
+        }
+    }
+
+    return &out
+}
+
+/* the compiled code of a function that is defined in the module */
+func (compiled *CompiledModule) function(defined int) (*compiledFunction, error) {
+    if defined < 0 || defined >= len(compiled.functions) {
+        return nil, fmt.Errorf("invalid function index %v", defined)
+    }
+
+    return compiled.functions[defined], compiled.errors[defined]
+}
+
+/* returned from Instantiate when the start function of the module traps or fails */
+type StartError struct {
+    Err error
+}
+
+func (failure *StartError) Error() string {
+    return fmt.Sprintf("start function failed: %v", failure.Err)
+}
+
+func (failure *StartError) Unwrap() error {
+    return failure.Err
+}
+
+/* make a new instance of the module with its own memories, tables and globals. the imported functions of
+ * the module are linked to the given host modules, then the start function runs if there is one.
+ */
+func (compiled *CompiledModule) Instantiate(hosts ...*HostModule) (*Instance, error) {
+    store := InitializeStore(compiled.module)
+    store.compiled = compiled
+
+    err := store.Link(compiled.module, hosts...)
+    if err != nil {
+        return nil, err
+    }
+
+    start := compiled.module.GetStartSection()
+    if start != nil {
+        _, err = callFunction(context.Background(), start.Start.Id, nil, &compiled.module, store)
+        if err != nil {
+            return nil, &StartError{Err: err}
+        }
+    }
+
+    return &Instance{module: compiled, store: store}, nil
+}
+
+/* an instance of a compiled module. like a store, an instance must only be used by one goroutine at a time,
+ * but instances do not share anything that changes so different instances can run in parallel.
+ */
+type Instance struct {
+    module *CompiledModule
+    store *Store
+    /* the state of an instance from a pool right after it was made */
+    initial *Snapshot
+}
+
+/* the store that holds the memories, tables, globals and fuel of the instance */
+func (instance *Instance) Store() *Store {
+    return instance.store
+}
+
+func (instance *Instance) Invoke(name string, args []RuntimeValue) ([]RuntimeValue, error) {
+    return InvokeContext(context.Background(), instance.module.module, instance.store, name, args)
+}
+
+func (instance *Instance) InvokeContext(ctx context.Context, name string, args []RuntimeValue) ([]RuntimeValue, error) {
+    return InvokeContext(ctx, instance.module.module, instance.store, name, args)
+}
+
+/* the module that the instance was made from, for passing to Invoke. every instance of a compiled module
+ * shares the same sections, so they must not be changed
+ */
+func (instance *Instance) Module() core.WebAssemblyModule {
+    return instance.module.module
+}
@@ -0,0 +1,90 @@
+package exec
+
+import (
+    "errors"
+    "sync"
+    "testing"
+)
+
+/* instances of one compiled module run in parallel without sharing memory or globals. run with -race */
+func TestParallelInstances(test *testing.T){
+    module := makeModule(test, `(module
+        (memory 1)
+        (global $count (mut i32) (i32.const 0))
+        (table 1 funcref)
+        (elem (i32.const 0) $load)
+        (func $load (result i32) (i32.load (i32.const 8)))
+        (func (export "bump") (param i32) (result i32)
+            (global.set $count (i32.add (global.get $count) (i32.const 1)))
+            (i32.store (i32.const 8) (i32.add (i32.load (i32.const 8)) (local.get 0)))
+            (i32.add (global.get $count) (call_indirect (result i32) (i32.const 0)))))`)
+
+    compiled := Compile(module)
+
+    var group sync.WaitGroup
+    failures := make(chan string, 8)
+    for i := 0; i < 8; i++ {
+        group.Add(1)
+        go func(step int32){
+            defer group.Done()
+
+            instance, err := compiled.Instantiate()
+            if err != nil {
+                failures <- err.Error()
+                return
+            }
+
+            var last RuntimeValue
+            for count := 0; count < 100; count++ {
+                result, err := instance.Invoke("bump", []RuntimeValue{ValueI32(step)})
+                if err != nil {
+                    failures <- err.Error()
+                    return
+                }
+                last = result[0]
+            }
+
+            /* 100 from the global plus 100 steps stored in memory */
+            if last.AsInt32() != 100 + 100 * step {
+                failures <- last.String()
+            }
+        }(int32(i))
+    }
+
+    group.Wait()
+    close(failures)
+    for failure := range failures {
+        test.Errorf("unexpected result: %v", failure)
+    }
+
+    /* the module of an instance can be given straight to Invoke */
+    instance, err := compiled.Instantiate()
+    if err != nil {
+        test.Fatalf("could not instantiate: %v", err)
+    }
+    result, err := Invoke(instance.Module(), instance.Store(), "bump", []RuntimeValue{ValueI32(5)})
+    if err != nil {
+        test.Fatalf("could not invoke: %v", err)
+    }
+    if result[0].AsInt32() != 6 {
+        test.Errorf("expected 6 but got %v", result[0])
+    }
+}
+
+/* only a failing start function gives a StartError, a missing import is a link error */
+func TestStartError(test *testing.T){
+    _, err := Compile(makeModule(test, `(module (func $init (drop (i32.div_s (i32.const 1) (i32.const 0)))) (start $init))`)).Instantiate()
+    var start *StartError
+    if !errors.As(err, &start) {
+        test.Fatalf("expected a start error but got %v", err)
+    }
+    var trap *TrapError
+    if !errors.As(err, &trap) {
+        test.Fatalf("expected the start error to hold a trap but got %v", err)
+    }
+
+    _, err = Compile(makeModule(test, `(module (import "env" "f" (func)))`)).Instantiate()
+    if err == nil || errors.As(err, &start) {
+        test.Fatalf("expected a link error but got %v", err)
+    }
+}
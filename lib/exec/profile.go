@@ -0,0 +1,404 @@
+package exec
+
+/* a profiler that counts how often each function is called, how many instructions it runs and how long it
+ * takes, for every call stack the function is seen in. the profile can be written in the pprof format so
+ * that it can be looked at with 'go tool pprof'.
+ *
+ * by default every instruction is counted and every call is timed. with a SampleRate only every
+ * SampleRate-th instruction is counted, with a weight of SampleRate, and calls are not timed, which costs
+ * much less. with PerInstruction the instructions are also counted at each instruction offset, and the
+ * frames of the callers are the call instructions, so pprof can show the hot instructions of a function.
+ *
+ * a profiler is used by one call at a time, like the store it belongs to.
+ */
+
+import (
+    "bufio"
+    "compress/gzip"
+    "fmt"
+    "io"
+    "sort"
+    "time"
+
+    "github.com/kazzmir/webassembly/lib/core"
+)
+
+type Profiler struct {
+    /* count the instructions at each offset of a function, not just in the function */
+    PerInstruction bool
+    /* when more than 0 only every SampleRate-th instruction is counted and calls are not timed */
+    SampleRate uint64
+    root *profileNode
+    /* the instructions left until the next one that is counted */
+    countdown uint64
+    start time.Time
+}
+
+/* where a function was called from, offset is the call instruction or 0 when instructions are not counted */
+type callSite struct {
+    offset int
+    function uint32
+}
+
+/* a function in one call stack */
+type profileNode struct {
+    function uint32
+    /* the call instruction in the parent */
+    site int
+    parent *profileNode
+    children map[callSite]*profileNode
+    calls uint64
+    instructions uint64
+    /* the time of all calls including the functions they called */
+    nanoseconds int64
+    /* the offset of the instruction that is running */
+    at int
+    offsets map[int]uint64
+}
+
+/* how much one function did, over all of the call stacks it was seen in */
+type FunctionProfile struct {
+    Function uint32
+    Calls uint64
+    /* the instructions and time of the function itself, without the functions it called */
+    Instructions uint64
+    Time time.Duration
+}
+
+func NewProfiler() *Profiler {
+    profiler := &Profiler{}
+    profiler.Reset()
+    return profiler
+}
+
+/* forget everything that was counted */
+func (profiler *Profiler) Reset(){
+    profiler.root = &profileNode{}
+    profiler.countdown = 0
+    profiler.start = time.Now()
+}
+
+func (profiler *Profiler) timed() bool {
+    return profiler.SampleRate == 0
+}
+
+/* the node of a function that is called from the given node, nil is the root */
+func (profiler *Profiler) enter(parent *profileNode, function uint32) *profileNode {
+    if parent == nil {
+        parent = profiler.root
+    }
+
+    site := callSite{function: function}
+    if profiler.PerInstruction {
+        site.offset = parent.at
+    }
+
+    node, ok := parent.children[site]
+    if !ok {
+        node = &profileNode{function: function, site: site.offset, parent: parent}
+        if parent.children == nil {
+            parent.children = make(map[callSite]*profileNode)
+        }
+        parent.children[site] = node
+    }
+
+    node.calls += 1
+    return node
+}
+
+/* count an instruction of the function that is running */
+func (profiler *Profiler) instruction(node *profileNode, offset int){
+    node.at = offset
+
+    weight := uint64(1)
+    if profiler.SampleRate > 0 {
+        if profiler.countdown == 0 {
+            profiler.countdown = profiler.SampleRate
+        }
+        profiler.countdown -= 1
+        if profiler.countdown > 0 {
+            return
+        }
+        weight = profiler.SampleRate
+    }
+
+    node.instructions += weight
+    if profiler.PerInstruction {
+        if node.offsets == nil {
+            node.offsets = make(map[int]uint64)
+        }
+        node.offsets[offset] += weight
+    }
+}
+
+/* the time spent in the node without the time of the functions it called */
+func (node *profileNode) selfTime() int64 {
+    out := node.nanoseconds
+    for _, child := range node.children {
+        out -= child.nanoseconds
+    }
+
+    if out < 0 {
+        return 0
+    }
+
+    return out
+}
+
+/* visit every node except the root */
+func (profiler *Profiler) walk(visit func(node *profileNode)){
+    var walk func(node *profileNode)
+    walk = func(node *profileNode){
+        for _, child := range node.children {
+            visit(child)
+            walk(child)
+        }
+    }
+
+    walk(profiler.root)
+}
+
+/* the functions that were seen, with the one that ran the most instructions first */
+func (profiler *Profiler) Functions() []FunctionProfile {
+    functions := make(map[uint32]*FunctionProfile)
+    profiler.walk(func(node *profileNode){
+        function, ok := functions[node.function]
+        if !ok {
+            function = &FunctionProfile{Function: node.function}
+            functions[node.function] = function
+        }
+
+        function.Calls += node.calls
+        function.Instructions += node.instructions
+        function.Time += time.Duration(node.selfTime())
+    })
+
+    var out []FunctionProfile
+    for _, function := range functions {
+        out = append(out, *function)
+    }
+
+    sort.Slice(out, func(i int, j int) bool {
+        if out[i].Instructions != out[j].Instructions {
+            return out[i].Instructions > out[j].Instructions
+        }
+        return out[i].Function < out[j].Function
+    })
+
+    return out
+}
+
+/* a protocol buffer message, which is all that is needed to write a pprof profile */
+type protoBuffer struct {
+    data []byte
+}
+
+func (buffer *protoBuffer) varint(value uint64){
+    for value >= 0x80 {
+        buffer.data = append(buffer.data, byte(value) | 0x80)
+        value >>= 7
+    }
+    buffer.data = append(buffer.data, byte(value))
+}
+
+func (buffer *protoBuffer) uint64(field int, value uint64){
+    if value != 0 {
+        buffer.varint(uint64(field) << 3)
+        buffer.varint(value)
+    }
+}
+
+func (buffer *protoBuffer) int64(field int, value int64){
+    buffer.uint64(field, uint64(value))
+}
+
+func (buffer *protoBuffer) bytes(field int, value []byte){
+    buffer.varint(uint64(field) << 3 | 2)
+    buffer.varint(uint64(len(value)))
+    buffer.data = append(buffer.data, value...)
+}
+
+func (buffer *protoBuffer) message(field int, message *protoBuffer){
+    buffer.bytes(field, message.data)
+}
+
+func (buffer *protoBuffer) packed(field int, values []uint64){
+    var packed protoBuffer
+    for _, value := range values {
+        packed.varint(value)
+    }
+    buffer.bytes(field, packed.data)
+}
+
+/* the string table of a profile, string 0 is always the empty string */
+type stringTable struct {
+    strings []string
+    index map[string]int64
+}
+
+func (table *stringTable) add(value string) int64 {
+    if table.index == nil {
+        table.strings = []string{""}
+        table.index = map[string]int64{"": 0}
+    }
+
+    index, ok := table.index[value]
+    if !ok {
+        index = int64(len(table.strings))
+        table.strings = append(table.strings, value)
+        table.index[value] = index
+    }
+
+    return index
+}
+
+/* a frame of a profile, offset is -1 for the function as a whole */
+type profileLocation struct {
+    function uint32
+    offset int
+}
+
+/* write the profile in the pprof format, gzipped like the profiles of the go runtime. the functions are
+ * named from the module, see core.FunctionNames, and the module can be nil. the line of an instruction is
+ * its offset plus 1, line 0 is the function as a whole.
+ */
+func (profiler *Profiler) WritePprof(writer io.Writer, module *core.WebAssemblyModule) error {
+    var names map[uint32]string
+    if module != nil {
+        names = module.FunctionNames()
+    }
+
+    var table stringTable
+    var profile protoBuffer
+
+    valueType := func(kind string, unit string) *protoBuffer {
+        var out protoBuffer
+        out.int64(1, table.add(kind))
+        out.int64(2, table.add(unit))
+        return &out
+    }
+
+    profile.message(1, valueType("calls", "count"))
+    profile.message(1, valueType("instructions", "count"))
+    profile.message(1, valueType("time", "nanoseconds"))
+
+    functions := make(map[uint32]uint64)
+    locations := make(map[profileLocation]uint64)
+    var functionMessages []*protoBuffer
+    var locationMessages []*protoBuffer
+
+    functionId := func(function uint32) uint64 {
+        id, ok := functions[function]
+        if !ok {
+            id = uint64(len(functions) + 1)
+            functions[function] = id
+
+            name, ok := names[function]
+            if !ok {
+                name = fmt.Sprintf("func[%v]", function)
+            }
+
+            var message protoBuffer
+            message.uint64(1, id)
+            message.int64(2, table.add(name))
+            message.int64(3, table.add(name))
+            message.int64(4, table.add("wasm"))
+            functionMessages = append(functionMessages, &message)
+        }
+        return id
+    }
+
+    locationId := func(location profileLocation) uint64 {
+        id, ok := locations[location]
+        if !ok {
+            id = uint64(len(locations) + 1)
+            locations[location] = id
+
+            var line protoBuffer
+            line.uint64(1, functionId(location.function))
+            line.int64(2, int64(location.offset + 1))
+
+            var message protoBuffer
+            message.uint64(1, id)
+            message.message(4, &line)
+            locationMessages = append(locationMessages, &message)
+        }
+        return id
+    }
+
+    /* the frames of the callers of a node, starting with its parent */
+    callers := func(node *profileNode) []uint64 {
+        var out []uint64
+        for ; node.parent != profiler.root; node = node.parent {
+            offset := -1
+            if profiler.PerInstruction {
+                offset = node.site
+            }
+            out = append(out, locationId(profileLocation{function: node.parent.function, offset: offset}))
+        }
+        return out
+    }
+
+    sample := func(stack []uint64, calls uint64, instructions uint64, nanoseconds int64){
+        var message protoBuffer
+        message.packed(1, stack)
+        message.packed(2, []uint64{calls, instructions, uint64(nanoseconds)})
+        profile.message(2, &message)
+    }
+
+    profiler.walk(func(node *profileNode){
+        parents := callers(node)
+        whole := locationId(profileLocation{function: node.function, offset: -1})
+
+        if !profiler.PerInstruction {
+            sample(append([]uint64{whole}, parents...), node.calls, node.instructions, node.selfTime())
+            return
+        }
+
+        sample(append([]uint64{whole}, parents...), node.calls, 0, node.selfTime())
+
+        var offsets []int
+        for offset := range node.offsets {
+            offsets = append(offsets, offset)
+        }
+        sort.Ints(offsets)
+
+        for _, offset := range offsets {
+            leaf := locationId(profileLocation{function: node.function, offset: offset})
+            sample(append([]uint64{leaf}, parents...), 0, node.offsets[offset], 0)
+        }
+    })
+
+    for _, message := range locationMessages {
+        profile.message(4, message)
+    }
+
+    for _, message := range functionMessages {
+        profile.message(5, message)
+    }
+
+    /* the string table has to be complete, so it comes after everything that adds strings */
+    periodType := valueType("instructions", "count")
+    for _, value := range table.strings {
+        profile.bytes(6, []byte(value))
+    }
+
+    profile.int64(9, profiler.start.UnixNano())
+    profile.int64(10, int64(time.Since(profiler.start)))
+    profile.message(11, periodType)
+    profile.int64(12, int64(max(int(profiler.SampleRate), 1)))
+
+    buffered := bufio.NewWriter(writer)
+    compressed := gzip.NewWriter(buffered)
+    _, err := compressed.Write(profile.data)
+    if err != nil {
+        return err
+    }
+
+    err = compressed.Close()
+    if err != nil {
+        return err
+    }
+
+    return buffered.Flush()
+}
@@ -0,0 +1,173 @@
+package exec
+
+import (
+    "bytes"
+    "compress/gzip"
+    "io"
+    "testing"
+)
+
+const profileModule = `(module
+    (func $square (param i32) (result i32)
+        (i32.mul (local.get 0) (local.get 0)))
+    (func (export "run") (result i32)
+        (i32.add (call $square (i32.const 2)) (call $square (i32.const 3)))))`
+
+/* the top level fields of a protocol buffer message, only varints and bytes are read */
+func readProto(test *testing.T, data []byte) map[int][][]byte {
+    out := make(map[int][][]byte)
+    readVarint := func() uint64 {
+        var value uint64
+        for shift := 0; ; shift += 7 {
+            if len(data) == 0 {
+                test.Fatalf("truncated message")
+            }
+            next := data[0]
+            data = data[1:]
+            value |= uint64(next & 0x7f) << shift
+            if next < 0x80 {
+                return value
+            }
+        }
+    }
+
+    for len(data) > 0 {
+        key := readVarint()
+        field := int(key >> 3)
+        switch key & 7 {
+            case 0:
+                readVarint()
+                out[field] = append(out[field], nil)
+            case 2:
+                length := int(readVarint())
+                out[field] = append(out[field], data[:length])
+                data = data[length:]
+            default:
+                test.Fatalf("unexpected wire type %v", key & 7)
+        }
+    }
+
+    return out
+}
+
+func TestProfiler(test *testing.T){
+    module := makeModule(test, profileModule)
+
+    profiler := NewProfiler()
+    store := InitializeStore(module)
+    store.Profiler = profiler
+
+    results, err := Invoke(module, store, "run", nil)
+    if err != nil || results[0].AsInt32() != 13 {
+        test.Fatalf("expected 13 but got %v %v", results, err)
+    }
+
+    /* square runs local.get, local.get, i32.mul and the return at its end, twice */
+    functions := profiler.Functions()
+    if len(functions) != 2 {
+        test.Fatalf("expected 2 functions but got %+v", functions)
+    }
+
+    if functions[0].Function != 0 || functions[0].Calls != 2 || functions[0].Instructions != 8 {
+        test.Fatalf("wrong profile of square %+v", functions[0])
+    }
+
+    if functions[1].Function != 1 || functions[1].Calls != 1 || functions[1].Instructions != 6 {
+        test.Fatalf("wrong profile of run %+v", functions[1])
+    }
+
+    var output bytes.Buffer
+    err = profiler.WritePprof(&output, &module)
+    if err != nil {
+        test.Fatalf("unable to write the profile: %v", err)
+    }
+
+    reader, err := gzip.NewReader(&output)
+    if err != nil {
+        test.Fatalf("the profile is not gzipped: %v", err)
+    }
+
+    data, err := io.ReadAll(reader)
+    if err != nil {
+        test.Fatalf("unable to read the profile: %v", err)
+    }
+
+    profile := readProto(test, data)
+
+    names := make(map[string]bool)
+    for _, value := range profile[6] {
+        names[string(value)] = true
+    }
+
+    /* square has a $name and run is an export */
+    if !names["square"] || !names["run"] || !names["instructions"] {
+        test.Fatalf("missing strings in %v", names)
+    }
+
+    /* one sample for run and one for square called from run */
+    if len(profile[2]) != 2 || len(profile[5]) != 2 {
+        test.Fatalf("expected 2 samples and 2 functions but got %v and %v", len(profile[2]), len(profile[5]))
+    }
+
+    profiler.Reset()
+    if len(profiler.Functions()) != 0 {
+        test.Fatalf("reset did not clear the profile")
+    }
+}
+
+func TestProfilerOptions(test *testing.T){
+    module := makeModule(test, profileModule)
+
+    profiler := NewProfiler()
+    profiler.PerInstruction = true
+    store := InitializeStore(module)
+    store.Profiler = profiler
+
+    _, err := Invoke(module, store, "run", nil)
+    if err != nil {
+        test.Fatalf("unable to invoke run: %v", err)
+    }
+
+    /* both calls of square are from different call instructions of run */
+    calls := 0
+    profiler.walk(func(node *profileNode){
+        if node.function == 0 {
+            calls += 1
+            if node.offsets[2] != 1 {
+                test.Errorf("expected the multiply to run once but got %v", node.offsets)
+            }
+        }
+    })
+
+    if calls != 2 {
+        test.Fatalf("expected square at 2 call sites but got %v", calls)
+    }
+
+    var output bytes.Buffer
+    err = profiler.WritePprof(&output, &module)
+    if err != nil {
+        test.Fatalf("unable to write the profile: %v", err)
+    }
+
+    /* every 5th instruction is counted with a weight of 5 */
+    profiler = NewProfiler()
+    profiler.SampleRate = 5
+    store.Profiler = profiler
+
+    _, err = Invoke(module, store, "run", nil)
+    if err != nil {
+        test.Fatalf("unable to invoke run: %v", err)
+    }
+
+    total := uint64(0)
+    for _, function := range profiler.Functions() {
+        total += function.Instructions
+        if function.Time != 0 {
+            test.Fatalf("sampled calls should not be timed")
+        }
+    }
+
+    if total != 10 {
+        test.Fatalf("expected 10 sampled instructions but got %v", total)
+    }
+}
@@ -0,0 +1,199 @@
+package exec
+
+/* snapshots of the state of an instance, so that an instance can be reused by putting it back the way it
+ * was instead of making a new one.
+ *
+ * after a snapshot is taken the store remembers which blocks of memory 0 the code has stored to, and a reset
+ * only copies those blocks back from the snapshot. memory 0 is the only memory that instructions can write.
+ * host functions that write to memory directly have to tell the store with MarkMemoryDirty.
+ */
+
+import (
+    "fmt"
+    "sync"
+
+    "github.com/kazzmir/webassembly/lib/core"
+)
+
+/* the granularity of the dirty tracking, smaller than a page so that a few stores do not copy a whole page */
+const snapshotBlockSize = 4096
+
+/* the memories, globals and tables of a store at some point in time */
+type Snapshot struct {
+    memory [][]byte
+    globals []RuntimeValue
+    tables [][]core.Index
+}
+
+/* copy the state of the store, and start tracking the memory that changes after this point */
+func (store *Store) Snapshot() *Snapshot {
+    var out Snapshot
+
+    for _, memory := range store.Memory {
+        out.memory = append(out.memory, append([]byte(nil), memory...))
+    }
+
+    for _, global := range store.Globals {
+        out.globals = append(out.globals, global.Value)
+    }
+
+    for _, table := range store.Tables {
+        out.tables = append(out.tables, append([]core.Index(nil), table.Elements...))
+    }
+
+    store.snapshot = &out
+    store.dirty = nil
+    if len(store.Memory) > 0 {
+        store.dirty = make([]bool, blocks(len(store.Memory[0])))
+    }
+
+    return &out
+}
+
+func blocks(size int) int {
+    return (size + snapshotBlockSize - 1) / snapshotBlockSize
+}
+
+/* note that the bytes [offset, offset+length) of memory 0 have changed */
+func (store *Store) MarkMemoryDirty(offset uint64, length uint64){
+    if store.dirty == nil || length == 0 {
+        return
+    }
+
+    last := (offset + length - 1) / snapshotBlockSize
+    for block := offset / snapshotBlockSize; block <= last && block < uint64(len(store.dirty)); block++ {
+        store.dirty[block] = true
+    }
+}
+
+/* put the memories, globals and tables back to the way they were in the snapshot. memory that grew since
+ * the snapshot shrinks back to its old size.
+ */
+func (store *Store) Reset(snapshot *Snapshot){
+    for i, saved := range snapshot.memory {
+        memory := store.Memory[i]
+        if len(memory) < len(saved) {
+            memory = append(memory, make([]byte, len(saved) - len(memory))...)
+        }
+        memory = memory[:len(saved)]
+
+        if i == 0 && snapshot == store.snapshot && store.dirty != nil {
+            for block, dirty := range store.dirty {
+                if dirty {
+                    start := block * snapshotBlockSize
+                    if start < len(saved) {
+                        copy(memory[start:], saved[start:min(start + snapshotBlockSize, len(saved))])
+                    }
+                    store.dirty[block] = false
+                }
+            }
+        } else {
+            copy(memory, saved)
+        }
+
+        store.Memory[i] = memory
+    }
+
+    for i, value := range snapshot.globals {
+        store.Globals[i].Value = value
+    }
+
+    for i, elements := range snapshot.tables {
+        store.Tables[i].Elements = append(store.Tables[i].Elements[:0], elements...)
+    }
+
+    /* the store now matches this snapshot, so track the changes from it from now on */
+    if snapshot != store.snapshot {
+        store.snapshot = snapshot
+        store.dirty = nil
+        if len(snapshot.memory) > 0 {
+            store.dirty = make([]bool, blocks(len(snapshot.memory[0])))
+        }
+    }
+}
+
+func min(a int, b int) int {
+    if a < b {
+        return a
+    }
+
+    return b
+}
+
+/* the state of the instance, see Store.Snapshot */
+func (instance *Instance) Snapshot() *Snapshot {
+    return instance.store.Snapshot()
+}
+
+/* put the instance back to the state it had in a snapshot of it */
+func (instance *Instance) Reset(snapshot *Snapshot){
+    instance.store.Reset(snapshot)
+}
+
+/* instances of a module that are handed out one at a time and reset when they are given back, so that every
+ * user of an instance sees it exactly as it was after it was instantiated. a pool is safe to use from many
+ * goroutines at once.
+ *
+ * host modules can keep state of their own, such as the open files of a wasi.System, so every instance gets
+ * host modules of its own from the function given to NewPool. that state is not reset when the instance is
+ * given back, it stays with the instance for as long as the pool keeps it.
+ */
+type InstancePool struct {
+    compiled *CompiledModule
+    hosts func() ([]*HostModule, error)
+    lock sync.Mutex
+    free []*Instance
+}
+
+/* hosts makes the host modules for each new instance, it can be nil for a module without imports. it is
+ * called from the goroutine that calls Get
+ */
+func (compiled *CompiledModule) NewPool(hosts func() ([]*HostModule, error)) *InstancePool {
+    return &InstancePool{
+        compiled: compiled,
+        hosts: hosts,
+    }
+}
+
+/* an instance that no one else is using, either a reset one or a new one */
+func (pool *InstancePool) Get() (*Instance, error) {
+    pool.lock.Lock()
+    if len(pool.free) > 0 {
+        instance := pool.free[len(pool.free)-1]
+        pool.free = pool.free[:len(pool.free)-1]
+        pool.lock.Unlock()
+        return instance, nil
+    }
+    pool.lock.Unlock()
+
+    var hosts []*HostModule
+    if pool.hosts != nil {
+        var err error
+        hosts, err = pool.hosts()
+        if err != nil {
+            return nil, fmt.Errorf("unable to make host modules: %w", err)
+        }
+    }
+
+    instance, err := pool.compiled.Instantiate(hosts...)
+    if err != nil {
+        return nil, err
+    }
+
+    instance.initial = instance.store.Snapshot()
+    return instance, nil
+}
+
+/* give back an instance that came from Get, it is reset before anyone else gets it. fuel is taken away
+ * and metering is turned off, as in a new instance
+ */
+func (pool *InstancePool) Put(instance *Instance){
+    instance.store.Reset(instance.initial)
+    instance.store.metered = false
+    instance.store.fuel = 0
+    instance.store.consumed = 0
+
+    pool.lock.Lock()
+    pool.free = append(pool.free, instance)
+    pool.lock.Unlock()
+}
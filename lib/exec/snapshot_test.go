@@ -0,0 +1,163 @@
+package exec
+
+import (
+    "sync"
+    "testing"
+)
+
+func TestSnapshotReset(test *testing.T){
+    module := makeModule(test, `(module
+        (memory 1)
+        (data (i32.const 5000) "\2a")
+        (global $count (mut i32) (i32.const 0))
+        (func $init (global.set $count (i32.const 10)))
+        (start $init)
+        (func (export "poke") (param i32 i32)
+            (i32.store8 (local.get 0) (local.get 1))
+            (global.set $count (i32.add (global.get $count) (i32.const 1))))
+        (func (export "peek") (param i32) (result i32)
+            (i32.load8_u (local.get 0)))
+        (func (export "count") (result i32) (global.get $count))
+        (func (export "grow") (result i32) (memory.grow (i32.const 1))))`)
+
+    instance, err := Compile(module).Instantiate()
+    if err != nil {
+        test.Fatalf("unable to instantiate: %v", err)
+    }
+
+    call := func(name string, args ...RuntimeValue) int32 {
+        result, err := instance.Invoke(name, args)
+        if err != nil {
+            test.Fatalf("unable to invoke %v: %v", name, err)
+        }
+        if len(result) == 0 {
+            return 0
+        }
+        return result[0].AsInt32()
+    }
+
+    /* the start function ran before the snapshot */
+    snapshot := instance.Snapshot()
+    if call("count") != 10 {
+        test.Fatalf("the start function did not run")
+    }
+
+    call("poke", ValueI32(5000), ValueI32(1))
+    call("poke", ValueI32(100), ValueI32(2))
+    call("grow")
+    call("poke", ValueI32(70000), ValueI32(3))
+    if call("peek", ValueI32(5000)) != 1 || call("count") != 13 {
+        test.Fatalf("the pokes did not change the instance")
+    }
+
+    instance.Reset(snapshot)
+    if call("peek", ValueI32(5000)) != 42 || call("peek", ValueI32(100)) != 0 || call("count") != 10 {
+        test.Fatalf("reset did not restore the instance")
+    }
+    if len(instance.Store().Memory[0]) != MemoryPageSize {
+        test.Fatalf("reset did not shrink memory back to one page")
+    }
+
+    /* memory that grows again after a reset starts out as zero */
+    call("grow")
+    if call("peek", ValueI32(70000)) != 0 {
+        test.Fatalf("grown memory was not zero")
+    }
+}
+
+func TestInstancePool(test *testing.T){
+    module := makeModule(test, `(module
+        (memory 1)
+        (func (export "bump") (result i32)
+            (i32.store (i32.const 0) (i32.add (i32.load (i32.const 0)) (i32.const 1)))
+            (i32.load (i32.const 0))))`)
+
+    pool := Compile(module).NewPool(nil)
+    for i := 0; i < 3; i++ {
+        instance, err := pool.Get()
+        if err != nil {
+            test.Fatalf("unable to get an instance: %v", err)
+        }
+
+        result, err := instance.Invoke("bump", nil)
+        if err != nil || result[0].AsInt32() != 1 {
+            test.Fatalf("expected every instance to start from 0 but got %v %v", result, err)
+        }
+
+        pool.Put(instance)
+    }
+}
+
+func TestInstancePoolHosts(test *testing.T){
+    module := makeModule(test, `(module
+        (import "env" "next" (func $next (result i32)))
+        (func (export "run") (result i32)
+            (call $next)))`)
+
+    /* each host module counts its own calls, which would race if two instances shared one */
+    var lock sync.Mutex
+    made := 0
+    pool := Compile(module).NewPool(func() ([]*HostModule, error) {
+        lock.Lock()
+        made += 1
+        lock.Unlock()
+
+        count := int32(0)
+        host := NewHostModule("env")
+        err := host.DefineFunc("next", func() int32 {
+            count += 1
+            return count
+        })
+        return []*HostModule{host}, err
+    })
+
+    first, err := pool.Get()
+    if err != nil {
+        test.Fatalf("unable to get an instance: %v", err)
+    }
+    second, err := pool.Get()
+    if err != nil {
+        test.Fatalf("unable to get an instance: %v", err)
+    }
+
+    var group sync.WaitGroup
+    for _, instance := range []*Instance{first, second} {
+        group.Add(1)
+        go func(instance *Instance){
+            defer group.Done()
+            for i := int32(1); i <= 100; i++ {
+                result, err := instance.Invoke("run", nil)
+                if err != nil || result[0].AsInt32() != i {
+                    test.Errorf("expected %v but got %v %v", i, result, err)
+                    return
+                }
+            }
+        }(instance)
+    }
+    group.Wait()
+
+    if made != 2 {
+        test.Fatalf("expected host modules for 2 instances but made %v", made)
+    }
+
+    /* fuel that was added for one user is gone for the next */
+    first.Store().AddFuel(100)
+    _, err = first.Invoke("run", nil)
+    if err != nil {
+        test.Fatalf("unable to run: %v", err)
+    }
+    pool.Put(first)
+
+    again, err := pool.Get()
+    if err != nil {
+        test.Fatalf("unable to get an instance: %v", err)
+    }
+    if again != first || again.Store().Fuel() != 0 || again.Store().FuelConsumed() != 0 {
+        test.Fatalf("expected the instance back without fuel but got %v %v", again.Store().Fuel(), again.Store().FuelConsumed())
+    }
+
+    _, err = again.Invoke("run", nil)
+    if err != nil {
+        test.Fatalf("expected no fuel metering after a reset but got %v", err)
+    }
+}
@@ -0,0 +1,278 @@
+package exec
+
+/* tracing tells a Tracer about every function call, instruction and memory access of the code, and about
+ * the trap that stops it. locations are the same as in the debugger, a function index and an instruction
+ * offset.
+ *
+ * an instruction is reported after it has run, so a call is reported after everything that the called
+ * function did. the value stack does not know the types of its values, so the operands and results of an
+ * instruction are the raw bits. the return at the end of a function is reported as the exit of the function.
+ */
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "strings"
+
+    "github.com/kazzmir/webassembly/lib/core"
+    "github.com/kazzmir/webassembly/lib/data"
+)
+
+type Tracer interface {
+    EnterFunction(function uint32, args []RuntimeValue)
+    /* err is set if the function trapped or a function it called trapped */
+    ExitFunction(function uint32, results []RuntimeValue, err error)
+    Instruction(event *TraceInstruction)
+    MemoryAccess(event *TraceMemory)
+    /* the instruction that trapped, this is only reported once even though every function on the way out
+     * exits with the error
+     */
+    Trap(location Location, err error)
+}
+
+type TraceInstruction struct {
+    Location Location
+    /* the number of active functions, 1 for the function that was called from go */
+    Depth int
+    /* the values the instruction took from the stack and the values it left on the stack */
+    Operands []uint64
+    Results []uint64
+    /* how much the height of the stack changed, a branch can also drop values that it does not use */
+    StackDelta int
+}
+
+type TraceMemory struct {
+    Location Location
+    Address uint64
+    Size uint64
+    Write bool
+    /* the value that was loaded or stored */
+    Value uint64
+}
+
+func max(a int, b int) int {
+    if a > b {
+        return a
+    }
+
+    return b
+}
+
+func (machine *machine) traceEnter(function *compiledFunction, fp int){
+    args := make([]RuntimeValue, function.parameters)
+    for i := range args {
+        args[i] = fromSlot(function.locals[i], machine.stack[fp + i])
+    }
+
+    machine.tracer.EnterFunction(function.index, args)
+}
+
+func (machine *machine) traceExit(function *compiledFunction, fp int, err error){
+    if err != nil {
+        if !machine.trapped {
+            machine.trapped = true
+            location := machine.location
+            if function.host != nil {
+                location = Location{Function: function.index, Offset: -1}
+            }
+            machine.tracer.Trap(location, err)
+        }
+
+        machine.tracer.ExitFunction(function.index, nil, err)
+        return
+    }
+
+    results := make([]RuntimeValue, len(function.results))
+    for i, kind := range function.results {
+        results[i] = fromSlot(kind, machine.stack[fp + i])
+    }
+
+    machine.tracer.ExitFunction(function.index, results, nil)
+}
+
+/* report an instruction that just ran, and the memory it accessed */
+func (machine *machine) traceInstruction(current *instruction, operands []uint64, delta int, sp int){
+    event := TraceInstruction{
+        Location: machine.location,
+        Depth: machine.depth,
+        Operands: operands,
+        Results: append([]uint64(nil), machine.stack[sp - min(current.pushes, sp):sp]...),
+        StackDelta: delta,
+    }
+
+    machine.tracer.Instruction(&event)
+
+    size, write, ok := accessSize(current.op)
+    if ok && len(operands) > 0 {
+        access := TraceMemory{
+            Location: machine.location,
+            Address: uint64(uint32(operands[0])) + current.value,
+            Size: size,
+            Write: write,
+        }
+
+        if write && len(operands) > 1 {
+            access.Value = operands[1]
+        } else if len(event.Results) > 0 {
+            access.Value = event.Results[0]
+        }
+
+        machine.tracer.MemoryAccess(&access)
+    }
+}
+
+/* the text of one instruction as it is written in the text format, without the instructions inside of a
+ * block
+ */
+func DescribeInstruction(expression core.Expression) string {
+    /* a branch is written with the block it goes to, which is not known outside of the function, so only
+     * the label depth is given
+     */
+    switch expression.(type) {
+        case *core.BlockExpression:
+            switch expression.(*core.BlockExpression).Kind {
+                case core.BlockKindLoop: return "loop"
+                case core.BlockKindIf: return "if"
+            }
+            return "block"
+        case *core.BranchExpression:
+            return fmt.Sprintf("br %v", expression.(*core.BranchExpression).Label)
+        case *core.BranchIfExpression:
+            return fmt.Sprintf("br_if %v", expression.(*core.BranchIfExpression).Label)
+        case *core.BranchTableExpression:
+            out := "br_table"
+            for _, label := range expression.(*core.BranchTableExpression).Labels {
+                out += fmt.Sprintf(" %v", label)
+            }
+            return out
+    }
+
+    return strings.TrimSpace(expression.ConvertToWat(data.Stack[int]{}, ""))
+}
+
+/* a tracer that writes every event as one line of json. writing stops at the first error, which Err
+ * returns
+ */
+type JSONTracer struct {
+    encoder *json.Encoder
+    module *core.WebAssemblyModule
+    /* the text of the instructions of each function that has been traced */
+    instructions map[uint32][]string
+    err error
+}
+
+type jsonEvent struct {
+    Event string `json:"event"`
+    Function uint32 `json:"function"`
+    Offset *int `json:"offset,omitempty"`
+    Depth int `json:"depth,omitempty"`
+    Instruction string `json:"instruction,omitempty"`
+    Operands []uint64 `json:"operands,omitempty"`
+    Results []uint64 `json:"results,omitempty"`
+    StackDelta int `json:"delta,omitempty"`
+    Values []string `json:"values,omitempty"`
+    Address *uint64 `json:"address,omitempty"`
+    Size uint64 `json:"size,omitempty"`
+    Write bool `json:"write,omitempty"`
+    Value *uint64 `json:"value,omitempty"`
+    Error string `json:"error,omitempty"`
+}
+
+/* the module is used to add the text of each instruction to the trace, it can be nil */
+func NewJSONTracer(writer io.Writer, module *core.WebAssemblyModule) *JSONTracer {
+    return &JSONTracer{
+        encoder: json.NewEncoder(writer),
+        module: module,
+        instructions: make(map[uint32][]string),
+    }
+}
+
+func (tracer *JSONTracer) Err() error {
+    return tracer.err
+}
+
+func (tracer *JSONTracer) write(event *jsonEvent){
+    if tracer.err == nil {
+        tracer.err = tracer.encoder.Encode(event)
+    }
+}
+
+/* the text of an instruction of a function that is defined in the module */
+func (tracer *JSONTracer) instruction(location Location) string {
+    if tracer.module == nil {
+        return ""
+    }
+
+    text, ok := tracer.instructions[location.Function]
+    if !ok {
+        codeSection := tracer.module.GetCodeSection()
+        defined := int(location.Function) - tracer.module.GetImportFunctionCount()
+        if codeSection != nil && defined >= 0 && defined < len(codeSection.Code) {
+            for _, expression := range FunctionInstructions(codeSection.Code[defined]) {
+                text = append(text, DescribeInstruction(expression))
+            }
+        }
+        tracer.instructions[location.Function] = text
+    }
+
+    if location.Offset >= 0 && location.Offset < len(text) {
+        return text[location.Offset]
+    }
+
+    return ""
+}
+
+func describeValues(values []RuntimeValue) []string {
+    var out []string
+    for _, value := range values {
+        out = append(out, value.String())
+    }
+    return out
+}
+
+func (tracer *JSONTracer) EnterFunction(function uint32, args []RuntimeValue){
+    tracer.write(&jsonEvent{Event: "enter", Function: function, Values: describeValues(args)})
+}
+
+func (tracer *JSONTracer) ExitFunction(function uint32, results []RuntimeValue, err error){
+    event := jsonEvent{Event: "exit", Function: function, Values: describeValues(results)}
+    if err != nil {
+        event.Error = err.Error()
+    }
+    tracer.write(&event)
+}
+
+func (tracer *JSONTracer) Instruction(event *TraceInstruction){
+    offset := event.Location.Offset
+    tracer.write(&jsonEvent{
+        Event: "instruction",
+        Function: event.Location.Function,
+        Offset: &offset,
+        Depth: event.Depth,
+        Instruction: tracer.instruction(event.Location),
+        Operands: event.Operands,
+        Results: event.Results,
+        StackDelta: event.StackDelta,
+    })
+}
+
+func (tracer *JSONTracer) MemoryAccess(event *TraceMemory){
+    offset := event.Location.Offset
+    address := event.Address
+    value := event.Value
+    tracer.write(&jsonEvent{
+        Event: "memory",
+        Function: event.Location.Function,
+        Offset: &offset,
+        Address: &address,
+        Size: event.Size,
+        Write: event.Write,
+        Value: &value,
+    })
+}
+
+func (tracer *JSONTracer) Trap(location Location, err error){
+    offset := location.Offset
+    tracer.write(&jsonEvent{Event: "trap", Function: location.Function, Offset: &offset, Error: err.Error()})
+}
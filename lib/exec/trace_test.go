@@ -0,0 +1,155 @@
+package exec
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "strings"
+    "testing"
+)
+
+/* remembers every event as a line of text */
+type recordingTracer struct {
+    events []string
+}
+
+func (tracer *recordingTracer) EnterFunction(function uint32, args []RuntimeValue){
+    tracer.events = append(tracer.events, fmt.Sprintf("enter %v %v", function, args))
+}
+
+func (tracer *recordingTracer) ExitFunction(function uint32, results []RuntimeValue, err error){
+    tracer.events = append(tracer.events, fmt.Sprintf("exit %v %v %v", function, results, err))
+}
+
+func (tracer *recordingTracer) Instruction(event *TraceInstruction){
+    tracer.events = append(tracer.events, fmt.Sprintf("instruction %v:%v %v %v %v", event.Location.Function, event.Location.Offset, event.Operands, event.Results, event.StackDelta))
+}
+
+func (tracer *recordingTracer) MemoryAccess(event *TraceMemory){
+    tracer.events = append(tracer.events, fmt.Sprintf("memory %v %v %v %v", event.Address, event.Size, event.Write, event.Value))
+}
+
+func (tracer *recordingTracer) Trap(location Location, err error){
+    tracer.events = append(tracer.events, fmt.Sprintf("trap %v:%v %v", location.Function, location.Offset, err))
+}
+
+func TestTracer(test *testing.T){
+    module := makeModule(test, `(module
+        (memory 1)
+        (func $divide (param i32 i32) (result i32)
+            (i32.div_s (local.get 0) (local.get 1)))
+        (func (export "run") (param i32) (result i32)
+            (i32.store (i32.const 8) (local.get 0))
+            (call $divide (i32.const 12) (i32.load (i32.const 8)))))`)
+
+    tracer := &recordingTracer{}
+    store := InitializeStore(module)
+    store.Tracer = tracer
+
+    results, err := Invoke(module, store, "run", []RuntimeValue{ValueI32(4)})
+    if err != nil || results[0].AsInt32() != 3 {
+        test.Fatalf("expected 3 but got %v %v", results, err)
+    }
+
+    expected := []string{
+        "enter 1 [4:i32]",
+        "instruction 1:0 [] [8] 1",
+        "instruction 1:1 [] [4] 1",
+        "instruction 1:2 [8 4] [] -2",
+        "memory 8 4 true 4",
+        "instruction 1:3 [] [12] 1",
+        "instruction 1:4 [] [8] 1",
+        "instruction 1:5 [8] [4] 0",
+        "memory 8 4 false 4",
+        "enter 0 [12:i32 4:i32]",
+        "instruction 0:0 [] [12] 1",
+        "instruction 0:1 [] [4] 1",
+        "instruction 0:2 [12 4] [3] -1",
+        "exit 0 [3:i32] <nil>",
+        "instruction 1:6 [12 4] [3] -1",
+        "exit 1 [3:i32] <nil>",
+    }
+
+    if strings.Join(tracer.events, "\n") != strings.Join(expected, "\n") {
+        test.Fatalf("expected\n%v\nbut got\n%v", strings.Join(expected, "\n"), strings.Join(tracer.events, "\n"))
+    }
+
+    /* the trap is reported once, where it happened */
+    tracer.events = nil
+    _, err = Invoke(module, store, "run", []RuntimeValue{ValueI32(0)})
+    if err == nil {
+        test.Fatalf("expected a trap")
+    }
+
+    var traps []string
+    for _, event := range tracer.events {
+        if strings.HasPrefix(event, "trap") {
+            traps = append(traps, event)
+        }
+    }
+
+    if len(traps) != 1 || traps[0] != "trap 0:2 integer divide by zero" {
+        test.Fatalf("wrong traps %v", traps)
+    }
+
+    last := tracer.events[len(tracer.events)-1]
+    if last != "exit 1 [] integer divide by zero" {
+        test.Fatalf("wrong last event %v", last)
+    }
+}
+
+func TestJSONTracer(test *testing.T){
+    module := makeModule(test, `(module
+        (func (export "add") (param i32 i32) (result i32)
+            (i32.add (local.get 0) (local.get 1))))`)
+
+    var output bytes.Buffer
+    tracer := NewJSONTracer(&output, &module)
+
+    store := InitializeStore(module)
+    store.Tracer = tracer
+
+    _, err := Invoke(module, store, "add", []RuntimeValue{ValueI32(1), ValueI32(2)})
+    if err != nil {
+        test.Fatalf("unable to invoke add: %v", err)
+    }
+
+    lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+    if len(lines) != 5 {
+        test.Fatalf("expected 5 events but got %v", lines)
+    }
+
+    var event map[string]any
+    err = json.Unmarshal([]byte(lines[3]), &event)
+    if err != nil {
+        test.Fatalf("invalid json %v: %v", lines[3], err)
+    }
+
+    if event["event"] != "instruction" || event["instruction"] != "i32.add" || event["offset"] != float64(2) {
+        test.Fatalf("wrong event %v", lines[3])
+    }
+
+    if tracer.Err() != nil {
+        test.Fatalf("unexpected error %v", tracer.Err())
+    }
+}
+
+func TestDescribeInstruction(test *testing.T){
+    module := makeModule(test, `(module
+        (func (param i32)
+            (block
+                (loop
+                    (br_if 1 (local.get 0))
+                    (br_table 0 1 (local.get 0))
+                    (br 0)))))`)
+
+    var text []string
+    for _, instruction := range FunctionInstructions(module.GetCodeSection().Code[0]) {
+        text = append(text, DescribeInstruction(instruction))
+    }
+
+    expected := "block|loop|local.get 0|br_if 1|local.get 0|br_table 0 1|br 0"
+    if strings.Join(text, "|") != expected {
+        test.Fatalf("expected %v but got %v", expected, strings.Join(text, "|"))
+    }
+}
@@ -0,0 +1,61 @@
+package exec
+
+import (
+    "math"
+    "strings"
+    "testing"
+
+    "github.com/kazzmir/webassembly/lib/core"
+)
+
+func TestValues(test *testing.T){
+    if ValueI32(-1).AsUint32() != math.MaxUint32 || ValueI64(-1).AsUint64() != math.MaxUint64 {
+        test.Fatalf("signed values should convert to unsigned by their bits")
+    }
+
+    if ValueF64(2.5).AsFloat64() != 2.5 || ValueF32(-0.5).AsFloat32() != -0.5 {
+        test.Fatalf("floats should convert back to the same value")
+    }
+
+    if ValueF32(1).Type() != core.ValueTypeF32 || ValueRefNull(core.ValueTypeRefExtern).Type() != core.ValueTypeRefExtern {
+        test.Fatalf("wrong types")
+    }
+
+    if !ValueRefNull(core.ValueTypeRefFunc).IsNull() || ValueRefFunc(0).IsNull() {
+        test.Fatalf("wrong null references")
+    }
+
+    /* equality is by bits, so nans with the same payload are equal and zeros with different signs are not */
+    if !ValueF32FromBits(0x7fc00001).Equal(ValueF32FromBits(0x7fc00001)) {
+        test.Fatalf("the same nan should be equal")
+    }
+    if ValueF64(0).Equal(ValueF64(math.Copysign(0, -1))) {
+        test.Fatalf("-0 should not equal +0")
+    }
+    if ValueI32(1).Equal(ValueI64(1)) {
+        test.Fatalf("values of different types should not be equal")
+    }
+}
+
+func TestInvokeArguments(test *testing.T){
+    module := makeModule(test, `(module
+        (func (export "add") (param i32 i64) (result i64)
+            (i64.add (i64.extend_i32_s (local.get 0)) (local.get 1))))`)
+
+    store := InitializeStore(module)
+
+    result, err := Invoke(module, store, "add", []RuntimeValue{ValueI32(-2), ValueI64(5)})
+    if err != nil || len(result) != 1 || !result[0].Equal(ValueI64(3)) {
+        test.Fatalf("expected 3 but got %v %v", result, err)
+    }
+
+    _, err = Invoke(module, store, "add", []RuntimeValue{ValueI32(1)})
+    if err == nil || !strings.Contains(err.Error(), "expects 2 arguments") {
+        test.Fatalf("expected an argument count error but got %v", err)
+    }
+
+    _, err = Invoke(module, store, "add", []RuntimeValue{ValueI32(1), ValueF64(2)})
+    if err == nil || !strings.Contains(err.Error(), "argument 1 of function 'add' should be i64 but is f64") {
+        test.Fatalf("expected an argument type error but got %v", err)
+    }
+}
@@ -0,0 +1,352 @@
+package literal
+
+/* Parse numeric literals as written in the webassembly text format
+ * https://webassembly.github.io/spec/core/text/values.html
+ *
+ * integers: sign? (num | 0x hexnum), where digits may be separated by single underscores
+ * floats: sign? (num ('.' frac?)? ([eE] sign? num)? | 0x hexnum ('.' hexfrac?)? ([pP] sign? num)? | inf | nan | nan:0x hexnum)
+ */
+
+import (
+    "errors"
+    "fmt"
+    "math"
+    "strconv"
+    "strings"
+)
+
+var InvalidLiteral = errors.New("invalid literal")
+var OutOfRange = errors.New("literal out of range")
+
+const (
+    F32CanonicalNaN uint32 = 0x7fc00000
+    F64CanonicalNaN uint64 = 0x7ff8000000000000
+
+    f32SignBit uint32 = 1 << 31
+    f32Infinity uint32 = 0x7f800000
+    f32PayloadMask uint32 = (1 << 23) - 1
+
+    f64SignBit uint64 = 1 << 63
+    f64Infinity uint64 = 0x7ff0000000000000
+    f64PayloadMask uint64 = (1 << 52) - 1
+)
+
+func isDigit(c byte, hex bool) bool {
+    if c >= '0' && c <= '9' {
+        return true
+    }
+
+    if hex {
+        return (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+    }
+
+    return false
+}
+
+/* remove the underscores from a sequence of digits, making sure each underscore sits between two digits */
+func digits(text string, hex bool) (string, error) {
+    if len(text) == 0 {
+        return "", InvalidLiteral
+    }
+
+    var out strings.Builder
+    for i := 0; i < len(text); i++ {
+        c := text[i]
+        if c == '_' {
+            if i == 0 || i == len(text) - 1 || text[i-1] == '_' {
+                return "", InvalidLiteral
+            }
+            continue
+        }
+
+        if !isDigit(c, hex) {
+            return "", InvalidLiteral
+        }
+
+        out.WriteByte(c)
+    }
+
+    return out.String(), nil
+}
+
+/* split off a leading + or - */
+func splitSign(text string) (string, bool, bool) {
+    if strings.HasPrefix(text, "-") {
+        return text[1:], true, true
+    }
+
+    if strings.HasPrefix(text, "+") {
+        return text[1:], false, true
+    }
+
+    return text, false, false
+}
+
+/* parse the magnitude of an integer, num or 0x hexnum */
+func parseNatural(text string) (uint64, error) {
+    base := 10
+    hex := false
+    if strings.HasPrefix(text, "0x") {
+        text = text[2:]
+        base = 16
+        hex = true
+    }
+
+    clean, err := digits(text, hex)
+    if err != nil {
+        return 0, err
+    }
+
+    value, err := strconv.ParseUint(clean, base, 64)
+    if err != nil {
+        return 0, OutOfRange
+    }
+
+    return value, nil
+}
+
+/* parse an integer of the given bit size. without a sign the literal is unsigned and may use
+ * all of the bits, with a sign it must fit in the signed range. the result is the two's complement bits.
+ */
+func parseInteger(text string, bits uint) (uint64, error) {
+    magnitude, negative, signed := splitSign(text)
+
+    value, err := parseNatural(magnitude)
+    if err != nil {
+        return 0, fmt.Errorf("%w: %v", err, text)
+    }
+
+    if !signed {
+        if bits < 64 && value >= 1 << bits {
+            return 0, fmt.Errorf("%w: %v", OutOfRange, text)
+        }
+        return value, nil
+    }
+
+    limit := uint64(1) << (bits - 1)
+    if negative {
+        if value > limit {
+            return 0, fmt.Errorf("%w: %v", OutOfRange, text)
+        }
+        return -value, nil
+    }
+
+    if value >= limit {
+        return 0, fmt.Errorf("%w: %v", OutOfRange, text)
+    }
+
+    return value, nil
+}
+
+/* parse an i32 literal, such as 42, -0x80000000 or 0xffff_ffff */
+func ParseI32(text string) (int32, error) {
+    value, err := parseInteger(text, 32)
+    return int32(uint32(value)), err
+}
+
+/* parse an i64 literal */
+func ParseI64(text string) (int64, error) {
+    value, err := parseInteger(text, 64)
+    return int64(value), err
+}
+
+/* parse an unsigned 32-bit number without a sign, as used for indices, limits and offsets */
+func ParseU32(text string) (uint32, error) {
+    if strings.HasPrefix(text, "-") || strings.HasPrefix(text, "+") {
+        return 0, fmt.Errorf("%w: %v", InvalidLiteral, text)
+    }
+
+    value, err := parseInteger(text, 32)
+    return uint32(value), err
+}
+
+/* check that the magnitude of a float matches the text grammar and convert it to a form that
+ * strconv.ParseFloat understands
+ */
+func normalizeFloat(text string) (string, error) {
+    hex := false
+    prefix := ""
+    if strings.HasPrefix(text, "0x") {
+        hex = true
+        prefix = "0x"
+        text = text[2:]
+    }
+
+    exponentMarker := "eE"
+    if hex {
+        exponentMarker = "pP"
+    }
+
+    mantissa := text
+    exponent := ""
+    if index := strings.IndexAny(text, exponentMarker); index != -1 {
+        mantissa = text[:index]
+        exponent = text[index+1:]
+    }
+
+    whole := mantissa
+    fraction := ""
+    hasDot := false
+    if index := strings.IndexByte(mantissa, '.'); index != -1 {
+        whole = mantissa[:index]
+        fraction = mantissa[index+1:]
+        hasDot = true
+    }
+
+    var out strings.Builder
+    out.WriteString(prefix)
+
+    clean, err := digits(whole, hex)
+    if err != nil {
+        return "", err
+    }
+    out.WriteString(clean)
+
+    if hasDot {
+        out.WriteByte('.')
+        if fraction != "" {
+            clean, err := digits(fraction, hex)
+            if err != nil {
+                return "", err
+            }
+            out.WriteString(clean)
+        }
+    }
+
+    if hex {
+        /* strconv requires an exponent for hex floats */
+        out.WriteByte('p')
+    } else {
+        out.WriteByte('e')
+    }
+
+    if exponent == "" {
+        if strings.ContainsAny(text, exponentMarker) {
+            return "", InvalidLiteral
+        }
+        out.WriteByte('0')
+    } else {
+        exponentDigits, negative, signed := splitSign(exponent)
+        if signed && negative {
+            out.WriteByte('-')
+        }
+
+        clean, err := digits(exponentDigits, false)
+        if err != nil {
+            return "", err
+        }
+        out.WriteString(clean)
+    }
+
+    return out.String(), nil
+}
+
+/* parse the float magnitude into bits, reporting infinity and nan to the caller */
+func parseFloatBits(text string, bitSize int) (uint64, error) {
+    normalized, err := normalizeFloat(text)
+    if err != nil {
+        return 0, fmt.Errorf("%w: %v", err, text)
+    }
+
+    value, err := strconv.ParseFloat(normalized, bitSize)
+    if err != nil {
+        /* a literal that rounds to infinity is out of range */
+        return 0, fmt.Errorf("%w: %v", OutOfRange, text)
+    }
+
+    if bitSize == 32 {
+        return uint64(math.Float32bits(float32(value))), nil
+    }
+
+    return math.Float64bits(value), nil
+}
+
+/* parse the payload of nan:0x... which must be non-zero and fit in the significand */
+func parseNaNPayload(text string, mask uint64) (uint64, error) {
+    if !strings.HasPrefix(text, "0x") {
+        return 0, InvalidLiteral
+    }
+
+    payload, err := parseNatural(text)
+    if err != nil {
+        return 0, err
+    }
+
+    if payload == 0 || payload > mask {
+        return 0, OutOfRange
+    }
+
+    return payload, nil
+}
+
+/* parse an f32 literal and return the exact bits of the value, including any nan payload */
+func ParseF32Bits(text string) (uint32, error) {
+    magnitude, negative, _ := splitSign(text)
+
+    var bits uint32
+    switch {
+        case magnitude == "inf":
+            bits = f32Infinity
+        case magnitude == "nan":
+            bits = F32CanonicalNaN
+        case strings.HasPrefix(magnitude, "nan:"):
+            payload, err := parseNaNPayload(magnitude[4:], uint64(f32PayloadMask))
+            if err != nil {
+                return 0, fmt.Errorf("%w: %v", err, text)
+            }
+            bits = f32Infinity | uint32(payload)
+        default:
+            value, err := parseFloatBits(magnitude, 32)
+            if err != nil {
+                return 0, err
+            }
+            bits = uint32(value)
+    }
+
+    if negative {
+        bits |= f32SignBit
+    }
+
+    return bits, nil
+}
+
+/* parse an f64 literal and return the exact bits of the value, including any nan payload */
+func ParseF64Bits(text string) (uint64, error) {
+    magnitude, negative, _ := splitSign(text)
+
+    var bits uint64
+    switch {
+        case magnitude == "inf":
+            bits = f64Infinity
+        case magnitude == "nan":
+            bits = F64CanonicalNaN
+        case strings.HasPrefix(magnitude, "nan:"):
+            payload, err := parseNaNPayload(magnitude[4:], f64PayloadMask)
+            if err != nil {
+                return 0, fmt.Errorf("%w: %v", err, text)
+            }
+            bits = f64Infinity | payload
+        default:
+            value, err := parseFloatBits(magnitude, 64)
+            if err != nil {
+                return 0, err
+            }
+            bits = value
+    }
+
+    if negative {
+        bits |= f64SignBit
+    }
+
+    return bits, nil
+}
+
+func ParseF32(text string) (float32, error) {
+    bits, err := ParseF32Bits(text)
+    return math.Float32frombits(bits), err
+}
+
+func ParseF64(text string) (float64, error) {
+    bits, err := ParseF64Bits(text)
+    return math.Float64frombits(bits), err
+}
@@ -0,0 +1,130 @@
+package literal
+
+import (
+    "testing"
+    "math"
+)
+
+func near(a float64, b float64) bool {
+    if math.Abs(a - b) > 0.00000001 {
+        return false
+    }
+
+    return true
+}
+
+func TestParseFloat(test *testing.T){
+    value, err := ParseF32("0x0p+0")
+    if err != nil {
+        test.Fatalf("unable to parse: %v", err)
+    }
+    if !near(float64(value), 0) {
+        test.Fatalf("value was not near 0: %v", value)
+    }
+
+    value, err = ParseF32("0x3p+2")
+    if err != nil {
+        test.Fatalf("unable to parse: %v", err)
+    }
+
+    if !near(float64(value), 12) {
+        test.Fatalf("value was not near 12: %v", value)
+    }
+}
+
+func TestFloatBits(test *testing.T){
+    f32 := map[string]uint32{
+        "0x1p127": 0x7f000000,
+        "-0x1.fffffep127": 0xff7fffff,
+        /* exactly halfway between two floats rounds to even */
+        "0x1.000001p0": 0x3f800000,
+        "0x1.000003p0": 0x3f800002,
+        /* just above halfway rounds up */
+        "0x1.00000100000000001p0": 0x3f800001,
+        "1_000.5e-3": 0x3f801062,
+        "-0.0": 0x80000000,
+        "inf": 0x7f800000,
+        "-inf": 0xff800000,
+        "nan": 0x7fc00000,
+        "-nan": 0xffc00000,
+        "nan:0x200000": 0x7fa00000,
+        "-nan:0x1": 0xff800001,
+    }
+
+    for text, expected := range f32 {
+        bits, err := ParseF32Bits(text)
+        if err != nil {
+            test.Fatalf("unable to parse f32 %v: %v", text, err)
+        }
+        if bits != expected {
+            test.Fatalf("f32 %v: expected 0x%x but got 0x%x", text, expected, bits)
+        }
+    }
+
+    f64 := map[string]uint64{
+        "0x1.fffffffffffffp1023": 0x7fefffffffffffff,
+        "0x0.0000000000001p-1022": 0x1,
+        "1e-324": 0,
+        "nan:0xf_ffff_ffff_ffff": 0x7fffffffffffffff,
+        "-nan": 0xfff8000000000000,
+    }
+
+    for text, expected := range f64 {
+        bits, err := ParseF64Bits(text)
+        if err != nil {
+            test.Fatalf("unable to parse f64 %v: %v", text, err)
+        }
+        if bits != expected {
+            test.Fatalf("f64 %v: expected 0x%x but got 0x%x", text, expected, bits)
+        }
+    }
+
+    for _, bad := range []string{"0x1p128", "nan:0x0", "nan:0x800000", "1__0", "_1", "1e", ".5", "0x", "infinity"} {
+        _, err := ParseF32Bits(bad)
+        if err == nil {
+            test.Fatalf("expected an error for %v", bad)
+        }
+    }
+}
+
+func TestIntegers(test *testing.T){
+    i32 := map[string]int32{
+        "0xffff_ffff": -1,
+        "4294967295": -1,
+        "-0x8000_0000": math.MinInt32,
+        "+0x7fffffff": math.MaxInt32,
+        "0_123": 123,
+    }
+
+    for text, expected := range i32 {
+        value, err := ParseI32(text)
+        if err != nil {
+            test.Fatalf("unable to parse i32 %v: %v", text, err)
+        }
+        if value != expected {
+            test.Fatalf("i32 %v: expected %v but got %v", text, expected, value)
+        }
+    }
+
+    value, err := ParseI64("0xffffffffffffffff")
+    if err != nil || value != -1 {
+        test.Fatalf("expected -1 but got %v: %v", value, err)
+    }
+
+    value, err = ParseI64("-9223372036854775808")
+    if err != nil || value != math.MinInt64 {
+        test.Fatalf("expected min int64 but got %v: %v", value, err)
+    }
+
+    for _, bad := range []string{"4294967296", "+0x80000000", "-2147483649", "0x", "1_", "0xg"} {
+        _, err := ParseI32(bad)
+        if err == nil {
+            test.Fatalf("expected an error for %v", bad)
+        }
+    }
+
+    _, err = ParseU32("-1")
+    if err == nil {
+        test.Fatalf("expected an error for a signed u32")
+    }
+}
@@ -138,6 +138,36 @@ func nextToken(reader io.ByteScanner) Token {
         
         var out strings.Builder
         out.WriteByte(first)
+
+        /* a string token, which may contain spaces and parens. the token keeps its quotes and
+         * escape sequences, it is up to the user of the token to decode the string
+         */
+        if first == '"' {
+            for {
+                next, err := reader.ReadByte()
+                if err != nil {
+                    break
+                }
+
+                out.WriteByte(next)
+
+                if next == '\\' {
+                    escaped, err := reader.ReadByte()
+                    if err != nil {
+                        break
+                    }
+                    out.WriteByte(escaped)
+                    continue
+                }
+
+                if next == '"' {
+                    break
+                }
+            }
+
+            return Token{Kind: TokenData, Value: out.String()}
+        }
+
         for {
             next, err := reader.ReadByte()
             if err != nil {
@@ -82,3 +82,22 @@ b c)
         test.Fatalf("expected 3 children for x but was %v", len(value.Children))
     }
 }
+
+func TestStrings(test *testing.T){
+    input := `(data "a b" "(c)" "d\"e" "")`
+    value, err := ParseSExpression(input)
+    if err != nil {
+        test.Fatalf("Could not parse '%v': %v", input, err)
+    }
+
+    if len(value.Children) != 4 {
+        test.Fatalf("expected 4 children for data but was %v", len(value.Children))
+    }
+
+    expected := []string{`"a b"`, `"(c)"`, `"d\"e"`, `""`}
+    for i, check := range expected {
+        if value.Children[i].Value != check {
+            test.Fatalf("expected child %v to be %v but was %v", i, check, value.Children[i].Value)
+        }
+    }
+}
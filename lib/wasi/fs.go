@@ -0,0 +1,411 @@
+package wasi
+
+/* the filesystems that a program sees through its preopened directories. any fs.FS can be preopened for
+ * reading, a filesystem that also implements WriteFS lets the program create and write files.
+ * MemoryFS is a writable filesystem that only lives in memory.
+ */
+
+import (
+    "errors"
+    "io"
+    "io/fs"
+    "os"
+    "path"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+/* an open file that can be written to and moved around in */
+type File interface {
+    fs.File
+    io.Writer
+    io.Seeker
+}
+
+/* a filesystem that can open files for writing. flag is a combination of the os.O_ flags */
+type WriteFS interface {
+    fs.FS
+    OpenFile(name string, flag int, perm fs.FileMode) (File, error)
+}
+
+/* a directory of the host's filesystem that can also be written to. like os.DirFS it does not stop a
+ * symbolic link inside the directory from pointing outside of it
+ */
+func DirFS(dir string) WriteFS {
+    return &dirFS{FS: os.DirFS(dir), dir: dir}
+}
+
+type dirFS struct {
+    fs.FS
+    dir string
+}
+
+func (directory *dirFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+    if !fs.ValidPath(name) {
+        return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+    }
+
+    file, err := os.OpenFile(filepath.Join(directory.dir, filepath.FromSlash(name)), flag, perm)
+    if err != nil {
+        return nil, err
+    }
+
+    return file, nil
+}
+
+/* a writable filesystem kept entirely in memory. it is safe to use from many goroutines at once */
+type MemoryFS struct {
+    lock sync.Mutex
+    files map[string]*memoryData
+    directories map[string]bool
+}
+
+type memoryData struct {
+    bytes []byte
+    modified time.Time
+}
+
+func NewMemoryFS() *MemoryFS {
+    return &MemoryFS{
+        files: make(map[string]*memoryData),
+        directories: map[string]bool{".": true},
+    }
+}
+
+/* make the directory and all the directories above it */
+func (memory *MemoryFS) MkdirAll(name string) error {
+    if !fs.ValidPath(name) {
+        return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrInvalid}
+    }
+
+    memory.lock.Lock()
+    defer memory.lock.Unlock()
+
+    for name != "." {
+        if memory.files[name] != nil {
+            return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+        }
+        memory.directories[name] = true
+        name = path.Dir(name)
+    }
+
+    return nil
+}
+
+/* set the contents of a file, making its directories if they do not exist */
+func (memory *MemoryFS) WriteFile(name string, data []byte) error {
+    if !fs.ValidPath(name) || name == "." {
+        return &fs.PathError{Op: "write", Path: name, Err: fs.ErrInvalid}
+    }
+
+    err := memory.MkdirAll(path.Dir(name))
+    if err != nil {
+        return err
+    }
+
+    memory.lock.Lock()
+    defer memory.lock.Unlock()
+
+    if memory.directories[name] {
+        return &fs.PathError{Op: "write", Path: name, Err: errors.New("is a directory")}
+    }
+
+    memory.files[name] = &memoryData{bytes: append([]byte(nil), data...), modified: time.Now()}
+    return nil
+}
+
+func (memory *MemoryFS) Open(name string) (fs.File, error) {
+    return memory.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (memory *MemoryFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+    if !fs.ValidPath(name) {
+        return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+    }
+
+    memory.lock.Lock()
+    defer memory.lock.Unlock()
+
+    writable := flag & (os.O_WRONLY | os.O_RDWR) != 0
+
+    if memory.directories[name] {
+        if writable || flag & os.O_CREATE != 0 {
+            return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+        }
+        return &memoryDirectory{memory: memory, name: name}, nil
+    }
+
+    data := memory.files[name]
+    if data == nil {
+        if flag & os.O_CREATE == 0 {
+            return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+        }
+
+        if !memory.directories[path.Dir(name)] {
+            return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+        }
+
+        data = &memoryData{modified: time.Now()}
+        memory.files[name] = data
+    } else if flag & (os.O_CREATE | os.O_EXCL) == os.O_CREATE | os.O_EXCL {
+        return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+    }
+
+    if flag & os.O_TRUNC != 0 && writable {
+        data.bytes = nil
+        data.modified = time.Now()
+    }
+
+    return &memoryFile{
+        memory: memory,
+        name: name,
+        data: data,
+        readable: flag & os.O_WRONLY == 0,
+        writable: writable,
+        append: flag & os.O_APPEND != 0,
+    }, nil
+}
+
+/* the entries of a directory sorted by name, see fs.ReadDirFS */
+func (memory *MemoryFS) ReadDir(name string) ([]fs.DirEntry, error) {
+    if !fs.ValidPath(name) {
+        return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+    }
+
+    memory.lock.Lock()
+    defer memory.lock.Unlock()
+
+    if !memory.directories[name] {
+        if memory.files[name] != nil {
+            return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+        }
+        return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+    }
+
+    /* the children of a directory are the paths whose parent is the directory */
+    var out []fs.DirEntry
+    for file, data := range memory.files {
+        if path.Dir(file) == name {
+            out = append(out, &memoryInfo{name: path.Base(file), size: int64(len(data.bytes)), modified: data.modified})
+        }
+    }
+
+    for directory := range memory.directories {
+        if directory != "." && path.Dir(directory) == name {
+            out = append(out, &memoryInfo{name: path.Base(directory), directory: true})
+        }
+    }
+
+    sort.Slice(out, func(i int, j int) bool {
+        return strings.Compare(out[i].Name(), out[j].Name()) < 0
+    })
+
+    return out, nil
+}
+
+/* an open regular file of a MemoryFS */
+type memoryFile struct {
+    memory *MemoryFS
+    name string
+    data *memoryData
+    offset int64
+    readable bool
+    writable bool
+    append bool
+    closed bool
+}
+
+func (file *memoryFile) Stat() (fs.FileInfo, error) {
+    file.memory.lock.Lock()
+    defer file.memory.lock.Unlock()
+    return &memoryInfo{name: path.Base(file.name), size: int64(len(file.data.bytes)), modified: file.data.modified}, nil
+}
+
+func (file *memoryFile) Read(buffer []byte) (int, error) {
+    if file.closed {
+        return 0, fs.ErrClosed
+    }
+
+    if !file.readable {
+        return 0, &fs.PathError{Op: "read", Path: file.name, Err: fs.ErrPermission}
+    }
+
+    file.memory.lock.Lock()
+    defer file.memory.lock.Unlock()
+
+    if file.offset >= int64(len(file.data.bytes)) {
+        return 0, io.EOF
+    }
+
+    count := copy(buffer, file.data.bytes[file.offset:])
+    file.offset += int64(count)
+    return count, nil
+}
+
+func (file *memoryFile) Write(buffer []byte) (int, error) {
+    if file.closed {
+        return 0, fs.ErrClosed
+    }
+
+    if !file.writable {
+        return 0, &fs.PathError{Op: "write", Path: file.name, Err: fs.ErrPermission}
+    }
+
+    file.memory.lock.Lock()
+    defer file.memory.lock.Unlock()
+
+    if file.append {
+        file.offset = int64(len(file.data.bytes))
+    }
+
+    end := file.offset + int64(len(buffer))
+    if end > int64(len(file.data.bytes)) {
+        file.data.bytes = append(file.data.bytes, make([]byte, end - int64(len(file.data.bytes)))...)
+    }
+
+    copy(file.data.bytes[file.offset:], buffer)
+    file.offset = end
+    file.data.modified = time.Now()
+    return len(buffer), nil
+}
+
+func (file *memoryFile) Seek(offset int64, whence int) (int64, error) {
+    if file.closed {
+        return 0, fs.ErrClosed
+    }
+
+    file.memory.lock.Lock()
+    defer file.memory.lock.Unlock()
+
+    switch whence {
+        case io.SeekStart:
+        case io.SeekCurrent: offset += file.offset
+        case io.SeekEnd: offset += int64(len(file.data.bytes))
+        default:
+            return 0, &fs.PathError{Op: "seek", Path: file.name, Err: fs.ErrInvalid}
+    }
+
+    if offset < 0 {
+        return 0, &fs.PathError{Op: "seek", Path: file.name, Err: fs.ErrInvalid}
+    }
+
+    file.offset = offset
+    return offset, nil
+}
+
+func (file *memoryFile) Close() error {
+    if file.closed {
+        return fs.ErrClosed
+    }
+    file.closed = true
+    return nil
+}
+
+/* an open directory of a MemoryFS */
+type memoryDirectory struct {
+    memory *MemoryFS
+    name string
+    entries []fs.DirEntry
+    read bool
+}
+
+func (directory *memoryDirectory) Stat() (fs.FileInfo, error) {
+    return &memoryInfo{name: path.Base(directory.name), directory: true}, nil
+}
+
+func (directory *memoryDirectory) Read(buffer []byte) (int, error) {
+    return 0, &fs.PathError{Op: "read", Path: directory.name, Err: errors.New("is a directory")}
+}
+
+func (directory *memoryDirectory) Write(buffer []byte) (int, error) {
+    return 0, &fs.PathError{Op: "write", Path: directory.name, Err: errors.New("is a directory")}
+}
+
+func (directory *memoryDirectory) Seek(offset int64, whence int) (int64, error) {
+    return 0, &fs.PathError{Op: "seek", Path: directory.name, Err: errors.New("is a directory")}
+}
+
+func (directory *memoryDirectory) Close() error {
+    return nil
+}
+
+/* see fs.ReadDirFile */
+func (directory *memoryDirectory) ReadDir(count int) ([]fs.DirEntry, error) {
+    if !directory.read {
+        entries, err := directory.memory.ReadDir(directory.name)
+        if err != nil {
+            return nil, err
+        }
+        directory.entries = entries
+        directory.read = true
+    }
+
+    if count <= 0 {
+        out := directory.entries
+        directory.entries = nil
+        return out, nil
+    }
+
+    if len(directory.entries) == 0 {
+        return nil, io.EOF
+    }
+
+    count = min(count, len(directory.entries))
+    out := directory.entries[:count]
+    directory.entries = directory.entries[count:]
+    return out, nil
+}
+
+/* describes a file or directory of a MemoryFS, as both a fs.FileInfo and a fs.DirEntry */
+type memoryInfo struct {
+    name string
+    size int64
+    directory bool
+    modified time.Time
+}
+
+func (info *memoryInfo) Name() string {
+    return info.name
+}
+
+func (info *memoryInfo) Size() int64 {
+    return info.size
+}
+
+func (info *memoryInfo) Mode() fs.FileMode {
+    if info.directory {
+        return fs.ModeDir | 0755
+    }
+    return 0644
+}
+
+func (info *memoryInfo) ModTime() time.Time {
+    return info.modified
+}
+
+func (info *memoryInfo) IsDir() bool {
+    return info.directory
+}
+
+func (info *memoryInfo) Sys() any {
+    return nil
+}
+
+func (info *memoryInfo) Type() fs.FileMode {
+    return info.Mode().Type()
+}
+
+func (info *memoryInfo) Info() (fs.FileInfo, error) {
+    return info, nil
+}
+
+func min(a int, b int) int {
+    if a < b {
+        return a
+    }
+
+    return b
+}
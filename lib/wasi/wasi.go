@@ -0,0 +1,766 @@
+package wasi
+
+/* wasi_snapshot_preview1, the system interface that programs compiled for wasm32-wasi import. a System
+ * holds the state of one program: its arguments, environment, standard streams and open files. the
+ * program can only see files inside the directories that are preopened for it.
+ *
+ *   system := wasi.New(wasi.Config{Args: []string{"program"}, Stdout: os.Stdout})
+ *   instance, err := exec.Compile(module).Instantiate(system.HostModule())
+ *
+ * a System belongs to a single instance, and like the instance it is not safe to use from many goroutines
+ * at once.
+ */
+
+import (
+    "crypto/rand"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "io/fs"
+    "os"
+    "path"
+    "strings"
+    "time"
+
+    "github.com/kazzmir/webassembly/lib/exec"
+)
+
+/* the module name that the functions are imported from */
+const ModuleName = "wasi_snapshot_preview1"
+
+/* the error numbers that wasi functions return, 0 is success */
+type Errno uint32
+
+const (
+    ErrnoSuccess Errno = 0
+    ErrnoAcces Errno = 2
+    ErrnoBadf Errno = 8
+    ErrnoExist Errno = 20
+    ErrnoFault Errno = 21
+    ErrnoInval Errno = 28
+    ErrnoIO Errno = 29
+    ErrnoIsdir Errno = 31
+    ErrnoNametoolong Errno = 37
+    ErrnoNoent Errno = 44
+    ErrnoNotdir Errno = 54
+    ErrnoNotsup Errno = 58
+    ErrnoRofs Errno = 69
+    ErrnoSpipe Errno = 70
+    ErrnoNotcapable Errno = 76
+)
+
+const (
+    clockRealtime = 0
+    clockMonotonic = 1
+    clockProcessCPUTime = 2
+    clockThreadCPUTime = 3
+)
+
+const (
+    filetypeCharacterDevice = 2
+    filetypeDirectory = 3
+    filetypeRegularFile = 4
+)
+
+const (
+    oflagCreate = 1
+    oflagDirectory = 2
+    oflagExclusive = 4
+    oflagTruncate = 8
+)
+
+const fdflagAppend = 1
+
+const (
+    rightFdRead = 1 << 1
+    rightFdWrite = 1 << 6
+    /* every right that preview1 defines */
+    allRights = 1 << 30 - 1
+)
+
+/* the size of a dirent without its name */
+const direntSize = 24
+
+/* returned from a call into the program when the program calls proc_exit */
+type ExitError struct {
+    Code uint32
+}
+
+func (err *ExitError) Error() string {
+    return fmt.Sprintf("exit with code %v", err.Code)
+}
+
+/* a directory that the program can open files in, Path is the name the program knows it by */
+type Preopen struct {
+    Path string
+    FS fs.FS
+}
+
+type Config struct {
+    Args []string
+    /* strings of the form name=value */
+    Environ []string
+    /* nil streams are empty for reading and discard writes */
+    Stdin io.Reader
+    Stdout io.Writer
+    Stderr io.Writer
+    /* the preopened directories get the file descriptors 3, 4, and so on in order */
+    Preopens []Preopen
+    /* the wall clock, time.Now if nil */
+    Now func() time.Time
+    /* the source of random_get, crypto/rand if nil */
+    Random io.Reader
+}
+
+type descriptor struct {
+    /* the standard streams */
+    reader io.Reader
+    writer io.Writer
+    /* an open file, nil for a directory */
+    file fs.File
+    /* the filesystem the file or directory is in, and its path in that filesystem */
+    filesystem fs.FS
+    path string
+    directory bool
+    flags uint16
+    /* whether the file can be read and written, from the rights it was opened with */
+    read bool
+    write bool
+    /* the name that the program sees for a preopened directory */
+    preopened bool
+    preopen string
+    /* the entries of a directory that is being read */
+    entries []fs.DirEntry
+}
+
+type System struct {
+    config Config
+    files map[uint32]*descriptor
+    next uint32
+    start time.Time
+}
+
+func New(config Config) *System {
+    if config.Stdin == nil {
+        config.Stdin = strings.NewReader("")
+    }
+    if config.Stdout == nil {
+        config.Stdout = io.Discard
+    }
+    if config.Stderr == nil {
+        config.Stderr = io.Discard
+    }
+    if config.Now == nil {
+        config.Now = time.Now
+    }
+    if config.Random == nil {
+        config.Random = rand.Reader
+    }
+
+    system := System{
+        config: config,
+        files: map[uint32]*descriptor{
+            0: &descriptor{reader: config.Stdin, read: true},
+            1: &descriptor{writer: config.Stdout, write: true},
+            2: &descriptor{writer: config.Stderr, write: true},
+        },
+        next: 3,
+        start: config.Now(),
+    }
+
+    for _, preopen := range config.Preopens {
+        system.add(&descriptor{
+            filesystem: preopen.FS,
+            path: ".",
+            directory: true,
+            preopened: true,
+            preopen: preopen.Path,
+        })
+    }
+
+    return &system
+}
+
+func (system *System) add(file *descriptor) uint32 {
+    fd := system.next
+    system.next += 1
+    system.files[fd] = file
+    return fd
+}
+
+/* the wasi functions, for an instance to import */
+func (system *System) HostModule() *exec.HostModule {
+    host := exec.NewHostModule(ModuleName)
+
+    functions := map[string]any{
+        "args_get": system.argsGet,
+        "args_sizes_get": system.argsSizesGet,
+        "environ_get": system.environGet,
+        "environ_sizes_get": system.environSizesGet,
+        "clock_res_get": system.clockResGet,
+        "clock_time_get": system.clockTimeGet,
+        "random_get": system.randomGet,
+        "fd_read": system.fdRead,
+        "fd_write": system.fdWrite,
+        "fd_seek": system.fdSeek,
+        "fd_close": system.fdClose,
+        "fd_fdstat_get": system.fdFdstatGet,
+        "fd_prestat_get": system.fdPrestatGet,
+        "fd_prestat_dir_name": system.fdPrestatDirName,
+        "fd_readdir": system.fdReaddir,
+        "path_open": system.pathOpen,
+        "proc_exit": system.procExit,
+    }
+
+    for name, function := range functions {
+        err := host.DefineFunc(name, function)
+        if err != nil {
+            /* all the functions above have valid types */
+            panic(err)
+        }
+    }
+
+    return host
+}
+
+/* the bytes [pointer, pointer+length) of memory 0, if they are in bounds */
+func readMemory(store *exec.Store, pointer uint32, length uint32) ([]byte, bool) {
+    if len(store.Memory) == 0 {
+        return nil, false
+    }
+
+    memory := store.Memory[0]
+    end := uint64(pointer) + uint64(length)
+    if end > uint64(len(memory)) {
+        return nil, false
+    }
+
+    return memory[pointer:end], true
+}
+
+/* like readMemory, for bytes that are about to be written */
+func writeMemory(store *exec.Store, pointer uint32, length uint32) ([]byte, bool) {
+    memory, ok := readMemory(store, pointer, length)
+    if ok {
+        store.MarkMemoryDirty(uint64(pointer), uint64(length))
+    }
+    return memory, ok
+}
+
+func putUint32(store *exec.Store, pointer uint32, value uint32) Errno {
+    memory, ok := writeMemory(store, pointer, 4)
+    if !ok {
+        return ErrnoFault
+    }
+    binary.LittleEndian.PutUint32(memory, value)
+    return ErrnoSuccess
+}
+
+func putUint64(store *exec.Store, pointer uint32, value uint64) Errno {
+    memory, ok := writeMemory(store, pointer, 8)
+    if !ok {
+        return ErrnoFault
+    }
+    binary.LittleEndian.PutUint64(memory, value)
+    return ErrnoSuccess
+}
+
+/* the wasi error for a go error from a filesystem */
+func errnoOf(err error) Errno {
+    switch {
+        case err == nil: return ErrnoSuccess
+        case errors.Is(err, fs.ErrNotExist): return ErrnoNoent
+        case errors.Is(err, fs.ErrExist): return ErrnoExist
+        case errors.Is(err, fs.ErrPermission): return ErrnoAcces
+        case errors.Is(err, fs.ErrInvalid): return ErrnoInval
+        case errors.Is(err, fs.ErrClosed): return ErrnoBadf
+    }
+
+    return ErrnoIO
+}
+
+/* the count and total size of a list of strings that are passed to the program nul terminated */
+func stringSizes(store *exec.Store, values []string, countPointer uint32, sizePointer uint32) Errno {
+    size := 0
+    for _, value := range values {
+        size += len(value) + 1
+    }
+
+    errno := putUint32(store, countPointer, uint32(len(values)))
+    if errno != ErrnoSuccess {
+        return errno
+    }
+
+    return putUint32(store, sizePointer, uint32(size))
+}
+
+/* write the strings into buffer one after the other, and a pointer to each of them into pointers */
+func writeStrings(store *exec.Store, values []string, pointers uint32, buffer uint32) Errno {
+    for i, value := range values {
+        errno := putUint32(store, pointers + uint32(i) * 4, buffer)
+        if errno != ErrnoSuccess {
+            return errno
+        }
+
+        memory, ok := writeMemory(store, buffer, uint32(len(value) + 1))
+        if !ok {
+            return ErrnoFault
+        }
+        copy(memory, value)
+        memory[len(value)] = 0
+
+        buffer += uint32(len(value) + 1)
+    }
+
+    return ErrnoSuccess
+}
+
+func (system *System) argsSizesGet(store *exec.Store, count uint32, size uint32) Errno {
+    return stringSizes(store, system.config.Args, count, size)
+}
+
+func (system *System) argsGet(store *exec.Store, pointers uint32, buffer uint32) Errno {
+    return writeStrings(store, system.config.Args, pointers, buffer)
+}
+
+func (system *System) environSizesGet(store *exec.Store, count uint32, size uint32) Errno {
+    return stringSizes(store, system.config.Environ, count, size)
+}
+
+func (system *System) environGet(store *exec.Store, pointers uint32, buffer uint32) Errno {
+    return writeStrings(store, system.config.Environ, pointers, buffer)
+}
+
+func (system *System) clockResGet(store *exec.Store, id uint32, result uint32) Errno {
+    switch id {
+        case clockRealtime, clockMonotonic, clockProcessCPUTime, clockThreadCPUTime:
+            return putUint64(store, result, 1)
+    }
+
+    return ErrnoInval
+}
+
+/* the cpu time clocks are the time since the system was made, there is no way to tell how much of it the
+ * program spent running
+ */
+func (system *System) clockTimeGet(store *exec.Store, id uint32, precision uint64, result uint32) Errno {
+    now := system.config.Now()
+    switch id {
+        case clockRealtime:
+            return putUint64(store, result, uint64(now.UnixNano()))
+        case clockMonotonic, clockProcessCPUTime, clockThreadCPUTime:
+            return putUint64(store, result, uint64(now.Sub(system.start).Nanoseconds()))
+    }
+
+    return ErrnoInval
+}
+
+func (system *System) randomGet(store *exec.Store, buffer uint32, length uint32) Errno {
+    memory, ok := writeMemory(store, buffer, length)
+    if !ok {
+        return ErrnoFault
+    }
+
+    _, err := io.ReadFull(system.config.Random, memory)
+    if err != nil {
+        return ErrnoIO
+    }
+
+    return ErrnoSuccess
+}
+
+/* the buffers of an array of iovecs, which are pairs of a pointer and a length */
+func iovecs(store *exec.Store, pointer uint32, count uint32, write bool) ([][]byte, Errno) {
+    if uint64(count) * 8 > 0xffffffff {
+        return nil, ErrnoFault
+    }
+
+    vectors, ok := readMemory(store, pointer, count * 8)
+    if !ok {
+        return nil, ErrnoFault
+    }
+
+    var out [][]byte
+    for i := uint32(0); i < count; i++ {
+        buffer := binary.LittleEndian.Uint32(vectors[i * 8:])
+        length := binary.LittleEndian.Uint32(vectors[i * 8 + 4:])
+
+        var memory []byte
+        if write {
+            memory, ok = writeMemory(store, buffer, length)
+        } else {
+            memory, ok = readMemory(store, buffer, length)
+        }
+        if !ok {
+            return nil, ErrnoFault
+        }
+
+        out = append(out, memory)
+    }
+
+    return out, ErrnoSuccess
+}
+
+func (system *System) fdRead(store *exec.Store, fd uint32, pointer uint32, count uint32, result uint32) Errno {
+    file := system.files[fd]
+    if file == nil {
+        return ErrnoBadf
+    }
+
+    if file.directory {
+        return ErrnoIsdir
+    }
+
+    /* stdout, stderr and files opened without rightFdRead can only be written */
+    if !file.read {
+        return ErrnoBadf
+    }
+
+    reader := file.reader
+    if reader == nil {
+        reader = file.file
+    }
+
+    buffers, errno := iovecs(store, pointer, count, true)
+    if errno != ErrnoSuccess {
+        return errno
+    }
+
+    total := 0
+    for _, buffer := range buffers {
+        read, err := reader.Read(buffer)
+        total += read
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return errnoOf(err)
+        }
+        /* a short read means there is nothing more to read right now */
+        if read < len(buffer) {
+            break
+        }
+    }
+
+    return putUint32(store, result, uint32(total))
+}
+
+func (system *System) fdWrite(store *exec.Store, fd uint32, pointer uint32, count uint32, result uint32) Errno {
+    file := system.files[fd]
+    if file == nil {
+        return ErrnoBadf
+    }
+
+    if file.directory {
+        return ErrnoIsdir
+    }
+
+    if !file.write {
+        return ErrnoBadf
+    }
+
+    writer := file.writer
+    if writer == nil {
+        var ok bool
+        writer, ok = file.file.(io.Writer)
+        if !ok {
+            return ErrnoBadf
+        }
+    }
+
+    buffers, errno := iovecs(store, pointer, count, false)
+    if errno != ErrnoSuccess {
+        return errno
+    }
+
+    total := 0
+    for _, buffer := range buffers {
+        wrote, err := writer.Write(buffer)
+        total += wrote
+        if err != nil {
+            return errnoOf(err)
+        }
+    }
+
+    return putUint32(store, result, uint32(total))
+}
+
+func (system *System) fdSeek(store *exec.Store, fd uint32, offset int64, whence uint32, result uint32) Errno {
+    file := system.files[fd]
+    if file == nil {
+        return ErrnoBadf
+    }
+
+    if file.directory {
+        return ErrnoIsdir
+    }
+
+    seeker, ok := file.file.(io.Seeker)
+    if !ok {
+        return ErrnoSpipe
+    }
+
+    var goWhence int
+    switch whence {
+        case 0: goWhence = io.SeekStart
+        case 1: goWhence = io.SeekCurrent
+        case 2: goWhence = io.SeekEnd
+        default:
+            return ErrnoInval
+    }
+
+    position, err := seeker.Seek(offset, goWhence)
+    if err != nil {
+        return errnoOf(err)
+    }
+
+    return putUint64(store, result, uint64(position))
+}
+
+func (system *System) fdClose(store *exec.Store, fd uint32) Errno {
+    file := system.files[fd]
+    if file == nil {
+        return ErrnoBadf
+    }
+
+    delete(system.files, fd)
+
+    if file.file != nil {
+        return errnoOf(file.file.Close())
+    }
+
+    return ErrnoSuccess
+}
+
+/* the filetype, flags and rights of a file descriptor. every file has all the rights except reading or
+ * writing when it was opened without them, beyond that what a program can do with a file is up to its filesystem
+ */
+func (system *System) fdFdstatGet(store *exec.Store, fd uint32, result uint32) Errno {
+    file := system.files[fd]
+    if file == nil {
+        return ErrnoBadf
+    }
+
+    memory, ok := writeMemory(store, result, 24)
+    if !ok {
+        return ErrnoFault
+    }
+
+    filetype := byte(filetypeRegularFile)
+    if file.directory {
+        filetype = filetypeDirectory
+    } else if file.file == nil {
+        filetype = filetypeCharacterDevice
+    }
+
+    for i := range memory {
+        memory[i] = 0
+    }
+    memory[0] = filetype
+    binary.LittleEndian.PutUint16(memory[2:], file.flags)
+    var rights uint64 = allRights
+    if !file.directory && !file.read {
+        rights &^= rightFdRead
+    }
+    if !file.directory && !file.write {
+        rights &^= rightFdWrite
+    }
+
+    binary.LittleEndian.PutUint64(memory[8:], rights)
+    binary.LittleEndian.PutUint64(memory[16:], allRights)
+
+    return ErrnoSuccess
+}
+
+/* a prestat is a tag, which is always 0 for a directory, and the length of the directory's name */
+func (system *System) fdPrestatGet(store *exec.Store, fd uint32, result uint32) Errno {
+    file := system.files[fd]
+    if file == nil || !file.preopened {
+        return ErrnoBadf
+    }
+
+    memory, ok := writeMemory(store, result, 8)
+    if !ok {
+        return ErrnoFault
+    }
+
+    binary.LittleEndian.PutUint32(memory, 0)
+    binary.LittleEndian.PutUint32(memory[4:], uint32(len(file.preopen)))
+    return ErrnoSuccess
+}
+
+func (system *System) fdPrestatDirName(store *exec.Store, fd uint32, pointer uint32, length uint32) Errno {
+    file := system.files[fd]
+    if file == nil || !file.preopened {
+        return ErrnoBadf
+    }
+
+    if length < uint32(len(file.preopen)) {
+        return ErrnoNametoolong
+    }
+
+    memory, ok := writeMemory(store, pointer, uint32(len(file.preopen)))
+    if !ok {
+        return ErrnoFault
+    }
+
+    copy(memory, file.preopen)
+    return ErrnoSuccess
+}
+
+/* fill the buffer with dirents starting at the entry numbered cookie. the last dirent is cut off if it does
+ * not fit, the program then knows to ask again with a bigger buffer
+ */
+func (system *System) fdReaddir(store *exec.Store, fd uint32, buffer uint32, length uint32, cookie uint64, result uint32) Errno {
+    file := system.files[fd]
+    if file == nil {
+        return ErrnoBadf
+    }
+
+    if !file.directory {
+        return ErrnoNotdir
+    }
+
+    if cookie == 0 || file.entries == nil {
+        entries, err := fs.ReadDir(file.filesystem, file.path)
+        if err != nil {
+            return errnoOf(err)
+        }
+        file.entries = entries
+    }
+
+    var out []byte
+    for index := cookie; index < uint64(len(file.entries)) && len(out) < int(length); index++ {
+        entry := file.entries[index]
+
+        var dirent [direntSize]byte
+        binary.LittleEndian.PutUint64(dirent[0:], index + 1)
+        binary.LittleEndian.PutUint32(dirent[16:], uint32(len(entry.Name())))
+        dirent[20] = filetypeRegularFile
+        if entry.IsDir() {
+            dirent[20] = filetypeDirectory
+        }
+
+        out = append(out, dirent[:]...)
+        out = append(out, entry.Name()...)
+    }
+
+    if len(out) > int(length) {
+        out = out[:length]
+    }
+
+    memory, ok := writeMemory(store, buffer, uint32(len(out)))
+    if !ok {
+        return ErrnoFault
+    }
+    copy(memory, out)
+
+    return putUint32(store, result, uint32(len(out)))
+}
+
+/* the path of name inside a directory, which cannot leave the directory */
+func resolve(directory string, name string) (string, bool) {
+    if path.IsAbs(name) {
+        return "", false
+    }
+
+    out := path.Join(directory, name)
+    return out, fs.ValidPath(out)
+}
+
+func (system *System) pathOpen(store *exec.Store, fd uint32, dirflags uint32, pointer uint32, length uint32, oflags uint32, rightsBase uint64, rightsInheriting uint64, fdflags uint32, result uint32) Errno {
+    directory := system.files[fd]
+    if directory == nil {
+        return ErrnoBadf
+    }
+
+    if !directory.directory {
+        return ErrnoNotdir
+    }
+
+    nameBytes, ok := readMemory(store, pointer, length)
+    if !ok {
+        return ErrnoFault
+    }
+
+    name, ok := resolve(directory.path, string(nameBytes))
+    if !ok {
+        return ErrnoNotcapable
+    }
+
+    filesystem := directory.filesystem
+
+    info, err := fs.Stat(filesystem, name)
+    if err != nil && !errors.Is(err, fs.ErrNotExist) {
+        return errnoOf(err)
+    }
+
+    if err == nil && info.IsDir() {
+        if oflags & (oflagCreate | oflagExclusive) == oflagCreate | oflagExclusive {
+            return ErrnoExist
+        }
+        if oflags & oflagTruncate != 0 || rightsBase & rightFdWrite != 0 {
+            return ErrnoIsdir
+        }
+
+        return putUint32(store, result, system.add(&descriptor{
+            filesystem: filesystem,
+            path: name,
+            directory: true,
+        }))
+    }
+
+    if oflags & oflagDirectory != 0 {
+        if err != nil {
+            return errnoOf(err)
+        }
+        return ErrnoNotdir
+    }
+
+    var file fs.File
+    if rightsBase & rightFdWrite != 0 || oflags & (oflagCreate | oflagTruncate) != 0 {
+        writable, ok := filesystem.(WriteFS)
+        if !ok {
+            return ErrnoRofs
+        }
+
+        flag := os.O_WRONLY
+        if rightsBase & rightFdRead != 0 {
+            flag = os.O_RDWR
+        }
+        if oflags & oflagCreate != 0 {
+            flag |= os.O_CREATE
+        }
+        if oflags & oflagExclusive != 0 {
+            flag |= os.O_EXCL
+        }
+        if oflags & oflagTruncate != 0 {
+            flag |= os.O_TRUNC
+        }
+        if fdflags & fdflagAppend != 0 {
+            flag |= os.O_APPEND
+        }
+
+        file, err = writable.OpenFile(name, flag, 0644)
+    } else {
+        file, err = filesystem.Open(name)
+    }
+
+    if err != nil {
+        return errnoOf(err)
+    }
+
+    return putUint32(store, result, system.add(&descriptor{
+        file: file,
+        filesystem: filesystem,
+        path: name,
+        flags: uint16(fdflags),
+        read: rightsBase & rightFdRead != 0,
+        write: rightsBase & rightFdWrite != 0,
+    }))
+}
+
+func (system *System) procExit(store *exec.Store, code uint32) error {
+    return &ExitError{Code: code}
+}
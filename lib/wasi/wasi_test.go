@@ -0,0 +1,293 @@
+package wasi
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "testing/fstest"
+    "time"
+
+    "github.com/kazzmir/webassembly/lib/core"
+    "github.com/kazzmir/webassembly/lib/exec"
+    "github.com/kazzmir/webassembly/lib/sexp"
+)
+
+func makeModule(test *testing.T, text string) core.WebAssemblyModule {
+    expr, err := sexp.ParseSExpression(text)
+    if err != nil {
+        test.Fatalf("unable to parse %v: %v", text, err)
+    }
+
+    module, err := core.CreateWastModule(&expr)
+    if err != nil {
+        test.Fatalf("unable to create module: %v", err)
+    }
+
+    return module
+}
+
+/* a store with one page of memory, for calling the functions directly */
+func makeStore() *exec.Store {
+    return &exec.Store{Memory: [][]byte{make([]byte, 65536)}}
+}
+
+func putString(store *exec.Store, pointer uint32, value string) uint32 {
+    copy(store.Memory[0][pointer:], value)
+    return uint32(len(value))
+}
+
+func getUint32(store *exec.Store, pointer uint32) uint32 {
+    return binary.LittleEndian.Uint32(store.Memory[0][pointer:])
+}
+
+func TestHello(test *testing.T){
+    module := makeModule(test, `(module
+        (import "wasi_snapshot_preview1" "fd_write" (func $fd_write (param i32 i32 i32 i32) (result i32)))
+        (import "wasi_snapshot_preview1" "proc_exit" (func $proc_exit (param i32)))
+        (memory (export "memory") 1)
+        (data (i32.const 16) "hello\n")
+        (func (export "_start")
+            (i32.store (i32.const 0) (i32.const 16))
+            (i32.store (i32.const 4) (i32.const 6))
+            (drop (call $fd_write (i32.const 1) (i32.const 0) (i32.const 1) (i32.const 8)))
+            (call $proc_exit (i32.load (i32.const 8)))))`)
+
+    var stdout bytes.Buffer
+    system := New(Config{Stdout: &stdout})
+
+    instance, err := exec.Compile(module).Instantiate(system.HostModule())
+    if err != nil {
+        test.Fatalf("unable to instantiate: %v", err)
+    }
+
+    _, err = instance.Invoke("_start", nil)
+    var exit *ExitError
+    if !errors.As(err, &exit) || exit.Code != 6 {
+        test.Fatalf("expected exit code 6 but got %v", err)
+    }
+
+    if stdout.String() != "hello\n" {
+        test.Fatalf("unexpected output %q", stdout.String())
+    }
+}
+
+func TestArgs(test *testing.T){
+    store := makeStore()
+    system := New(Config{Args: []string{"program", "-x"}, Environ: []string{"HOME=/"}})
+
+    if system.argsSizesGet(store, 0, 4) != ErrnoSuccess || getUint32(store, 0) != 2 || getUint32(store, 4) != 11 {
+        test.Fatalf("wrong argument sizes %v %v", getUint32(store, 0), getUint32(store, 4))
+    }
+
+    if system.argsGet(store, 100, 200) != ErrnoSuccess {
+        test.Fatalf("unable to get the arguments")
+    }
+
+    second := getUint32(store, 104)
+    if getUint32(store, 100) != 200 || second != 208 || string(store.Memory[0][second:second + 3]) != "-x\x00" {
+        test.Fatalf("wrong arguments")
+    }
+
+    if system.environSizesGet(store, 0, 4) != ErrnoSuccess || getUint32(store, 0) != 1 || getUint32(store, 4) != 7 {
+        test.Fatalf("wrong environment sizes")
+    }
+
+    if system.argsGet(store, 65535, 200) != ErrnoFault {
+        test.Fatalf("expected a fault for an argument pointer out of bounds")
+    }
+}
+
+func TestClock(test *testing.T){
+    store := makeStore()
+    now := time.Unix(100, 0)
+    system := New(Config{Now: func() time.Time { return now }})
+    now = now.Add(time.Second)
+
+    if system.clockTimeGet(store, clockRealtime, 0, 0) != ErrnoSuccess || binary.LittleEndian.Uint64(store.Memory[0]) != 101e9 {
+        test.Fatalf("wrong realtime clock")
+    }
+
+    if system.clockTimeGet(store, clockMonotonic, 0, 0) != ErrnoSuccess || binary.LittleEndian.Uint64(store.Memory[0]) != 1e9 {
+        test.Fatalf("wrong monotonic clock")
+    }
+
+    if system.clockTimeGet(store, 10, 0, 0) != ErrnoInval {
+        test.Fatalf("expected an invalid clock")
+    }
+
+    random := New(Config{Random: strings.NewReader("abcd")})
+    if random.randomGet(store, 0, 4) != ErrnoSuccess || string(store.Memory[0][:4]) != "abcd" {
+        test.Fatalf("wrong random bytes")
+    }
+}
+
+func TestFiles(test *testing.T){
+    store := makeStore()
+
+    memory := NewMemoryFS()
+    memory.WriteFile("data/input.txt", []byte("some input"))
+
+    readonly := fstest.MapFS{"notes.txt": &fstest.MapFile{Data: []byte("notes")}}
+
+    system := New(Config{Preopens: []Preopen{{Path: "/work", FS: memory}, {Path: "/docs", FS: readonly}}})
+
+    /* the preopened directories are 3 and 4, 5 is not open */
+    if system.fdPrestatGet(store, 3, 0) != ErrnoSuccess || getUint32(store, 4) != 5 {
+        test.Fatalf("wrong prestat for 3")
+    }
+    if system.fdPrestatDirName(store, 3, 8, 5) != ErrnoSuccess || string(store.Memory[0][8:13]) != "/work" {
+        test.Fatalf("wrong name for 3")
+    }
+    if system.fdPrestatGet(store, 5, 0) != ErrnoBadf {
+        test.Fatalf("expected 5 to not be preopened")
+    }
+
+    /* read a file 4 bytes at a time */
+    length := putString(store, 1000, "data/input.txt")
+    if errno := system.pathOpen(store, 3, 0, 1000, length, 0, rightFdRead, 0, 0, 0); errno != ErrnoSuccess {
+        test.Fatalf("unable to open input.txt: %v", errno)
+    }
+    fd := getUint32(store, 0)
+
+    binary.LittleEndian.PutUint32(store.Memory[0][100:], 2000)
+    binary.LittleEndian.PutUint32(store.Memory[0][104:], 4)
+    if system.fdRead(store, fd, 100, 1, 0) != ErrnoSuccess || getUint32(store, 0) != 4 || string(store.Memory[0][2000:2004]) != "some" {
+        test.Fatalf("wrong read")
+    }
+
+    if system.fdSeek(store, fd, -5, 2, 0) != ErrnoSuccess || getUint32(store, 0) != 5 {
+        test.Fatalf("wrong seek")
+    }
+    if system.fdRead(store, fd, 100, 1, 0) != ErrnoSuccess || string(store.Memory[0][2000:2004]) != "inpu" {
+        test.Fatalf("wrong read after seek")
+    }
+
+    if system.fdClose(store, fd) != ErrnoSuccess || system.fdClose(store, fd) != ErrnoBadf {
+        test.Fatalf("wrong close")
+    }
+
+    /* create a file and write to it */
+    length = putString(store, 1000, "data/output.txt")
+    if errno := system.pathOpen(store, 3, 0, 1000, length, oflagCreate, rightFdWrite, 0, 0, 0); errno != ErrnoSuccess {
+        test.Fatalf("unable to create output.txt: %v", errno)
+    }
+    fd = getUint32(store, 0)
+
+    putString(store, 2000, "written")
+    binary.LittleEndian.PutUint32(store.Memory[0][104:], 7)
+    if system.fdWrite(store, fd, 100, 1, 0) != ErrnoSuccess || getUint32(store, 0) != 7 {
+        test.Fatalf("wrong write")
+    }
+
+    contents, err := fs.ReadFile(memory, "data/output.txt")
+    if err != nil || string(contents) != "written" {
+        test.Fatalf("wrong contents %q %v", contents, err)
+    }
+
+    /* the program cannot leave its directories or write to a read only filesystem */
+    length = putString(store, 1000, "../secret")
+    if system.pathOpen(store, 3, 0, 1000, length, 0, rightFdRead, 0, 0, 0) != ErrnoNotcapable {
+        test.Fatalf("expected to not be able to leave the directory")
+    }
+
+    length = putString(store, 1000, "notes.txt")
+    if system.pathOpen(store, 4, 0, 1000, length, 0, rightFdWrite, 0, 0, 0) != ErrnoRofs {
+        test.Fatalf("expected a read only filesystem")
+    }
+
+    if system.pathOpen(store, 4, 0, 1000, length, 0, rightFdRead, 0, 0, 0) != ErrnoSuccess {
+        test.Fatalf("unable to open notes.txt")
+    }
+
+    length = putString(store, 1000, "missing.txt")
+    if system.pathOpen(store, 4, 0, 1000, length, 0, rightFdRead, 0, 0, 0) != ErrnoNoent {
+        test.Fatalf("expected missing.txt to not exist")
+    }
+}
+
+func TestReaddir(test *testing.T){
+    store := makeStore()
+
+    memory := NewMemoryFS()
+    memory.WriteFile("b.txt", []byte("b"))
+    memory.WriteFile("a/c.txt", []byte("c"))
+
+    system := New(Config{Preopens: []Preopen{{Path: ".", FS: memory}}})
+
+    if errno := system.fdReaddir(store, 3, 100, 1000, 0, 0); errno != ErrnoSuccess {
+        test.Fatalf("unable to read the directory: %v", errno)
+    }
+
+    /* a directory 'a' then a file 'b.txt' */
+    if getUint32(store, 0) != direntSize * 2 + 1 + 5 {
+        test.Fatalf("wrong size %v", getUint32(store, 0))
+    }
+
+    first := store.Memory[0][100:]
+    if binary.LittleEndian.Uint64(first) != 1 || getUint32(store, 116) != 1 || first[20] != filetypeDirectory || first[direntSize] != 'a' {
+        test.Fatalf("wrong first entry")
+    }
+
+    /* start from the second entry with a buffer too small for it */
+    if system.fdReaddir(store, 3, 100, 10, 1, 0) != ErrnoSuccess || getUint32(store, 0) != 10 {
+        test.Fatalf("expected a full buffer")
+    }
+
+    if system.fdReaddir(store, 3, 100, 1000, 2, 0) != ErrnoSuccess || getUint32(store, 0) != 0 {
+        test.Fatalf("expected no more entries")
+    }
+}
+
+func TestMemoryFS(test *testing.T){
+    memory := NewMemoryFS()
+    memory.WriteFile("a/b/c.txt", []byte("c"))
+    memory.WriteFile("d.txt", []byte("d"))
+    memory.MkdirAll("e")
+
+    err := fstest.TestFS(memory, "a/b/c.txt", "d.txt", "e")
+    if err != nil {
+        test.Fatalf("%v", err)
+    }
+}
+
+func TestReadWriteOnly(test *testing.T){
+    store := makeStore()
+    system := New(Config{})
+
+    binary.LittleEndian.PutUint32(store.Memory[0][100:], 2000)
+    binary.LittleEndian.PutUint32(store.Memory[0][104:], 4)
+    for _, fd := range []uint32{1, 2} {
+        if errno := system.fdRead(store, fd, 100, 1, 0); errno != ErrnoBadf {
+            test.Fatalf("expected EBADF from reading fd %v but got %v", fd, errno)
+        }
+    }
+
+    directory := test.TempDir()
+    if err := os.WriteFile(filepath.Join(directory, "file.txt"), []byte("data"), 0644); err != nil {
+        test.Fatalf("%v", err)
+    }
+
+    system = New(Config{Preopens: []Preopen{{Path: "/", FS: DirFS(directory)}}})
+    length := putString(store, 1000, "file.txt")
+
+    /* a file opened only for writing cannot be read */
+    if errno := system.pathOpen(store, 3, 0, 1000, length, 0, rightFdWrite, 0, 0, 0); errno != ErrnoSuccess {
+        test.Fatalf("unable to open file.txt for writing: %v", errno)
+    }
+    if errno := system.fdRead(store, getUint32(store, 0), 100, 1, 0); errno != ErrnoBadf {
+        test.Fatalf("expected EBADF from reading a write only file but got %v", errno)
+    }
+
+    /* and a file opened only for reading cannot be written, even though the host file could be */
+    if errno := system.pathOpen(store, 3, 0, 1000, length, 0, rightFdRead, 0, 0, 0); errno != ErrnoSuccess {
+        test.Fatalf("unable to open file.txt for reading: %v", errno)
+    }
+    if errno := system.fdWrite(store, getUint32(store, 0), 100, 1, 0); errno != ErrnoBadf {
+        test.Fatalf("expected EBADF from writing a read only file but got %v", errno)
+    }
+}
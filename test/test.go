@@ -99,7 +99,7 @@ func runWastFile(path string) (int, int, error) {
         switch command.Name {
             case "module":
                 var err error
-                module, err = core.CreateWasmModule(&command)
+                module, err = core.CreateWastModule(&command)
                 if err != nil {
                     return 0, 0, err
                 }
@@ -115,7 +115,22 @@ func runWastFile(path string) (int, int, error) {
                 err := exec.AssertReturn(module, command, store)
                 if err != nil {
                     fail = err
-                    fmt.Printf("Error: %v\n", err)
+                    fmt.Printf("Error: %v\n%v", err, exec.FormatBacktrace(err))
+                } else {
+                    pass += 1
+                }
+            case "assert_exhaustion":
+                total += 1
+
+                if store == nil {
+                    fail = fmt.Errorf("Error: no module defined")
+                    break
+                }
+
+                err := exec.AssertExhaustion(module, command, store)
+                if err != nil {
+                    fail = err
+                    fmt.Printf("Error: %v\n%v", err, exec.FormatBacktrace(err))
                 } else {
                     pass += 1
                 }